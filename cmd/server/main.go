@@ -23,6 +23,8 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"net/http"
@@ -175,10 +177,13 @@ func main() {
 			users.POST("", middleware.Admin(), h.User.Create)
 			users.PUT("/:id", h.User.Update)
 			users.DELETE("/:id", middleware.Admin(), h.User.Delete)
+			users.PUT("/:id/attributes", middleware.Admin(), h.User.SetAttributes)
 			users.GET("/me", h.User.GetMe)
 			users.PUT("/me", h.User.UpdateMe)
 			users.PUT("/me/password", h.User.ChangePassword)
 			users.PUT("/me/avatar", h.User.UploadAvatar)
+			users.GET("/me/consents", h.SSO.ListConsents)
+			users.DELETE("/me/consents/:client_id", h.SSO.RevokeConsent)
 		}
 
 		// Application routes
@@ -190,6 +195,30 @@ func main() {
 			applications.POST("", h.Application.Create)
 			applications.PUT("/:id", h.Application.Update)
 			applications.DELETE("/:id", h.Application.Delete)
+
+			// OAuth clients of an application
+			applications.GET("/:id/oauth-clients", h.OAuthClient.List)
+			applications.POST("/:id/oauth-clients", h.OAuthClient.Create)
+			applications.GET("/:id/oauth-clients/:client_id", h.OAuthClient.Get)
+			applications.PUT("/:id/oauth-clients/:client_id", h.OAuthClient.Update)
+			applications.DELETE("/:id/oauth-clients/:client_id", h.OAuthClient.Delete)
+			applications.POST("/:id/oauth-clients/:client_id/rotate-secret", h.OAuthClient.RotateSecret)
+
+			// SAML settings of SAML applications
+			applications.GET("/:id/saml-config", h.SAMLConfig.Get)
+			applications.PUT("/:id/saml-config", h.SAMLConfig.Update)
+			applications.POST("/:id/saml-config/metadata", h.SAMLConfig.ImportMetadata)
+			applications.GET("/:id/saml-keys", h.SAMLKey.List)
+			applications.POST("/:id/saml-keys", h.SAMLKey.Generate)
+			applications.POST("/:id/saml-keys/:key_id/activate", h.SAMLKey.Activate)
+			applications.DELETE("/:id/saml-keys/:key_id", h.SAMLKey.Delete)
+
+			// Services registered to CAS applications
+			applications.GET("/:id/cas-services", h.CASConfig.List)
+			applications.POST("/:id/cas-services", h.CASConfig.Create)
+			applications.GET("/:id/cas-services/:service_id", h.CASConfig.Get)
+			applications.PUT("/:id/cas-services/:service_id", h.CASConfig.Update)
+			applications.DELETE("/:id/cas-services/:service_id", h.CASConfig.Delete)
 		}
 
 		// MFA routes
@@ -225,6 +254,11 @@ func main() {
 			admin.POST("/whitelist/entries", h.Admin.CreateWhitelistEntry)
 			admin.PUT("/whitelist/entries/:id", h.Admin.UpdateWhitelistEntry)
 			admin.DELETE("/whitelist/entries/:id", h.Admin.DeleteWhitelistEntry)
+
+			// Initial access tokens for dynamic client registration
+			admin.GET("/initial-access-tokens", h.OAuthClient.ListInitialAccessTokens)
+			admin.POST("/initial-access-tokens", h.OAuthClient.CreateInitialAccessToken)
+			admin.POST("/initial-access-tokens/:id/revoke", h.OAuthClient.RevokeInitialAccessToken)
 		}
 
 		// Role and Permission routes
@@ -321,6 +355,39 @@ func main() {
 			apiKeys.POST("/:id/revoke", h.APIKey.Revoke)
 		}
 
+		// Scope registry routes
+		oauthScopes := api.Group("/oauth-scopes")
+		oauthScopes.Use(middleware.Auth(cfg.JWT), middleware.Admin())
+		{
+			oauthScopes.GET("", h.OAuthScope.List)
+			oauthScopes.GET("/:id", h.OAuthScope.Get)
+			oauthScopes.POST("", h.OAuthScope.Create)
+			oauthScopes.PUT("/:id", h.OAuthScope.Update)
+			oauthScopes.DELETE("/:id", h.OAuthScope.Delete)
+		}
+
+		// Global SAML signing keys, used by applications without their own
+		samlKeys := api.Group("/saml-keys")
+		samlKeys.Use(middleware.Auth(cfg.JWT), middleware.Admin())
+		{
+			samlKeys.GET("", h.SAMLKey.List)
+			samlKeys.POST("", h.SAMLKey.Generate)
+			samlKeys.POST("/:key_id/activate", h.SAMLKey.Activate)
+			samlKeys.DELETE("/:key_id", h.SAMLKey.Delete)
+		}
+
+		// External SAML IdPs users can sign in with
+		samlIdentityProviders := api.Group("/saml-identity-providers")
+		samlIdentityProviders.Use(middleware.Auth(cfg.JWT), middleware.Admin())
+		{
+			samlIdentityProviders.GET("", h.SAMLIdentityProvider.List)
+			samlIdentityProviders.GET("/:id", h.SAMLIdentityProvider.Get)
+			samlIdentityProviders.POST("", h.SAMLIdentityProvider.Create)
+			samlIdentityProviders.PUT("/:id", h.SAMLIdentityProvider.Update)
+			samlIdentityProviders.POST("/:id/metadata", h.SAMLIdentityProvider.ImportMetadata)
+			samlIdentityProviders.DELETE("/:id", h.SAMLIdentityProvider.Delete)
+		}
+
 		// Webhook routes
 		webhooks := api.Group("/webhooks")
 		webhooks.Use(middleware.Auth(cfg.JWT), middleware.Admin())
@@ -368,7 +435,8 @@ func main() {
 	}
 
 	// SSO protocol routes
-	router.Any("/oauth2/authorize", h.SSO.OAuth2Authorize)
+	router.Any("/oauth2/authorize", middleware.OptionalAuth(cfg.JWT), h.SSO.OAuth2Authorize)
+	router.POST("/oauth2/consent", middleware.OptionalAuth(cfg.JWT), h.SSO.OAuth2Consent)
 	router.POST("/oauth2/token", func(c *gin.Context) {
 		// Check grant_type to route to appropriate handler
 		grantType := c.PostForm("grant_type")
@@ -377,19 +445,49 @@ func main() {
 			h.SSO.OAuth2ClientCredentials(c)
 		case "password":
 			h.SSO.OAuth2PasswordCredentials(c)
+		case "refresh_token":
+			h.SSO.OAuth2RefreshToken(c)
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			h.SSO.OAuth2DeviceToken(c)
+		case "urn:ietf:params:oauth:grant-type:token-exchange":
+			h.SSO.OAuth2TokenExchange(c)
 		default:
 			h.SSO.OAuth2Token(c)
 		}
 	})
 	router.GET("/oauth2/userinfo", h.SSO.OAuth2UserInfo)
-	router.Any("/saml/sso", h.SSO.SAMLSSO)
-	router.Any("/saml/slo", h.SSO.SAMLSLO)
+	router.POST("/oauth2/userinfo", h.SSO.OAuth2UserInfo)
+	router.POST("/oauth2/introspect", h.SSO.OAuth2Introspect)
+	router.POST("/oauth2/revoke", h.SSO.OAuth2Revoke)
+	router.GET("/oauth2/logout", middleware.OptionalAuth(cfg.JWT), h.SSO.OIDCEndSession)
+	router.POST("/oauth2/logout", middleware.OptionalAuth(cfg.JWT), h.SSO.OIDCEndSession)
+	router.POST("/oauth2/device_authorization", h.SSO.OAuth2DeviceAuthorization)
+	router.POST("/oauth2/par", h.SSO.OAuth2PushedAuthorization)
+	router.POST("/oauth2/register", h.SSO.OAuth2Register)
+	router.GET("/oauth2/register/:client_id", h.SSO.OAuth2GetRegistration)
+	router.PUT("/oauth2/register/:client_id", h.SSO.OAuth2UpdateRegistration)
+	router.DELETE("/oauth2/register/:client_id", h.SSO.OAuth2DeleteRegistration)
+	router.GET("/oauth2/device", middleware.OptionalAuth(cfg.JWT), h.SSO.OAuth2DeviceVerify)
+	router.POST("/oauth2/device", middleware.OptionalAuth(cfg.JWT), h.SSO.OAuth2DeviceVerify)
+	router.GET("/.well-known/openid-configuration", h.SSO.OIDCDiscovery)
+	router.GET("/jwks.json", h.SSO.OIDCJWKS)
+	router.Any("/saml/sso", middleware.OptionalAuth(cfg.JWT), h.SSO.SAMLSSO)
+	router.Any("/saml/slo", middleware.OptionalAuth(cfg.JWT), h.SSO.SAMLSLO)
 	router.GET("/saml/metadata", h.SSO.SAMLMetadata)
+	router.GET("/saml/metadata/:app_id", h.SSO.SAMLMetadata)
+	router.GET("/saml/sp/metadata", h.SSO.SAMLSPMetadata)
+	router.GET("/saml/sp/login", h.SSO.SAMLSPLogin)
+	router.POST("/saml/sp/acs", h.SSO.SAMLSPACS)
+	router.POST("/saml/sp/mfa", h.SSO.SAMLSPMFA)
 
 	// CAS protocol routes
-	router.Any("/cas/login", h.CAS.CASLogin)
+	router.Any("/cas/login", middleware.OptionalAuth(cfg.JWT), h.CAS.CASLogin)
 	router.Any("/cas/validate", h.CAS.CASValidate)
 	router.Any("/cas/serviceValidate", h.CAS.CASServiceValidate)
+	router.Any("/cas/proxyValidate", h.CAS.CASProxyValidate)
+	router.Any("/cas/proxy", h.CAS.CASProxy)
+	router.Any("/cas/p3/serviceValidate", h.CAS.CASServiceValidate)
+	router.Any("/cas/p3/proxyValidate", h.CAS.CASProxyValidate)
 	router.Any("/cas/logout", h.CAS.CASLogout)
 
 	// Start server
@@ -398,9 +496,34 @@ func main() {
 		Handler: router,
 	}
 
+	// Client certificates are requested but optional, so only clients
+	// registered for tls_client_auth need one
+	tlsEnabled := cfg.Server.TLSCertFile != "" && cfg.Server.TLSKeyFile != ""
+	if tlsEnabled && cfg.Server.TLSClientCAFile != "" {
+		caPEM, err := os.ReadFile(cfg.Server.TLSClientCAFile)
+		if err != nil {
+			logger.Fatalf("Failed to read client CA file: %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			logger.Fatalf("No certificates found in client CA file %s", cfg.Server.TLSClientCAFile)
+		}
+		srv.TLSConfig = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+
+	// Retry failed back-channel logout deliveries until shutdown
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	go h.Services.SSO.RunLogoutDeliveries(workerCtx)
+
 	// Graceful shutdown
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tlsEnabled {
+			err = srv.ListenAndServeTLS(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatalf("Failed to start server: %v", err)
 		}
 	}()
@@ -421,6 +544,7 @@ func main() {
 	<-quit
 
 	logger.Info("Shutting down server...")
+	stopWorkers()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
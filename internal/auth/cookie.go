@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SessionCookie carries the session token of a logged in browser to the
+// protocol endpoints (authorize, SAML and CAS login, logout), which browsers
+// reach by navigation rather than API calls
+const SessionCookie = "access_token"
+
+// SetSessionCookie stores a session token in an HttpOnly cookie. SameSite=Lax
+// keeps it off cross-site POSTs while top-level redirects from relying
+// parties still carry it.
+func SetSessionCookie(c *gin.Context, token string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(SessionCookie, token, maxAge, "/", "", c.Request.TLS != nil, true)
+}
+
+// ClearSessionCookie removes the session cookie
+func ClearSessionCookie(c *gin.Context) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(SessionCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+}
@@ -11,15 +11,33 @@ type Claims struct {
 	UserID   uint64   `json:"user_id"`
 	Username string   `json:"username"`
 	Roles    []string `json:"roles"`
+	// SessionID identifies the login session for OIDC logout (sid)
+	SessionID string `json:"sid,omitempty"`
+	// AuthTime is when the user authenticated; tokens renewed by a refresh
+	// keep the time of the login
+	AuthTime int64 `json:"auth_time,omitempty"`
 	jwt.RegisteredClaims
 }
 
 func GenerateToken(userID uint64, username string, roles []string, secret string, expiryMinutes int, issuer string) (string, error) {
+	return GenerateSessionToken(userID, username, roles, "", secret, expiryMinutes, issuer)
+}
+
+// GenerateSessionToken is GenerateToken for a token bound to a login session
+func GenerateSessionToken(userID uint64, username string, roles []string, sessionID, secret string, expiryMinutes int, issuer string) (string, error) {
+	return RenewSessionToken(userID, username, roles, sessionID, time.Now(), secret, expiryMinutes, issuer)
+}
+
+// RenewSessionToken is GenerateSessionToken for a login session the user
+// authenticated at authTime
+func RenewSessionToken(userID uint64, username string, roles []string, sessionID string, authTime time.Time, secret string, expiryMinutes int, issuer string) (string, error) {
 	expiry := time.Now().Add(time.Duration(expiryMinutes) * time.Minute)
 	claims := Claims{
-		UserID:   userID,
-		Username: username,
-		Roles:    roles,
+		UserID:    userID,
+		Username:  username,
+		Roles:     roles,
+		SessionID: sessionID,
+		AuthTime:  authTime.Unix(),
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expiry),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
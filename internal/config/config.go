@@ -16,11 +16,17 @@ type Config struct {
 	Email       EmailConfig
 	SMS         SMSConfig
 	Swagger     SwaggerConfig
+	OIDC        OIDCConfig
 }
 
 type ServerConfig struct {
 	Port int
 	Host string
+	// TLS is served when both files are set; ClientCAFile enables client
+	// certificates for tls_client_auth
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
 }
 
 type DatabaseConfig struct {
@@ -66,6 +72,19 @@ type SwaggerConfig struct {
 	Whitelist []string
 }
 
+type OIDCConfig struct {
+	Issuer         string
+	SigningKeyFile string // PEM encoded RSA private key; generated at startup if empty
+	IDTokenExpiry  int    // minutes
+	// PEM RSA public keys trusted to sign software statements in dynamic client registration
+	SoftwareStatementKeys []string
+	// Header carrying the URL-escaped PEM client certificate when TLS is
+	// terminated by a proxy
+	MTLSClientCertHeader string
+	// DPoPRequireNonce makes DPoP proofs carry a server-issued nonce
+	DPoPRequireNonce bool
+}
+
 func Load() (*Config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -85,6 +104,8 @@ func Load() (*Config, error) {
 	viper.SetDefault("jwt.issuer", "openauth")
 	viper.SetDefault("swagger.enabled", true)
 	viper.SetDefault("swagger.whitelist", []string{})
+	viper.SetDefault("oidc.issuer", "http://localhost:8080")
+	viper.SetDefault("oidc.id_token_expiry", 60)
 
 	// Environment variables
 	viper.SetEnvPrefix("OPENAUTH")
@@ -102,6 +123,8 @@ func Load() (*Config, error) {
 	viper.BindEnv("environment", "OPENAUTH_ENVIRONMENT")
 	viper.BindEnv("swagger.enabled", "OPENAUTH_SWAGGER_ENABLED")
 	viper.BindEnv("swagger.whitelist", "OPENAUTH_SWAGGER_WHITELIST")
+	viper.BindEnv("oidc.issuer", "OPENAUTH_OIDC_ISSUER")
+	viper.BindEnv("oidc.signing_key_file", "OPENAUTH_OIDC_SIGNING_KEY_FILE")
 
 	// Read config file
 	if err := viper.ReadInConfig(); err != nil {
@@ -115,6 +138,9 @@ func Load() (*Config, error) {
 		Server: ServerConfig{
 			Port: viper.GetInt("server.port"),
 			Host: viper.GetString("server.host"),
+			TLSCertFile:     viper.GetString("server.tls_cert_file"),
+			TLSKeyFile:      viper.GetString("server.tls_key_file"),
+			TLSClientCAFile: viper.GetString("server.tls_client_ca_file"),
 		},
 		Database: DatabaseConfig{
 			Host:     getEnvOrViper("database.host", "localhost"),
@@ -153,6 +179,14 @@ func Load() (*Config, error) {
 			Enabled:   viper.GetBool("swagger.enabled"),
 			Whitelist: getSwaggerWhitelist(),
 		},
+		OIDC: OIDCConfig{
+			Issuer:         strings.TrimSuffix(viper.GetString("oidc.issuer"), "/"),
+			SigningKeyFile: getEnvOrViper("oidc.signing_key_file", ""),
+			IDTokenExpiry:  viper.GetInt("oidc.id_token_expiry"),
+			SoftwareStatementKeys: viper.GetStringSlice("oidc.software_statement_keys"),
+			MTLSClientCertHeader:  viper.GetString("oidc.mtls_client_cert_header"),
+			DPoPRequireNonce:      viper.GetBool("oidc.dpop_require_nonce"),
+		},
 	}
 
 	// Validate required fields
@@ -37,7 +37,18 @@ func Migrate(cfg config.DatabaseConfig) error {
 		&models.MFADevice{},
 		&models.OAuthClient{},
 		&models.OAuthToken{},
+		&models.OAuthConsent{},
+		&models.OAuthScope{},
+		&models.OAuthInitialAccessToken{},
+		&models.OIDCSessionClient{},
+		&models.OIDCLogoutDelivery{},
 		&models.SAMLConfig{},
+		&models.SAMLSessionParticipant{},
+		&models.SAMLPersistentID{},
+		&models.SAMLKey{},
+		&models.SAMLIdentityProvider{},
+		&models.SAMLFederatedIdentity{},
+		&models.CASServiceConfig{},
 		&models.AuditLog{},
 		&models.PasswordPolicy{},
 		&models.MFAPolicy{},
@@ -4,8 +4,10 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/auth"
 	"github.com/hanyouqing/openauth/internal/config"
 	"github.com/hanyouqing/openauth/internal/middleware"
+	"github.com/hanyouqing/openauth/internal/models"
 	"github.com/hanyouqing/openauth/internal/services"
 	"github.com/sirupsen/logrus"
 )
@@ -32,13 +34,23 @@ type RefreshRequest struct {
 	RefreshToken string `json:"refresh_token" binding:"required" example:"uuid-refresh-token"`
 }
 
+// AuthService is the part of services.AuthService the auth handler uses
+type AuthService interface {
+	Login(username, password, mfaCode, ipAddress, userAgent string) (*services.LoginResult, error)
+	Logout(userID uint64) error
+	Refresh(refreshToken string) (*services.LoginResult, error)
+	Register(username, email, password string) (*models.User, error)
+	ForgotPassword(email string) error
+	ResetPassword(token, password string) error
+}
+
 type AuthHandler struct {
-	service *services.AuthService
+	service AuthService
 	config  *config.Config
 	logger  *logrus.Logger
 }
 
-func NewAuthHandler(service *services.AuthService, cfg *config.Config, logger *logrus.Logger) *AuthHandler {
+func NewAuthHandler(service AuthService, cfg *config.Config, logger *logrus.Logger) *AuthHandler {
 	return &AuthHandler{
 		service: service,
 		config:  cfg,
@@ -48,7 +60,7 @@ func NewAuthHandler(service *services.AuthService, cfg *config.Config, logger *l
 
 // Login handles user login
 // @Summary User login
-// @Description Authenticate user with username/password and optional MFA code
+// @Description Authenticate user with username/password and optional MFA code. The access token is also set as an HttpOnly session cookie, which signs the browser in to the OAuth2, SAML and CAS endpoints
 // @Tags auth
 // @Accept json
 // @Produce json
@@ -92,6 +104,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		})
 		return
 	}
+	auth.SetSessionCookie(c, result.AccessToken, result.ExpiresIn)
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
@@ -102,7 +115,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 
 // Logout handles user logout
 // @Summary User logout
-// @Description Logout current user and invalidate session
+// @Description Logout current user, invalidate their sessions and clear the session cookie
 // @Tags auth
 // @Produce json
 // @Security BearerAuth
@@ -118,6 +131,7 @@ func (h *AuthHandler) Logout(c *gin.Context) {
 		})
 		return
 	}
+	auth.ClearSessionCookie(c)
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
@@ -154,6 +168,7 @@ func (h *AuthHandler) Refresh(c *gin.Context) {
 		})
 		return
 	}
+	auth.SetSessionCookie(c, result.AccessToken, result.ExpiresIn)
 
 	c.JSON(http.StatusOK, gin.H{
 		"code": 200,
@@ -9,12 +9,11 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/hanyouqing/openauth/internal/config"
+	"github.com/hanyouqing/openauth/internal/models"
 	"github.com/hanyouqing/openauth/internal/services"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 )
 
 type MockAuthService struct {
@@ -29,12 +28,12 @@ func (m *MockAuthService) Login(username, password, mfaCode, ipAddress, userAgen
 	return args.Get(0).(*services.LoginResult), args.Error(1)
 }
 
-func (m *MockAuthService) Register(username, email, password string) (*services.User, error) {
+func (m *MockAuthService) Register(username, email, password string) (*models.User, error) {
 	args := m.Called(username, email, password)
 	if args.Get(0) == nil {
 		return nil, args.Error(1)
 	}
-	return args.Get(0).(*services.User), args.Error(1)
+	return args.Get(0).(*models.User), args.Error(1)
 }
 
 func (m *MockAuthService) Refresh(refreshToken string) (*services.LoginResult, error) {
@@ -88,7 +87,7 @@ func TestAuthHandler_Login(t *testing.T) {
 				Password: "password123",
 			},
 			mockSetup: func() {
-				mockService.On("Login", "testuser", "password123", "", "", "").
+				mockService.On("Login", "testuser", "password123", "", mock.Anything, mock.Anything).
 					Return(&services.LoginResult{
 						AccessToken:  "token",
 						RefreshToken: "refresh",
@@ -111,7 +110,7 @@ func TestAuthHandler_Login(t *testing.T) {
 				Password: "wrongpassword",
 			},
 			mockSetup: func() {
-				mockService.On("Login", "testuser", "wrongpassword", "", "", "").
+				mockService.On("Login", "testuser", "wrongpassword", "", mock.Anything, mock.Anything).
 					Return(nil, assert.AnError)
 			},
 			expectedStatus: http.StatusUnauthorized,
@@ -158,11 +157,11 @@ func TestAuthHandler_Register(t *testing.T) {
 			requestBody: RegisterRequest{
 				Username: "newuser",
 				Email:    "newuser@example.com",
-				Password: "password123",
+				Password: "Password123!",
 			},
 			mockSetup: func() {
-				mockService.On("Register", "newuser", "newuser@example.com", "password123").
-					Return(&services.User{
+				mockService.On("Register", "newuser", "newuser@example.com", "Password123!").
+					Return(&models.User{
 						Username: "newuser",
 						Email:    "newuser@example.com",
 					}, nil)
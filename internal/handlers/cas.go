@@ -17,10 +17,12 @@ func NewCASHandler(service *services.CASService, logger *logrus.Logger) *CASHand
 
 // CASLogin handles CAS protocol login
 // @Summary CAS Login
-// @Description CAS (Central Authentication Service) protocol login endpoint
+// @Description CAS (Central Authentication Service) protocol login endpoint. Redirects to service with a service ticket
 // @Tags sso
 // @Produce html
 // @Param service query string false "Service URL to redirect after login"
+// @Param renew query bool false "Require the user to present credentials"
+// @Param gateway query bool false "Return to service without a ticket instead of asking the user to log in"
 // @Success 200 "Login page or redirect to service"
 // @Router /cas/login [get]
 func (h *CASHandler) CASLogin(c *gin.Context) {
@@ -40,20 +42,54 @@ func (h *CASHandler) CASValidate(c *gin.Context) {
 	h.service.CASValidate(c)
 }
 
-// CASServiceValidate handles CAS 2.0 service ticket validation
-// @Summary CAS 2.0 Service Validate
-// @Description CAS 2.0 protocol service ticket validation endpoint (XML format)
+// CASServiceValidate handles CAS 2.0 and 3.0 service ticket validation
+// @Summary CAS Service Validate
+// @Description CAS 2.0 and 3.0 service ticket validation endpoint. The ticket must have been issued for service; proxy tickets are rejected. The response carries the attributes configured for the service and, when pgtUrl is given and the service may proxy, the PGTIOU of a proxy-granting ticket sent to pgtUrl. format=JSON selects the CAS 3.0 JSON response
 // @Tags sso
-// @Produce application/xml
+// @Produce application/xml,application/json
 // @Param ticket query string true "Service ticket"
 // @Param service query string true "Service URL"
-// @Success 200 "CAS 2.0 XML response"
-// @Failure 400 "Invalid ticket"
+// @Param pgtUrl query string false "Proxy callback URL (https)"
+// @Param renew query bool false "Require a ticket issued from primary credentials"
+// @Param format query string false "XML (default) or JSON"
+// @Success 200 "CAS service response"
 // @Router /cas/serviceValidate [get]
+// @Router /cas/p3/serviceValidate [get]
 func (h *CASHandler) CASServiceValidate(c *gin.Context) {
 	h.service.CASServiceValidate(c)
 }
 
+// CASProxyValidate handles CAS service and proxy ticket validation
+// @Summary CAS Proxy Validate
+// @Description Validate a service or proxy ticket like serviceValidate. For proxy tickets the response lists the proxies the ticket went through, the most recent first
+// @Tags sso
+// @Produce application/xml,application/json
+// @Param ticket query string true "Service or proxy ticket"
+// @Param service query string true "Service URL"
+// @Param pgtUrl query string false "Proxy callback URL (https)"
+// @Param renew query bool false "Require a ticket issued from primary credentials"
+// @Param format query string false "XML (default) or JSON"
+// @Success 200 "CAS service response"
+// @Router /cas/proxyValidate [get]
+// @Router /cas/p3/proxyValidate [get]
+func (h *CASHandler) CASProxyValidate(c *gin.Context) {
+	h.service.CASProxyValidate(c)
+}
+
+// CASProxy issues CAS proxy tickets
+// @Summary CAS Proxy
+// @Description Issue a proxy ticket for targetService to the holder of a proxy-granting ticket
+// @Tags sso
+// @Produce application/xml,application/json
+// @Param pgt query string true "Proxy-granting ticket"
+// @Param targetService query string true "Service the proxy ticket is for"
+// @Param format query string false "XML (default) or JSON"
+// @Success 200 "CAS service response"
+// @Router /cas/proxy [get]
+func (h *CASHandler) CASProxy(c *gin.Context) {
+	h.service.CASProxy(c)
+}
+
 // CASLogout handles CAS protocol logout
 // @Summary CAS Logout
 // @Description CAS protocol logout endpoint
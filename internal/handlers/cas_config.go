@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/services"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+type CASConfigHandler struct {
+	service *services.CASConfigService
+	logger  *logrus.Logger
+}
+
+func NewCASConfigHandler(service *services.CASConfigService, logger *logrus.Logger) *CASConfigHandler {
+	return &CASConfigHandler{service: service, logger: logger}
+}
+
+// List lists the services registered to a CAS application
+// @Summary List CAS services
+// @Description Get the services registered to a CAS application (admin only)
+// @Tags applications
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Success 200 {object} map[string]interface{} "CAS service list"
+// @Failure 404 {object} map[string]interface{} "CAS application not found"
+// @Router /applications/{id}/cas-services [get]
+func (h *CASConfigHandler) List(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	configs, err := h.service.List(appID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    configs,
+	})
+}
+
+// Get gets a service registered to a CAS application
+// @Summary Get CAS service
+// @Description Get a service registered to a CAS application (admin only)
+// @Tags applications
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param service_id path int true "CAS service ID"
+// @Success 200 {object} map[string]interface{} "CAS service"
+// @Failure 404 {object} map[string]interface{} "CAS service not found"
+// @Router /applications/{id}/cas-services/{service_id} [get]
+func (h *CASConfigHandler) Get(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	id, _ := strconv.ParseUint(c.Param("service_id"), 10, 64)
+	config, err := h.service.Get(appID, id)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    config,
+	})
+}
+
+// Create registers a service to a CAS application
+// @Summary Register CAS service
+// @Description Register the service URLs that match pattern by match_type: exact, prefix (default) or regex (matched against the whole URL). CAS only issues tickets to registered services of active CAS applications; an exact match wins over the longest prefix, which wins over a regex. attribute_map lists the attributes released to the services, mapping their names to a source (id, username, email, name, phone, roles, groups, organizations, org_paths, attribute:<key>); without one email and username are released. allow_proxy lets the services obtain proxy-granting tickets with an https pgtUrl on a public address that matches proxy_callback_pattern, a regex matched against the whole URL and required with allow_proxy. sso_enabled (default true) lets users in with their single sign-on session; otherwise they present credentials on every login (admin only)
+// @Tags applications
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param request body map[string]interface{} true "CAS service settings" example:"{\"name\":\"Portal\",\"match_type\":\"prefix\",\"pattern\":\"https://portal.example.com/\",\"attribute_map\":{\"mail\":\"email\",\"memberOf\":\"groups\"},\"allow_proxy\":true,\"proxy_callback_pattern\":\"https://portal[.]example[.]com/pgt\"}"
+// @Success 200 {object} map[string]interface{} "CAS service registered"
+// @Failure 400 {object} map[string]interface{} "Invalid CAS service"
+// @Failure 404 {object} map[string]interface{} "CAS application not found"
+// @Failure 409 {object} map[string]interface{} "Pattern already registered"
+// @Router /applications/{id}/cas-services [post]
+func (h *CASConfigHandler) Create(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+
+	var req services.CASServiceConfigUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "Invalid request",
+		})
+		return
+	}
+
+	config, err := h.service.Create(appID, &req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    config,
+	})
+}
+
+// Update updates a service registered to a CAS application
+// @Summary Update CAS service
+// @Description Update a registered CAS service; see Create for the fields (admin only)
+// @Tags applications
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param service_id path int true "CAS service ID"
+// @Param request body map[string]interface{} true "CAS service settings to update"
+// @Success 200 {object} map[string]interface{} "CAS service updated"
+// @Failure 400 {object} map[string]interface{} "Invalid CAS service"
+// @Failure 404 {object} map[string]interface{} "CAS service not found"
+// @Router /applications/{id}/cas-services/{service_id} [put]
+func (h *CASConfigHandler) Update(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	id, _ := strconv.ParseUint(c.Param("service_id"), 10, 64)
+
+	var req services.CASServiceConfigUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "Invalid request",
+		})
+		return
+	}
+
+	config, err := h.service.Update(appID, id, &req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    config,
+	})
+}
+
+// Delete unregisters a CAS service
+// @Summary Delete CAS service
+// @Description Unregister a CAS service. No tickets are issued to it afterwards (admin only)
+// @Tags applications
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param service_id path int true "CAS service ID"
+// @Success 200 {object} map[string]interface{} "CAS service deleted"
+// @Failure 404 {object} map[string]interface{} "CAS service not found"
+// @Router /applications/{id}/cas-services/{service_id} [delete]
+func (h *CASConfigHandler) Delete(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	id, _ := strconv.ParseUint(c.Param("service_id"), 10, 64)
+	if err := h.service.Delete(appID, id); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+func (h *CASConfigHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "Not found",
+		})
+	case errors.Is(err, services.ErrInvalidCASServiceConfig):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": err.Error(),
+		})
+	case errors.Is(err, services.ErrCASServiceConfigExists):
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    409,
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+	}
+}
@@ -27,8 +27,14 @@ type Handlers struct {
 	LDAP                *LDAPHandler
 	ConditionalAccess   *ConditionalAccessHandler
 	APIKey              *APIKeyHandler
+	OAuthClient         *OAuthClientHandler
+	OAuthScope          *OAuthScopeHandler
+	SAMLConfig          *SAMLConfigHandler
+	SAMLIdentityProvider *SAMLIdentityProviderHandler
+	SAMLKey             *SAMLKeyHandler
 	Webhook             *WebhookHandler
 	CAS                 *CASHandler
+	CASConfig           *CASConfigHandler
 	UserImportExport    *UserImportExportHandler
 	Device              *DeviceHandler
 	Automation          *AutomationHandler
@@ -55,8 +61,14 @@ func New(db *gorm.DB, redis *redis.Client, cfg *config.Config, logger *logrus.Lo
 		LDAP:                NewLDAPHandler(svcs.LDAP, logger),
 		ConditionalAccess:   NewConditionalAccessHandler(svcs.ConditionalAccess, logger),
 		APIKey:              NewAPIKeyHandler(svcs.APIKey, logger),
+		OAuthClient:         NewOAuthClientHandler(svcs.OAuthClient, logger),
+		OAuthScope:          NewOAuthScopeHandler(svcs.OAuthScope, logger),
+		SAMLConfig:          NewSAMLConfigHandler(svcs.SAMLConfig, logger),
+		SAMLIdentityProvider: NewSAMLIdentityProviderHandler(svcs.SAMLIdentityProvider, logger),
+		SAMLKey:             NewSAMLKeyHandler(svcs.SAMLKey, logger),
 		Webhook:             NewWebhookHandler(svcs.Webhook, logger),
 		CAS:                 NewCASHandler(svcs.CAS, logger),
+		CASConfig:           NewCASConfigHandler(svcs.CASConfig, logger),
 		UserImportExport:    NewUserImportExportHandler(svcs.UserImportExport, logger),
 		Device:              NewDeviceHandler(svcs.Risk, logger),
 		Automation:          NewAutomationHandler(svcs.Automation, logger),
@@ -0,0 +1,459 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/services"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+type OAuthClientHandler struct {
+	service *services.OAuthClientService
+	logger  *logrus.Logger
+}
+
+func NewOAuthClientHandler(service *services.OAuthClientService, logger *logrus.Logger) *OAuthClientHandler {
+	return &OAuthClientHandler{service: service, logger: logger}
+}
+
+// List lists the OAuth clients of an application
+// @Summary List OAuth clients
+// @Description Get the OAuth clients registered for an application (admin only)
+// @Tags applications
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Success 200 {object} map[string]interface{} "OAuth client list"
+// @Failure 500 {object} map[string]interface{} "Internal server error"
+// @Router /applications/{id}/oauth-clients [get]
+func (h *OAuthClientHandler) List(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	clients, err := h.service.List(appID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    clients,
+	})
+}
+
+// Get gets an OAuth client
+// @Summary Get OAuth client
+// @Description Get an OAuth client of an application by client_id (admin only)
+// @Tags applications
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param client_id path string true "OAuth client ID"
+// @Success 200 {object} map[string]interface{} "OAuth client details"
+// @Failure 404 {object} map[string]interface{} "OAuth client not found"
+// @Router /applications/{id}/oauth-clients/{client_id} [get]
+func (h *OAuthClientHandler) Get(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	client, err := h.service.Get(appID, c.Param("client_id"))
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    client,
+	})
+}
+
+// Create creates an OAuth client
+// @Summary Create OAuth client
+// @Description Register an OAuth client for an application. The client secret is generated and shown only once (admin only)
+// @Tags applications
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param request body map[string]interface{} true "Client data" example:"{\"redirect_uris\":[\"https://app.example.com/callback\"],\"grant_types\":[\"authorization_code\",\"refresh_token\"],\"scopes\":[\"openid\",\"profile\"],\"public\":false,\"first_party\":false,\"access_token_format\":\"jwt\",\"access_token_audience\":\"https://api.example.com\"}"
+// @Success 200 {object} map[string]interface{} "OAuth client created (secret shown only once)"
+// @Failure 400 {object} map[string]interface{} "Invalid client metadata"
+// @Failure 404 {object} map[string]interface{} "Application not found"
+// @Router /applications/{id}/oauth-clients [post]
+func (h *OAuthClientHandler) Create(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+
+	var req struct {
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		GrantTypes   []string `json:"grant_types"`
+		Public       bool     `json:"public"`
+		FirstParty   bool     `json:"first_party"`
+
+		AccessTokenFormat   string `json:"access_token_format"`
+		AccessTokenAudience string `json:"access_token_audience"`
+
+		TokenEndpointAuthMethod string       `json:"token_endpoint_auth_method"`
+		JWKS                    models.JSONB `json:"jwks"`
+		JWKSURI                 string       `json:"jwks_uri"`
+		TLSClientAuthSubjectDN  string       `json:"tls_client_auth_subject_dn"`
+
+		TokenExchangeSubjectClients []string `json:"token_exchange_subject_clients"`
+		TokenExchangeAudiences      []string `json:"token_exchange_audiences"`
+		TokenExchangeImpersonation  bool     `json:"token_exchange_impersonation"`
+
+		PostLogoutRedirectURIs            []string `json:"post_logout_redirect_uris"`
+		FrontchannelLogoutURI             string   `json:"frontchannel_logout_uri"`
+		FrontchannelLogoutSessionRequired bool     `json:"frontchannel_logout_session_required"`
+		BackchannelLogoutURI              string   `json:"backchannel_logout_uri"`
+		BackchannelLogoutSessionRequired  bool     `json:"backchannel_logout_session_required"`
+
+		RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests"`
+		DPoPBoundAccessTokens              bool `json:"dpop_bound_access_tokens"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "Invalid request",
+		})
+		return
+	}
+
+	client := &models.OAuthClient{
+		RedirectURIs: req.RedirectURIs,
+		Scopes:       req.Scopes,
+		GrantTypes:   req.GrantTypes,
+		Public:       req.Public,
+		FirstParty:   req.FirstParty,
+
+		AccessTokenFormat:   req.AccessTokenFormat,
+		AccessTokenAudience: req.AccessTokenAudience,
+
+		TokenEndpointAuthMethod: req.TokenEndpointAuthMethod,
+		JWKS:                    req.JWKS,
+		JWKSURI:                 req.JWKSURI,
+		TLSClientAuthSubjectDN:  req.TLSClientAuthSubjectDN,
+
+		TokenExchangeSubjectClients: req.TokenExchangeSubjectClients,
+		TokenExchangeAudiences:      req.TokenExchangeAudiences,
+		TokenExchangeImpersonation:  req.TokenExchangeImpersonation,
+
+		PostLogoutRedirectURIs:            req.PostLogoutRedirectURIs,
+		FrontchannelLogoutURI:             req.FrontchannelLogoutURI,
+		FrontchannelLogoutSessionRequired: req.FrontchannelLogoutSessionRequired,
+		BackchannelLogoutURI:              req.BackchannelLogoutURI,
+		BackchannelLogoutSessionRequired:  req.BackchannelLogoutSessionRequired,
+
+		RequirePushedAuthorizationRequests: req.RequirePushedAuthorizationRequests,
+		DPoPBoundAccessTokens:              req.DPoPBoundAccessTokens,
+	}
+	secret, err := h.service.Create(appID, client)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	data := gin.H{
+		"id":            client.ID,
+		"client_id":     client.ClientID,
+		"redirect_uris": client.RedirectURIs,
+		"scopes":        client.Scopes,
+		"grant_types":   client.GrantTypes,
+		"public":        client.Public,
+		"first_party":   client.FirstParty,
+
+		"access_token_format":   client.AccessTokenFormat,
+		"access_token_audience": client.AccessTokenAudience,
+
+		"token_endpoint_auth_method": client.TokenEndpointAuthMethod,
+		"jwks":                       client.JWKS,
+		"jwks_uri":                   client.JWKSURI,
+		"tls_client_auth_subject_dn": client.TLSClientAuthSubjectDN,
+
+		"token_exchange_subject_clients": client.TokenExchangeSubjectClients,
+		"token_exchange_audiences":       client.TokenExchangeAudiences,
+		"token_exchange_impersonation":   client.TokenExchangeImpersonation,
+
+		"post_logout_redirect_uris":            client.PostLogoutRedirectURIs,
+		"frontchannel_logout_uri":              client.FrontchannelLogoutURI,
+		"frontchannel_logout_session_required": client.FrontchannelLogoutSessionRequired,
+		"backchannel_logout_uri":               client.BackchannelLogoutURI,
+		"backchannel_logout_session_required":  client.BackchannelLogoutSessionRequired,
+
+		"require_pushed_authorization_requests": client.RequirePushedAuthorizationRequests,
+		"dpop_bound_access_tokens":              client.DPoPBoundAccessTokens,
+	}
+	if secret != "" {
+		data["client_secret"] = secret // Only shown once
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    data,
+	})
+}
+
+// Update updates an OAuth client
+// @Summary Update OAuth client
+// @Description Update redirect URIs, scopes, grant types, the first-party flag, the access token format, the token endpoint authentication method, the token exchange policy, the logout URIs and whether pushed authorization requests and DPoP-bound access tokens are required of an OAuth client (admin only)
+// @Tags applications
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param client_id path string true "OAuth client ID"
+// @Param request body map[string]interface{} true "Client data to update"
+// @Success 200 {object} map[string]interface{} "OAuth client updated"
+// @Failure 400 {object} map[string]interface{} "Invalid client metadata"
+// @Failure 404 {object} map[string]interface{} "OAuth client not found"
+// @Router /applications/{id}/oauth-clients/{client_id} [put]
+func (h *OAuthClientHandler) Update(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+
+	var req services.OAuthClientUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "Invalid request",
+		})
+		return
+	}
+
+	client, err := h.service.Update(appID, c.Param("client_id"), &req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    client,
+	})
+}
+
+// Delete deletes an OAuth client
+// @Summary Delete OAuth client
+// @Description Delete an OAuth client and revoke all tokens issued to it (admin only)
+// @Tags applications
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param client_id path string true "OAuth client ID"
+// @Success 200 {object} map[string]interface{} "OAuth client deleted"
+// @Failure 404 {object} map[string]interface{} "OAuth client not found"
+// @Router /applications/{id}/oauth-clients/{client_id} [delete]
+func (h *OAuthClientHandler) Delete(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err := h.service.Delete(c.Request.Context(), appID, c.Param("client_id")); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// RotateSecret rotates the secret of an OAuth client
+// @Summary Rotate OAuth client secret
+// @Description Generate a new client secret. The previous secret stays valid for overlap_hours (default 24, 0 revokes it immediately) so both secrets are accepted during the switch-over (admin only)
+// @Tags applications
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param client_id path string true "OAuth client ID"
+// @Param request body map[string]interface{} false "Rotation options" example:"{\"overlap_hours\":24}"
+// @Success 200 {object} map[string]interface{} "New client secret (shown only once)"
+// @Failure 400 {object} map[string]interface{} "Client has no secret"
+// @Failure 404 {object} map[string]interface{} "OAuth client not found"
+// @Router /applications/{id}/oauth-clients/{client_id}/rotate-secret [post]
+func (h *OAuthClientHandler) RotateSecret(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+
+	var req struct {
+		OverlapHours *int `json:"overlap_hours"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil || (req.OverlapHours != nil && *req.OverlapHours < 0) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "Invalid request",
+			})
+			return
+		}
+	}
+	overlap := services.DefaultSecretOverlap
+	if req.OverlapHours != nil {
+		overlap = time.Duration(*req.OverlapHours) * time.Hour
+	}
+
+	client, secret, err := h.service.RotateSecret(appID, c.Param("client_id"), overlap)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"client_id":                  client.ClientID,
+			"client_secret":              secret, // Only shown once
+			"previous_secret_expires_at": client.PreviousSecretExpiresAt,
+		},
+	})
+}
+
+func (h *OAuthClientHandler) respondError(c *gin.Context, err error) {
+	var metadataErr *sso.ClientMetadataError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "Not found",
+		})
+	case errors.As(err, &metadataErr):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": metadataErr.Description,
+			"error":   metadataErr.Code,
+		})
+	case errors.Is(err, services.ErrNoClientSecret):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+	}
+}
+
+// CreateInitialAccessToken creates an initial access token for dynamic client registration
+// @Summary Create initial access token
+// @Description Issue a token that authorizes dynamic client registration at /oauth2/register. The token is shown only once (admin only)
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body map[string]interface{} true "Token data; grant_types adds grant types beyond authorization_code, refresh_token and the device grant" example:"{\"name\":\"preview environments\",\"max_uses\":50,\"expires_in_hours\":720}"
+// @Success 200 {object} map[string]interface{} "Initial access token created (token shown only once)"
+// @Failure 400 {object} map[string]interface{} "Invalid request"
+// @Failure 500 {object} map[string]interface{} "Internal server error"
+// @Router /admin/initial-access-tokens [post]
+func (h *OAuthClientHandler) CreateInitialAccessToken(c *gin.Context) {
+	var req struct {
+		Name           string   `json:"name" binding:"required"`
+		MaxUses        int      `json:"max_uses"`
+		ExpiresInHours *int     `json:"expires_in_hours"`
+		GrantTypes     []string `json:"grant_types"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.MaxUses < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "Invalid request",
+		})
+		return
+	}
+
+	var createdBy *uint64
+	if userID, exists := c.Get("user_id"); exists {
+		if id, ok := userID.(uint64); ok {
+			createdBy = &id
+		}
+	}
+
+	initialToken, token, err := h.service.CreateInitialAccessToken(req.Name, req.MaxUses, req.ExpiresInHours, req.GrantTypes, createdBy)
+	if errors.Is(err, services.ErrUnsupportedGrantType) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data": gin.H{
+			"id":           initialToken.ID,
+			"name":         initialToken.Name,
+			"token":        token, // Only shown once
+			"token_prefix": initialToken.TokenPrefix,
+			"max_uses":     initialToken.MaxUses,
+			"grant_types":  initialToken.GrantTypes,
+			"expires_at":   initialToken.ExpiresAt,
+		},
+	})
+}
+
+// ListInitialAccessTokens lists initial access tokens
+// @Summary List initial access tokens
+// @Description Get the initial access tokens for dynamic client registration (admin only)
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{} "Initial access token list"
+// @Failure 500 {object} map[string]interface{} "Internal server error"
+// @Router /admin/initial-access-tokens [get]
+func (h *OAuthClientHandler) ListInitialAccessTokens(c *gin.Context) {
+	tokens, err := h.service.ListInitialAccessTokens()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    tokens,
+	})
+}
+
+// RevokeInitialAccessToken revokes an initial access token
+// @Summary Revoke initial access token
+// @Description Revoke an initial access token so it can no longer register clients (admin only)
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Initial access token ID"
+// @Success 200 {object} map[string]interface{} "Initial access token revoked"
+// @Failure 404 {object} map[string]interface{} "Initial access token not found"
+// @Router /admin/initial-access-tokens/{id}/revoke [post]
+func (h *OAuthClientHandler) RevokeInitialAccessToken(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err := h.service.RevokeInitialAccessToken(id); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/services"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+type OAuthScopeHandler struct {
+	service *services.OAuthScopeService
+	logger  *logrus.Logger
+}
+
+func NewOAuthScopeHandler(service *services.OAuthScopeService, logger *logrus.Logger) *OAuthScopeHandler {
+	return &OAuthScopeHandler{service: service, logger: logger}
+}
+
+// List lists the scope registry
+// @Summary List OAuth scopes
+// @Description Get the scopes defined in the registry and the claims each releases (admin only)
+// @Tags oauth-scopes
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{} "Scope list"
+// @Failure 500 {object} map[string]interface{} "Internal server error"
+// @Router /oauth-scopes [get]
+func (h *OAuthScopeHandler) List(c *gin.Context) {
+	scopes, err := h.service.List()
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    scopes,
+	})
+}
+
+// Get gets a scope
+// @Summary Get OAuth scope
+// @Description Get a scope of the registry by ID (admin only)
+// @Tags oauth-scopes
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Scope ID"
+// @Success 200 {object} map[string]interface{} "Scope details"
+// @Failure 404 {object} map[string]interface{} "Scope not found"
+// @Router /oauth-scopes/{id} [get]
+func (h *OAuthScopeHandler) Get(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	scope, err := h.service.Get(id)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    scope,
+	})
+}
+
+// Create defines a scope
+// @Summary Create OAuth scope
+// @Description Define a scope and the claims it releases. Claims are standard OIDC claims, roles, groups, org_path or the name of a custom user attribute (admin only)
+// @Tags oauth-scopes
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body map[string]interface{} true "Scope data" example:"{\"name\":\"hr\",\"description\":\"HR profile\",\"claims\":[\"roles\",\"org_path\",\"employee_id\"]}"
+// @Success 200 {object} map[string]interface{} "Scope created"
+// @Failure 400 {object} map[string]interface{} "Invalid scope definition"
+// @Failure 409 {object} map[string]interface{} "Scope already exists"
+// @Router /oauth-scopes [post]
+func (h *OAuthScopeHandler) Create(c *gin.Context) {
+	var req struct {
+		Name        string   `json:"name" binding:"required"`
+		Description string   `json:"description"`
+		Claims      []string `json:"claims"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "Invalid request",
+		})
+		return
+	}
+
+	scope := &models.OAuthScope{Name: req.Name, Description: req.Description, Claims: req.Claims}
+	if err := h.service.Create(scope); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    scope,
+	})
+}
+
+// Update updates a scope
+// @Summary Update OAuth scope
+// @Description Update the description and claims of a scope (admin only)
+// @Tags oauth-scopes
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Scope ID"
+// @Param request body map[string]interface{} true "Scope data to update"
+// @Success 200 {object} map[string]interface{} "Scope updated"
+// @Failure 400 {object} map[string]interface{} "Invalid scope definition"
+// @Failure 404 {object} map[string]interface{} "Scope not found"
+// @Router /oauth-scopes/{id} [put]
+func (h *OAuthScopeHandler) Update(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+
+	var req services.OAuthScopeUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "Invalid request",
+		})
+		return
+	}
+
+	scope, err := h.service.Update(id, &req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    scope,
+	})
+}
+
+// Delete deletes a scope
+// @Summary Delete OAuth scope
+// @Description Remove a scope from the registry (admin only)
+// @Tags oauth-scopes
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Scope ID"
+// @Success 200 {object} map[string]interface{} "Scope deleted"
+// @Failure 404 {object} map[string]interface{} "Scope not found"
+// @Router /oauth-scopes/{id} [delete]
+func (h *OAuthScopeHandler) Delete(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err := h.service.Delete(id); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+func (h *OAuthScopeHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "Not found",
+		})
+	case errors.Is(err, services.ErrInvalidScopeDefinition):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": err.Error(),
+		})
+	case errors.Is(err, services.ErrScopeExists):
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    409,
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+	}
+}
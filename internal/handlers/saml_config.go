@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/services"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// maxSAMLMetadataSize bounds uploaded SP metadata
+const maxSAMLMetadataSize = 1 << 20
+
+type SAMLConfigHandler struct {
+	service *services.SAMLConfigService
+	logger  *logrus.Logger
+}
+
+func NewSAMLConfigHandler(service *services.SAMLConfigService, logger *logrus.Logger) *SAMLConfigHandler {
+	return &SAMLConfigHandler{service: service, logger: logger}
+}
+
+// Get gets the SAML settings of an application
+// @Summary Get SAML configuration
+// @Description Get the SAML settings of a SAML application. The private key is never returned (admin only)
+// @Tags applications
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Success 200 {object} map[string]interface{} "SAML configuration"
+// @Failure 404 {object} map[string]interface{} "SAML configuration not found"
+// @Router /applications/{id}/saml-config [get]
+func (h *SAMLConfigHandler) Get(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	config, err := h.service.Get(appID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    config,
+	})
+}
+
+// Update updates the SAML settings of an application
+// @Summary Update SAML configuration
+// @Description Set the SP entity ID and ACS URL, the signing certificate and private key (PEM) and whether the assertion, the response or both are signed (signature_target). encrypt_assertions sends assertions encrypted to the SP's encryption_certificate with encryption_method (aes128-gcm by default). attribute_map maps SAML attribute names to a source (id, username, email, name, phone, roles, groups, organizations, org_paths, attribute:<key>) or to a rule object with source, values (static), name_format, friendly_name and separator. name_id_format is email (default), persistent, transient or unspecified; name_id_source selects the value of the email and unspecified formats. sign_metadata signs the published IdP metadata. Key sets at /applications/{id}/saml-keys take precedence over the certificate and private key. SP settings (acs_endpoints, sp_certificates, name_id_formats, authn_requests_signed) are usually imported from the SP metadata. The settings are created on first update (admin only)
+// @Tags applications
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param request body map[string]interface{} true "SAML settings" example:"{\"entity_id\":\"https://sp.example.com\",\"sso_url\":\"https://sp.example.com/acs\",\"signature_target\":\"both\"}"
+// @Success 200 {object} map[string]interface{} "SAML configuration updated"
+// @Failure 400 {object} map[string]interface{} "Invalid SAML configuration"
+// @Failure 404 {object} map[string]interface{} "SAML application not found"
+// @Router /applications/{id}/saml-config [put]
+func (h *SAMLConfigHandler) Update(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+
+	var req services.SAMLConfigUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "Invalid request",
+		})
+		return
+	}
+
+	config, err := h.service.Save(appID, &req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    config,
+	})
+}
+
+// ImportMetadata imports the SP metadata of an application
+// @Summary Import SAML SP metadata
+// @Description Upload (file) or paste (XML body) the SP's metadata. It sets the SP entity ID, the ACS endpoints with their bindings, the SLO URL, the SP signing and encryption certificates and NameID formats, and whether AuthnRequests must be signed (admin only)
+// @Tags applications
+// @Accept multipart/form-data,application/xml
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param file formData file false "SP metadata XML file"
+// @Success 200 {object} map[string]interface{} "SAML configuration updated"
+// @Failure 400 {object} map[string]interface{} "Invalid metadata"
+// @Failure 404 {object} map[string]interface{} "SAML application not found"
+// @Router /applications/{id}/saml-config/metadata [post]
+func (h *SAMLConfigHandler) ImportMetadata(c *gin.Context) {
+	appID, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+
+	var data []byte
+	if c.ContentType() == "multipart/form-data" {
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "File required",
+			})
+			return
+		}
+
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "Failed to open file",
+			})
+			return
+		}
+		defer f.Close()
+
+		data, err = io.ReadAll(io.LimitReader(f, maxSAMLMetadataSize))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "Failed to read file",
+			})
+			return
+		}
+	} else {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSAMLMetadataSize))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "Invalid request body",
+			})
+			return
+		}
+		data = body
+	}
+
+	config, err := h.service.ImportMetadata(appID, data)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    config,
+	})
+}
+
+func (h *SAMLConfigHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "Not found",
+		})
+	case errors.Is(err, services.ErrInvalidSAMLConfig):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+	}
+}
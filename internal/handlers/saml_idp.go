@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/services"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+type SAMLIdentityProviderHandler struct {
+	service *services.SAMLIdentityProviderService
+	logger  *logrus.Logger
+}
+
+func NewSAMLIdentityProviderHandler(service *services.SAMLIdentityProviderService, logger *logrus.Logger) *SAMLIdentityProviderHandler {
+	return &SAMLIdentityProviderHandler{service: service, logger: logger}
+}
+
+// List lists the external SAML IdP connections
+// @Summary List SAML identity providers
+// @Description Get the external SAML IdPs users can sign in with. SP private keys are never returned (admin only)
+// @Tags saml-identity-providers
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{} "Identity provider list"
+// @Failure 500 {object} map[string]interface{} "Internal server error"
+// @Router /saml-identity-providers [get]
+func (h *SAMLIdentityProviderHandler) List(c *gin.Context) {
+	providers, err := h.service.List()
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    providers,
+	})
+}
+
+// Get gets an external SAML IdP connection
+// @Summary Get SAML identity provider
+// @Description Get an external SAML IdP connection by ID (admin only)
+// @Tags saml-identity-providers
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Identity provider ID"
+// @Success 200 {object} map[string]interface{} "Identity provider details"
+// @Failure 404 {object} map[string]interface{} "Identity provider not found"
+// @Router /saml-identity-providers/{id} [get]
+func (h *SAMLIdentityProviderHandler) Get(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	provider, err := h.service.Get(id)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    provider,
+	})
+}
+
+// Create creates an external SAML IdP connection
+// @Summary Create SAML identity provider
+// @Description Add an external SAML IdP. The IdP settings (entity_id, sso_url, sso_binding, certificates) are usually imported from its metadata afterwards. certificate and private_key are the SP key pair (PEM) AuthnRequests are signed with (sign_authn_requests) and encrypted assertions decrypted with. Accounts are linked by NameID; link_by_email links existing users whose asserted email is in one of email_domains, except administrators and users with MFA, and jit_provisioning creates new users. attribute_map maps user fields (username, email, phone, attribute:<key>) to SAML attribute names. role_mappings grant roles and groups for attribute values ({"attribute","value","roles","groups"}), default_roles are granted to every user and sync_roles removes mapped roles and groups the IdP no longer asserts (admin only)
+// @Tags saml-identity-providers
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body map[string]interface{} true "Identity provider settings" example:"{\"name\":\"Corporate IdP\",\"jit_provisioning\":true,\"role_mappings\":[{\"attribute\":\"memberOf\",\"value\":\"admins\",\"roles\":[\"admin\"]}]}"
+// @Success 200 {object} map[string]interface{} "Identity provider created"
+// @Failure 400 {object} map[string]interface{} "Invalid identity provider"
+// @Failure 409 {object} map[string]interface{} "Identity provider already exists"
+// @Router /saml-identity-providers [post]
+func (h *SAMLIdentityProviderHandler) Create(c *gin.Context) {
+	var req services.SAMLIdentityProviderUpdate
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "Invalid request",
+		})
+		return
+	}
+
+	provider, err := h.service.Create(*req.Name, &req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    provider,
+	})
+}
+
+// Update updates an external SAML IdP connection
+// @Summary Update SAML identity provider
+// @Description Update the settings of an external SAML IdP connection; see Create for the fields. status is active or inactive (admin only)
+// @Tags saml-identity-providers
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Identity provider ID"
+// @Param request body map[string]interface{} true "Identity provider settings to update"
+// @Success 200 {object} map[string]interface{} "Identity provider updated"
+// @Failure 400 {object} map[string]interface{} "Invalid identity provider"
+// @Failure 404 {object} map[string]interface{} "Identity provider not found"
+// @Router /saml-identity-providers/{id} [put]
+func (h *SAMLIdentityProviderHandler) Update(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+
+	var req services.SAMLIdentityProviderUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "Invalid request",
+		})
+		return
+	}
+
+	provider, err := h.service.Update(id, &req)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    provider,
+	})
+}
+
+// ImportMetadata imports the metadata of an external SAML IdP
+// @Summary Import SAML IdP metadata
+// @Description Upload (file) or paste (XML body) the IdP's metadata. It sets the IdP entity ID, the SSO endpoint and binding and the IdP signing certificates, and turns on signed AuthnRequests if the IdP wants them (admin only)
+// @Tags saml-identity-providers
+// @Accept multipart/form-data,application/xml
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Identity provider ID"
+// @Param file formData file false "IdP metadata XML file"
+// @Success 200 {object} map[string]interface{} "Identity provider updated"
+// @Failure 400 {object} map[string]interface{} "Invalid metadata"
+// @Failure 404 {object} map[string]interface{} "Identity provider not found"
+// @Router /saml-identity-providers/{id}/metadata [post]
+func (h *SAMLIdentityProviderHandler) ImportMetadata(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+
+	var data []byte
+	if c.ContentType() == "multipart/form-data" {
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "File required",
+			})
+			return
+		}
+
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "Failed to open file",
+			})
+			return
+		}
+		defer f.Close()
+
+		data, err = io.ReadAll(io.LimitReader(f, maxSAMLMetadataSize))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "Failed to read file",
+			})
+			return
+		}
+	} else {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSAMLMetadataSize))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "Invalid request body",
+			})
+			return
+		}
+		data = body
+	}
+
+	provider, err := h.service.ImportMetadata(id, data)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    provider,
+	})
+}
+
+// Delete deletes an external SAML IdP connection
+// @Summary Delete SAML identity provider
+// @Description Remove an external SAML IdP connection and the account links made through it. The users are kept (admin only)
+// @Tags saml-identity-providers
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Identity provider ID"
+// @Success 200 {object} map[string]interface{} "Identity provider deleted"
+// @Failure 404 {object} map[string]interface{} "Identity provider not found"
+// @Router /saml-identity-providers/{id} [delete]
+func (h *SAMLIdentityProviderHandler) Delete(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err := h.service.Delete(id); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+func (h *SAMLIdentityProviderHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "Not found",
+		})
+	case errors.Is(err, services.ErrInvalidSAMLIdentityProvider):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": err.Error(),
+		})
+	case errors.Is(err, services.ErrSAMLIdentityProviderExists):
+		c.JSON(http.StatusConflict, gin.H{
+			"code":    409,
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+	}
+}
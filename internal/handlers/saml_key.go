@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/services"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// SAMLKeyHandler serves the SAML signing key sets, both per application at
+// /applications/:id/saml-keys and the global one at /saml-keys
+type SAMLKeyHandler struct {
+	service *services.SAMLKeyService
+	logger  *logrus.Logger
+}
+
+func NewSAMLKeyHandler(service *services.SAMLKeyService, logger *logrus.Logger) *SAMLKeyHandler {
+	return &SAMLKeyHandler{service: service, logger: logger}
+}
+
+// List lists the signing keys of a SAML application or the global ones
+// @Summary List SAML signing keys
+// @Description Get the signing key set with the state of each key: next keys are published in the metadata, the active key signs, retired keys are no longer used. Private keys are never returned. /saml-keys is the global key set used by applications without keys or a key pair of their own (admin only)
+// @Tags saml-keys
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Success 200 {object} map[string]interface{} "Key list"
+// @Failure 404 {object} map[string]interface{} "SAML application not found"
+// @Router /applications/{id}/saml-keys [get]
+// @Router /saml-keys [get]
+func (h *SAMLKeyHandler) List(c *gin.Context) {
+	appID, ok := h.keySet(c)
+	if !ok {
+		return
+	}
+	keys, err := h.service.List(appID)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    keys,
+	})
+}
+
+// Generate generates a signing key
+// @Summary Generate SAML signing key
+// @Description Generate an RSA key pair with a self-signed certificate, valid for validity_days (730 by default). The key starts as next: it is published in the metadata but does not sign until it is activated (admin only)
+// @Tags saml-keys
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param request body map[string]interface{} false "Key options" example:"{\"validity_days\":365}"
+// @Success 200 {object} map[string]interface{} "Key generated"
+// @Failure 400 {object} map[string]interface{} "Invalid request"
+// @Failure 404 {object} map[string]interface{} "SAML application not found"
+// @Router /applications/{id}/saml-keys [post]
+// @Router /saml-keys [post]
+func (h *SAMLKeyHandler) Generate(c *gin.Context) {
+	appID, ok := h.keySet(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ValidityDays *int `json:"validity_days"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "Invalid request",
+			})
+			return
+		}
+	}
+	validity := services.DefaultSAMLKeyValidity
+	if req.ValidityDays != nil {
+		validity = time.Duration(*req.ValidityDays) * 24 * time.Hour
+	}
+
+	key, err := h.service.Generate(appID, validity)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    key,
+	})
+}
+
+// Activate switches over to a signing key
+// @Summary Activate SAML signing key
+// @Description Make a next key the active signing key, at once or at activate_at (RFC 3339). The key it replaces is retired. SPs only trust the new key after refetching the metadata, so schedule the switch-over at least a metadata cache period (one day) after generating the key (admin only)
+// @Tags saml-keys
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param key_id path int true "Key ID"
+// @Param request body map[string]interface{} false "Switch-over time" example:"{\"activate_at\":\"2026-11-01T00:00:00Z\"}"
+// @Success 200 {object} map[string]interface{} "Key activated or scheduled"
+// @Failure 400 {object} map[string]interface{} "Key is not a next key"
+// @Failure 404 {object} map[string]interface{} "Key not found"
+// @Router /applications/{id}/saml-keys/{key_id}/activate [post]
+// @Router /saml-keys/{key_id}/activate [post]
+func (h *SAMLKeyHandler) Activate(c *gin.Context) {
+	appID, ok := h.keySet(c)
+	if !ok {
+		return
+	}
+	keyID, _ := strconv.ParseUint(c.Param("key_id"), 10, 64)
+
+	var req struct {
+		ActivateAt *time.Time `json:"activate_at"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"code":    400,
+				"message": "Invalid request",
+			})
+			return
+		}
+	}
+
+	key, err := h.service.Activate(appID, keyID, req.ActivateAt)
+	if err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    key,
+	})
+}
+
+// Delete deletes a signing key
+// @Summary Delete SAML signing key
+// @Description Delete a next or retired key. The active key cannot be deleted (admin only)
+// @Tags saml-keys
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Application ID"
+// @Param key_id path int true "Key ID"
+// @Success 200 {object} map[string]interface{} "Key deleted"
+// @Failure 400 {object} map[string]interface{} "Key is active"
+// @Failure 404 {object} map[string]interface{} "Key not found"
+// @Router /applications/{id}/saml-keys/{key_id} [delete]
+// @Router /saml-keys/{key_id} [delete]
+func (h *SAMLKeyHandler) Delete(c *gin.Context) {
+	appID, ok := h.keySet(c)
+	if !ok {
+		return
+	}
+	keyID, _ := strconv.ParseUint(c.Param("key_id"), 10, 64)
+	if err := h.service.Delete(appID, keyID); err != nil {
+		h.respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// keySet returns the application of the key set in the path, 0 for the
+// global key set
+func (h *SAMLKeyHandler) keySet(c *gin.Context) (uint64, bool) {
+	if c.Param("id") == "" {
+		return 0, true
+	}
+	appID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || appID == 0 {
+		h.respondError(c, gorm.ErrRecordNotFound)
+		return 0, false
+	}
+	return appID, true
+}
+
+func (h *SAMLKeyHandler) respondError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"code":    404,
+			"message": "Not found",
+		})
+	case errors.Is(err, services.ErrInvalidSAMLKey):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": err.Error(),
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+	}
+}
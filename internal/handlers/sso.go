@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"errors"
+	"net/http"
+
 	"github.com/gin-gonic/gin"
 	"github.com/hanyouqing/openauth/internal/config"
 	"github.com/hanyouqing/openauth/internal/services"
 	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
 type SSOHandler struct {
@@ -22,11 +26,19 @@ func NewSSOHandler(service *services.SSOService, cfg *config.Config, logger *log
 // @Description OAuth 2.0 Authorization Code Flow authorization endpoint
 // @Tags sso
 // @Produce json
-// @Param response_type query string true "Response type (code)" example:"code"
+// @Param response_type query string false "Response type (code), required unless request or request_uri is used" example:"code"
 // @Param client_id query string true "Client ID"
-// @Param redirect_uri query string true "Redirect URI"
+// @Param redirect_uri query string false "Redirect URI, required unless request or request_uri is used"
 // @Param scope query string false "Requested scopes"
 // @Param state query string false "State parameter"
+// @Param nonce query string false "OIDC nonce echoed in the ID token"
+// @Param prompt query string false "OIDC prompt (none, login, consent)"
+// @Param max_age query int false "Maximum authentication age in seconds"
+// @Param code_challenge query string false "PKCE code challenge (required for public clients)"
+// @Param code_challenge_method query string false "PKCE method (S256, plain)"
+// @Param request query string false "Signed request object (RFC 9101) carrying the parameters"
+// @Param request_uri query string false "request_uri returned by the pushed authorization request endpoint"
+// @Param dpop_jkt query string false "Thumbprint of the DPoP key the authorization code is bound to (RFC 9449)"
 // @Success 302 "Redirect to authorization page or redirect_uri"
 // @Failure 400 {object} map[string]interface{} "Invalid request"
 // @Router /oauth2/authorize [get]
@@ -44,8 +56,10 @@ func (h *SSOHandler) OAuth2Authorize(c *gin.Context) {
 // @Param code formData string false "Authorization code"
 // @Param refresh_token formData string false "Refresh token"
 // @Param client_id formData string true "Client ID"
-// @Param client_secret formData string true "Client secret"
+// @Param client_secret formData string false "Client secret (not used by public clients)"
 // @Param redirect_uri formData string false "Redirect URI"
+// @Param code_verifier formData string false "PKCE code verifier"
+// @Param DPoP header string false "DPoP proof JWT binding the issued tokens to its key (RFC 9449)"
 // @Success 200 {object} map[string]interface{} "Token response"
 // @Failure 400 {object} map[string]interface{} "Invalid request"
 // @Failure 401 {object} map[string]interface{} "Invalid credentials"
@@ -54,12 +68,33 @@ func (h *SSOHandler) OAuth2Token(c *gin.Context) {
 	h.service.OAuth2Token(c)
 }
 
+// OAuth2RefreshToken handles the OAuth 2.0 refresh_token grant
+// @Summary OAuth 2.0 Refresh Token
+// @Description Exchange a refresh token for new tokens. Refresh tokens are rotated and reuse revokes the token family.
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "Grant type (refresh_token)" example:"refresh_token"
+// @Param refresh_token formData string true "Refresh token"
+// @Param client_id formData string false "Client ID"
+// @Param client_secret formData string false "Client secret"
+// @Param scope formData string false "Narrowed scope (subset of the original grant)"
+// @Param DPoP header string false "DPoP proof JWT, required for DPoP-bound refresh tokens of public clients"
+// @Success 200 {object} map[string]interface{} "Token response"
+// @Failure 400 {object} map[string]interface{} "Invalid request"
+// @Failure 401 {object} map[string]interface{} "Invalid credentials"
+// @Router /oauth2/token [post]
+func (h *SSOHandler) OAuth2RefreshToken(c *gin.Context) {
+	h.service.OAuth2RefreshToken(c)
+}
+
 // OAuth2UserInfo handles OIDC UserInfo endpoint
 // @Summary OIDC UserInfo
-// @Description Get user information using access token (OIDC UserInfo endpoint)
+// @Description Get user information using access token (OIDC UserInfo endpoint). DPoP-bound tokens are sent with the DPoP authorization scheme and a DPoP proof.
 // @Tags sso
 // @Produce json
 // @Security BearerAuth
+// @Param DPoP header string false "DPoP proof JWT for DPoP-bound access tokens (RFC 9449)"
 // @Success 200 {object} map[string]interface{} "User information"
 // @Failure 401 {object} map[string]interface{} "Invalid token"
 // @Router /oauth2/userinfo [get]
@@ -67,17 +102,320 @@ func (h *SSOHandler) OAuth2UserInfo(c *gin.Context) {
 	h.service.OAuth2UserInfo(c)
 }
 
+// OAuth2Introspect handles the OAuth 2.0 token introspection endpoint
+// @Summary OAuth 2.0 Token Introspection
+// @Description Check whether a token is active (RFC 7662). Requires confidential client credentials. DPoP-bound tokens report the key thumbprint in cnf.jkt; a resource server may forward the DPoP proof it received to have it checked.
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Produce json
+// @Param token formData string true "Token to introspect"
+// @Param token_type_hint formData string false "access_token or refresh_token"
+// @Param client_id formData string true "Client ID"
+// @Param client_secret formData string true "Client secret"
+// @Param dpop_proof formData string false "DPoP proof presented to the resource server with the token"
+// @Param dpop_method formData string false "HTTP method of the request the proof was presented with"
+// @Param dpop_uri formData string false "URI of the request the proof was presented with"
+// @Success 200 {object} map[string]interface{} "Introspection response"
+// @Failure 401 {object} map[string]interface{} "Invalid credentials"
+// @Router /oauth2/introspect [post]
+func (h *SSOHandler) OAuth2Introspect(c *gin.Context) {
+	h.service.OAuth2Introspect(c)
+}
+
+// OAuth2PushedAuthorization handles pushed authorization requests
+// @Summary OAuth 2.0 Pushed Authorization Request
+// @Description Push the parameters of an authorization request, optionally as a signed request object, and receive a request_uri for the authorization endpoint (RFC 9126). Requires client authentication.
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Produce json
+// @Param client_id formData string true "Client ID"
+// @Param response_type formData string false "Response type (code)"
+// @Param redirect_uri formData string false "Registered redirect URI"
+// @Param scope formData string false "Requested scopes"
+// @Param request formData string false "Signed request object (RFC 9101) carrying the parameters"
+// @Param DPoP header string false "DPoP proof JWT binding the authorization code to its key (RFC 9449)"
+// @Success 201 {object} map[string]interface{} "request_uri and expires_in"
+// @Failure 400 {object} map[string]interface{} "Invalid request"
+// @Failure 401 {object} map[string]interface{} "Invalid client credentials"
+// @Router /oauth2/par [post]
+func (h *SSOHandler) OAuth2PushedAuthorization(c *gin.Context) {
+	h.service.OAuth2PushedAuthorization(c)
+}
+
+// OIDCEndSession handles OpenID Connect RP-initiated logout
+// @Summary OpenID Connect End Session
+// @Description End the user's login session (RP-Initiated Logout 1.0). Without a matching id_token_hint the user confirms on a page. Clients that took part in the session are notified over front-channel and back-channel logout.
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Produce html
+// @Param id_token_hint query string false "ID token previously issued to the client"
+// @Param client_id query string false "Client ID"
+// @Param post_logout_redirect_uri query string false "Registered post-logout redirect URI"
+// @Param state query string false "State returned to the post-logout redirect URI"
+// @Success 200 "Logout confirmation or logged out page"
+// @Failure 400 {object} map[string]interface{} "Invalid request"
+// @Router /oauth2/logout [get]
+func (h *SSOHandler) OIDCEndSession(c *gin.Context) {
+	h.service.OIDCEndSession(c)
+}
+
+// OAuth2Revoke handles the OAuth 2.0 token revocation endpoint
+// @Summary OAuth 2.0 Token Revocation
+// @Description Revoke an access or refresh token (RFC 7009)
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Param token formData string true "Token to revoke"
+// @Param token_type_hint formData string false "access_token or refresh_token"
+// @Param client_id formData string true "Client ID"
+// @Param client_secret formData string false "Client secret"
+// @Success 200 "Token revoked"
+// @Failure 401 {object} map[string]interface{} "Invalid credentials"
+// @Router /oauth2/revoke [post]
+func (h *SSOHandler) OAuth2Revoke(c *gin.Context) {
+	h.service.OAuth2Revoke(c)
+}
+
+// OAuth2DeviceAuthorization handles the device authorization endpoint
+// @Summary OAuth 2.0 Device Authorization
+// @Description Start the device authorization grant (RFC 8628) for input-constrained devices
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Produce json
+// @Param client_id formData string true "Client ID"
+// @Param client_secret formData string false "Client secret"
+// @Param scope formData string false "Requested scopes"
+// @Success 200 {object} map[string]interface{} "Device code, user code and verification URI"
+// @Failure 400 {object} map[string]interface{} "Invalid request"
+// @Failure 401 {object} map[string]interface{} "Invalid credentials"
+// @Router /oauth2/device_authorization [post]
+func (h *SSOHandler) OAuth2DeviceAuthorization(c *gin.Context) {
+	h.service.OAuth2DeviceAuthorization(c)
+}
+
+// OAuth2DeviceVerify handles the device user code verification page
+// @Summary OAuth 2.0 Device Verification
+// @Description Page where users enter the user code from their device and approve the request
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Produce html
+// @Param user_code query string false "User code displayed on the device"
+// @Success 200 "Verification page"
+// @Router /oauth2/device [get]
+func (h *SSOHandler) OAuth2DeviceVerify(c *gin.Context) {
+	h.service.OAuth2DeviceVerify(c)
+}
+
+// OAuth2Consent handles the consent screen decision
+// @Summary OAuth 2.0 Consent
+// @Description Approve or deny a pending authorization request shown on the consent screen
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Produce html
+// @Param consent_id formData string true "Pending consent request ID"
+// @Param csrf_token formData string true "Anti-CSRF token from the consent page"
+// @Param action formData string true "approve or deny"
+// @Success 302 "Redirect to the client's redirect_uri"
+// @Failure 400 "Expired consent request"
+// @Router /oauth2/consent [post]
+func (h *SSOHandler) OAuth2Consent(c *gin.Context) {
+	h.service.OAuth2Consent(c)
+}
+
+// ListConsents lists the applications the current user has authorized
+// @Summary List authorized applications
+// @Description Get the OAuth clients the current user has granted consent to, with the granted scopes
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{} "Authorized application list"
+// @Failure 500 {object} map[string]interface{} "Internal server error"
+// @Router /users/me/consents [get]
+func (h *SSOHandler) ListConsents(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	apps, err := h.service.ListConsents(userID.(uint64))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    apps,
+	})
+}
+
+// RevokeConsent revokes the current user's consent for a client
+// @Summary Revoke authorized application
+// @Description Remove the consent granted to an OAuth client and revoke all of its tokens for the current user
+// @Tags users
+// @Produce json
+// @Security BearerAuth
+// @Param client_id path string true "OAuth client ID"
+// @Success 200 {object} map[string]interface{} "Consent revoked"
+// @Failure 404 {object} map[string]interface{} "Consent not found"
+// @Router /users/me/consents/{client_id} [delete]
+func (h *SSOHandler) RevokeConsent(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	if err := h.service.RevokeConsent(c.Request.Context(), userID.(uint64), c.Param("client_id")); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"code":    404,
+				"message": "Consent not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+	})
+}
+
+// OAuth2Register handles dynamic client registration
+// @Summary OAuth 2.0 Dynamic Client Registration
+// @Description Register an OAuth client (RFC 7591). Requires an initial access token issued by an admin. The metadata may carry a signed software_statement
+// @Tags sso
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body map[string]interface{} true "Client metadata" example:"{\"client_name\":\"Preview 42\",\"redirect_uris\":[\"https://pr-42.preview.example.com/callback\"],\"grant_types\":[\"authorization_code\",\"refresh_token\"],\"scope\":\"openid profile\"}"
+// @Success 201 {object} map[string]interface{} "Client information response"
+// @Failure 400 {object} map[string]interface{} "invalid_redirect_uri, invalid_client_metadata, invalid_software_statement or unapproved_software_statement"
+// @Failure 401 {object} map[string]interface{} "Invalid initial access token"
+// @Router /oauth2/register [post]
+func (h *SSOHandler) OAuth2Register(c *gin.Context) {
+	h.service.OAuth2Register(c)
+}
+
+// OAuth2GetRegistration reads a client registration
+// @Summary Read client registration
+// @Description Read the registered metadata of a client with its registration access token (RFC 7592)
+// @Tags sso
+// @Produce json
+// @Security BearerAuth
+// @Param client_id path string true "Client ID"
+// @Success 200 {object} map[string]interface{} "Client information response"
+// @Failure 401 {object} map[string]interface{} "Invalid registration access token"
+// @Router /oauth2/register/{client_id} [get]
+func (h *SSOHandler) OAuth2GetRegistration(c *gin.Context) {
+	h.service.OAuth2GetRegistration(c)
+}
+
+// OAuth2UpdateRegistration updates a client registration
+// @Summary Update client registration
+// @Description Replace the metadata of a registered client with its registration access token (RFC 7592)
+// @Tags sso
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param client_id path string true "Client ID"
+// @Param request body map[string]interface{} true "Client metadata including client_id"
+// @Success 200 {object} map[string]interface{} "Client information response"
+// @Failure 400 {object} map[string]interface{} "Invalid client metadata"
+// @Failure 401 {object} map[string]interface{} "Invalid registration access token"
+// @Router /oauth2/register/{client_id} [put]
+func (h *SSOHandler) OAuth2UpdateRegistration(c *gin.Context) {
+	h.service.OAuth2UpdateRegistration(c)
+}
+
+// OAuth2DeleteRegistration deletes a client registration
+// @Summary Delete client registration
+// @Description Deregister a client with its registration access token, revoking its tokens (RFC 7592)
+// @Tags sso
+// @Security BearerAuth
+// @Param client_id path string true "Client ID"
+// @Success 204 "Client deleted"
+// @Failure 401 {object} map[string]interface{} "Invalid registration access token"
+// @Router /oauth2/register/{client_id} [delete]
+func (h *SSOHandler) OAuth2DeleteRegistration(c *gin.Context) {
+	h.service.OAuth2DeleteRegistration(c)
+}
+
+// OAuth2DeviceToken handles the device_code grant
+// @Summary OAuth 2.0 Device Code Grant
+// @Description Poll for tokens with a device code (urn:ietf:params:oauth:grant-type:device_code)
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "Grant type" example:"urn:ietf:params:oauth:grant-type:device_code"
+// @Param device_code formData string true "Device code"
+// @Param client_id formData string true "Client ID"
+// @Param client_secret formData string false "Client secret"
+// @Success 200 {object} map[string]interface{} "Token response"
+// @Failure 400 {object} map[string]interface{} "authorization_pending, slow_down, access_denied or expired_token"
+// @Router /oauth2/token [post]
+func (h *SSOHandler) OAuth2DeviceToken(c *gin.Context) {
+	h.service.OAuth2DeviceToken(c)
+}
+
+// OAuth2TokenExchange handles the token exchange grant
+// @Summary OAuth 2.0 Token Exchange
+// @Description Exchange a subject token for a down-scoped token recording the act chain (RFC 8693). Clients allowed to impersonate may pass requested_subject with a user actor_token instead
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Produce json
+// @Param grant_type formData string true "Grant type" example:"urn:ietf:params:oauth:grant-type:token-exchange"
+// @Param subject_token formData string false "Subject token"
+// @Param subject_token_type formData string false "Subject token type" example:"urn:ietf:params:oauth:token-type:access_token"
+// @Param actor_token formData string false "Actor token"
+// @Param actor_token_type formData string false "Actor token type"
+// @Param requested_subject formData string false "User ID to impersonate"
+// @Param requested_token_type formData string false "access_token or jwt token type"
+// @Param audience formData string false "Target audience"
+// @Param scope formData string false "Requested scope"
+// @Success 200 {object} map[string]interface{} "Token response with issued_token_type"
+// @Failure 400 {object} map[string]interface{} "invalid_request, invalid_grant, invalid_scope or invalid_target"
+// @Failure 401 {object} map[string]interface{} "invalid_client"
+// @Router /oauth2/token [post]
+func (h *SSOHandler) OAuth2TokenExchange(c *gin.Context) {
+	h.service.OAuth2TokenExchange(c)
+}
+
+// OIDCDiscovery handles the OpenID Connect discovery endpoint
+// @Summary OIDC Discovery
+// @Description OpenID Provider configuration metadata
+// @Tags sso
+// @Produce json
+// @Success 200 {object} map[string]interface{} "OpenID Provider metadata"
+// @Router /.well-known/openid-configuration [get]
+func (h *SSOHandler) OIDCDiscovery(c *gin.Context) {
+	h.service.OIDCDiscovery(c)
+}
+
+// OIDCJWKS handles the JSON Web Key Set endpoint
+// @Summary OIDC JWKS
+// @Description Public keys used to verify ID tokens
+// @Tags sso
+// @Produce json
+// @Success 200 {object} map[string]interface{} "JSON Web Key Set"
+// @Router /jwks.json [get]
+func (h *SSOHandler) OIDCJWKS(c *gin.Context) {
+	h.service.OIDCJWKS(c)
+}
+
 // SAMLSSO handles SAML 2.0 SSO
 // @Summary SAML 2.0 SSO
-// @Description SAML 2.0 Single Sign-On endpoint (supports SP-initiated and IdP-initiated)
+// @Description SAML 2.0 Single Sign-On endpoint (supports SP-initiated and IdP-initiated). AuthnRequests are accepted with the HTTP-Redirect (DEFLATE, GET) and HTTP-POST bindings; the response is posted to the ACS with an auto-submitting form, together with the RelayState.
 // @Tags sso
 // @Accept application/x-www-form-urlencoded
 // @Produce html,json
+// @Param app_id query int true "Application ID"
 // @Param SAMLRequest query string false "SAML Request (SP-initiated)"
-// @Param SAMLResponse formData string false "SAML Response"
 // @Param RelayState query string false "Relay state"
-// @Success 200 "SAML Response (POST form or redirect)"
+// @Success 200 "HTML form posting the SAML Response to the ACS"
+// @Success 302 "Redirect to the login page"
 // @Failure 400 {object} map[string]interface{} "Invalid request"
+// @Router /saml/sso [get]
 // @Router /saml/sso [post]
 func (h *SSOHandler) SAMLSSO(c *gin.Context) {
 	h.service.SAMLSSO(c)
@@ -85,12 +423,14 @@ func (h *SSOHandler) SAMLSSO(c *gin.Context) {
 
 // SAMLMetadata handles SAML 2.0 metadata endpoint
 // @Summary SAML 2.0 Metadata
-// @Description Get SAML 2.0 Entity Descriptor metadata
+// @Description Get the SAML 2.0 Entity Descriptor metadata of an application. It lists a signing KeyDescriptor for the current key and for each next key of a rollover, is valid for 7 days (validUntil) and should be refetched daily (cacheDuration). It is signed if the application's sign_metadata is set
 // @Tags sso
 // @Produce application/xml
-// @Param application_id query int true "Application ID"
+// @Param app_id path int false "Application ID"
+// @Param app_id query int false "Application ID"
 // @Success 200 "SAML Metadata XML"
 // @Failure 400 {object} map[string]interface{} "Invalid request"
+// @Router /saml/metadata/{app_id} [get]
 // @Router /saml/metadata [get]
 func (h *SSOHandler) SAMLMetadata(c *gin.Context) {
 	h.service.SAMLMetadata(c)
@@ -98,20 +438,83 @@ func (h *SSOHandler) SAMLMetadata(c *gin.Context) {
 
 // SAMLSLO handles SAML 2.0 Single Logout
 // @Summary SAML 2.0 SLO
-// @Description SAML 2.0 Single Logout endpoint
+// @Description SAML 2.0 Single Logout endpoint. LogoutRequests end the login session and are propagated to the other SPs of the session.
 // @Tags sso
 // @Accept application/x-www-form-urlencoded
 // @Produce html
+// @Param app_id query int true "Application ID"
 // @Param SAMLRequest query string false "SAML Logout Request"
 // @Param SAMLResponse formData string false "SAML Logout Response"
 // @Param RelayState query string false "Relay state"
 // @Success 200 "SAML Logout Response (POST form or redirect)"
+// @Success 302 "Redirect to the next SP or the end session endpoint"
 // @Failure 400 {object} map[string]interface{} "Invalid request"
+// @Router /saml/slo [get]
 // @Router /saml/slo [post]
 func (h *SSOHandler) SAMLSLO(c *gin.Context) {
 	h.service.SAMLSLO(c)
 }
 
+// SAMLSPMetadata handles the SP metadata of an external IdP connection
+// @Summary SAML SP metadata
+// @Description SP metadata of a connection to an external SAML IdP, for the IdP to import: the entity ID, the HTTP-POST ACS and the SP certificate for signing and encryption
+// @Tags sso
+// @Produce application/xml
+// @Param idp_id query int true "Identity provider ID"
+// @Success 200 "SAML Metadata XML"
+// @Failure 404 {object} map[string]interface{} "Identity provider not found"
+// @Router /saml/sp/metadata [get]
+func (h *SSOHandler) SAMLSPMetadata(c *gin.Context) {
+	h.service.SAMLSPMetadata(c)
+}
+
+// SAMLSPLogin starts a login with an external IdP
+// @Summary SAML SP login
+// @Description Sign in with an external SAML IdP: sends an AuthnRequest to the IdP with its SSO binding. After the ACS the user is redirected to redirect, a local path
+// @Tags sso
+// @Produce html
+// @Param idp_id query int true "Identity provider ID"
+// @Param redirect query string false "Local path to return to" example:"/dashboard"
+// @Success 200 "HTML form posting the AuthnRequest to the IdP"
+// @Success 302 "Redirect to the IdP"
+// @Failure 404 {object} map[string]interface{} "Identity provider not found"
+// @Router /saml/sp/login [get]
+func (h *SSOHandler) SAMLSPLogin(c *gin.Context) {
+	h.service.SAMLSPLogin(c)
+}
+
+// SAMLSPACS handles the assertion consumer service of an external IdP connection
+// @Summary SAML SP assertion consumer service
+// @Description Receives the IdP's SAML Response with the HTTP-POST binding, validates its signature and conditions, finds, links or provisions the user, applies the role mappings and starts a login session (access_token cookie). Users with MFA enabled are first asked for a TOTP code
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Produce html
+// @Param idp_id query int true "Identity provider ID"
+// @Param SAMLResponse formData string true "SAML Response"
+// @Param RelayState formData string false "Relay state"
+// @Success 302 "Redirect to the page the login started from"
+// @Failure 400 "Sign-in failed page"
+// @Failure 404 {object} map[string]interface{} "Identity provider not found"
+// @Router /saml/sp/acs [post]
+func (h *SSOHandler) SAMLSPACS(c *gin.Context) {
+	h.service.SAMLSPACS(c)
+}
+
+// SAMLSPMFA completes an external IdP login of a user with MFA enabled
+// @Summary SAML SP one-time code
+// @Description Takes the TOTP code the ACS asked a user with MFA enabled for and starts the login session (access_token cookie). The pending login is single use; after a wrong code the user signs in at the IdP again
+// @Tags sso
+// @Accept application/x-www-form-urlencoded
+// @Produce html
+// @Param mfa_token formData string true "Pending login from the code page"
+// @Param code formData string true "TOTP code"
+// @Success 302 "Redirect to the page the login started from"
+// @Failure 400 "Sign-in failed page"
+// @Router /saml/sp/mfa [post]
+func (h *SSOHandler) SAMLSPMFA(c *gin.Context) {
+	h.service.SAMLSPMFA(c)
+}
+
 // OAuth2ClientCredentials handles OAuth 2.0 Client Credentials Flow
 // @Summary OAuth 2.0 Client Credentials
 // @Description OAuth 2.0 Client Credentials Flow for service-to-service authentication
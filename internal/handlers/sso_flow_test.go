@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/auth"
+	"github.com/hanyouqing/openauth/internal/config"
+	"github.com/hanyouqing/openauth/internal/middleware"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// setupSSOFlowRouter wires the password login and OAuth2 authorization
+// routes the way cmd/server does, backed by SQLite and an in-memory Redis
+func setupSSOFlowRouter(t *testing.T) (*gin.Engine, *gorm.DB) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(
+		&models.User{},
+		&models.Role{},
+		&models.UserRole{},
+		&models.MFADevice{},
+		&models.Session{},
+		&models.OAuthClient{},
+		&models.OAuthConsent{},
+		&models.OAuthScope{},
+		&models.OIDCSessionClient{},
+	))
+
+	server := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	cfg := &config.Config{
+		JWT: config.JWTConfig{
+			Secret:        "test-secret-key",
+			AccessExpiry:  15,
+			RefreshExpiry: 7,
+			Issuer:        "http://localhost",
+		},
+	}
+
+	h := New(db, redisClient, cfg, logger)
+	router := setupTestRouter()
+	router.POST("/api/v1/auth/login", h.Auth.Login)
+	router.Any("/oauth2/authorize", middleware.OptionalAuth(cfg.JWT), h.SSO.OAuth2Authorize)
+	return router, db
+}
+
+func TestSSOFlow_LoginAuthorizeCode(t *testing.T) {
+	router, db := setupSSOFlowRouter(t)
+
+	passwordHash, _ := auth.HashPassword("Password123!")
+	require.NoError(t, db.Create(&models.User{
+		Username:     "testuser",
+		Email:        "test@example.com",
+		PasswordHash: passwordHash,
+		Status:       "active",
+	}).Error)
+	require.NoError(t, db.Create(&models.OAuthClient{
+		ApplicationID: 1,
+		ClientID:      "portal",
+		RedirectURIs:  models.StringArray{"https://portal.example.com/callback"},
+		GrantTypes:    models.StringArray{"authorization_code"},
+		FirstParty:    true,
+	}).Error)
+
+	authorizeURL := "/oauth2/authorize?" + url.Values{
+		"client_id":     {"portal"},
+		"response_type": {"code"},
+		"redirect_uri":  {"https://portal.example.com/callback"},
+		"scope":         {"openid"},
+		"state":         {"xyz"},
+	}.Encode()
+
+	// Without a session the user is sent to the login page and back
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", authorizeURL, nil))
+	require.Equal(t, http.StatusFound, w.Code)
+	loginURL, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/login", loginURL.Path)
+	returnTo := loginURL.Query().Get("redirect")
+	assert.True(t, strings.HasPrefix(returnTo, "/oauth2/authorize?"))
+
+	// Password login sets the session cookie
+	body, _ := json.Marshal(LoginRequest{Username: "testuser", Password: "Password123!"})
+	req := httptest.NewRequest("POST", "/api/v1/auth/login", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var sessionCookie *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == auth.SessionCookie {
+			sessionCookie = cookie
+		}
+	}
+	require.NotNil(t, sessionCookie)
+	assert.True(t, sessionCookie.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, sessionCookie.SameSite)
+
+	// Returning to the authorization request with the cookie yields a code
+	req = httptest.NewRequest("GET", returnTo, nil)
+	req.AddCookie(sessionCookie)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusFound, w.Code)
+	callback, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "portal.example.com", callback.Host)
+	assert.NotEmpty(t, callback.Query().Get("code"))
+	assert.Equal(t, "xyz", callback.Query().Get("state"))
+}
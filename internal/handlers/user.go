@@ -1,13 +1,16 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/hanyouqing/openauth/internal/middleware"
+	"github.com/hanyouqing/openauth/internal/models"
 	"github.com/hanyouqing/openauth/internal/services"
 	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
 type UserHandler struct {
@@ -373,3 +376,51 @@ func (h *UserHandler) UploadAvatar(c *gin.Context) {
 		"data":    user,
 	})
 }
+
+// SetAttributes sets the custom attributes of a user
+// @Summary Set user attributes
+// @Description Replace the custom attributes of a user. Scopes in the scope registry release them as claims (admin only)
+// @Tags users
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "User ID"
+// @Param request body map[string]interface{} true "Attributes" example:"{\"employee_id\":\"E1024\",\"cost_center\":\"FIN-42\"}"
+// @Success 200 {object} map[string]interface{} "Attributes updated"
+// @Failure 400 {object} map[string]interface{} "Invalid request"
+// @Failure 404 {object} map[string]interface{} "User not found"
+// @Router /users/{id}/attributes [put]
+func (h *UserHandler) SetAttributes(c *gin.Context) {
+	id, _ := strconv.ParseUint(c.Param("id"), 10, 64)
+
+	var attributes models.JSONB
+	if err := c.ShouldBindJSON(&attributes); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"code":    400,
+			"message": "Invalid request",
+		})
+		return
+	}
+
+	user, err := h.service.SetAttributes(id, attributes)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"code":    404,
+				"message": "User not found",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"code":    500,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":    200,
+		"message": "success",
+		"data":    user,
+	})
+}
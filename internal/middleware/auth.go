@@ -45,6 +45,9 @@ func Auth(cfg config.JWTConfig) gin.HandlerFunc {
 		c.Set("user_id", claims.UserID)
 		c.Set("username", claims.Username)
 		c.Set("roles", claims.Roles)
+		if claims.SessionID != "" {
+			c.Set("session_id", claims.SessionID)
+		}
 		c.Next()
 	}
 }
@@ -91,3 +94,35 @@ func Admin() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// OptionalAuth populates the user context when a valid token is present but
+// lets anonymous requests through. Browser-facing protocol endpoints use it so
+// they can redirect unauthenticated users to the login page themselves.
+func OptionalAuth(cfg config.JWTConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := ""
+		if authHeader := c.GetHeader("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+			token = strings.TrimPrefix(authHeader, "Bearer ")
+		} else if cookie, err := c.Cookie(auth.SessionCookie); err == nil {
+			token = cookie
+		}
+
+		if token != "" {
+			if claims, err := auth.ValidateToken(token, cfg.Secret); err == nil {
+				c.Set("user_id", claims.UserID)
+				c.Set("username", claims.Username)
+				c.Set("roles", claims.Roles)
+				if claims.AuthTime != 0 {
+					c.Set("auth_time", claims.AuthTime)
+				} else if claims.IssuedAt != nil {
+					c.Set("auth_time", claims.IssuedAt.Unix())
+				}
+				if claims.SessionID != "" {
+					c.Set("session_id", claims.SessionID)
+				}
+			}
+		}
+
+		c.Next()
+	}
+}
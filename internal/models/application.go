@@ -4,6 +4,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -14,15 +15,16 @@ type Application struct {
 	Name        string         `gorm:"not null" json:"name"`
 	Description string         `json:"description,omitempty"`
 	LogoURL     string         `json:"logo_url,omitempty"`
-	Protocol    string         `gorm:"not null" json:"protocol"` // oauth2, saml, ldap
+	Protocol    string         `gorm:"not null" json:"protocol"` // oauth2, saml, cas, ldap
 	Config      JSONB          `gorm:"type:jsonb" json:"config"`
 	Status      string         `gorm:"default:active" json:"status"`
 	CreatedAt   time.Time      `json:"created_at"`
 	UpdatedAt   time.Time      `json:"updated_at"`
 	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
 
-	OAuthClients []OAuthClient `gorm:"foreignKey:ApplicationID" json:"oauth_clients,omitempty"`
-	SAMLConfigs  []SAMLConfig  `gorm:"foreignKey:ApplicationID" json:"saml_configs,omitempty"`
+	OAuthClients []OAuthClient      `gorm:"foreignKey:ApplicationID" json:"oauth_clients,omitempty"`
+	SAMLConfigs  []SAMLConfig       `gorm:"foreignKey:ApplicationID" json:"saml_configs,omitempty"`
+	CASServices  []CASServiceConfig `gorm:"foreignKey:ApplicationID" json:"cas_services,omitempty"`
 }
 
 type JSONB map[string]interface{}
@@ -45,3 +47,86 @@ func (j *JSONB) Scan(value interface{}) error {
 	}
 	return json.Unmarshal(bytes, j)
 }
+
+// StringArray is a list of strings stored as a Postgres text[] array literal,
+// so it also round-trips through databases without array types
+type StringArray []string
+
+func (a StringArray) Value() (driver.Value, error) {
+	if a == nil {
+		return nil, nil
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, s := range a {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('"')
+		for _, r := range s {
+			if r == '"' || r == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String(), nil
+}
+
+func (a *StringArray) Scan(value interface{}) error {
+	var src string
+	switch v := value.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case []byte:
+		src = string(v)
+	case string:
+		src = v
+	default:
+		return fmt.Errorf("cannot scan %T into StringArray", value)
+	}
+	if len(src) < 2 || src[0] != '{' || src[len(src)-1] != '}' {
+		return fmt.Errorf("invalid array literal %q", src)
+	}
+	src = src[1 : len(src)-1]
+
+	result := StringArray{}
+	for i := 0; i < len(src); {
+		var elem strings.Builder
+		if src[i] == '"' {
+			i++
+			for i < len(src) && src[i] != '"' {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				elem.WriteByte(src[i])
+				i++
+			}
+			if i >= len(src) {
+				return fmt.Errorf("unterminated element in array literal")
+			}
+			i++
+			result = append(result, elem.String())
+		} else {
+			end := strings.IndexByte(src[i:], ',')
+			if end < 0 {
+				end = len(src) - i
+			}
+			if s := strings.TrimSpace(src[i : i+end]); s != "NULL" {
+				result = append(result, s)
+			}
+			i += end
+		}
+		if i < len(src) {
+			if src[i] != ',' {
+				return fmt.Errorf("invalid array literal")
+			}
+			i++
+		}
+	}
+	*a = result
+	return nil
+}
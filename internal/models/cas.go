@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CASServiceConfig registers the services of a CAS application: the service
+// URLs that match Pattern by MatchType (exact, prefix or regex). Tickets are
+// only issued to registered services. AttributeMap maps the attribute names
+// released to the services to their sources. AllowProxy lets the services
+// request proxy-granting tickets with a pgtUrl that matches the regex
+// ProxyCallbackPattern as a whole. Without SSOEnabled users present their
+// credentials on every login to the services.
+type CASServiceConfig struct {
+	ID                   uint64         `gorm:"primaryKey" json:"id"`
+	ApplicationID        uint64         `gorm:"not null;index" json:"application_id"`
+	Name                 string         `gorm:"not null" json:"name"`
+	MatchType            string         `gorm:"not null;default:prefix" json:"match_type"`
+	Pattern              string         `gorm:"not null;index" json:"pattern"`
+	AttributeMap         JSONB          `gorm:"type:jsonb" json:"attribute_map"`
+	AllowProxy           bool           `gorm:"default:false" json:"allow_proxy"`
+	ProxyCallbackPattern string         `json:"proxy_callback_pattern"`
+	SSOEnabled           bool           `json:"sso_enabled"`
+	CreatedAt            time.Time      `json:"created_at"`
+	UpdatedAt            time.Time      `json:"updated_at"`
+	DeletedAt            gorm.DeletedAt `gorm:"index" json:"-"`
+
+	Application Application `gorm:"foreignKey:ApplicationID" json:"-"`
+}
@@ -40,7 +40,7 @@ type APIKey struct {
 	KeyPrefix   string         `gorm:"not null" json:"key_prefix"`     // First 8 chars for display
 	UserID      *uint64        `gorm:"index" json:"user_id,omitempty"`
 	ApplicationID *uint64      `gorm:"index" json:"application_id,omitempty"`
-	Scopes      []string       `gorm:"type:text[]" json:"scopes"`
+	Scopes      StringArray    `gorm:"type:text[]" json:"scopes"`
 	LastUsedAt  *time.Time     `json:"last_used_at,omitempty"`
 	ExpiresAt   *time.Time     `gorm:"index" json:"expires_at,omitempty"`
 	Enabled     bool           `gorm:"default:true" json:"enabled"`
@@ -57,7 +57,7 @@ type Webhook struct {
 	Name        string         `gorm:"not null" json:"name"`
 	URL         string         `gorm:"not null" json:"url"`
 	Secret      string         `gorm:"not null" json:"-"` // Webhook secret for signing
-	Events      []string       `gorm:"type:text[]" json:"events"` // user.created, user.updated, etc.
+	Events      StringArray    `gorm:"type:text[]" json:"events"` // user.created, user.updated, etc.
 	Enabled     bool           `gorm:"default:true" json:"enabled"`
 	RetryCount  int            `gorm:"default:3" json:"retry_count"`
 	Timeout     int            `gorm:"default:30" json:"timeout"` // seconds
@@ -7,15 +7,50 @@ import (
 )
 
 type OAuthClient struct {
-	ID            uint64         `gorm:"primaryKey" json:"id"`
-	ApplicationID uint64         `gorm:"not null;index" json:"application_id"`
-	ClientID      string         `gorm:"uniqueIndex;not null" json:"client_id"`
-	ClientSecret  string         `gorm:"not null" json:"-"`
-	RedirectURIs  []string       `gorm:"type:text[]" json:"redirect_uris"`
-	Scopes        []string       `gorm:"type:text[]" json:"scopes"`
-	GrantTypes    []string       `gorm:"type:text[]" json:"grant_types"`
-	CreatedAt     time.Time      `json:"created_at"`
-	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
+	ID            uint64      `gorm:"primaryKey" json:"id"`
+	ApplicationID uint64      `gorm:"not null;index" json:"application_id"`
+	ClientID      string      `gorm:"uniqueIndex;not null" json:"client_id"`
+	ClientSecret  string      `gorm:"not null" json:"-"` // bcrypt hash, empty for public clients
+	RedirectURIs  StringArray `gorm:"type:text[]" json:"redirect_uris"`
+	Scopes        StringArray `gorm:"type:text[]" json:"scopes"`
+	GrantTypes    StringArray `gorm:"type:text[]" json:"grant_types"`
+	Public        bool        `gorm:"default:false" json:"public"`      // public clients have no secret and must use PKCE
+	FirstParty    bool        `gorm:"default:false" json:"first_party"` // first-party clients skip the consent screen
+	// TokenEndpointAuthMethod is client_secret_basic, client_secret_post, private_key_jwt,
+	// tls_client_auth or none. Keys for private_key_jwt come from JWKS or JWKSURI.
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method"`
+	JWKS                    JSONB  `gorm:"type:jsonb" json:"jwks,omitempty"`
+	JWKSURI                 string `json:"jwks_uri,omitempty"`
+	TLSClientAuthSubjectDN  string `json:"tls_client_auth_subject_dn,omitempty"`
+	// AccessTokenFormat is "opaque" or "jwt" (RFC 9068); AccessTokenAudience is the aud of JWT access tokens
+	AccessTokenFormat   string `gorm:"default:opaque" json:"access_token_format"`
+	AccessTokenAudience string `json:"access_token_audience,omitempty"`
+	// Token exchange policy (RFC 8693): clients whose tokens may be exchanged ("*" for any),
+	// audiences that may be requested, and whether requested_subject impersonation is allowed
+	TokenExchangeSubjectClients StringArray `gorm:"type:text[]" json:"token_exchange_subject_clients,omitempty"`
+	TokenExchangeAudiences      StringArray `gorm:"type:text[]" json:"token_exchange_audiences,omitempty"`
+	TokenExchangeImpersonation  bool        `gorm:"default:false" json:"token_exchange_impersonation"`
+	// OIDC logout: allowed post_logout_redirect_uris, front-channel and back-channel logout URIs
+	PostLogoutRedirectURIs            StringArray `gorm:"type:text[]" json:"post_logout_redirect_uris,omitempty"`
+	FrontchannelLogoutURI             string      `json:"frontchannel_logout_uri,omitempty"`
+	FrontchannelLogoutSessionRequired bool        `gorm:"default:false" json:"frontchannel_logout_session_required"`
+	BackchannelLogoutURI              string      `json:"backchannel_logout_uri,omitempty"`
+	BackchannelLogoutSessionRequired  bool        `gorm:"default:false" json:"backchannel_logout_session_required"`
+	// RequirePushedAuthorizationRequests rejects authorization requests that were not pushed (RFC 9126).
+	// Signed request objects are verified with JWKS or JWKSURI.
+	RequirePushedAuthorizationRequests bool `gorm:"default:false" json:"require_pushed_authorization_requests"`
+	// DPoPBoundAccessTokens rejects token requests without a DPoP proof (RFC 9449)
+	DPoPBoundAccessTokens bool `gorm:"default:false" json:"dpop_bound_access_tokens"`
+	// Hash of the secret replaced by the last rotation, accepted until PreviousSecretExpiresAt
+	PreviousClientSecret    string     `json:"-"`
+	PreviousSecretExpiresAt *time.Time `json:"previous_secret_expires_at,omitempty"`
+	SecretRotatedAt         *time.Time `json:"secret_rotated_at,omitempty"`
+	// Client metadata and registration access token of dynamically registered clients (RFC 7591/7592)
+	Metadata              JSONB          `gorm:"type:jsonb" json:"metadata,omitempty"`
+	RegistrationTokenHash string         `gorm:"index" json:"-"`
+	CreatedAt             time.Time      `json:"created_at"`
+	UpdatedAt             time.Time      `json:"updated_at"`
+	DeletedAt             gorm.DeletedAt `gorm:"index" json:"-"`
 
 	Application Application `gorm:"foreignKey:ApplicationID" json:"-"`
 }
@@ -25,10 +60,84 @@ type OAuthToken struct {
 	ClientID     string         `gorm:"not null;index" json:"client_id"`
 	UserID       *uint64        `gorm:"index" json:"user_id,omitempty"`
 	AccessToken  string         `gorm:"uniqueIndex;not null" json:"-"`
-	RefreshToken string         `gorm:"uniqueIndex" json:"-"`
-	TokenType    string         `gorm:"default:Bearer" json:"token_type"`
+	RefreshToken *string        `gorm:"uniqueIndex" json:"-"`             // nil when no refresh token was issued
+	FamilyID     string         `gorm:"index" json:"family_id,omitempty"` // shared by all tokens rotated from one grant
+	Format       string         `gorm:"default:opaque" json:"format"`     // opaque, or jwt with AccessToken holding the jti
+	JWT          string         `gorm:"-" json:"-"`                       // signed JWT access token handed to the client
+	TokenType    string         `gorm:"default:Bearer" json:"token_type"` // Bearer, or DPoP when bound to JKT
+	JKT          string         `json:"jkt,omitempty"`                    // thumbprint of the DPoP key the token is bound to
 	ExpiresAt    time.Time      `gorm:"not null" json:"expires_at"`
 	Scope        string         `json:"scope,omitempty"`
+	Revoked      bool           `gorm:"default:false;index" json:"revoked"`
+	RevokedAt    *time.Time     `json:"revoked_at,omitempty"`
 	CreatedAt    time.Time      `json:"created_at"`
 	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
 }
+
+// OAuthInitialAccessToken is issued by admins to authorize dynamic client
+// registration. Only the SHA-256 hash of the token is stored.
+type OAuthInitialAccessToken struct {
+	ID          uint64 `gorm:"primaryKey" json:"id"`
+	Name        string `gorm:"not null" json:"name"`
+	TokenHash   string `gorm:"uniqueIndex;not null" json:"-"`
+	TokenPrefix string `json:"token_prefix"`
+	MaxUses     int    `gorm:"default:0" json:"max_uses"` // 0 = unlimited
+	// GrantTypes lists grant types beyond authorization_code, refresh_token and
+	// the device grant that clients registered with the token may use
+	GrantTypes StringArray    `gorm:"type:text[]" json:"grant_types,omitempty"`
+	Uses       int            `gorm:"default:0" json:"uses"`
+	ExpiresAt  *time.Time     `json:"expires_at,omitempty"`
+	Revoked    bool           `gorm:"default:false" json:"revoked"`
+	CreatedBy  *uint64        `json:"created_by,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// OAuthConsent records the scopes a user has granted to a client. The user is
+// only asked again when a client requests scopes outside this set.
+type OAuthConsent struct {
+	ID        uint64      `gorm:"primaryKey" json:"id"`
+	UserID    uint64      `gorm:"not null;uniqueIndex:idx_oauth_consent_user_client" json:"user_id"`
+	ClientID  string      `gorm:"not null;uniqueIndex:idx_oauth_consent_user_client" json:"client_id"`
+	Scopes    StringArray `gorm:"type:text[]" json:"scopes"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// OAuthScope is a scope defined in the scope registry. Granting it releases
+// its claims in UserInfo, ID tokens and JWT access tokens.
+type OAuthScope struct {
+	ID          uint64      `gorm:"primaryKey" json:"id"`
+	Name        string      `gorm:"uniqueIndex;not null" json:"name"`
+	Description string      `json:"description,omitempty"`
+	Claims      StringArray `gorm:"type:text[]" json:"claims"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+// OIDCSessionClient records that a client received tokens within a login
+// session, so the client can be notified when the session ends.
+type OIDCSessionClient struct {
+	ID        uint64    `gorm:"primaryKey" json:"id"`
+	SessionID string    `gorm:"not null;uniqueIndex:idx_oidc_session_client" json:"sid"`
+	ClientID  string    `gorm:"not null;uniqueIndex:idx_oidc_session_client" json:"client_id"`
+	UserID    uint64    `gorm:"not null;index" json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OIDCLogoutDelivery is a back-channel logout token sent to a client. Failed
+// deliveries are retried until MaxLogoutAttempts is reached.
+type OIDCLogoutDelivery struct {
+	ID            uint64     `gorm:"primaryKey" json:"id"`
+	ClientID      string     `gorm:"not null;index" json:"client_id"`
+	UserID        uint64     `gorm:"not null;index" json:"user_id"`
+	SessionID     string     `json:"sid,omitempty"`
+	LogoutURI     string     `gorm:"not null" json:"logout_uri"`
+	Status        string     `gorm:"default:pending;index" json:"status"` // pending, success, failed
+	Response      string     `gorm:"type:text" json:"response,omitempty"`
+	Attempts      int        `gorm:"default:0" json:"attempts"`
+	NextAttemptAt *time.Time `gorm:"index" json:"next_attempt_at,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
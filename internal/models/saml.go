@@ -1,23 +1,199 @@
 package models
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"gorm.io/gorm"
 )
 
 type SAMLConfig struct {
-	ID            uint64         `gorm:"primaryKey" json:"id"`
-	ApplicationID uint64         `gorm:"not null;index" json:"application_id"`
-	EntityID      string         `gorm:"not null" json:"entity_id"`
-	SSOURL        string         `gorm:"not null" json:"sso_url"`
-	SLOURL        string         `json:"slo_url,omitempty"`
-	Certificate   string         `gorm:"type:text" json:"certificate,omitempty"`
-	PrivateKey    string         `gorm:"type:text" json:"-"`
-	AttributeMap  JSONB          `gorm:"type:jsonb" json:"attribute_map"`
-	CreatedAt     time.Time      `json:"created_at"`
-	UpdatedAt     time.Time      `json:"updated_at"`
-	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
+	ID            uint64 `gorm:"primaryKey" json:"id"`
+	ApplicationID uint64 `gorm:"not null;index" json:"application_id"`
+	EntityID      string `gorm:"not null" json:"entity_id"`
+	SSOURL        string `gorm:"not null" json:"sso_url"`
+	SLOURL        string `json:"slo_url,omitempty"`
+	Certificate   string `gorm:"type:text" json:"certificate,omitempty"`
+	PrivateKey    string `gorm:"type:text" json:"-"`
+	AttributeMap  JSONB  `gorm:"type:jsonb" json:"attribute_map"`
+	// SignatureTarget selects what is signed: assertion (default), response or both
+	SignatureTarget string `gorm:"default:assertion" json:"signature_target"`
+	// SP metadata: ACS endpoints (SSOURL is the default one), signing certificates (PEM)
+	// and NameID formats. AuthnRequestsSigned rejects unsigned AuthnRequests.
+	ACSEndpoints        SAMLEndpoints `gorm:"type:jsonb" json:"acs_endpoints,omitempty"`
+	SPCertificates      StringArray   `gorm:"type:text[]" json:"sp_certificates,omitempty"`
+	NameIDFormats       StringArray   `gorm:"type:text[]" json:"name_id_formats,omitempty"`
+	AuthnRequestsSigned bool          `gorm:"default:false" json:"authn_requests_signed"`
+	SPMetadata          string        `gorm:"type:text" json:"sp_metadata,omitempty"` // last imported metadata XML
+	// SLOBinding is how LogoutRequests and LogoutResponses are sent to SLOURL: HTTP-Redirect or HTTP-POST
+	SLOBinding string `json:"slo_binding,omitempty"`
+	// EncryptAssertions sends assertions as EncryptedAssertion to the SP's encryption
+	// certificate (PEM). EncryptionMethod is the block cipher, aes128-gcm by default.
+	EncryptAssertions     bool   `gorm:"default:false" json:"encrypt_assertions"`
+	EncryptionCertificate string `gorm:"type:text" json:"encryption_certificate,omitempty"`
+	EncryptionMethod      string `json:"encryption_method,omitempty"`
+	// NameIDFormat of the subject: email (default), persistent (pairwise), transient or
+	// unspecified. NameIDSource selects the value of the email and unspecified formats.
+	NameIDFormat string `json:"name_id_format,omitempty"`
+	NameIDSource string `json:"name_id_source,omitempty"`
+	// SignMetadata signs the IdP metadata published for the application
+	SignMetadata bool           `gorm:"default:false" json:"sign_metadata"`
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
 
 	Application Application `gorm:"foreignKey:ApplicationID" json:"-"`
 }
+
+// SAMLSessionParticipant records that an SP received an assertion within a
+// login session, with the session index and NameID it was given, so it can
+// be sent a LogoutRequest when the session ends.
+type SAMLSessionParticipant struct {
+	ID            uint64    `gorm:"primaryKey" json:"id"`
+	SessionID     string    `gorm:"not null;uniqueIndex:idx_saml_session_participant" json:"sid"`
+	ApplicationID uint64    `gorm:"not null;uniqueIndex:idx_saml_session_participant" json:"application_id"`
+	UserID        uint64    `gorm:"not null;index" json:"user_id"`
+	SessionIndex  string    `gorm:"not null;index" json:"session_index"`
+	NameID        string    `json:"name_id"`
+	NameIDFormat  string    `json:"name_id_format,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// SAMLPersistentID is the pairwise persistent NameID of a user at the SP of
+// an application. It is random, so SPs cannot correlate users.
+type SAMLPersistentID struct {
+	ID            uint64    `gorm:"primaryKey" json:"id"`
+	ApplicationID uint64    `gorm:"not null;uniqueIndex:idx_saml_persistent_id" json:"application_id"`
+	UserID        uint64    `gorm:"not null;uniqueIndex:idx_saml_persistent_id" json:"user_id"`
+	NameID        string    `gorm:"not null;uniqueIndex" json:"name_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// SAMLKey is a signing key pair in the key set of a SAML application, or in
+// the global key set when ApplicationID is 0. Next keys are published in the
+// metadata ahead of use, the active key signs and retired keys are kept for
+// the record. A next key with ActivatesAt becomes active at that time.
+type SAMLKey struct {
+	ID            uint64     `gorm:"primaryKey" json:"id"`
+	ApplicationID uint64     `gorm:"not null;default:0;index" json:"application_id"`
+	Status        string     `gorm:"not null;default:next;index" json:"status"`
+	Certificate   string     `gorm:"type:text;not null" json:"certificate"`
+	PrivateKey    string     `gorm:"type:text;not null" json:"-"`
+	Fingerprint   string     `json:"fingerprint"` // SHA-256 of the certificate, hex
+	NotAfter      time.Time  `json:"not_after"`
+	ActivatesAt   *time.Time `json:"activates_at,omitempty"`
+	ActivatedAt   *time.Time `json:"activated_at,omitempty"`
+	RetiredAt     *time.Time `json:"retired_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// SAMLIdentityProvider is an external SAML IdP users can sign in with.
+// OpenAuth is the SP of the connection.
+type SAMLIdentityProvider struct {
+	ID     uint64 `gorm:"primaryKey" json:"id"`
+	Name   string `gorm:"uniqueIndex;not null" json:"name"`
+	Status string `gorm:"default:active" json:"status"`
+	// IdP settings, usually imported from the IdP metadata: entity ID, SSO
+	// endpoint and binding, and signing certificates (PEM)
+	EntityID     string      `gorm:"not null" json:"entity_id"`
+	SSOURL       string      `gorm:"not null" json:"sso_url"`
+	SSOBinding   string      `json:"sso_binding,omitempty"`
+	Certificates StringArray `gorm:"type:text[]" json:"certificates,omitempty"`
+	Metadata     string      `gorm:"type:text" json:"metadata,omitempty"` // last imported metadata XML
+	// SP key pair (PEM) AuthnRequests are signed with and encrypted assertions
+	// decrypted with. NameIDFormat is requested in AuthnRequests.
+	Certificate       string `gorm:"type:text" json:"certificate,omitempty"`
+	PrivateKey        string `gorm:"type:text" json:"-"`
+	SignAuthnRequests bool   `gorm:"default:false" json:"sign_authn_requests"`
+	NameIDFormat      string `json:"name_id_format,omitempty"`
+	AllowIDPInitiated bool   `gorm:"default:false" json:"allow_idp_initiated"`
+	// Accounts: JITProvisioning creates users on first login, LinkByEmail links
+	// existing users with the asserted email if it is in one of EmailDomains.
+	// AttributeMap maps user fields to SAML attribute names.
+	JITProvisioning bool        `gorm:"default:false" json:"jit_provisioning"`
+	LinkByEmail     bool        `gorm:"default:false" json:"link_by_email"`
+	EmailDomains    StringArray `gorm:"type:text[]" json:"email_domains,omitempty"`
+	AttributeMap    JSONB       `gorm:"type:jsonb" json:"attribute_map"`
+	// RoleMappings grant roles and groups for attribute values, DefaultRoles
+	// are granted to every user. SyncRoles also removes mapped roles and groups
+	// the assertion no longer grants.
+	RoleMappings SAMLRoleMappings `gorm:"type:jsonb" json:"role_mappings,omitempty"`
+	DefaultRoles StringArray      `gorm:"type:text[]" json:"default_roles,omitempty"`
+	SyncRoles    bool             `gorm:"default:false" json:"sync_roles"`
+	CreatedAt    time.Time        `json:"created_at"`
+	UpdatedAt    time.Time        `json:"updated_at"`
+	DeletedAt    gorm.DeletedAt   `gorm:"index" json:"-"`
+}
+
+// SAMLFederatedIdentity links the NameID a user has at an external IdP to
+// the user
+type SAMLFederatedIdentity struct {
+	ID          uint64     `gorm:"primaryKey" json:"id"`
+	ProviderID  uint64     `gorm:"not null;uniqueIndex:idx_saml_federated_identity" json:"provider_id"`
+	NameID      string     `gorm:"not null;uniqueIndex:idx_saml_federated_identity" json:"name_id"`
+	UserID      uint64     `gorm:"not null;index" json:"user_id"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// SAMLRoleMapping grants roles and groups to users whose assertion has
+// Attribute with Value, or any value if Value is empty
+type SAMLRoleMapping struct {
+	Attribute string   `json:"attribute"`
+	Value     string   `json:"value,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+}
+
+type SAMLRoleMappings []SAMLRoleMapping
+
+func (m SAMLRoleMappings) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
+	return json.Marshal(m)
+}
+
+func (m *SAMLRoleMappings) Scan(value interface{}) error {
+	if value == nil {
+		*m = nil
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return json.Unmarshal([]byte(fmt.Sprintf("%v", value)), m)
+	}
+	return json.Unmarshal(bytes, m)
+}
+
+// SAMLEndpoint is an indexed endpoint from SAML metadata
+type SAMLEndpoint struct {
+	Binding   string `json:"binding"`
+	Location  string `json:"location"`
+	Index     int    `json:"index"`
+	IsDefault bool   `json:"is_default,omitempty"`
+}
+
+type SAMLEndpoints []SAMLEndpoint
+
+func (e SAMLEndpoints) Value() (driver.Value, error) {
+	if e == nil {
+		return nil, nil
+	}
+	return json.Marshal(e)
+}
+
+func (e *SAMLEndpoints) Scan(value interface{}) error {
+	if value == nil {
+		*e = nil
+		return nil
+	}
+	bytes, ok := value.([]byte)
+	if !ok {
+		return json.Unmarshal([]byte(fmt.Sprintf("%v", value)), e)
+	}
+	return json.Unmarshal(bytes, e)
+}
@@ -10,6 +10,7 @@ type Session struct {
 	ID        uint64         `gorm:"primaryKey" json:"id"`
 	UserID    uint64         `gorm:"not null;index" json:"user_id"`
 	Token     string         `gorm:"uniqueIndex;not null" json:"-"`
+	SID       string         `gorm:"column:sid;index" json:"sid,omitempty"` // session ID shared with relying parties for OIDC logout
 	IPAddress string         `json:"ip_address,omitempty"`
 	UserAgent string         `json:"user_agent,omitempty"`
 	ExpiresAt time.Time      `gorm:"not null" json:"expires_at"`
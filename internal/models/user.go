@@ -17,6 +17,7 @@ type User struct {
 	EmailVerified bool           `gorm:"default:false" json:"email_verified"`
 	PhoneVerified bool           `gorm:"default:false" json:"phone_verified"`
 	MFAEnabled    bool           `gorm:"default:false" json:"mfa_enabled"`
+	Attributes    JSONB          `gorm:"type:jsonb" json:"attributes,omitempty"` // custom attributes, released as claims by scopes
 	LastLoginAt   *time.Time     `json:"last_login_at,omitempty"`
 	CreatedAt     time.Time      `json:"created_at"`
 	UpdatedAt     time.Time      `json:"updated_at"`
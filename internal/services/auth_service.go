@@ -104,8 +104,7 @@ func (s *AuthService) Login(username, password, mfaCode, ipAddress, userAgent st
 	mfaRequired := user.MFAEnabled || mfaRequiredByRisk
 	if mfaRequired {
 		// Check if user has MFA device
-		var mfaDevice models.MFADevice
-		hasMFADevice := s.db.Where("user_id = ? AND type = ? AND verified = ?", user.ID, "totp", true).First(&mfaDevice).Error == nil
+		mfaDevice, hasMFADevice := verifiedTOTPDevice(s.db, user.ID)
 		
 		// If user has MFA enabled but no device, require MFA
 		if user.MFAEnabled && !hasMFADevice {
@@ -148,8 +147,9 @@ func (s *AuthService) Login(username, password, mfaCode, ipAddress, userAgent st
 		roles = append(roles, role.Name)
 	}
 
-	// Generate tokens
-	accessToken, err := auth.GenerateToken(user.ID, user.Username, roles, s.config.JWT.Secret, s.config.JWT.AccessExpiry, s.config.JWT.Issuer)
+	// Generate tokens bound to a new login session
+	sessionID := uuid.New().String()
+	accessToken, err := auth.GenerateSessionToken(user.ID, user.Username, roles, sessionID, s.config.JWT.Secret, s.config.JWT.AccessExpiry, s.config.JWT.Issuer)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate access token: %w", err)
 	}
@@ -162,7 +162,8 @@ func (s *AuthService) Login(username, password, mfaCode, ipAddress, userAgent st
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	if err := s.redis.Set(ctx, fmt.Sprintf("refresh_token:%s", refreshToken), fmt.Sprintf("%d", user.ID), time.Until(refreshExpiry)).Err(); err != nil {
+	// The value is "<user id>:<session id>" so refreshed tokens stay in the session
+	if err := s.redis.Set(ctx, fmt.Sprintf("refresh_token:%s", refreshToken), fmt.Sprintf("%d:%s", user.ID, sessionID), time.Until(refreshExpiry)).Err(); err != nil {
 		return nil, fmt.Errorf("failed to store refresh token: %w", err)
 	}
 
@@ -213,6 +214,7 @@ func (s *AuthService) Login(username, password, mfaCode, ipAddress, userAgent st
 	session := models.Session{
 		UserID:    user.ID,
 		Token:     accessToken,
+		SID:       sessionID,
 		IPAddress: ipAddress,
 		UserAgent: userAgent,
 		ExpiresAt: time.Now().Add(time.Duration(s.config.JWT.AccessExpiry) * time.Minute),
@@ -231,7 +233,14 @@ func (s *AuthService) Login(username, password, mfaCode, ipAddress, userAgent st
 func (s *AuthService) Logout(userID uint64) error {
 	// In a real implementation, you would invalidate the token
 	// For now, we'll just delete sessions
+	var sessionIDs []string
+	s.db.Model(&models.Session{}).Where("user_id = ? AND sid <> ''", userID).Pluck("sid", &sessionIDs)
 	s.db.Where("user_id = ?", userID).Delete(&models.Session{})
+
+	// Tell the relying parties of the ended sessions
+	if s.Services != nil && s.Services.SSO != nil {
+		s.Services.SSO.NotifySessionsEnded(context.Background(), userID, sessionIDs)
+	}
 	return nil
 }
 
@@ -247,6 +256,15 @@ func (s *AuthService) Refresh(refreshToken string) (*LoginResult, error) {
 
 	var userID uint64
 	fmt.Sscanf(userIDStr, "%d", &userID)
+	_, sessionID, _ := strings.Cut(userIDStr, ":")
+
+	// Refresh tokens die with their session, e.g. after an OIDC logout
+	var session models.Session
+	if sessionID != "" {
+		if err := s.db.Where("sid = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+			return nil, errors.New("session has ended")
+		}
+	}
 
 	var user models.User
 	if err := s.db.First(&user, userID).Error; err != nil {
@@ -264,11 +282,21 @@ func (s *AuthService) Refresh(refreshToken string) (*LoginResult, error) {
 		roles = append(roles, role.Name)
 	}
 
-	// Generate new access token
-	accessToken, err := auth.GenerateToken(user.ID, user.Username, roles, s.config.JWT.Secret, s.config.JWT.AccessExpiry, s.config.JWT.Issuer)
+	// Generate new access token, which keeps the login time of the session
+	authTime := time.Now()
+	if session.ID != 0 {
+		authTime = session.CreatedAt
+	}
+	accessToken, err := auth.RenewSessionToken(user.ID, user.Username, roles, sessionID, authTime, s.config.JWT.Secret, s.config.JWT.AccessExpiry, s.config.JWT.Issuer)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate access token: %w", err)
 	}
+	if session.ID != 0 {
+		s.db.Model(&session).Updates(map[string]interface{}{
+			"token":      accessToken,
+			"expires_at": time.Now().Add(time.Duration(s.config.JWT.AccessExpiry) * time.Minute),
+		})
+	}
 
 	return &LoginResult{
 		AccessToken: accessToken,
@@ -327,7 +355,7 @@ func (s *AuthService) ForgotPassword(email string) error {
 	}
 
 	// Send email with reset link
-	if s.Services.Notification != nil {
+	if s.Services != nil && s.Services.Notification != nil {
 		if err := s.Services.Notification.SendPasswordResetEmail(email, token); err != nil {
 			s.logger.WithError(err).Warn("Failed to send password reset email")
 		}
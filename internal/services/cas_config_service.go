@@ -0,0 +1,162 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidCASServiceConfig = errors.New("invalid CAS service config")
+	ErrCASServiceConfigExists  = errors.New("CAS service config already exists")
+)
+
+// CASConfigService manages the services registered to CAS applications:
+// their URL patterns, released attributes and whether they may proxy
+type CASConfigService struct {
+	db     *gorm.DB
+	logger *logrus.Logger
+}
+
+func NewCASConfigService(db *gorm.DB, logger *logrus.Logger) *CASConfigService {
+	return &CASConfigService{db: db, logger: logger}
+}
+
+// CASServiceConfigUpdate holds the settings of a registered service that can be changed
+type CASServiceConfigUpdate struct {
+	Name                 *string       `json:"name"`
+	MatchType            *string       `json:"match_type"`
+	Pattern              *string       `json:"pattern"`
+	AttributeMap         *models.JSONB `json:"attribute_map"`
+	AllowProxy           *bool         `json:"allow_proxy"`
+	ProxyCallbackPattern *string       `json:"proxy_callback_pattern"`
+	SSOEnabled           *bool         `json:"sso_enabled"`
+}
+
+// List returns the services registered to a CAS application
+func (s *CASConfigService) List(appID uint64) ([]models.CASServiceConfig, error) {
+	if err := s.checkApplication(appID); err != nil {
+		return nil, err
+	}
+	var configs []models.CASServiceConfig
+	if err := s.db.Where("application_id = ?", appID).Order("id").Find(&configs).Error; err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// Get returns a service registered to a CAS application
+func (s *CASConfigService) Get(appID, id uint64) (*models.CASServiceConfig, error) {
+	var config models.CASServiceConfig
+	if err := s.db.Where("id = ? AND application_id = ?", id, appID).First(&config).Error; err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Create registers a service to a CAS application. Services match by prefix
+// and take part in single sign-on unless set otherwise.
+func (s *CASConfigService) Create(appID uint64, data *CASServiceConfigUpdate) (*models.CASServiceConfig, error) {
+	if err := s.checkApplication(appID); err != nil {
+		return nil, err
+	}
+	config := &models.CASServiceConfig{ApplicationID: appID, MatchType: sso.CASMatchPrefix, SSOEnabled: true}
+	applyCASServiceConfigUpdate(config, data)
+	return s.store(config)
+}
+
+// Update changes the settings of a registered service
+func (s *CASConfigService) Update(appID, id uint64, data *CASServiceConfigUpdate) (*models.CASServiceConfig, error) {
+	config, err := s.Get(appID, id)
+	if err != nil {
+		return nil, err
+	}
+	applyCASServiceConfigUpdate(config, data)
+	return s.store(config)
+}
+
+// Delete unregisters a service. No tickets are issued to it afterwards and
+// its outstanding tickets no longer validate.
+func (s *CASConfigService) Delete(appID, id uint64) error {
+	result := s.db.Where("application_id = ?", appID).Delete(&models.CASServiceConfig{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// checkApplication checks that services are registered to a CAS application
+func (s *CASConfigService) checkApplication(appID uint64) error {
+	var app models.Application
+	return s.db.Where("id = ? AND protocol = ?", appID, "cas").First(&app).Error
+}
+
+func applyCASServiceConfigUpdate(config *models.CASServiceConfig, data *CASServiceConfigUpdate) {
+	if data.Name != nil {
+		config.Name = *data.Name
+	}
+	if data.MatchType != nil {
+		config.MatchType = *data.MatchType
+	}
+	if data.Pattern != nil {
+		config.Pattern = *data.Pattern
+	}
+	if data.AttributeMap != nil {
+		config.AttributeMap = *data.AttributeMap
+	}
+	if data.AllowProxy != nil {
+		config.AllowProxy = *data.AllowProxy
+	}
+	if data.ProxyCallbackPattern != nil {
+		config.ProxyCallbackPattern = *data.ProxyCallbackPattern
+	}
+	if data.SSOEnabled != nil {
+		config.SSOEnabled = *data.SSOEnabled
+	}
+}
+
+// store validates and saves a registered service
+func (s *CASConfigService) store(config *models.CASServiceConfig) (*models.CASServiceConfig, error) {
+	if config.Name == "" || config.Pattern == "" {
+		return nil, fmt.Errorf("%w: name and pattern are required", ErrInvalidCASServiceConfig)
+	}
+	if err := sso.ValidateCASServicePattern(config.MatchType, config.Pattern); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCASServiceConfig, err)
+	}
+	if err := sso.ValidateCASAttributeMap(config.AttributeMap); err != nil {
+		return nil, fmt.Errorf("%w: attribute_map: %v", ErrInvalidCASServiceConfig, err)
+	}
+	if config.AllowProxy && config.ProxyCallbackPattern == "" {
+		return nil, fmt.Errorf("%w: allow_proxy needs proxy_callback_pattern", ErrInvalidCASServiceConfig)
+	}
+	if config.ProxyCallbackPattern != "" {
+		if err := sso.ValidateCASProxyCallbackPattern(config.ProxyCallbackPattern); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCASServiceConfig, err)
+		}
+	}
+	var count int64
+	s.db.Model(&models.CASServiceConfig{}).
+		Where("match_type = ? AND pattern = ? AND id <> ?", config.MatchType, config.Pattern, config.ID).
+		Count(&count)
+	if count > 0 {
+		return nil, ErrCASServiceConfigExists
+	}
+
+	var err error
+	if config.ID == 0 {
+		err = s.db.Create(config).Error
+	} else {
+		err = s.db.Save(config).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
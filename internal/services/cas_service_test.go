@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type casJSONResponse struct {
+	ServiceResponse struct {
+		AuthenticationSuccess *struct {
+			User                string   `json:"user"`
+			ProxyGrantingTicket string   `json:"proxyGrantingTicket"`
+			Proxies             []string `json:"proxies"`
+		} `json:"authenticationSuccess"`
+		AuthenticationFailure *struct {
+			Code string `json:"code"`
+		} `json:"authenticationFailure"`
+		ProxySuccess *struct {
+			ProxyTicket string `json:"proxyTicket"`
+		} `json:"proxySuccess"`
+		ProxyFailure *struct {
+			Code string `json:"code"`
+		} `json:"proxyFailure"`
+	} `json:"serviceResponse"`
+}
+
+func TestCASProxy(t *testing.T) {
+	s := setupSSOTest(t)
+	db := s.SSO.db
+	user := createTestUser(t, db, "alice")
+	app := &models.Application{Name: "Portal", Protocol: "cas", Status: "active"}
+	require.NoError(t, db.Create(app).Error)
+	register := func(name, pattern string, allowProxy bool, callbackPattern string) error {
+		_, err := s.CASConfig.Create(app.ID, &CASServiceConfigUpdate{
+			Name:                 &name,
+			Pattern:              &pattern,
+			AllowProxy:           &allowProxy,
+			ProxyCallbackPattern: &callbackPattern,
+		})
+		return err
+	}
+	require.NoError(t, register("Portal", "https://portal.example.com/", true, `https://portal[.]example[.]com/pgt`))
+	require.NoError(t, register("Backend", "https://backend.example.com/", false, ""))
+
+	// Proxying needs a valid callback pattern
+	assert.ErrorIs(t, register("Other", "https://other.example.com/", true, ""), ErrInvalidCASServiceConfig)
+	assert.ErrorIs(t, register("Other", "https://other.example.com/", true, "https://("), ErrInvalidCASServiceConfig)
+
+	// Stand in for the proxy's callback endpoint, which the public client
+	// could not reach on a test server
+	var callbacks []url.Values
+	callbackStatus := http.StatusOK
+	client := casProxyCallbackClient
+	casProxyCallbackClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		callbacks = append(callbacks, req.URL.Query())
+		return &http.Response{StatusCode: callbackStatus, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}
+	t.Cleanup(func() { casProxyCallbackClient = client })
+
+	serviceTicket := func(service string) string {
+		ticket := sso.NewCASTicket(sso.CASServiceTicketPrefix)
+		require.NoError(t, s.CAS.storeTicket(context.Background(), ticket, &sso.CASTicket{
+			UserID:   user.ID,
+			Service:  service,
+			AuthTime: time.Now(),
+		}))
+		return ticket
+	}
+	call := func(handler gin.HandlerFunc, path string, query url.Values) casJSONResponse {
+		query.Set("format", "JSON")
+		w := performRequest(handler, http.MethodGet, path+"?"+query.Encode(), nil, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var response casJSONResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+	validate := func(service, pgtURL string) casJSONResponse {
+		query := url.Values{"ticket": {serviceTicket(service)}, "service": {service}}
+		if pgtURL != "" {
+			query.Set("pgtUrl", pgtURL)
+		}
+		return call(s.CAS.CASServiceValidate, "/cas/serviceValidate", query)
+	}
+	failureCode := func(response casJSONResponse) string {
+		if response.ServiceResponse.AuthenticationFailure == nil {
+			return ""
+		}
+		return response.ServiceResponse.AuthenticationFailure.Code
+	}
+
+	t.Run("pgtUrl must match the callback pattern", func(t *testing.T) {
+		response := validate("https://portal.example.com/home", "https://attacker.example.com/pgt")
+		assert.Equal(t, sso.CASInvalidProxyCallback, failureCode(response))
+		response = validate("https://portal.example.com/home", "https://portal.example.com/pgt?x=1")
+		assert.Equal(t, sso.CASInvalidProxyCallback, failureCode(response))
+		assert.Empty(t, callbacks)
+	})
+
+	t.Run("pgtUrl must be public", func(t *testing.T) {
+		response := validate("https://portal.example.com/home", "https://127.0.0.1/pgt")
+		assert.Equal(t, sso.CASInvalidProxyCallback, failureCode(response))
+		assert.Empty(t, callbacks)
+	})
+
+	t.Run("service must be allowed to proxy", func(t *testing.T) {
+		response := validate("https://backend.example.com/api", "https://portal.example.com/pgt")
+		assert.Equal(t, sso.CASUnauthorizedServiceProxy, failureCode(response))
+		assert.Empty(t, callbacks)
+	})
+
+	t.Run("failed callback grants no ticket", func(t *testing.T) {
+		callbackStatus = http.StatusNotFound
+		defer func() { callbackStatus = http.StatusOK }()
+		response := validate("https://portal.example.com/home", "https://portal.example.com/pgt")
+		require.NotNil(t, response.ServiceResponse.AuthenticationSuccess)
+		assert.Empty(t, response.ServiceResponse.AuthenticationSuccess.ProxyGrantingTicket)
+		require.Len(t, callbacks, 1)
+
+		proxy := call(s.CAS.CASProxy, "/cas/proxy", url.Values{
+			"pgt":           {callbacks[0].Get("pgtId")},
+			"targetService": {"https://backend.example.com/api"},
+		})
+		require.NotNil(t, proxy.ServiceResponse.ProxyFailure)
+		assert.Equal(t, sso.CASInvalidTicket, proxy.ServiceResponse.ProxyFailure.Code)
+		callbacks = nil
+	})
+
+	t.Run("proxy chain", func(t *testing.T) {
+		response := validate("https://portal.example.com/home", "https://portal.example.com/pgt")
+		require.NotNil(t, response.ServiceResponse.AuthenticationSuccess)
+		assert.Equal(t, "alice", response.ServiceResponse.AuthenticationSuccess.User)
+
+		// The PGTIOU in the response is the one sent to the callback
+		require.Len(t, callbacks, 1)
+		iou := response.ServiceResponse.AuthenticationSuccess.ProxyGrantingTicket
+		assert.True(t, strings.HasPrefix(iou, sso.CASProxyGrantingTicketIOUPrefix))
+		assert.Equal(t, iou, callbacks[0].Get("pgtIou"))
+		pgt := callbacks[0].Get("pgtId")
+		assert.True(t, strings.HasPrefix(pgt, sso.CASProxyGrantingTicketPrefix))
+
+		// Proxy tickets are only issued for registered services
+		proxy := call(s.CAS.CASProxy, "/cas/proxy", url.Values{"pgt": {pgt}, "targetService": {"https://unknown.example.com/"}})
+		require.NotNil(t, proxy.ServiceResponse.ProxyFailure)
+		assert.Equal(t, sso.CASUnauthorizedService, proxy.ServiceResponse.ProxyFailure.Code)
+
+		proxy = call(s.CAS.CASProxy, "/cas/proxy", url.Values{"pgt": {pgt}, "targetService": {"https://backend.example.com/api"}})
+		require.NotNil(t, proxy.ServiceResponse.ProxySuccess)
+		proxyTicket := proxy.ServiceResponse.ProxySuccess.ProxyTicket
+		assert.True(t, strings.HasPrefix(proxyTicket, sso.CASProxyTicketPrefix))
+
+		// serviceValidate rejects proxy tickets without redeeming them
+		query := url.Values{"ticket": {proxyTicket}, "service": {"https://backend.example.com/api"}}
+		response = call(s.CAS.CASServiceValidate, "/cas/serviceValidate", query)
+		assert.Equal(t, sso.CASInvalidTicketSpec, failureCode(response))
+
+		response = call(s.CAS.CASProxyValidate, "/cas/proxyValidate", query)
+		require.NotNil(t, response.ServiceResponse.AuthenticationSuccess)
+		assert.Equal(t, "alice", response.ServiceResponse.AuthenticationSuccess.User)
+		assert.Equal(t, []string{"https://portal.example.com/pgt"}, response.ServiceResponse.AuthenticationSuccess.Proxies)
+
+		// Proxy tickets are single use
+		response = call(s.CAS.CASProxyValidate, "/cas/proxyValidate", query)
+		assert.Equal(t, sso.CASInvalidTicket, failureCode(response))
+	})
+}
+
+func TestSendProxyCallback_RefusesLoopback(t *testing.T) {
+	s := setupSSOTest(t)
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	err := s.CAS.sendProxyCallback(context.Background(), server.URL+"/pgt?pgtId=PGT-1&pgtIou=PGTIOU-1")
+	assert.True(t, errors.Is(err, sso.ErrNonPublicAddress))
+	assert.False(t, called)
+}
@@ -66,6 +66,16 @@ func (s *MFAService) CreateTOTPDevice(userID uint64, name string) (string, strin
 	return secret, url, nil
 }
 
+// verifiedTOTPDevice returns the user's verified TOTP device, whose code
+// logins of users with MFA enabled must present
+func verifiedTOTPDevice(db *gorm.DB, userID uint64) (*models.MFADevice, bool) {
+	var device models.MFADevice
+	if err := db.Where("user_id = ? AND type = ? AND verified = ?", userID, "totp", true).First(&device).Error; err != nil {
+		return nil, false
+	}
+	return &device, true
+}
+
 func (s *MFAService) VerifyTOTP(userID uint64, code string) error {
 	var device models.MFADevice
 	if err := s.db.Where("user_id = ? AND type = ? AND verified = ?", userID, "totp", true).First(&device).Error; err != nil {
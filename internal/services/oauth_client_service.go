@@ -0,0 +1,298 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// DefaultSecretOverlap is how long the previous secret keeps working after a
+// rotation when no overlap is requested.
+const DefaultSecretOverlap = 24 * time.Hour
+
+var ErrNoClientSecret = errors.New("client does not authenticate with a client secret")
+
+var ErrUnsupportedGrantType = errors.New("unsupported grant type")
+
+type OAuthClientService struct {
+	db     *gorm.DB
+	redis  *redis.Client
+	logger *logrus.Logger
+}
+
+func NewOAuthClientService(db *gorm.DB, redis *redis.Client, logger *logrus.Logger) *OAuthClientService {
+	return &OAuthClientService{db: db, redis: redis, logger: logger}
+}
+
+// OAuthClientUpdate holds the client fields that can be changed after creation
+type OAuthClientUpdate struct {
+	RedirectURIs *[]string `json:"redirect_uris"`
+	Scopes       *[]string `json:"scopes"`
+	GrantTypes   *[]string `json:"grant_types"`
+	FirstParty   *bool     `json:"first_party"`
+
+	AccessTokenFormat   *string `json:"access_token_format"`
+	AccessTokenAudience *string `json:"access_token_audience"`
+
+	TokenEndpointAuthMethod *string       `json:"token_endpoint_auth_method"`
+	JWKS                    *models.JSONB `json:"jwks"`
+	JWKSURI                 *string       `json:"jwks_uri"`
+	TLSClientAuthSubjectDN  *string       `json:"tls_client_auth_subject_dn"`
+
+	TokenExchangeSubjectClients *[]string `json:"token_exchange_subject_clients"`
+	TokenExchangeAudiences      *[]string `json:"token_exchange_audiences"`
+	TokenExchangeImpersonation  *bool     `json:"token_exchange_impersonation"`
+
+	PostLogoutRedirectURIs            *[]string `json:"post_logout_redirect_uris"`
+	FrontchannelLogoutURI             *string   `json:"frontchannel_logout_uri"`
+	FrontchannelLogoutSessionRequired *bool     `json:"frontchannel_logout_session_required"`
+	BackchannelLogoutURI              *string   `json:"backchannel_logout_uri"`
+	BackchannelLogoutSessionRequired  *bool     `json:"backchannel_logout_session_required"`
+
+	RequirePushedAuthorizationRequests *bool `json:"require_pushed_authorization_requests"`
+	DPoPBoundAccessTokens              *bool `json:"dpop_bound_access_tokens"`
+}
+
+func (s *OAuthClientService) List(appID uint64) ([]models.OAuthClient, error) {
+	var clients []models.OAuthClient
+	if err := s.db.Where("application_id = ?", appID).Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (s *OAuthClientService) Get(appID uint64, clientID string) (*models.OAuthClient, error) {
+	var client models.OAuthClient
+	if err := s.db.Where("application_id = ? AND client_id = ?", appID, clientID).First(&client).Error; err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// Create registers a new client for the application and returns the plaintext
+// secret, which is not stored and cannot be retrieved again.
+func (s *OAuthClientService) Create(appID uint64, client *models.OAuthClient) (string, error) {
+	var app models.Application
+	if err := s.db.First(&app, appID).Error; err != nil {
+		return "", err
+	}
+
+	client.ID = 0
+	client.ApplicationID = appID
+	client.ClientID = sso.GenerateClientID()
+	if err := sso.ValidateClientMetadata(client); err != nil {
+		return "", err
+	}
+
+	var secret string
+	if sso.ClientUsesSecret(client) {
+		var hash string
+		var err error
+		secret, hash, err = sso.GenerateClientSecret()
+		if err != nil {
+			return "", err
+		}
+		client.ClientSecret = hash
+	}
+
+	if err := s.db.Create(client).Error; err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (s *OAuthClientService) Update(appID uint64, clientID string, data *OAuthClientUpdate) (*models.OAuthClient, error) {
+	client, err := s.Get(appID, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.RedirectURIs != nil {
+		client.RedirectURIs = *data.RedirectURIs
+	}
+	if data.Scopes != nil {
+		client.Scopes = *data.Scopes
+	}
+	if data.GrantTypes != nil {
+		client.GrantTypes = *data.GrantTypes
+	}
+	if data.FirstParty != nil {
+		client.FirstParty = *data.FirstParty
+	}
+	if data.AccessTokenFormat != nil {
+		client.AccessTokenFormat = *data.AccessTokenFormat
+	}
+	if data.AccessTokenAudience != nil {
+		client.AccessTokenAudience = *data.AccessTokenAudience
+	}
+	if data.TokenEndpointAuthMethod != nil {
+		client.TokenEndpointAuthMethod = *data.TokenEndpointAuthMethod
+	}
+	if data.JWKS != nil {
+		client.JWKS = *data.JWKS
+	}
+	if data.JWKSURI != nil {
+		client.JWKSURI = *data.JWKSURI
+	}
+	if data.TLSClientAuthSubjectDN != nil {
+		client.TLSClientAuthSubjectDN = *data.TLSClientAuthSubjectDN
+	}
+	if data.TokenExchangeSubjectClients != nil {
+		client.TokenExchangeSubjectClients = *data.TokenExchangeSubjectClients
+	}
+	if data.TokenExchangeAudiences != nil {
+		client.TokenExchangeAudiences = *data.TokenExchangeAudiences
+	}
+	if data.TokenExchangeImpersonation != nil {
+		client.TokenExchangeImpersonation = *data.TokenExchangeImpersonation
+	}
+	if data.PostLogoutRedirectURIs != nil {
+		client.PostLogoutRedirectURIs = *data.PostLogoutRedirectURIs
+	}
+	if data.FrontchannelLogoutURI != nil {
+		client.FrontchannelLogoutURI = *data.FrontchannelLogoutURI
+	}
+	if data.FrontchannelLogoutSessionRequired != nil {
+		client.FrontchannelLogoutSessionRequired = *data.FrontchannelLogoutSessionRequired
+	}
+	if data.BackchannelLogoutURI != nil {
+		client.BackchannelLogoutURI = *data.BackchannelLogoutURI
+	}
+	if data.BackchannelLogoutSessionRequired != nil {
+		client.BackchannelLogoutSessionRequired = *data.BackchannelLogoutSessionRequired
+	}
+	if data.RequirePushedAuthorizationRequests != nil {
+		client.RequirePushedAuthorizationRequests = *data.RequirePushedAuthorizationRequests
+	}
+	if data.DPoPBoundAccessTokens != nil {
+		client.DPoPBoundAccessTokens = *data.DPoPBoundAccessTokens
+	}
+	if err := sso.ValidateClientMetadata(client); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Model(client).Select("redirect_uris", "scopes", "grant_types", "first_party", "access_token_format", "access_token_audience",
+		"token_endpoint_auth_method", "jwks", "jwks_uri", "tls_client_auth_subject_dn",
+		"token_exchange_subject_clients", "token_exchange_audiences", "token_exchange_impersonation",
+		"post_logout_redirect_uris", "frontchannel_logout_uri", "frontchannel_logout_session_required",
+		"backchannel_logout_uri", "backchannel_logout_session_required", "require_pushed_authorization_requests",
+		"dpop_bound_access_tokens", "updated_at").Updates(client).Error; err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Delete removes the client and revokes every token issued to it
+func (s *OAuthClientService) Delete(ctx context.Context, appID uint64, clientID string) error {
+	client, err := s.Get(appID, clientID)
+	if err != nil {
+		return err
+	}
+
+	var tokens []models.OAuthToken
+	if err := s.db.Where("client_id = ? AND revoked = ?", client.ClientID, false).Find(&tokens).Error; err != nil {
+		return err
+	}
+	if err := revokeOAuthTokens(ctx, s.db, s.redis, tokens); err != nil {
+		return err
+	}
+
+	return s.db.Delete(client).Error
+}
+
+// RotateSecret issues a new secret. The current secret stays valid for the
+// overlap window so deployments can switch without downtime; a zero overlap
+// invalidates it immediately.
+func (s *OAuthClientService) RotateSecret(appID uint64, clientID string, overlap time.Duration) (*models.OAuthClient, string, error) {
+	client, err := s.Get(appID, clientID)
+	if err != nil {
+		return nil, "", err
+	}
+	if !sso.ClientUsesSecret(client) {
+		return nil, "", ErrNoClientSecret
+	}
+
+	secret, hash, err := sso.GenerateClientSecret()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	client.PreviousClientSecret = ""
+	client.PreviousSecretExpiresAt = nil
+	if overlap > 0 {
+		expiresAt := now.Add(overlap)
+		client.PreviousClientSecret = client.ClientSecret
+		client.PreviousSecretExpiresAt = &expiresAt
+	}
+	client.ClientSecret = hash
+	client.SecretRotatedAt = &now
+
+	if err := s.db.Model(client).Select("client_secret", "previous_client_secret", "previous_secret_expires_at", "secret_rotated_at", "updated_at").Updates(client).Error; err != nil {
+		return nil, "", err
+	}
+	return client, secret, nil
+}
+
+// CreateInitialAccessToken issues a token that authorizes dynamic client
+// registration. The plaintext token is returned once and only its hash is kept.
+// grantTypes lists grant types the registered clients may use in addition to
+// sso.RegistrationGrantTypes.
+func (s *OAuthClientService) CreateInitialAccessToken(name string, maxUses int, expiresInHours *int, grantTypes []string, createdBy *uint64) (*models.OAuthInitialAccessToken, string, error) {
+	for _, grantType := range grantTypes {
+		if !containsString(sso.SupportedGrantTypes, grantType) {
+			return nil, "", ErrUnsupportedGrantType
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	initialToken := models.OAuthInitialAccessToken{
+		Name:        name,
+		TokenHash:   sso.HashToken(token),
+		TokenPrefix: token[:8],
+		MaxUses:     maxUses,
+		GrantTypes:  grantTypes,
+		CreatedBy:   createdBy,
+	}
+	if expiresInHours != nil {
+		expiresAt := time.Now().Add(time.Duration(*expiresInHours) * time.Hour)
+		initialToken.ExpiresAt = &expiresAt
+	}
+
+	if err := s.db.Create(&initialToken).Error; err != nil {
+		return nil, "", err
+	}
+	return &initialToken, token, nil
+}
+
+func (s *OAuthClientService) ListInitialAccessTokens() ([]models.OAuthInitialAccessToken, error) {
+	var tokens []models.OAuthInitialAccessToken
+	if err := s.db.Order("created_at DESC").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *OAuthClientService) RevokeInitialAccessToken(id uint64) error {
+	result := s.db.Model(&models.OAuthInitialAccessToken{}).Where("id = ?", id).Update("revoked", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
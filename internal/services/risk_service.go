@@ -80,7 +80,7 @@ func (s *RiskService) CalculateRiskScore(userID uint64, ipAddress, userAgent, de
 
 	// Check failed login attempts in last hour
 	ctx := context.Background()
-	key := fmt.Sprintf("failed_login:%s:%s", ipAddress, userID)
+	key := fmt.Sprintf("failed_login:%s:%d", ipAddress, userID)
 	failedCount, _ := s.redis.Get(ctx, key).Int()
 	factors.FailedLoginAttempts = failedCount
 	score += failedCount * 5 // Each failed attempt adds 5 points
@@ -0,0 +1,232 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidSAMLConfig = errors.New("invalid SAML configuration")
+
+// SAMLConfigService manages the SAML settings of applications
+type SAMLConfigService struct {
+	db     *gorm.DB
+	logger *logrus.Logger
+}
+
+func NewSAMLConfigService(db *gorm.DB, logger *logrus.Logger) *SAMLConfigService {
+	return &SAMLConfigService{db: db, logger: logger}
+}
+
+// SAMLConfigUpdate holds the SAML settings that can be changed. The private
+// key is write-only.
+type SAMLConfigUpdate struct {
+	EntityID        *string       `json:"entity_id"`
+	SSOURL          *string       `json:"sso_url"`
+	SLOURL          *string       `json:"slo_url"`
+	SLOBinding      *string       `json:"slo_binding"`
+	Certificate     *string       `json:"certificate"`
+	PrivateKey      *string       `json:"private_key"`
+	AttributeMap    *models.JSONB `json:"attribute_map"`
+	SignatureTarget *string       `json:"signature_target"`
+	// SP settings, usually imported from the SP metadata
+	ACSEndpoints        *models.SAMLEndpoints `json:"acs_endpoints"`
+	SPCertificates      *[]string             `json:"sp_certificates"`
+	NameIDFormats       *[]string             `json:"name_id_formats"`
+	AuthnRequestsSigned *bool                 `json:"authn_requests_signed"`
+	// Assertion encryption to the SP's encryption certificate
+	EncryptAssertions     *bool   `json:"encrypt_assertions"`
+	EncryptionCertificate *string `json:"encryption_certificate"`
+	EncryptionMethod      *string `json:"encryption_method"`
+	// Subject NameID: format and, for email and unspecified, the source of its value
+	NameIDFormat *string `json:"name_id_format"`
+	NameIDSource *string `json:"name_id_source"`
+	SignMetadata *bool   `json:"sign_metadata"`
+}
+
+// Get returns the SAML settings of a SAML application
+func (s *SAMLConfigService) Get(appID uint64) (*models.SAMLConfig, error) {
+	var config models.SAMLConfig
+	if err := s.db.Where("application_id = ?", appID).First(&config).Error; err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Save updates the SAML settings of an application, creating them on first use
+func (s *SAMLConfigService) Save(appID uint64, data *SAMLConfigUpdate) (*models.SAMLConfig, error) {
+	config, err := s.load(appID)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.EntityID != nil {
+		config.EntityID = *data.EntityID
+	}
+	if data.SSOURL != nil {
+		config.SSOURL = *data.SSOURL
+	}
+	if data.SLOURL != nil {
+		config.SLOURL = *data.SLOURL
+	}
+	if data.SLOBinding != nil {
+		config.SLOBinding = *data.SLOBinding
+	}
+	if data.Certificate != nil {
+		config.Certificate = *data.Certificate
+	}
+	if data.PrivateKey != nil {
+		config.PrivateKey = *data.PrivateKey
+	}
+	if data.AttributeMap != nil {
+		config.AttributeMap = *data.AttributeMap
+	}
+	if data.SignatureTarget != nil {
+		config.SignatureTarget = *data.SignatureTarget
+	}
+	if data.ACSEndpoints != nil {
+		config.ACSEndpoints = *data.ACSEndpoints
+	}
+	if data.SPCertificates != nil {
+		config.SPCertificates = *data.SPCertificates
+	}
+	if data.NameIDFormats != nil {
+		config.NameIDFormats = *data.NameIDFormats
+	}
+	if data.AuthnRequestsSigned != nil {
+		config.AuthnRequestsSigned = *data.AuthnRequestsSigned
+	}
+	if data.EncryptAssertions != nil {
+		config.EncryptAssertions = *data.EncryptAssertions
+	}
+	if data.EncryptionCertificate != nil {
+		config.EncryptionCertificate = *data.EncryptionCertificate
+	}
+	if data.EncryptionMethod != nil {
+		config.EncryptionMethod = *data.EncryptionMethod
+	}
+	if data.NameIDFormat != nil {
+		config.NameIDFormat = *data.NameIDFormat
+	}
+	if data.NameIDSource != nil {
+		config.NameIDSource = *data.NameIDSource
+	}
+	if data.SignMetadata != nil {
+		config.SignMetadata = *data.SignMetadata
+	}
+	return s.store(config)
+}
+
+// ImportMetadata replaces the SP settings of an application with those from
+// the SP's metadata XML: entity ID, ACS endpoints, SLO URL, signing and
+// encryption certificates and NameID formats. Whether assertions are
+// encrypted is left to the administrator.
+func (s *SAMLConfigService) ImportMetadata(appID uint64, data []byte) (*models.SAMLConfig, error) {
+	metadata, err := sso.ParseSAMLSPMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLConfig, err)
+	}
+	acsURL := sso.DefaultACSURL(metadata.ACSEndpoints)
+	if acsURL == "" {
+		return nil, fmt.Errorf("%w: metadata has no HTTP-POST AssertionConsumerService", ErrInvalidSAMLConfig)
+	}
+
+	config, err := s.load(appID)
+	if err != nil {
+		return nil, err
+	}
+
+	config.EntityID = metadata.EntityID
+	config.SSOURL = acsURL
+	config.ACSEndpoints = metadata.ACSEndpoints
+	config.SPCertificates = metadata.Certificates
+	config.NameIDFormats = metadata.NameIDFormats
+	config.AuthnRequestsSigned = metadata.AuthnRequestsSigned
+	config.EncryptionCertificate = metadata.EncryptionCertificate
+	config.EncryptionMethod = metadata.EncryptionMethod
+	config.SPMetadata = string(data)
+	if metadata.SLOURL != "" {
+		config.SLOURL = metadata.SLOURL
+		config.SLOBinding = metadata.SLOBinding
+	}
+	return s.store(config)
+}
+
+// load returns the SAML settings of a SAML application, or new ones
+func (s *SAMLConfigService) load(appID uint64) (*models.SAMLConfig, error) {
+	var app models.Application
+	if err := s.db.Where("id = ? AND protocol = ?", appID, "saml").First(&app).Error; err != nil {
+		return nil, err
+	}
+	config, err := s.Get(appID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &models.SAMLConfig{ApplicationID: appID}, nil
+	}
+	return config, err
+}
+
+// store validates and saves the SAML settings
+func (s *SAMLConfigService) store(config *models.SAMLConfig) (*models.SAMLConfig, error) {
+	if err := validateSAMLConfig(config); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if config.ID == 0 {
+		err = s.db.Create(config).Error
+	} else {
+		err = s.db.Save(config).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func validateSAMLConfig(config *models.SAMLConfig) error {
+	if config.EntityID == "" || config.SSOURL == "" {
+		return fmt.Errorf("%w: entity_id and sso_url are required", ErrInvalidSAMLConfig)
+	}
+	if !sso.ValidSAMLSignatureTarget(config.SignatureTarget) {
+		return fmt.Errorf("%w: signature_target must be assertion, response or both", ErrInvalidSAMLConfig)
+	}
+	if config.Certificate != "" || config.PrivateKey != "" {
+		if _, err := sso.NewSAMLSigner(config.Certificate, config.PrivateKey); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSAMLConfig, err)
+		}
+	}
+	if config.SLOBinding != "" && config.SLOBinding != saml.HTTPRedirectBinding && config.SLOBinding != saml.HTTPPostBinding {
+		return fmt.Errorf("%w: slo_binding must be the HTTP-Redirect or HTTP-POST binding", ErrInvalidSAMLConfig)
+	}
+	for _, endpoint := range config.ACSEndpoints {
+		if endpoint.Binding == "" || endpoint.Location == "" {
+			return fmt.Errorf("%w: ACS endpoints need a binding and a location", ErrInvalidSAMLConfig)
+		}
+	}
+	if _, err := sso.ParseSAMLCertificates(config.SPCertificates); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSAMLConfig, err)
+	}
+	if config.AuthnRequestsSigned && len(config.SPCertificates) == 0 {
+		return fmt.Errorf("%w: signed AuthnRequests need an SP signing certificate", ErrInvalidSAMLConfig)
+	}
+	if _, err := sso.ParseSAMLAttributeMap(config.AttributeMap); err != nil {
+		return fmt.Errorf("%w: attribute_map: %v", ErrInvalidSAMLConfig, err)
+	}
+	if err := sso.ValidSAMLNameID(config.NameIDFormat, config.NameIDSource); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSAMLConfig, err)
+	}
+	if !sso.ValidSAMLEncryptionMethod(config.EncryptionMethod) {
+		return fmt.Errorf("%w: encryption_method must be aes128-gcm, aes256-gcm, aes128-cbc, aes192-cbc or aes256-cbc", ErrInvalidSAMLConfig)
+	}
+	if config.EncryptionCertificate != "" || config.EncryptAssertions {
+		if _, err := sso.NewSAMLEncrypter(config.EncryptionCertificate, config.EncryptionMethod); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSAMLConfig, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/config"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidSAMLIdentityProvider = errors.New("invalid SAML identity provider")
+	ErrSAMLIdentityProviderExists  = errors.New("SAML identity provider already exists")
+)
+
+// SAMLIdentityProviderService manages the connections to external SAML IdPs
+// users can sign in with
+type SAMLIdentityProviderService struct {
+	db     *gorm.DB
+	config *config.Config
+	logger *logrus.Logger
+}
+
+func NewSAMLIdentityProviderService(db *gorm.DB, cfg *config.Config, logger *logrus.Logger) *SAMLIdentityProviderService {
+	return &SAMLIdentityProviderService{db: db, config: cfg, logger: logger}
+}
+
+// SAMLIdentityProviderUpdate holds the connection settings that can be
+// changed. The SP private key is write-only.
+type SAMLIdentityProviderUpdate struct {
+	Name   *string `json:"name"`
+	Status *string `json:"status"`
+	// IdP settings, usually imported from the IdP metadata
+	EntityID     *string   `json:"entity_id"`
+	SSOURL       *string   `json:"sso_url"`
+	SSOBinding   *string   `json:"sso_binding"`
+	Certificates *[]string `json:"certificates"`
+	// SP settings
+	Certificate       *string `json:"certificate"`
+	PrivateKey        *string `json:"private_key"`
+	SignAuthnRequests *bool   `json:"sign_authn_requests"`
+	NameIDFormat      *string `json:"name_id_format"`
+	AllowIDPInitiated *bool   `json:"allow_idp_initiated"`
+	// Accounts
+	JITProvisioning *bool                    `json:"jit_provisioning"`
+	LinkByEmail     *bool                    `json:"link_by_email"`
+	EmailDomains    *[]string                `json:"email_domains"`
+	AttributeMap    *models.JSONB            `json:"attribute_map"`
+	RoleMappings    *models.SAMLRoleMappings `json:"role_mappings"`
+	DefaultRoles    *[]string                `json:"default_roles"`
+	SyncRoles       *bool                    `json:"sync_roles"`
+}
+
+func (s *SAMLIdentityProviderService) List() ([]models.SAMLIdentityProvider, error) {
+	var providers []models.SAMLIdentityProvider
+	if err := s.db.Order("name").Find(&providers).Error; err != nil {
+		return nil, err
+	}
+	return providers, nil
+}
+
+func (s *SAMLIdentityProviderService) Get(id uint64) (*models.SAMLIdentityProvider, error) {
+	var provider models.SAMLIdentityProvider
+	if err := s.db.First(&provider, id).Error; err != nil {
+		return nil, err
+	}
+	return &provider, nil
+}
+
+// Create adds a connection. The IdP settings can be imported from its
+// metadata afterwards, so only the name is required.
+func (s *SAMLIdentityProviderService) Create(name string, data *SAMLIdentityProviderUpdate) (*models.SAMLIdentityProvider, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidSAMLIdentityProvider)
+	}
+	var count int64
+	s.db.Model(&models.SAMLIdentityProvider{}).Where("name = ?", name).Count(&count)
+	if count > 0 {
+		return nil, ErrSAMLIdentityProviderExists
+	}
+
+	provider := &models.SAMLIdentityProvider{Name: name, Status: "active"}
+	applySAMLIdentityProviderUpdate(provider, data)
+	if err := s.validate(provider); err != nil {
+		return nil, err
+	}
+	if err := s.db.Create(provider).Error; err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// Update changes the settings of a connection
+func (s *SAMLIdentityProviderService) Update(id uint64, data *SAMLIdentityProviderUpdate) (*models.SAMLIdentityProvider, error) {
+	provider, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if data.Name != nil && *data.Name != provider.Name {
+		var count int64
+		s.db.Model(&models.SAMLIdentityProvider{}).Where("name = ? AND id <> ?", *data.Name, id).Count(&count)
+		if count > 0 {
+			return nil, ErrSAMLIdentityProviderExists
+		}
+	}
+	applySAMLIdentityProviderUpdate(provider, data)
+	return s.store(provider)
+}
+
+// ImportMetadata replaces the IdP settings of a connection with those from
+// the IdP's metadata XML: entity ID, SSO endpoint and signing certificates.
+// AuthnRequests are signed if the IdP wants them signed and an SP key pair
+// is configured.
+func (s *SAMLIdentityProviderService) ImportMetadata(id uint64, data []byte) (*models.SAMLIdentityProvider, error) {
+	metadata, err := sso.ParseSAMLIdPMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLIdentityProvider, err)
+	}
+	provider, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	provider.EntityID = metadata.EntityID
+	provider.SSOURL = metadata.SSOURL
+	provider.SSOBinding = metadata.SSOBinding
+	provider.Certificates = metadata.Certificates
+	provider.Metadata = string(data)
+	if metadata.WantAuthnRequestsSigned {
+		if provider.PrivateKey == "" {
+			return nil, fmt.Errorf("%w: the IdP wants signed AuthnRequests, set an SP key pair first", ErrInvalidSAMLIdentityProvider)
+		}
+		provider.SignAuthnRequests = true
+	}
+	return s.store(provider)
+}
+
+// Delete removes a connection and the accounts linked through it. The
+// users themselves are kept.
+func (s *SAMLIdentityProviderService) Delete(id uint64) error {
+	result := s.db.Delete(&models.SAMLIdentityProvider{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return s.db.Where("provider_id = ?", id).Delete(&models.SAMLFederatedIdentity{}).Error
+}
+
+func applySAMLIdentityProviderUpdate(provider *models.SAMLIdentityProvider, data *SAMLIdentityProviderUpdate) {
+	if data.Name != nil {
+		provider.Name = *data.Name
+	}
+	if data.Status != nil {
+		provider.Status = *data.Status
+	}
+	if data.EntityID != nil {
+		provider.EntityID = *data.EntityID
+	}
+	if data.SSOURL != nil {
+		provider.SSOURL = *data.SSOURL
+	}
+	if data.SSOBinding != nil {
+		provider.SSOBinding = *data.SSOBinding
+	}
+	if data.Certificates != nil {
+		provider.Certificates = *data.Certificates
+	}
+	if data.Certificate != nil {
+		provider.Certificate = *data.Certificate
+	}
+	if data.PrivateKey != nil {
+		provider.PrivateKey = *data.PrivateKey
+	}
+	if data.SignAuthnRequests != nil {
+		provider.SignAuthnRequests = *data.SignAuthnRequests
+	}
+	if data.NameIDFormat != nil {
+		provider.NameIDFormat = *data.NameIDFormat
+	}
+	if data.AllowIDPInitiated != nil {
+		provider.AllowIDPInitiated = *data.AllowIDPInitiated
+	}
+	if data.JITProvisioning != nil {
+		provider.JITProvisioning = *data.JITProvisioning
+	}
+	if data.LinkByEmail != nil {
+		provider.LinkByEmail = *data.LinkByEmail
+	}
+	if data.EmailDomains != nil {
+		provider.EmailDomains = make(models.StringArray, 0, len(*data.EmailDomains))
+		for _, domain := range *data.EmailDomains {
+			provider.EmailDomains = append(provider.EmailDomains, strings.ToLower(strings.TrimSpace(domain)))
+		}
+	}
+	if data.AttributeMap != nil {
+		provider.AttributeMap = *data.AttributeMap
+	}
+	if data.RoleMappings != nil {
+		provider.RoleMappings = *data.RoleMappings
+	}
+	if data.DefaultRoles != nil {
+		provider.DefaultRoles = *data.DefaultRoles
+	}
+	if data.SyncRoles != nil {
+		provider.SyncRoles = *data.SyncRoles
+	}
+}
+
+// store validates and saves a connection
+func (s *SAMLIdentityProviderService) store(provider *models.SAMLIdentityProvider) (*models.SAMLIdentityProvider, error) {
+	if err := s.validate(provider); err != nil {
+		return nil, err
+	}
+	if err := s.db.Save(provider).Error; err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// validate checks the settings of a connection. Until the IdP settings are
+// set only the SP and account settings are checked.
+func (s *SAMLIdentityProviderService) validate(provider *models.SAMLIdentityProvider) error {
+	complete := provider.EntityID != "" || provider.SSOURL != "" || len(provider.Certificates) > 0
+	if provider.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidSAMLIdentityProvider)
+	}
+	if provider.Status != "active" && provider.Status != "inactive" {
+		return fmt.Errorf("%w: status must be active or inactive", ErrInvalidSAMLIdentityProvider)
+	}
+	if complete && (provider.EntityID == "" || provider.SSOURL == "") {
+		return fmt.Errorf("%w: entity_id and sso_url are required", ErrInvalidSAMLIdentityProvider)
+	}
+	if complete {
+		sp := sso.NewSAMLSP(s.config.OIDC.Issuer, provider.ID)
+		if _, err := sso.NewSAMLServiceProvider(sp, provider); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSAMLIdentityProvider, err)
+		}
+	} else if provider.Certificate != "" || provider.PrivateKey != "" {
+		if _, err := sso.NewSAMLSigner(provider.Certificate, provider.PrivateKey); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSAMLIdentityProvider, err)
+		}
+	}
+	if provider.SSOBinding != "" && provider.SSOBinding != saml.HTTPRedirectBinding && provider.SSOBinding != saml.HTTPPostBinding {
+		return fmt.Errorf("%w: sso_binding must be the HTTP-Redirect or HTTP-POST binding", ErrInvalidSAMLIdentityProvider)
+	}
+	if err := sso.ValidSAMLNameID(provider.NameIDFormat, ""); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSAMLIdentityProvider, err)
+	}
+	for _, domain := range provider.EmailDomains {
+		if domain == "" || strings.ContainsAny(domain, "@/ ") {
+			return fmt.Errorf("%w: invalid email domain %q", ErrInvalidSAMLIdentityProvider, domain)
+		}
+	}
+	if provider.LinkByEmail && len(provider.EmailDomains) == 0 {
+		return fmt.Errorf("%w: link_by_email needs email_domains", ErrInvalidSAMLIdentityProvider)
+	}
+	if err := sso.ValidateSAMLUserAttributeMap(provider.AttributeMap); err != nil {
+		return fmt.Errorf("%w: attribute_map: %v", ErrInvalidSAMLIdentityProvider, err)
+	}
+	if err := sso.ValidateSAMLRoleMappings(provider.RoleMappings); err != nil {
+		return fmt.Errorf("%w: role_mappings: %v", ErrInvalidSAMLIdentityProvider, err)
+	}
+
+	// Mapped roles and groups must exist
+	roles, groups := sso.SAMLMappedRoles(provider.RoleMappings)
+	for _, role := range append(roles, provider.DefaultRoles...) {
+		var count int64
+		s.db.Model(&models.Role{}).Where("name = ?", role).Count(&count)
+		if count == 0 {
+			return fmt.Errorf("%w: role %q does not exist", ErrInvalidSAMLIdentityProvider, role)
+		}
+	}
+	for _, group := range groups {
+		var count int64
+		s.db.Model(&models.UserGroup{}).Where("name = ?", group).Count(&count)
+		if count == 0 {
+			return fmt.Errorf("%w: group %q does not exist", ErrInvalidSAMLIdentityProvider, group)
+		}
+	}
+	return nil
+}
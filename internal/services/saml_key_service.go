@@ -0,0 +1,156 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidSAMLKey = errors.New("invalid SAML key")
+
+// DefaultSAMLKeyValidity is how long generated certificates are valid by default
+const DefaultSAMLKeyValidity = 2 * 365 * 24 * time.Hour
+
+// SAMLKeyService manages the signing key sets of SAML applications and the
+// global key set (application ID 0) that applications without keys of their
+// own sign with
+type SAMLKeyService struct {
+	db     *gorm.DB
+	logger *logrus.Logger
+}
+
+func NewSAMLKeyService(db *gorm.DB, logger *logrus.Logger) *SAMLKeyService {
+	return &SAMLKeyService{db: db, logger: logger}
+}
+
+// List returns the key set of an application, or the global one
+func (s *SAMLKeyService) List(appID uint64) ([]models.SAMLKey, error) {
+	if err := s.checkApplication(appID); err != nil {
+		return nil, err
+	}
+	return loadSAMLKeys(s.db, appID)
+}
+
+// Generate adds a next key with a self-signed certificate valid for
+// validity. It is published in the metadata until it is activated.
+func (s *SAMLKeyService) Generate(appID uint64, validity time.Duration) (*models.SAMLKey, error) {
+	if validity < 24*time.Hour {
+		return nil, fmt.Errorf("%w: keys must be valid for at least a day", ErrInvalidSAMLKey)
+	}
+	commonName := "OpenAuth SAML"
+	if appID != 0 {
+		var app models.Application
+		if err := s.db.Where("id = ? AND protocol = ?", appID, "saml").First(&app).Error; err != nil {
+			return nil, err
+		}
+		commonName = fmt.Sprintf("OpenAuth SAML %s", app.Name)
+	}
+
+	key, err := sso.GenerateSAMLKey(commonName, validity)
+	if err != nil {
+		return nil, err
+	}
+	key.ApplicationID = appID
+	if err := s.db.Create(key).Error; err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Activate switches an application over to a next key, at once or at the
+// scheduled time. SPs only trust the key once they have fetched metadata
+// that publishes it, so the switch-over should leave them time to.
+func (s *SAMLKeyService) Activate(appID, keyID uint64, at *time.Time) (*models.SAMLKey, error) {
+	if err := s.checkApplication(appID); err != nil {
+		return nil, err
+	}
+
+	var activated *models.SAMLKey
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		keys, err := loadSAMLKeys(tx, appID)
+		if err != nil {
+			return err
+		}
+		index := -1
+		for i := range keys {
+			if keys[i].ID == keyID {
+				index = i
+			}
+		}
+		if index < 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if keys[index].Status != sso.SAMLKeyNext {
+			return fmt.Errorf("%w: only next keys can be activated", ErrInvalidSAMLKey)
+		}
+
+		now := time.Now()
+		if at != nil && at.After(now) {
+			keys[index].ActivatesAt = at
+			activated = &keys[index]
+			return tx.Save(activated).Error
+		}
+		sso.ActivateSAMLKey(keys, index, now)
+		activated = &keys[index]
+		return saveSAMLKeys(tx, keys)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return activated, nil
+}
+
+// Delete removes a next or retired key. The active key is replaced by
+// activating another one.
+func (s *SAMLKeyService) Delete(appID, keyID uint64) error {
+	if err := s.checkApplication(appID); err != nil {
+		return err
+	}
+	var key models.SAMLKey
+	if err := s.db.Where("id = ? AND application_id = ?", keyID, appID).First(&key).Error; err != nil {
+		return err
+	}
+	if key.Status == sso.SAMLKeyActive {
+		return fmt.Errorf("%w: the active key cannot be deleted, activate another key first", ErrInvalidSAMLKey)
+	}
+	return s.db.Delete(&key).Error
+}
+
+// checkApplication checks that a key set belongs to a SAML application;
+// application ID 0 is the global key set
+func (s *SAMLKeyService) checkApplication(appID uint64) error {
+	if appID == 0 {
+		return nil
+	}
+	var app models.Application
+	return s.db.Where("id = ? AND protocol = ?", appID, "saml").First(&app).Error
+}
+
+// loadSAMLKeys returns the key set of an application, or the global one,
+// after activating the keys whose switch-over is due
+func loadSAMLKeys(db *gorm.DB, appID uint64) ([]models.SAMLKey, error) {
+	var keys []models.SAMLKey
+	if err := db.Where("application_id = ?", appID).Order("id").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	if sso.PromoteSAMLKeys(keys, time.Now()) {
+		if err := saveSAMLKeys(db, keys); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func saveSAMLKeys(db *gorm.DB, keys []models.SAMLKey) error {
+	for i := range keys {
+		if err := db.Model(&keys[i]).Select("status", "activates_at", "activated_at", "retired_at", "updated_at").Updates(&keys[i]).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
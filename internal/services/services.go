@@ -26,8 +26,14 @@ type Services struct {
 	LDAP                *LDAPService
 	ConditionalAccess   *ConditionalAccessService
 	APIKey              *APIKeyService
+	OAuthClient         *OAuthClientService
+	OAuthScope          *OAuthScopeService
+	SAMLConfig          *SAMLConfigService
+	SAMLIdentityProvider *SAMLIdentityProviderService
+	SAMLKey             *SAMLKeyService
 	Webhook             *WebhookService
 	CAS                 *CASService
+	CASConfig           *CASConfigService
 	UserImportExport    *UserImportExportService
 	Risk                *RiskService
 	Automation          *AutomationService
@@ -56,8 +62,14 @@ func New(db *gorm.DB, redis *redis.Client, cfg *config.Config, logger *logrus.Lo
 		LDAP:                NewLDAPService(db, cfg, logger),
 		ConditionalAccess:   NewConditionalAccessService(db, logger),
 		APIKey:              NewAPIKeyService(db, logger),
+		OAuthClient:         NewOAuthClientService(db, redis, logger),
+		OAuthScope:          NewOAuthScopeService(db, logger),
+		SAMLConfig:          NewSAMLConfigService(db, logger),
+		SAMLIdentityProvider: NewSAMLIdentityProviderService(db, cfg, logger),
+		SAMLKey:             NewSAMLKeyService(db, logger),
 		Webhook:             NewWebhookService(db, logger),
 		CAS:                 NewCASService(db, redis, logger),
+		CASConfig:           NewCASConfigService(db, logger),
 		UserImportExport:    NewUserImportExportService(db, logger),
 		Risk:                NewRiskService(db, redis, logger),
 		Automation:          NewAutomationService(db, logger),
@@ -71,6 +83,9 @@ func New(db *gorm.DB, redis *redis.Client, cfg *config.Config, logger *logrus.Lo
 	services.MFA.SetNotificationService(services.Notification)
 	services.MFA.SetRedis(redis)
 
+	// CAS looks up sessions and memberships through the SSO service
+	services.CAS.SetSSOService(services.SSO)
+
 	// Set services reference for AutomationService
 	services.Automation.SetServices(services)
 
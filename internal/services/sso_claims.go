@@ -0,0 +1,155 @@
+package services
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"gorm.io/gorm"
+)
+
+// maxOrgDepth bounds the walk up the organization tree for org_path
+const maxOrgDepth = 32
+
+// buildUserInfo returns the claims released by the granted scope: those of
+// the standard OIDC scopes and of scopes defined in the registry.
+func (s *SSOService) buildUserInfo(user *models.User, scope string) map[string]interface{} {
+	claims := sso.ScopeClaims(scope, s.scopeDefinitions(scope))
+	src := &sso.ClaimSource{User: user}
+	for _, claim := range claims {
+		switch claim {
+		case sso.ClaimRoles:
+			src.Roles = s.userRoleNames(user.ID)
+		case sso.ClaimGroups:
+			src.Groups = s.userGroupNames(user.ID)
+		case sso.ClaimOrgPath:
+			src.OrgPaths = s.userOrgPaths(user.ID)
+		}
+	}
+	return sso.ReleaseClaims(src, claims)
+}
+
+// scopeDefinitions loads the registry entries of the granted scopes
+func (s *SSOService) scopeDefinitions(scope string) map[string][]string {
+	names := sso.ParseScopes(scope)
+	definitions := make(map[string][]string)
+	if len(names) == 0 {
+		return definitions
+	}
+	var scopes []models.OAuthScope
+	if err := s.db.Where("name IN ?", names).Find(&scopes).Error; err != nil {
+		s.logger.WithError(err).Error("Failed to load scope definitions")
+		return definitions
+	}
+	for _, sc := range scopes {
+		definitions[sc.Name] = sc.Claims
+	}
+	return definitions
+}
+
+// userRoleIDs is a subquery of the ids of the user's roles, including those
+// of its groups
+func (s *SSOService) userRoleIDs(userID uint64) *gorm.DB {
+	direct := s.db.Table("user_roles").Select("role_id").Where("user_id = ?", userID)
+	groups := s.db.Table("user_group_users").Select("user_group_id").Where("user_id = ?", userID)
+	viaGroups := s.db.Table("user_group_roles").Select("role_id").Where("user_group_id IN (?)", groups)
+	return s.db.Model(&models.Role{}).Select("id").Where("id IN (?) OR id IN (?)", direct, viaGroups)
+}
+
+// userRoleNames returns the user's roles, including those of its groups
+func (s *SSOService) userRoleNames(userID uint64) []string {
+	var names []string
+	s.db.Model(&models.Role{}).Where("id IN (?)", s.userRoleIDs(userID)).Order("name").Pluck("name", &names)
+	return names
+}
+
+// userHasPermission reports whether one of the user's roles grants the
+// permission on resource
+func (s *SSOService) userHasPermission(userID uint64, resource, action string) bool {
+	granted := s.db.Table("role_permissions").Select("permission_id").Where("role_id IN (?)", s.userRoleIDs(userID))
+	var count int64
+	s.db.Model(&models.Permission{}).Where("id IN (?) AND resource = ? AND action = ?", granted, resource, action).Count(&count)
+	return count > 0
+}
+
+// userPrivileged reports whether the user holds the admin role or any role
+// that grants permissions
+func (s *SSOService) userPrivileged(userID uint64) bool {
+	var count int64
+	s.db.Model(&models.Role{}).Where("id IN (?) AND name = ?", s.userRoleIDs(userID), "admin").Count(&count)
+	if count > 0 {
+		return true
+	}
+	s.db.Table("role_permissions").Where("role_id IN (?)", s.userRoleIDs(userID)).Count(&count)
+	return count > 0
+}
+
+func (s *SSOService) userGroupNames(userID uint64) []string {
+	var names []string
+	s.db.Model(&models.UserGroup{}).
+		Where("id IN (?)", s.db.Table("user_group_users").Select("user_group_id").Where("user_id = ?", userID)).
+		Order("name").Pluck("name", &names)
+	return names
+}
+
+// userOrgPaths returns the path of names from the root organization to each
+// organization the user belongs to, e.g. /Acme/Finance/Payments
+func (s *SSOService) userOrgPaths(userID uint64) []string {
+	var orgs []models.Organization
+	s.db.Where("id IN (?)", s.db.Table("user_organizations").Select("organization_id").Where("user_id = ?", userID)).
+		Order("id").Find(&orgs)
+
+	paths := make([]string, 0, len(orgs))
+	for _, org := range orgs {
+		names := []string{org.Name}
+		parentID := org.ParentID
+		for depth := 0; parentID != nil && depth < maxOrgDepth; depth++ {
+			var parent models.Organization
+			if err := s.db.Select("id", "name", "parent_id").First(&parent, *parentID).Error; err != nil {
+				break
+			}
+			names = append([]string{parent.Name}, names...)
+			parentID = parent.ParentID
+		}
+		paths = append(paths, "/"+strings.Join(names, "/"))
+	}
+	return paths
+}
+
+// checkClientScope rejects scopes the client is not registered for. On
+// failure the invalid_scope error response has been written.
+func (s *SSOService) checkClientScope(c *gin.Context, client *models.OAuthClient, scope string) bool {
+	if sso.ClientAllowsScope(client, scope) {
+		return true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":             "invalid_scope",
+		"error_description": "Client is not allowed to request the scope",
+	})
+	return false
+}
+
+// addRegistryScopes lists the registry's scopes and claims in the discovery document
+func (s *SSOService) addRegistryScopes(doc map[string]interface{}) {
+	var scopes []models.OAuthScope
+	if err := s.db.Order("name").Find(&scopes).Error; err != nil {
+		s.logger.WithError(err).Error("Failed to load scope definitions")
+		return
+	}
+	scopeNames, _ := doc["scopes_supported"].([]string)
+	claimNames, _ := doc["claims_supported"].([]string)
+	for _, sc := range scopes {
+		if !containsString(scopeNames, sc.Name) {
+			scopeNames = append(scopeNames, sc.Name)
+		}
+		for _, claim := range sc.Claims {
+			if !containsString(claimNames, claim) {
+				claimNames = append(claimNames, claim)
+			}
+		}
+	}
+	doc["scopes_supported"] = scopeNames
+	doc["claims_supported"] = claimNames
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+)
+
+const (
+	// jwksCacheExpiry is how long a client's jwks_uri document is reused
+	jwksCacheExpiry = 10 * time.Minute
+	// maxJWKSSize bounds the jwks_uri response body
+	maxJWKSSize = 1 << 20
+)
+
+// errNoClientCredentials is returned when the request carries no client
+// authentication at all, which some grants accept.
+var errNoClientCredentials = errors.New("no client credentials")
+
+// jwksHTTPClient fetches jwks_uri documents, which clients choose, so it
+// only reaches public addresses
+var jwksHTTPClient = sso.PublicHTTPClient(5 * time.Second)
+
+// hasClientCredentials reports whether the request presents any form of
+// client authentication.
+func hasClientCredentials(c *gin.Context) bool {
+	_, _, basic := c.Request.BasicAuth()
+	return basic || c.PostForm("client_secret") != "" || c.PostForm("client_assertion") != ""
+}
+
+// authenticateClient identifies and authenticates the client calling a
+// token endpoint with the method it registered: client_secret_basic,
+// client_secret_post, private_key_jwt, tls_client_auth or none for public
+// clients. Presenting more than one method is rejected (RFC 6749 section 2.3).
+func (s *SSOService) authenticateClient(c *gin.Context) (*models.OAuthClient, error) {
+	clientID := c.PostForm("client_id")
+	clientSecret := c.PostForm("client_secret")
+	assertion := c.PostForm("client_assertion")
+
+	var method string
+	methods := 0
+	if username, password, ok := c.Request.BasicAuth(); ok {
+		id, secret, err := sso.ParseBasicCredentials(username, password)
+		if err != nil {
+			return nil, errors.New("malformed basic credentials")
+		}
+		if clientID != "" && clientID != id {
+			return nil, errors.New("client_id does not match the basic credentials")
+		}
+		clientID, clientSecret = id, secret
+		method = sso.AuthMethodClientSecretBasic
+		methods++
+	}
+	if c.PostForm("client_secret") != "" {
+		method = sso.AuthMethodClientSecretPost
+		methods++
+	}
+	if assertion != "" || c.PostForm("client_assertion_type") != "" {
+		if c.PostForm("client_assertion_type") != sso.ClientAssertionType {
+			return nil, errors.New("unsupported client_assertion_type")
+		}
+		if clientID == "" {
+			// client_id is optional with an assertion, whose sub names the client
+			claims := jwt.MapClaims{}
+			if _, _, err := jwt.NewParser().ParseUnverified(assertion, claims); err != nil {
+				return nil, errors.New("malformed client assertion")
+			}
+			clientID, _ = claims["sub"].(string)
+		}
+		method = sso.AuthMethodPrivateKeyJWT
+		methods++
+	}
+	if methods > 1 {
+		return nil, errors.New("multiple client authentication methods")
+	}
+	if clientID == "" {
+		return nil, errNoClientCredentials
+	}
+
+	var client models.OAuthClient
+	if err := s.db.Where("client_id = ?", clientID).First(&client).Error; err != nil {
+		return nil, errors.New("invalid client credentials")
+	}
+
+	// A certificate is only checked when no other method was presented, as
+	// TLS connections may carry one regardless of the client's method
+	if methods == 0 && client.TokenEndpointAuthMethod == sso.AuthMethodTLSClientAuth {
+		method = sso.AuthMethodTLSClientAuth
+	} else if methods == 0 {
+		method = sso.AuthMethodNone
+	}
+	if !sso.ClientAllowsAuthMethod(&client, method) {
+		return nil, fmt.Errorf("client is not registered for %s authentication", method)
+	}
+
+	switch method {
+	case sso.AuthMethodClientSecretBasic, sso.AuthMethodClientSecretPost:
+		return sso.ValidateClient(s.db, clientID, clientSecret)
+	case sso.AuthMethodPrivateKeyJWT:
+		if err := s.verifyClientAssertion(c, &client, assertion); err != nil {
+			return nil, err
+		}
+	case sso.AuthMethodTLSClientAuth:
+		cert := s.clientCertificate(c)
+		if cert == nil || !sso.MatchSubjectDN(cert, client.TLSClientAuthSubjectDN) {
+			return nil, errors.New("client certificate does not match")
+		}
+	}
+	return &client, nil
+}
+
+// verifyClientAssertion checks a private_key_jwt assertion and records its
+// jti so it cannot be replayed while it is valid.
+func (s *SSOService) verifyClientAssertion(c *gin.Context, client *models.OAuthClient, assertion string) error {
+	issuer := s.config.OIDC.Issuer
+	audiences := []string{issuer, issuer + "/oauth2/token", issuer + c.Request.URL.Path}
+
+	ctx := c.Request.Context()
+	jwks := client.JWKS
+	fromURI := len(jwks) == 0
+	if fromURI {
+		var err error
+		if jwks, err = s.clientJWKS(ctx, client, false); err != nil {
+			return err
+		}
+	}
+
+	claims, err := sso.VerifyClientAssertion(assertion, client.ClientID, jwks, audiences, time.Now())
+	if err != nil && fromURI {
+		// The client may have rotated its keys since the set was cached
+		if jwks, err = s.clientJWKS(ctx, client, true); err != nil {
+			return err
+		}
+		claims, err = sso.VerifyClientAssertion(assertion, client.ClientID, jwks, audiences, time.Now())
+	}
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("oauth2:client_assertion:%s:%s", client.ClientID, claims.JTI)
+	ttl := time.Until(claims.ExpiresAt) + time.Minute
+	stored, err := s.redis.SetNX(ctx, key, "1", ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return errors.New("client assertion has already been used")
+	}
+	return nil
+}
+
+// clientJWKS returns the JWK Set published at the client's jwks_uri, cached
+// in Redis unless refresh is set.
+func (s *SSOService) clientJWKS(ctx context.Context, client *models.OAuthClient, refresh bool) (map[string]interface{}, error) {
+	if client.JWKSURI == "" {
+		return nil, errors.New("client has no jwks")
+	}
+	key := "oauth2:jwks:" + client.ClientID
+
+	var jwks map[string]interface{}
+	if !refresh {
+		if data, err := s.redis.Get(ctx, key).Bytes(); err == nil && json.Unmarshal(data, &jwks) == nil {
+			return jwks, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := jwksHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch client jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch client jwks: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxJWKSSize {
+		return nil, errors.New("client jwks is too large")
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("invalid client jwks: %w", err)
+	}
+
+	if err := s.redis.Set(ctx, key, data, jwksCacheExpiry).Err(); err != nil {
+		s.logger.WithError(err).Warn("Failed to cache client jwks")
+	}
+	return jwks, nil
+}
+
+// clientCertificate returns the verified TLS client certificate, either from
+// the connection or from the header set by a TLS terminating proxy.
+func (s *SSOService) clientCertificate(c *gin.Context) *x509.Certificate {
+	if tls := c.Request.TLS; tls != nil && len(tls.VerifiedChains) > 0 && len(tls.VerifiedChains[0]) > 0 {
+		return tls.VerifiedChains[0][0]
+	}
+	header := s.config.OIDC.MTLSClientCertHeader
+	if header == "" {
+		return nil
+	}
+	value := strings.TrimSpace(c.GetHeader(header))
+	if value == "" {
+		return nil
+	}
+	cert, err := sso.ParseClientCertificate(value)
+	if err != nil {
+		s.logger.WithError(err).Warn("Invalid forwarded client certificate")
+		return nil
+	}
+	return cert
+}
@@ -0,0 +1,226 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const consentRequestExpiry = 10 * time.Minute
+
+// ConsentedApp is a client the user has granted access to
+type ConsentedApp struct {
+	ClientID        string    `json:"client_id"`
+	ApplicationID   uint64    `json:"application_id"`
+	ApplicationName string    `json:"application_name"`
+	LogoURL         string    `json:"logo_url,omitempty"`
+	Scopes          []string  `json:"scopes"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// consentRequired reports whether the user must approve the authorization
+// request. First-party clients are pre-consented; prompt=consent always asks.
+func (s *SSOService) consentRequired(client *models.OAuthClient, userID uint64, scope, prompt string) bool {
+	if sso.HasPrompt(prompt, "consent") {
+		return true
+	}
+	if client.FirstParty {
+		return false
+	}
+
+	var consent models.OAuthConsent
+	if err := s.db.Where("user_id = ? AND client_id = ?", userID, client.ClientID).First(&consent).Error; err != nil {
+		return true
+	}
+	for _, requested := range sso.ParseScopes(scope) {
+		if !containsString(consent.Scopes, requested) {
+			return true
+		}
+	}
+	return false
+}
+
+// showConsent parks the pending authorization request in Redis and renders
+// the consent screen for it.
+func (s *SSOService) showConsent(c *gin.Context, client *models.OAuthClient, user *models.User, codeData map[string]interface{}, state string) {
+	ctx := c.Request.Context()
+	consentID := uuid.New().String()
+	consentKey := fmt.Sprintf("oauth2:consent:%s", consentID)
+
+	pending := make(map[string]interface{}, len(codeData)+1)
+	for k, v := range codeData {
+		pending[k] = v
+	}
+	pending["state"] = state
+	if err := s.redis.HSet(ctx, consentKey, pending).Err(); err != nil {
+		s.logger.WithError(err).Error("Failed to store consent request")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
+	}
+	s.redis.Expire(ctx, consentKey, consentRequestExpiry)
+
+	var app models.Application
+	clientName := client.ClientID
+	if err := s.db.First(&app, client.ApplicationID).Error; err == nil && app.Name != "" {
+		clientName = app.Name
+	}
+
+	s.renderPage(c, http.StatusOK, "consent", sso.ConsentPageData{
+		Title:      "Authorize " + clientName,
+		ClientName: clientName,
+		Username:   user.Username,
+		Scopes:     sso.ParseScopes(fmt.Sprintf("%v", codeData["scope"])),
+		ConsentID:  consentID,
+		CSRFToken:  s.issueFormToken(ctx, fmt.Sprintf("%d", user.ID)),
+	})
+}
+
+// OAuth2Consent handles the user's decision on the consent screen
+func (s *SSOService) OAuth2Consent(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+	owner := fmt.Sprintf("%v", userID)
+
+	ctx := c.Request.Context()
+	if !s.consumeFormToken(ctx, c.PostForm("csrf_token"), owner) {
+		s.renderPage(c, http.StatusBadRequest, "message", sso.MessagePageData{
+			Title:   "Request expired",
+			Message: "Your session has expired, please return to the application and try again.",
+		})
+		return
+	}
+
+	// The pending request is single use
+	consentKey := fmt.Sprintf("oauth2:consent:%s", c.PostForm("consent_id"))
+	pending, err := s.redis.HGetAll(ctx, consentKey).Result()
+	if err != nil || len(pending) == 0 || pending["user_id"] != owner {
+		s.renderPage(c, http.StatusBadRequest, "message", sso.MessagePageData{
+			Title:   "Request expired",
+			Message: "The authorization request has expired, please return to the application and try again.",
+		})
+		return
+	}
+	s.redis.Del(ctx, consentKey)
+
+	state := pending["state"]
+	if c.PostForm("action") != "approve" {
+		c.Redirect(http.StatusFound, sso.AppendQuery(pending["redirect_uri"], url.Values{
+			"error":             {"access_denied"},
+			"error_description": {"The user denied the request"},
+			"state":             {state},
+		}))
+		return
+	}
+
+	var id uint64
+	fmt.Sscanf(owner, "%d", &id)
+	if err := s.saveConsent(id, pending["client_id"], pending["scope"]); err != nil {
+		s.logger.WithError(err).Error("Failed to save consent")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
+	}
+
+	delete(pending, "state")
+	codeData := make(map[string]interface{}, len(pending))
+	for k, v := range pending {
+		codeData[k] = v
+	}
+	s.redirectWithCode(c, codeData, state)
+}
+
+// saveConsent adds the scopes to the user's grant for the client
+func (s *SSOService) saveConsent(userID uint64, clientID, scope string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var consent models.OAuthConsent
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ? AND client_id = ?", userID, clientID).First(&consent).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		scopes := consent.Scopes
+		for _, requested := range sso.ParseScopes(scope) {
+			if !containsString(scopes, requested) {
+				scopes = append(scopes, requested)
+			}
+		}
+		sort.Strings(scopes)
+
+		if err == gorm.ErrRecordNotFound {
+			return tx.Create(&models.OAuthConsent{UserID: userID, ClientID: clientID, Scopes: scopes}).Error
+		}
+		consent.Scopes = scopes
+		return tx.Save(&consent).Error
+	})
+}
+
+// ListConsents returns the clients the user has granted access to
+func (s *SSOService) ListConsents(userID uint64) ([]ConsentedApp, error) {
+	var consents []models.OAuthConsent
+	if err := s.db.Where("user_id = ?", userID).Order("updated_at DESC").Find(&consents).Error; err != nil {
+		return nil, err
+	}
+
+	apps := make([]ConsentedApp, 0, len(consents))
+	for _, consent := range consents {
+		app := ConsentedApp{
+			ClientID:  consent.ClientID,
+			Scopes:    consent.Scopes,
+			CreatedAt: consent.CreatedAt,
+			UpdatedAt: consent.UpdatedAt,
+		}
+		var client models.OAuthClient
+		if err := s.db.Preload("Application").Where("client_id = ?", consent.ClientID).First(&client).Error; err == nil {
+			app.ApplicationID = client.ApplicationID
+			app.ApplicationName = client.Application.Name
+			app.LogoURL = client.Application.LogoURL
+		}
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+// RevokeConsent removes the user's grant for the client and revokes every
+// token the client holds for the user.
+func (s *SSOService) RevokeConsent(ctx context.Context, userID uint64, clientID string) error {
+	result := s.db.Where("user_id = ? AND client_id = ?", userID, clientID).Delete(&models.OAuthConsent{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	var tokens []models.OAuthToken
+	if err := s.db.Where("user_id = ? AND client_id = ? AND revoked = ?", userID, clientID, false).Find(&tokens).Error; err != nil {
+		return err
+	}
+	return revokeOAuthTokens(ctx, s.db, s.redis, tokens)
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
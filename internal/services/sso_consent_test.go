@@ -0,0 +1,111 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSOService_ConsentRequired(t *testing.T) {
+	svcs := setupSSOTest(t)
+	user := createTestUser(t, svcs.DB, "alice")
+	client := createConfidentialClient(t, svcs.DB, "web", "web-secret")
+	firstParty := createConfidentialClient(t, svcs.DB, "portal", "portal-secret")
+	firstParty.FirstParty = true
+	require.NoError(t, svcs.DB.Save(firstParty).Error)
+
+	// Nothing granted yet
+	assert.True(t, svcs.SSO.consentRequired(client, user.ID, "openid", ""))
+
+	require.NoError(t, svcs.DB.Create(&models.OAuthConsent{
+		UserID:   user.ID,
+		ClientID: "web",
+		Scopes:   models.StringArray{"openid", "profile"},
+	}).Error)
+	assert.False(t, svcs.SSO.consentRequired(client, user.ID, "openid profile", ""))
+	assert.False(t, svcs.SSO.consentRequired(client, user.ID, "openid", "login"))
+	// A scope beyond the grant or prompt=consent asks again
+	assert.True(t, svcs.SSO.consentRequired(client, user.ID, "openid email", ""))
+	assert.True(t, svcs.SSO.consentRequired(client, user.ID, "openid", "login consent"))
+
+	// First-party clients only ask when prompted to
+	assert.False(t, svcs.SSO.consentRequired(firstParty, user.ID, "openid email", ""))
+	assert.True(t, svcs.SSO.consentRequired(firstParty, user.ID, "openid", "consent"))
+}
+
+func TestSSOService_AuthorizePrompt(t *testing.T) {
+	svcs := setupSSOTest(t)
+	user := createTestUser(t, svcs.DB, "alice")
+	createConfidentialClient(t, svcs.DB, "web", "web-secret")
+
+	authorize := func(prompt string, loggedIn bool) *httptest.ResponseRecorder {
+		query := url.Values{
+			"client_id":     {"web"},
+			"response_type": {"code"},
+			"redirect_uri":  {"https://web.example.com/callback"},
+			"scope":         {"openid"},
+			"state":         {"xyz"},
+		}
+		if prompt != "" {
+			query.Set("prompt", prompt)
+		}
+		return performRequest(svcs.SSO.OAuth2Authorize, http.MethodGet, "/oauth2/authorize?"+query.Encode(), nil, func(c *gin.Context) {
+			if loggedIn {
+				c.Set("user_id", user.ID)
+			}
+		})
+	}
+	redirected := func(prompt string, loggedIn bool) *url.URL {
+		w := authorize(prompt, loggedIn)
+		require.Equal(t, http.StatusFound, w.Code)
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		return location
+	}
+
+	t.Run("none with other values", func(t *testing.T) {
+		location := redirected("none login", true)
+		assert.Equal(t, "invalid_request", location.Query().Get("error"))
+		assert.Equal(t, "xyz", location.Query().Get("state"))
+		assert.Equal(t, "invalid_request", redirected("consent none", false).Query().Get("error"))
+	})
+
+	t.Run("none without a session", func(t *testing.T) {
+		assert.Equal(t, "login_required", redirected("none", false).Query().Get("error"))
+	})
+
+	t.Run("none without consent", func(t *testing.T) {
+		assert.Equal(t, "consent_required", redirected("none", true).Query().Get("error"))
+	})
+
+	t.Run("login", func(t *testing.T) {
+		location := redirected("login", true)
+		assert.Equal(t, "/login", location.Path)
+		// The request resumes without prompt=login
+		returnTo, err := url.Parse(location.Query().Get("redirect"))
+		require.NoError(t, err)
+		assert.Empty(t, returnTo.Query().Get("prompt"))
+	})
+
+	t.Run("consent screen", func(t *testing.T) {
+		w := authorize("", true)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "csrf_token")
+	})
+
+	t.Run("none with consent", func(t *testing.T) {
+		require.NoError(t, svcs.SSO.saveConsent(user.ID, "web", "openid"))
+		location := redirected("none", true)
+		assert.Empty(t, location.Query().Get("error"))
+		assert.NotEmpty(t, location.Query().Get("code"))
+
+		// prompt=consent asks again even though consent was given
+		assert.Equal(t, http.StatusOK, authorize("consent", true).Code)
+	})
+}
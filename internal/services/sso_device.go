@@ -0,0 +1,362 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+)
+
+const (
+	deviceCodeExpiry   = 10 * time.Minute
+	devicePollInterval = 5 // seconds
+
+	// User codes are short enough to guess, so wrong entries are limited per
+	// user and per IP address (which many users may share behind a NAT)
+	deviceUserCodeUserAttempts = 5
+	deviceUserCodeIPAttempts   = 20
+	deviceUserCodeWindow       = 15 * time.Minute
+)
+
+// OAuth2DeviceAuthorization starts the device authorization grant (RFC 8628)
+func (s *SSOService) OAuth2DeviceAuthorization(c *gin.Context) {
+	scope := c.PostForm("scope")
+
+	oauthClient, err := s.authenticateClient(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":             "invalid_client",
+			"error_description": "Invalid client credentials",
+		})
+		return
+	}
+	clientID := oauthClient.ClientID
+
+	if !sso.ClientAllowsGrant(oauthClient, sso.GrantTypeDeviceCode) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "unauthorized_client",
+			"error_description": "Client is not allowed to use the device authorization grant",
+		})
+		return
+	}
+	if !s.checkClientScope(c, oauthClient, scope) {
+		return
+	}
+
+	deviceCode := sso.GenerateAuthorizationCode()
+	userCode := sso.GenerateUserCode()
+	expiresAt := time.Now().Add(deviceCodeExpiry)
+
+	ctx := c.Request.Context()
+	deviceKey := fmt.Sprintf("oauth2:device:%s", deviceCode)
+	deviceData := map[string]interface{}{
+		"client_id":  clientID,
+		"scope":      scope,
+		"user_code":  sso.NormalizeUserCode(userCode),
+		"status":     "pending",
+		"interval":   devicePollInterval,
+		"last_poll":  0,
+		"expires_at": expiresAt.Unix(),
+	}
+	if err := s.redis.HSet(ctx, deviceKey, deviceData).Err(); err != nil {
+		s.logger.WithError(err).Error("Failed to store device code")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
+	}
+	s.redis.Expire(ctx, deviceKey, deviceCodeExpiry)
+	s.redis.Set(ctx, fmt.Sprintf("oauth2:device:user_code:%s", sso.NormalizeUserCode(userCode)), deviceCode, deviceCodeExpiry)
+
+	verificationURI := s.config.OIDC.Issuer + "/oauth2/device"
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + url.QueryEscape(userCode),
+		"expires_in":                int(deviceCodeExpiry.Seconds()),
+		"interval":                  devicePollInterval,
+	})
+}
+
+// OAuth2DeviceVerify serves the page where users enter the user code shown on
+// their device and approve or deny the request.
+func (s *SSOService) OAuth2DeviceVerify(c *gin.Context) {
+	// Tokens of logged out sessions no longer count
+	userID, exists := c.Get("user_id")
+	if sessionID := c.GetString("session_id"); exists && sessionID != "" && !s.sessionActive(sessionID) {
+		exists = false
+	}
+	if !exists {
+		if c.Request.Method != http.MethodGet {
+			c.Redirect(http.StatusFound, "/oauth2/device")
+			return
+		}
+		s.redirectToLogin(c)
+		return
+	}
+
+	ctx := c.Request.Context()
+	userCode := c.Query("user_code")
+	if c.Request.Method == http.MethodPost {
+		userCode = c.PostForm("user_code")
+	}
+
+	page := sso.DevicePageData{Title: "Connect a device", UserCode: userCode}
+	if userCode == "" {
+		s.renderPage(c, http.StatusOK, "device", page)
+		return
+	}
+
+	attempts := map[string]int64{
+		fmt.Sprintf("oauth2:device:attempts:user:%v", userID):     deviceUserCodeUserAttempts,
+		fmt.Sprintf("oauth2:device:attempts:ip:%s", c.ClientIP()): deviceUserCodeIPAttempts,
+	}
+	for key, limit := range attempts {
+		if count, _ := s.redis.Get(ctx, key).Int64(); count >= limit {
+			page.Error = "Too many invalid codes. Please wait a few minutes and try again."
+			s.renderPage(c, http.StatusTooManyRequests, "device", page)
+			return
+		}
+	}
+
+	normalized := sso.NormalizeUserCode(userCode)
+	deviceCode, err := s.redis.Get(ctx, fmt.Sprintf("oauth2:device:user_code:%s", normalized)).Result()
+	deviceKey := fmt.Sprintf("oauth2:device:%s", deviceCode)
+	deviceData, _ := s.redis.HGetAll(ctx, deviceKey).Result()
+	if err != nil || len(deviceData) == 0 || deviceData["status"] != "pending" {
+		for key := range attempts {
+			if count, _ := s.redis.Incr(ctx, key).Result(); count == 1 {
+				s.redis.Expire(ctx, key, deviceUserCodeWindow)
+			}
+		}
+		page.Error = "The code is invalid or has expired."
+		s.renderPage(c, http.StatusBadRequest, "device", page)
+		return
+	}
+
+	if c.Request.Method != http.MethodPost {
+		var oauthClient models.OAuthClient
+		if err := s.db.Preload("Application").Where("client_id = ?", deviceData["client_id"]).First(&oauthClient).Error; err != nil {
+			page.Error = "The code is invalid or has expired."
+			s.renderPage(c, http.StatusBadRequest, "device", page)
+			return
+		}
+		page.ClientName = oauthClient.Application.Name
+		if page.ClientName == "" {
+			page.ClientName = oauthClient.ClientID
+		}
+		page.Scopes = sso.ParseScopes(deviceData["scope"])
+		page.CSRFToken = s.issueFormToken(ctx, fmt.Sprintf("%v", userID))
+		s.renderPage(c, http.StatusOK, "device", page)
+		return
+	}
+
+	if !s.consumeFormToken(ctx, c.PostForm("csrf_token"), fmt.Sprintf("%v", userID)) {
+		page.Error = "Your session has expired, please try again."
+		s.renderPage(c, http.StatusBadRequest, "device", page)
+		return
+	}
+
+	// The user code is single use whatever the decision
+	s.redis.Del(ctx, fmt.Sprintf("oauth2:device:user_code:%s", normalized))
+
+	if c.PostForm("action") != "approve" {
+		s.redis.HSet(ctx, deviceKey, "status", "denied")
+		s.renderPage(c, http.StatusOK, "message", sso.MessagePageData{
+			Title:   "Access denied",
+			Message: "The device was not connected. You can close this window.",
+		})
+		return
+	}
+
+	var user models.User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		page.Error = "User not found."
+		s.renderPage(c, http.StatusBadRequest, "device", page)
+		return
+	}
+	authTime := c.GetInt64("auth_time")
+	if authTime == 0 {
+		authTime = time.Now().Unix()
+	}
+	acr, amr := s.authenticationContext(&user)
+	s.redis.HSet(ctx, deviceKey, map[string]interface{}{
+		"status":    "approved",
+		"user_id":   user.ID,
+		"auth_time": authTime,
+		"acr":       acr,
+		"amr":       strings.Join(amr, " "),
+	})
+	if err := s.saveConsent(user.ID, deviceData["client_id"], deviceData["scope"]); err != nil {
+		s.logger.WithError(err).Error("Failed to save consent")
+	}
+
+	s.renderPage(c, http.StatusOK, "message", sso.MessagePageData{
+		Title:   "Device connected",
+		Message: "You can close this window and return to your device.",
+	})
+}
+
+// OAuth2DeviceToken handles the device_code grant polled by the device
+func (s *SSOService) OAuth2DeviceToken(c *gin.Context) {
+	deviceCode := c.PostForm("device_code")
+
+	oauthClient, err := s.authenticateClient(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":             "invalid_client",
+			"error_description": "Invalid client credentials",
+		})
+		return
+	}
+	clientID := oauthClient.ClientID
+	if !sso.ClientAllowsGrant(oauthClient, sso.GrantTypeDeviceCode) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "unauthorized_client",
+			"error_description": "Client is not allowed to use the device authorization grant",
+		})
+		return
+	}
+	dpopJKT, ok := s.tokenDPoPKey(c, oauthClient)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	deviceKey := fmt.Sprintf("oauth2:device:%s", deviceCode)
+	deviceData, err := s.redis.HGetAll(ctx, deviceKey).Result()
+	if err != nil || len(deviceData) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "expired_token",
+			"error_description": "The device code has expired",
+		})
+		return
+	}
+
+	if deviceData["client_id"] != clientID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_grant",
+			"error_description": "Device code was issued to another client",
+		})
+		return
+	}
+
+	// Enforce the polling interval, backing off by 5 seconds on every violation
+	var interval, lastPoll int64
+	fmt.Sscanf(deviceData["interval"], "%d", &interval)
+	fmt.Sscanf(deviceData["last_poll"], "%d", &lastPoll)
+	now := time.Now().Unix()
+	s.redis.HSet(ctx, deviceKey, "last_poll", now)
+	if lastPoll != 0 && now-lastPoll < interval {
+		s.redis.HIncrBy(ctx, deviceKey, "interval", 5)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "slow_down",
+			"error_description": "Polling too frequently",
+		})
+		return
+	}
+
+	switch deviceData["status"] {
+	case "pending":
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "authorization_pending",
+		})
+		return
+	case "denied":
+		s.redis.Del(ctx, deviceKey)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "access_denied",
+			"error_description": "The user denied the request",
+		})
+		return
+	}
+
+	// Approved: the device code is single use
+	if deleted, _ := s.redis.Del(ctx, deviceKey).Result(); deleted == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "expired_token",
+			"error_description": "The device code has expired",
+		})
+		return
+	}
+
+	var userID uint64
+	fmt.Sscanf(deviceData["user_id"], "%d", &userID)
+	var user models.User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_grant",
+			"error_description": "User not found",
+		})
+		return
+	}
+
+	oauthToken, err := s.issueTokens(ctx, &tokenGrant{
+		ClientID: clientID,
+		UserID:   &user.ID,
+		Scope:    deviceData["scope"],
+		Refresh:  true,
+		AuthData: deviceData,
+		DPoPJKT:  dpopJKT,
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to issue tokens")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
+	}
+	response := tokenResponse(oauthToken)
+
+	if sso.HasScope(deviceData["scope"], "openid") {
+		idToken, err := s.issueIDToken(&user, clientID, deviceData["scope"], accessTokenValue(oauthToken), deviceData)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to issue ID token")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "server_error",
+			})
+			return
+		}
+		response["id_token"] = idToken
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *SSOService) renderPage(c *gin.Context, status int, name string, data interface{}) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Cache-Control", "no-store")
+	c.Status(status)
+	if err := sso.RenderPage(c.Writer, name, data); err != nil {
+		s.logger.WithError(err).Error("Failed to render page")
+	}
+}
+
+// issueFormToken creates a single-use anti-CSRF token bound to the user for
+// the server-rendered pages.
+func (s *SSOService) issueFormToken(ctx context.Context, owner string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	token := base64.RawURLEncoding.EncodeToString(b)
+	s.redis.Set(ctx, fmt.Sprintf("oauth2:form:%s", token), owner, 10*time.Minute)
+	return token
+}
+
+func (s *SSOService) consumeFormToken(ctx context.Context, token, owner string) bool {
+	if token == "" {
+		return false
+	}
+	stored, err := s.redis.GetDel(ctx, fmt.Sprintf("oauth2:form:%s", token)).Result()
+	return err == nil && stored == owner
+}
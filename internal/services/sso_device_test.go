@@ -0,0 +1,130 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSOService_DeviceGrant(t *testing.T) {
+	svcs := setupSSOTest(t)
+	user := createTestUser(t, svcs.DB, "alice")
+	client := createPublicClient(t, svcs.DB, "tv")
+	client.GrantTypes = models.StringArray{sso.GrantTypeDeviceCode, "refresh_token"}
+	require.NoError(t, svcs.DB.Save(client).Error)
+	ctx := t.Context()
+
+	authorize := func() (string, string) {
+		w := performRequest(svcs.SSO.OAuth2DeviceAuthorization, http.MethodPost, "/oauth2/device_authorization", url.Values{
+			"client_id": {"tv"},
+			"scope":     {"profile"},
+		}, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		body := decodeJSON(t, w)
+		return body["device_code"].(string), body["user_code"].(string)
+	}
+	poll := func(deviceCode string) *httptest.ResponseRecorder {
+		return performRequest(svcs.SSO.OAuth2DeviceToken, http.MethodPost, "/oauth2/token", url.Values{
+			"grant_type":  {sso.GrantTypeDeviceCode},
+			"device_code": {deviceCode},
+			"client_id":   {"tv"},
+		}, nil)
+	}
+	// allowPoll clears the last poll so that the next one respects the interval
+	allowPoll := func(deviceCode string) {
+		svcs.Redis.HSet(ctx, "oauth2:device:"+deviceCode, "last_poll", 0)
+	}
+	asUser := func(c *gin.Context) {
+		c.Set("user_id", user.ID)
+		c.Request.RemoteAddr = "192.0.2.1:1234"
+	}
+	decide := func(userCode, action string) *httptest.ResponseRecorder {
+		return performRequest(svcs.SSO.OAuth2DeviceVerify, http.MethodPost, "/oauth2/device", url.Values{
+			"user_code":  {userCode},
+			"action":     {action},
+			"csrf_token": {svcs.SSO.issueFormToken(ctx, fmt.Sprintf("%v", user.ID))},
+		}, asUser)
+	}
+	errorCode := func(w *httptest.ResponseRecorder) interface{} {
+		return decodeJSON(t, w)["error"]
+	}
+
+	t.Run("pending, slow_down and approval", func(t *testing.T) {
+		deviceCode, userCode := authorize()
+
+		w := poll(deviceCode)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "authorization_pending", errorCode(w))
+
+		// Polling again right away backs off the interval
+		assert.Equal(t, "slow_down", errorCode(poll(deviceCode)))
+		interval, _ := svcs.Redis.HGet(ctx, "oauth2:device:"+deviceCode, "interval").Int()
+		assert.Equal(t, devicePollInterval+5, interval)
+
+		w = performRequest(svcs.SSO.OAuth2DeviceVerify, http.MethodGet, "/oauth2/device?user_code="+url.QueryEscape(userCode), nil, asUser)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "csrf_token")
+
+		require.Equal(t, http.StatusOK, decide(userCode, "approve").Code)
+		allowPoll(deviceCode)
+		w = poll(deviceCode)
+		require.Equal(t, http.StatusOK, w.Code)
+		body := decodeJSON(t, w)
+		assert.NotEmpty(t, body["access_token"])
+		assert.NotEmpty(t, body["refresh_token"])
+
+		// The device code and the user code are single use
+		assert.Equal(t, "expired_token", errorCode(poll(deviceCode)))
+		assert.Equal(t, http.StatusBadRequest, decide(userCode, "approve").Code)
+	})
+
+	t.Run("access_denied", func(t *testing.T) {
+		deviceCode, userCode := authorize()
+		require.Equal(t, http.StatusOK, decide(userCode, "deny").Code)
+		assert.Equal(t, "access_denied", errorCode(poll(deviceCode)))
+		assert.Equal(t, "expired_token", errorCode(poll(deviceCode)))
+	})
+
+	t.Run("expired_token", func(t *testing.T) {
+		deviceCode, _ := authorize()
+		svcs.Redis.Del(ctx, "oauth2:device:"+deviceCode)
+		assert.Equal(t, "expired_token", errorCode(poll(deviceCode)))
+	})
+
+	t.Run("logged out session cannot approve", func(t *testing.T) {
+		deviceCode, userCode := authorize()
+		form := url.Values{
+			"user_code":  {userCode},
+			"action":     {"approve"},
+			"csrf_token": {svcs.SSO.issueFormToken(ctx, fmt.Sprintf("%v", user.ID))},
+		}
+		// The cookie names a session that no longer exists
+		w := performRequest(svcs.SSO.OAuth2DeviceVerify, http.MethodPost, "/oauth2/device", form, func(c *gin.Context) {
+			asUser(c)
+			c.Set("session_id", "sid-logged-out")
+		})
+		assert.Equal(t, "/oauth2/device", w.Header().Get("Location"))
+		assert.Equal(t, "pending", svcs.Redis.HGet(ctx, "oauth2:device:"+deviceCode, "status").Val())
+		allowPoll(deviceCode)
+		assert.Equal(t, "authorization_pending", errorCode(poll(deviceCode)))
+	})
+
+	t.Run("user code entry is limited", func(t *testing.T) {
+		// Start from no failures; the single use check above counted one
+		svcs.Redis.Del(ctx, fmt.Sprintf("oauth2:device:attempts:user:%d", user.ID), "oauth2:device:attempts:ip:192.0.2.1")
+		_, userCode := authorize()
+		for i := 0; i < deviceUserCodeUserAttempts; i++ {
+			assert.Equal(t, http.StatusBadRequest, decide(fmt.Sprintf("WRONG-%04d", i), "approve").Code)
+		}
+		// Once the limit is reached even the right code is refused
+		assert.Equal(t, http.StatusTooManyRequests, decide(userCode, "approve").Code)
+	})
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+)
+
+// dpopError is a rejected DPoP proof, with the OAuth error code to return
+type dpopError struct {
+	code        string
+	description string
+}
+
+func (e *dpopError) Error() string {
+	return e.description
+}
+
+// verifyDPoP checks the DPoP proof sent with the request, if any, and its
+// nonce when nonces are required. accessToken is the token the proof
+// accompanies at a resource. It returns nil when the request has no proof.
+func (s *SSOService) verifyDPoP(c *gin.Context, accessToken string) (*sso.DPoPProof, error) {
+	proofs := c.Request.Header.Values("DPoP")
+	if len(proofs) == 0 {
+		return nil, nil
+	}
+	if len(proofs) > 1 {
+		return nil, &dpopError{"invalid_dpop_proof", "Only one DPoP proof may be sent"}
+	}
+	proof, err := s.checkDPoPProof(c, proofs[0], c.Request.Method, s.config.OIDC.Issuer+c.Request.URL.Path, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.OIDC.DPoPRequireNonce && !sso.CheckDPoPNonce(s.dpopNonceKey(), proof.Nonce, time.Now()) {
+		return nil, &dpopError{"use_dpop_nonce", "DPoP proof must carry the nonce from the DPoP-Nonce header"}
+	}
+	return proof, nil
+}
+
+// checkDPoPProof verifies a proof for a request to uri and records its jti so
+// it cannot be replayed
+func (s *SSOService) checkDPoPProof(c *gin.Context, proof, method, uri, accessToken string) (*sso.DPoPProof, error) {
+	verified, err := sso.VerifyDPoPProof(proof, method, uri, accessToken, time.Now())
+	if err != nil {
+		return nil, &dpopError{"invalid_dpop_proof", err.Error()}
+	}
+
+	replayKey := fmt.Sprintf("oauth2:dpop:jti:%s:%s", verified.JKT, verified.JTI)
+	fresh, err := s.redis.SetNX(c.Request.Context(), replayKey, 1, sso.DPoPProofMaxAge+time.Minute).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to record DPoP proof: %w", err)
+	}
+	if !fresh {
+		return nil, &dpopError{"invalid_dpop_proof", "DPoP proof has already been used"}
+	}
+	return verified, nil
+}
+
+// dpopNonceKey authenticates server-issued DPoP nonces
+func (s *SSOService) dpopNonceKey() []byte {
+	sum := sha256.Sum256([]byte("dpop-nonce:" + s.config.JWT.Secret))
+	return sum[:]
+}
+
+// setDPoPNonce hands the client a fresh nonce for its next proof
+func (s *SSOService) setDPoPNonce(c *gin.Context) {
+	if s.config.OIDC.DPoPRequireNonce {
+		c.Header("DPoP-Nonce", sso.NewDPoPNonce(s.dpopNonceKey(), time.Now()))
+	}
+}
+
+// tokenDPoPKey verifies the DPoP proof of a token request and returns the
+// thumbprint to bind the issued tokens to, or "" for bearer tokens. On
+// failure the error response has been written.
+func (s *SSOService) tokenDPoPKey(c *gin.Context, client *models.OAuthClient) (string, bool) {
+	proof, err := s.verifyDPoP(c, "")
+	if err != nil {
+		s.dpopTokenError(c, err)
+		return "", false
+	}
+	if proof == nil {
+		if client != nil && client.DPoPBoundAccessTokens {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":             "invalid_dpop_proof",
+				"error_description": "Client requires DPoP-bound access tokens",
+			})
+			return "", false
+		}
+		return "", true
+	}
+	s.setDPoPNonce(c)
+	return proof.JKT, true
+}
+
+// dpopTokenError writes the token endpoint response for a rejected proof
+func (s *SSOService) dpopTokenError(c *gin.Context, err error) {
+	var dErr *dpopError
+	if !errors.As(err, &dErr) {
+		s.logger.WithError(err).Error("Failed to verify DPoP proof")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	if dErr.code == "use_dpop_nonce" {
+		s.setDPoPNonce(c)
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":             dErr.code,
+		"error_description": dErr.description,
+	})
+}
+
+// checkTokenBinding verifies that an access token is presented the way it was
+// issued: DPoP-bound tokens with the DPoP scheme and a proof of the bound key,
+// others as bearer tokens. On failure the 401 response has been written.
+func (s *SSOService) checkTokenBinding(c *gin.Context, scheme, token, jkt string) bool {
+	if jkt == "" {
+		if scheme == "DPoP" {
+			s.dpopResourceError(c, &dpopError{"invalid_token", "Access token is not DPoP-bound"})
+			return false
+		}
+		return true
+	}
+	if scheme != "DPoP" {
+		s.dpopResourceError(c, &dpopError{"invalid_token", "DPoP-bound access token must be sent with the DPoP scheme"})
+		return false
+	}
+
+	proof, err := s.verifyDPoP(c, token)
+	if err == nil && proof == nil {
+		err = &dpopError{"invalid_dpop_proof", "DPoP proof is required"}
+	}
+	if err == nil && proof.JKT != jkt {
+		err = &dpopError{"invalid_dpop_proof", "DPoP proof key does not match the access token"}
+	}
+	if err != nil {
+		s.dpopResourceError(c, err)
+		return false
+	}
+	s.setDPoPNonce(c)
+	return true
+}
+
+// dpopResourceError writes the 401 response of a protected resource for a
+// rejected DPoP presentation (RFC 9449 section 7.1)
+func (s *SSOService) dpopResourceError(c *gin.Context, err error) {
+	var dErr *dpopError
+	if !errors.As(err, &dErr) {
+		s.logger.WithError(err).Error("Failed to verify DPoP proof")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	if dErr.code == "use_dpop_nonce" {
+		s.setDPoPNonce(c)
+	}
+	c.Header("WWW-Authenticate", fmt.Sprintf(`DPoP error="%s", algs="%s"`, dErr.code, strings.Join(sso.ClientAssertionAlgs, " ")))
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"error":             dErr.code,
+		"error_description": dErr.description,
+	})
+}
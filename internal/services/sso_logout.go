@@ -0,0 +1,382 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hanyouqing/openauth/internal/auth"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// logoutDeliveryInterval is how often failed back-channel deliveries are retried
+	logoutDeliveryInterval = 30 * time.Second
+	// logoutDeliveryTimeout bounds one back-channel logout request
+	logoutDeliveryTimeout = 5 * time.Second
+)
+
+// Logout endpoints must answer directly (Back-Channel Logout section 2.8),
+// which PublicHTTPClient enforces by not following redirects
+var logoutHTTPClient = sso.PublicHTTPClient(logoutDeliveryTimeout)
+
+// trackSessionClient records that the client received tokens in the user's
+// login session so it is notified when the session ends.
+func (s *SSOService) trackSessionClient(sessionID, clientID string, userID uint64) {
+	if sessionID == "" {
+		return
+	}
+	row := models.OIDCSessionClient{SessionID: sessionID, ClientID: clientID, UserID: userID}
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&row).Error; err != nil {
+		s.logger.WithError(err).Warn("Failed to record session client")
+	}
+}
+
+// sessionActive reports whether the login session has not been logged out
+func (s *SSOService) sessionActive(sessionID string) bool {
+	var count int64
+	s.db.Model(&models.Session{}).Where("sid = ?", sessionID).Count(&count)
+	return count > 0
+}
+
+// hintedSession returns the user and login session named by the sub and sid
+// of an id_token_hint when that session is still active
+func (s *SSOService) hintedSession(hint map[string]interface{}) (string, string, bool) {
+	subject, _ := hint["sub"].(string)
+	sessionID, _ := hint["sid"].(string)
+	userID, err := strconv.ParseUint(subject, 10, 64)
+	if err != nil || sessionID == "" {
+		return "", "", false
+	}
+	var count int64
+	s.db.Model(&models.Session{}).Where("sid = ? AND user_id = ?", sessionID, userID).Count(&count)
+	return subject, sessionID, count > 0
+}
+
+// OIDCEndSession is the end_session_endpoint of OpenID Connect RP-Initiated
+// Logout 1.0. Without a valid id_token_hint for the current user the logout
+// must be confirmed on a CSRF protected page. Clients in the session are
+// notified through front-channel iframes and back-channel logout tokens.
+func (s *SSOService) OIDCEndSession(c *gin.Context) {
+	ctx := c.Request.Context()
+	idTokenHint := c.Request.FormValue("id_token_hint")
+	clientID := c.Request.FormValue("client_id")
+	redirectURI := c.Request.FormValue("post_logout_redirect_uri")
+	state := c.Request.FormValue("state")
+
+	var hint map[string]interface{}
+	if idTokenHint != "" {
+		var claims jwt.MapClaims
+		err := errors.New("no signing key available")
+		if s.signingKey != nil {
+			claims, err = sso.ParseIDTokenHint(idTokenHint, &s.signingKey.PrivateKey.PublicKey, s.config.OIDC.Issuer)
+		}
+		if err != nil {
+			s.renderPage(c, http.StatusBadRequest, "message", sso.MessagePageData{
+				Title:   "Invalid logout request",
+				Message: "The id_token_hint is not valid.",
+			})
+			return
+		}
+		hint = claims
+		aud, _ := claims.GetAudience()
+		if clientID == "" && len(aud) == 1 {
+			clientID = aud[0]
+		} else if clientID != "" && !containsString(aud, clientID) {
+			s.renderPage(c, http.StatusBadRequest, "message", sso.MessagePageData{
+				Title:   "Invalid logout request",
+				Message: "client_id does not match the id_token_hint.",
+			})
+			return
+		}
+	}
+
+	// post_logout_redirect_uri must be registered by the identified client
+	var client *models.OAuthClient
+	if clientID != "" {
+		var oauthClient models.OAuthClient
+		if err := s.db.Where("client_id = ?", clientID).First(&oauthClient).Error; err == nil {
+			client = &oauthClient
+		}
+	}
+	if redirectURI != "" && (client == nil || !sso.ValidatePostLogoutRedirectURI(client, redirectURI)) {
+		s.renderPage(c, http.StatusBadRequest, "message", sso.MessagePageData{
+			Title:   "Invalid logout request",
+			Message: "The post_logout_redirect_uri is not registered for this client.",
+		})
+		return
+	}
+	if redirectURI != "" && state != "" {
+		redirectURI = sso.AppendQuery(redirectURI, url.Values{"state": {state}})
+	}
+
+	userID, loggedIn := c.Get("user_id")
+	owner := fmt.Sprintf("%v", userID)
+	sessionID := c.GetString("session_id")
+	if loggedIn && sessionID != "" && !s.sessionActive(sessionID) {
+		// The cookie outlived its session
+		auth.ClearSessionCookie(c)
+		loggedIn = false
+	}
+
+	// A hint for the current user proves the request comes from its RP.
+	// Otherwise the user confirms, so third parties cannot log users out.
+	confirmed := loggedIn && hint != nil && fmt.Sprintf("%v", hint["sub"]) == owner
+	if !loggedIn {
+		// Without a browser session, e.g. when the RP's cookie is not sent,
+		// the hint's sid names the session to end
+		var ok bool
+		if owner, sessionID, ok = s.hintedSession(hint); !ok {
+			s.renderPage(c, http.StatusOK, "logged_out", sso.LoggedOutPageData{
+				Title:       "Not signed out",
+				Message:     "No session was ended because you are not signed in.",
+				RedirectURI: redirectURI,
+			})
+			return
+		}
+		confirmed = true
+	}
+	if !confirmed && c.Request.Method == http.MethodPost && c.PostForm("csrf_token") != "" {
+		if !s.consumeFormToken(ctx, c.PostForm("csrf_token"), owner) {
+			s.renderPage(c, http.StatusBadRequest, "message", sso.MessagePageData{
+				Title:   "Request expired",
+				Message: "The logout request has expired, please try again.",
+			})
+			return
+		}
+		if c.PostForm("action") != "logout" {
+			s.renderPage(c, http.StatusOK, "message", sso.MessagePageData{
+				Title:   "Still signed in",
+				Message: "You are still signed in.",
+			})
+			return
+		}
+		confirmed = true
+	}
+	if !confirmed {
+		data := sso.LogoutPageData{
+			Title:                 "Sign out",
+			Username:              c.GetString("username"),
+			ClientID:              clientID,
+			PostLogoutRedirectURI: c.Request.FormValue("post_logout_redirect_uri"),
+			State:                 state,
+			CSRFToken:             s.issueFormToken(ctx, owner),
+		}
+		if client != nil {
+			data.ClientName = s.clientName(client)
+		}
+		s.renderPage(c, http.StatusOK, "logout", data)
+		return
+	}
+
+	var id uint64
+	fmt.Sscanf(owner, "%d", &id)
+	sessionIDs := []string{sessionID}
+	if sessionID == "" {
+		// Tokens from before session IDs end every session of the user
+		s.db.Model(&models.Session{}).Where("user_id = ? AND sid <> ''", id).Pluck("sid", &sessionIDs)
+		s.db.Where("user_id = ?", id).Delete(&models.Session{})
+	} else {
+		s.db.Where("sid = ?", sessionID).Delete(&models.Session{})
+	}
+	auth.ClearSessionCookie(c)
+
+	clients := s.endSessions(ctx, id, sessionIDs)
+	var frontchannel []string
+	for _, sc := range clients {
+		if sc.client.FrontchannelLogoutURI != "" {
+			frontchannel = append(frontchannel, sso.FrontchannelLogoutURL(sc.client, s.config.OIDC.Issuer, sc.sessionID))
+		}
+	}
+	// SAML SPs of the sessions are visited before the logged out page
+	logout := &samlLogout{FrontchannelURLs: frontchannel, RedirectURI: redirectURI}
+	logout.Pending = s.takeSAMLParticipants(sessionIDs, id, 0)
+	s.continueSAMLLogout(c, logout)
+}
+
+// NotifySessionsEnded sends back-channel logout tokens for login sessions
+// that ended outside the end session endpoint, e.g. an API logout.
+func (s *SSOService) NotifySessionsEnded(ctx context.Context, userID uint64, sessionIDs []string) {
+	s.endSessions(ctx, userID, sessionIDs)
+}
+
+type sessionClient struct {
+	client    *models.OAuthClient
+	sessionID string
+}
+
+// endSessions forgets the clients of the sessions and queues a back-channel
+// logout for each that registered one. The clients are returned for
+// front-channel logout.
+func (s *SSOService) endSessions(ctx context.Context, userID uint64, sessionIDs []string) []sessionClient {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+	var rows []models.OIDCSessionClient
+	if err := s.db.Where("session_id IN ? AND user_id = ?", sessionIDs, userID).Find(&rows).Error; err != nil {
+		s.logger.WithError(err).Error("Failed to load session clients")
+		return nil
+	}
+	s.db.Where("session_id IN ? AND user_id = ?", sessionIDs, userID).Delete(&models.OIDCSessionClient{})
+
+	var clients []sessionClient
+	for _, row := range rows {
+		var client models.OAuthClient
+		if err := s.db.Where("client_id = ?", row.ClientID).First(&client).Error; err != nil {
+			continue
+		}
+		clients = append(clients, sessionClient{client: &client, sessionID: row.SessionID})
+		if client.BackchannelLogoutURI == "" {
+			continue
+		}
+
+		// The first attempt runs now; the retry loop only picks the delivery
+		// up if it has not succeeded by the time the first backoff elapses
+		next := time.Now().Add(sso.LogoutRetryDelay(1))
+		delivery := models.OIDCLogoutDelivery{
+			ClientID:      client.ClientID,
+			UserID:        userID,
+			SessionID:     row.SessionID,
+			LogoutURI:     client.BackchannelLogoutURI,
+			Status:        "pending",
+			NextAttemptAt: &next,
+		}
+		if err := s.db.Create(&delivery).Error; err != nil {
+			s.logger.WithError(err).Error("Failed to record logout delivery")
+			continue
+		}
+		go s.deliverLogout(context.WithoutCancel(ctx), delivery)
+	}
+	return clients
+}
+
+// deliverLogout posts a logout token to the client's back-channel logout URI
+// and records the outcome, scheduling a retry on failure.
+func (s *SSOService) deliverLogout(ctx context.Context, delivery models.OIDCLogoutDelivery) {
+	var sendErr error
+	var response string
+	if s.signingKey == nil {
+		sendErr = fmt.Errorf("no signing key available")
+	} else {
+		claims := sso.LogoutTokenClaims(s.config.OIDC.Issuer, delivery.ClientID, fmt.Sprintf("%d", delivery.UserID), delivery.SessionID, time.Now())
+		var token string
+		if token, sendErr = s.signingKey.SignWithType(claims, sso.LogoutTokenType); sendErr == nil {
+			response, sendErr = postLogoutToken(ctx, delivery.LogoutURI, token)
+		}
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"attempts":   delivery.Attempts + 1,
+		"response":   response,
+		"updated_at": now,
+	}
+	switch {
+	case sendErr == nil:
+		updates["status"] = "success"
+		updates["delivered_at"] = now
+		updates["next_attempt_at"] = nil
+	case delivery.Attempts+1 >= sso.MaxLogoutAttempts:
+		updates["status"] = "failed"
+		updates["response"] = sendErr.Error()
+		updates["next_attempt_at"] = nil
+	default:
+		updates["response"] = sendErr.Error()
+		updates["next_attempt_at"] = now.Add(sso.LogoutRetryDelay(delivery.Attempts + 1))
+	}
+	if err := s.db.Model(&models.OIDCLogoutDelivery{}).Where("id = ?", delivery.ID).Updates(updates).Error; err != nil {
+		s.logger.WithError(err).Error("Failed to update logout delivery")
+	}
+	if sendErr != nil {
+		s.logger.WithError(sendErr).WithField("client_id", delivery.ClientID).Warn("Back-channel logout delivery failed")
+	}
+}
+
+func postLogoutToken(ctx context.Context, logoutURI, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, logoutURI, strings.NewReader(url.Values{"logout_token": {token}}.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := logoutHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	response := fmt.Sprintf("HTTP %d", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return response, fmt.Errorf("%s: %s", response, strings.TrimSpace(string(body)))
+	}
+	return response, nil
+}
+
+// RunLogoutDeliveries retries due back-channel logout deliveries until ctx
+// is cancelled.
+func (s *SSOService) RunLogoutDeliveries(ctx context.Context) {
+	ticker := time.NewTicker(logoutDeliveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.retryLogoutDeliveries(ctx)
+		}
+	}
+}
+
+func (s *SSOService) retryLogoutDeliveries(ctx context.Context) {
+	var due []models.OIDCLogoutDelivery
+	if err := s.db.Where("status = ? AND next_attempt_at <= ?", "pending", time.Now()).
+		Order("next_attempt_at").Limit(100).Find(&due).Error; err != nil {
+		s.logger.WithError(err).Error("Failed to load logout deliveries")
+		return
+	}
+	for _, delivery := range due {
+		// Claim the delivery so concurrent instances do not send it twice
+		claimed := s.db.Model(&models.OIDCLogoutDelivery{}).
+			Where("id = ? AND next_attempt_at = ?", delivery.ID, delivery.NextAttemptAt).
+			Update("next_attempt_at", time.Now().Add(logoutDeliveryTimeout+logoutDeliveryInterval))
+		if claimed.Error != nil || claimed.RowsAffected == 0 {
+			continue
+		}
+		s.deliverLogout(ctx, delivery)
+	}
+}
+
+func (s *SSOService) renderLoggedOut(c *gin.Context, frontchannel []string, redirectURI string) {
+	// Allow the front-channel logout iframes in the page's CSP
+	frameSources := make([]string, 0, len(frontchannel))
+	for _, uri := range frontchannel {
+		if u, err := url.Parse(uri); err == nil {
+			frameSources = append(frameSources, u.Scheme+"://"+u.Host)
+		}
+	}
+	if len(frameSources) > 0 {
+		c.Header("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; frame-src "+strings.Join(frameSources, " "))
+	}
+	s.renderPage(c, http.StatusOK, "logged_out", sso.LoggedOutPageData{
+		Title:            "Signed out",
+		FrontchannelURLs: frontchannel,
+		RedirectURI:      redirectURI,
+	})
+}
+
+func (s *SSOService) clientName(client *models.OAuthClient) string {
+	var app models.Application
+	if err := s.db.Select("name").First(&app, client.ApplicationID).Error; err == nil && app.Name != "" {
+		return app.Name
+	}
+	return client.ClientID
+}
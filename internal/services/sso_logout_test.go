@@ -0,0 +1,83 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOIDCEndSession_IDTokenHintWithoutCookie(t *testing.T) {
+	s := setupSSOTest(t)
+	user := createTestUser(t, s.SSO.db, "alice")
+	createPublicClient(t, s.SSO.db, "spa")
+	require.NoError(t, s.SSO.db.Create(&models.Session{
+		UserID:    user.ID,
+		Token:     "session-token",
+		SID:       "sid-1",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}).Error)
+	s.SSO.trackSessionClient("sid-1", "spa", user.ID)
+
+	idToken := func(sid string) string {
+		token, err := s.SSO.signingKey.Sign(jwt.MapClaims{
+			"iss": "https://idp.example.com",
+			"aud": "spa",
+			"sub": fmt.Sprintf("%d", user.ID),
+			"sid": sid,
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		require.NoError(t, err)
+		return token
+	}
+
+	t.Run("hint for another session ends nothing", func(t *testing.T) {
+		target := "/oauth2/logout?" + url.Values{"id_token_hint": {idToken("sid-other")}}.Encode()
+		w := performRequest(s.SSO.OIDCEndSession, http.MethodGet, target, nil, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "No session was ended")
+		assert.True(t, s.SSO.sessionActive("sid-1"))
+	})
+
+	t.Run("no hint ends nothing", func(t *testing.T) {
+		w := performRequest(s.SSO.OIDCEndSession, http.MethodGet, "/oauth2/logout", nil, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "No session was ended")
+		assert.True(t, s.SSO.sessionActive("sid-1"))
+	})
+
+	t.Run("hint sid ends its session", func(t *testing.T) {
+		target := "/oauth2/logout?" + url.Values{"id_token_hint": {idToken("sid-1")}}.Encode()
+		w := performRequest(s.SSO.OIDCEndSession, http.MethodGet, target, nil, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "You have been signed out")
+		assert.False(t, s.SSO.sessionActive("sid-1"))
+
+		var clients int64
+		s.SSO.db.Model(&models.OIDCSessionClient{}).Where("session_id = ?", "sid-1").Count(&clients)
+		assert.Zero(t, clients)
+	})
+}
+
+func TestPostLogoutToken_RefusesLoopback(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	_, err := postLogoutToken(context.Background(), server.URL, "token")
+	assert.True(t, errors.Is(err, sso.ErrNonPublicAddress))
+	assert.False(t, called)
+}
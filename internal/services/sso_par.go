@@ -0,0 +1,247 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+)
+
+// loginRequestExpiry is how long an authorization request waits for the user
+// to log in when it cannot be carried in the login redirect
+const loginRequestExpiry = 10 * time.Minute
+
+// clientAuthParams are token endpoint style client authentication
+// parameters, which are not part of a pushed authorization request
+var clientAuthParams = []string{"client_secret", "client_assertion", "client_assertion_type"}
+
+// OAuth2PushedAuthorization is the pushed authorization request endpoint
+// (RFC 9126). The authenticated client posts its authorization request,
+// optionally as a signed request object, and receives a short-lived
+// request_uri to send the user agent to the authorization endpoint with.
+func (s *SSOService) OAuth2PushedAuthorization(c *gin.Context) {
+	oauthClient, err := s.authenticateClient(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":             "invalid_client",
+			"error_description": "Invalid client credentials",
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	params := url.Values{}
+	for name, values := range c.Request.PostForm {
+		if !containsString(clientAuthParams, name) {
+			params[name] = values
+		}
+	}
+	if params.Get("request_uri") != "" {
+		s.parError(c, "invalid_request", "request_uri is not allowed in a pushed authorization request")
+		return
+	}
+	if requestObject := params.Get("request"); requestObject != "" {
+		if params, err = s.verifyRequestObject(ctx, oauthClient, requestObject); err != nil {
+			s.parError(c, "invalid_request_object", err.Error())
+			return
+		}
+	}
+	params.Set("client_id", oauthClient.ClientID)
+
+	// Reject requests the authorization endpoint would refuse, so that the
+	// client learns about them directly instead of through the user agent
+	if params.Get("response_type") != "code" {
+		s.parError(c, "unsupported_response_type", "Only authorization code flow is supported")
+		return
+	}
+	if !sso.ValidateRedirectURI(oauthClient, params.Get("redirect_uri")) {
+		s.parError(c, "invalid_request", "Invalid redirect_uri")
+		return
+	}
+	if !sso.ClientAllowsScope(oauthClient, params.Get("scope")) {
+		s.parError(c, "invalid_scope", "Client is not allowed to request the scope")
+		return
+	}
+	if codeChallenge := params.Get("code_challenge"); codeChallenge != "" {
+		method := params.Get("code_challenge_method")
+		if method == "" {
+			method = sso.CodeChallengePlain
+		}
+		if !sso.ValidCodeChallenge(codeChallenge, method) {
+			s.parError(c, "invalid_request", "Invalid code_challenge or code_challenge_method")
+			return
+		}
+	} else if oauthClient.Public {
+		s.parError(c, "invalid_request", "code_challenge is required for public clients")
+		return
+	}
+
+	// A DPoP proof binds the authorization code to its key (RFC 9449 section 10.1)
+	proof, err := s.verifyDPoP(c, "")
+	if err != nil {
+		s.dpopTokenError(c, err)
+		return
+	}
+	if proof != nil {
+		if jkt := params.Get("dpop_jkt"); jkt != "" && jkt != proof.JKT {
+			s.parError(c, "invalid_dpop_proof", "dpop_jkt does not match the DPoP proof")
+			return
+		}
+		params.Set("dpop_jkt", proof.JKT)
+		s.setDPoPNonce(c)
+	}
+
+	requestURI, err := s.storeAuthorizationRequest(ctx, params, sso.PushedRequestExpiry)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to store pushed authorization request")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, gin.H{
+		"request_uri": requestURI,
+		"expires_in":  int(sso.PushedRequestExpiry.Seconds()),
+	})
+}
+
+// authorizationParams returns the parameters of an authorization request.
+// With request_uri or request only the parameters of the pushed request or
+// of the verified request object count (RFC 9126 section 4, RFC 9101
+// section 6.3). On failure the error response has been written.
+func (s *SSOService) authorizationParams(c *gin.Context, client *models.OAuthClient) (url.Values, bool) {
+	ctx := c.Request.Context()
+	query := c.Request.URL.Query()
+	requestURI := query.Get("request_uri")
+	requestObject := query.Get("request")
+
+	switch {
+	case requestURI != "" && requestObject != "":
+		s.parError(c, "invalid_request", "request and request_uri cannot both be used")
+		return nil, false
+
+	case requestURI != "":
+		params, err := s.loadAuthorizationRequest(ctx, requestURI)
+		if err != nil || params.Get("client_id") != client.ClientID {
+			s.parError(c, "invalid_request_uri", "The request_uri is invalid or has expired")
+			return nil, false
+		}
+		params.Set("request_uri", requestURI)
+		return params, true
+
+	case client.RequirePushedAuthorizationRequests:
+		s.parError(c, "invalid_request", "Client must use pushed authorization requests")
+		return nil, false
+
+	case requestObject != "":
+		params, err := s.verifyRequestObject(ctx, client, requestObject)
+		if err != nil {
+			s.parError(c, "invalid_request_object", err.Error())
+			return nil, false
+		}
+		params.Set("request", requestObject)
+		return params, true
+	}
+	return query, true
+}
+
+// verifyRequestObject checks a request object against the client's keys,
+// refetching a jwks_uri once in case the client rotated its keys.
+func (s *SSOService) verifyRequestObject(ctx context.Context, client *models.OAuthClient, requestObject string) (url.Values, error) {
+	issuer := s.config.OIDC.Issuer
+	jwks := client.JWKS
+	fromURI := len(jwks) == 0
+	if fromURI {
+		var err error
+		if jwks, err = s.clientJWKS(ctx, client, false); err != nil {
+			return nil, err
+		}
+	}
+
+	params, err := sso.ParseRequestObject(requestObject, client.ClientID, issuer, jwks, time.Now())
+	if err != nil && fromURI {
+		if jwks, err = s.clientJWKS(ctx, client, true); err != nil {
+			return nil, err
+		}
+		params, err = sso.ParseRequestObject(requestObject, client.ClientID, issuer, jwks, time.Now())
+	}
+	return params, err
+}
+
+// redirectToLoginPushed sends the user to the login page and back to a pushed
+// or signed authorization request. Its parameters cannot be edited in the
+// URL, so they are stored again without prompt=login under a new request_uri
+// that outlives the login.
+func (s *SSOService) redirectToLoginPushed(c *gin.Context, params url.Values) {
+	ctx := c.Request.Context()
+	stored := url.Values{}
+	for name, values := range params {
+		if name != "request" && name != "request_uri" {
+			stored[name] = values
+		}
+	}
+	requestURI, err := s.storeAuthorizationRequest(ctx, withoutLoginPrompt(stored), loginRequestExpiry)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to store authorization request")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	s.consumeAuthorizationRequest(ctx, params)
+
+	query := url.Values{"client_id": {params.Get("client_id")}, "request_uri": {requestURI}}
+	returnTo := c.Request.URL.Path + "?" + query.Encode()
+	c.Redirect(http.StatusFound, "/login?redirect="+url.QueryEscape(returnTo))
+}
+
+// consumeAuthorizationRequest makes a request_uri unusable once the request
+// has been acted on (RFC 9126 section 4)
+func (s *SSOService) consumeAuthorizationRequest(ctx context.Context, params url.Values) {
+	if requestURI := params.Get("request_uri"); requestURI != "" {
+		s.redis.Del(ctx, authorizationRequestKey(requestURI))
+	}
+}
+
+func (s *SSOService) storeAuthorizationRequest(ctx context.Context, params url.Values, expiry time.Duration) (string, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	requestURI := sso.GenerateRequestURI()
+	if err := s.redis.Set(ctx, authorizationRequestKey(requestURI), data, expiry).Err(); err != nil {
+		return "", err
+	}
+	return requestURI, nil
+}
+
+func (s *SSOService) loadAuthorizationRequest(ctx context.Context, requestURI string) (url.Values, error) {
+	if !strings.HasPrefix(requestURI, sso.RequestURIPrefix) {
+		return nil, errors.New("unknown request_uri")
+	}
+	data, err := s.redis.Get(ctx, authorizationRequestKey(requestURI)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	if err := json.Unmarshal(data, &params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func authorizationRequestKey(requestURI string) string {
+	return "oauth2:par:" + strings.TrimPrefix(requestURI, sso.RequestURIPrefix)
+}
+
+func (s *SSOService) parError(c *gin.Context, code, description string) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":             code,
+		"error_description": description,
+	})
+}
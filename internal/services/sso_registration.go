@@ -0,0 +1,322 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"gorm.io/gorm"
+)
+
+var errInitialAccessTokenUsed = errors.New("initial access token has been used up")
+
+// OAuth2Register handles dynamic client registration (RFC 7591). Callers
+// authenticate with an initial access token issued by an admin.
+func (s *SSOService) OAuth2Register(c *gin.Context) {
+	initialToken, err := s.findInitialAccessToken(bearerToken(c))
+	if err != nil {
+		s.registrationUnauthorized(c)
+		return
+	}
+
+	var reg sso.ClientRegistration
+	if err := c.ShouldBindJSON(&reg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_client_metadata",
+			"error_description": "Request body must be a JSON object of client metadata",
+		})
+		return
+	}
+	if err := sso.ApplySoftwareStatement(&reg, s.softwareStatementKeys); err != nil {
+		s.registrationError(c, err)
+		return
+	}
+
+	client := &models.OAuthClient{ClientID: sso.GenerateClientID()}
+	if err := reg.ToClient(client); err != nil {
+		s.registrationError(c, err)
+		return
+	}
+	if err := sso.CheckRegistrationGrants(client, initialToken.GrantTypes); err != nil {
+		s.registrationError(c, err)
+		return
+	}
+
+	var secret string
+	if sso.ClientUsesSecret(client) {
+		var hash string
+		if secret, hash, err = sso.GenerateClientSecret(); err != nil {
+			s.logger.WithError(err).Error("Failed to generate client secret")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+			return
+		}
+		client.ClientSecret = hash
+	}
+	registrationToken := generateRegistrationToken()
+	client.RegistrationTokenHash = sso.HashToken(registrationToken)
+	client.Metadata = registrationMetadata(&reg)
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.OAuthInitialAccessToken{}).
+			Where("id = ? AND (max_uses = 0 OR uses < max_uses)", initialToken.ID).
+			UpdateColumn("uses", gorm.Expr("uses + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInitialAccessTokenUsed
+		}
+
+		app := models.Application{
+			Name:        reg.ClientName,
+			Description: "Dynamically registered OAuth client",
+			LogoURL:     reg.LogoURI,
+			Protocol:    "oauth2",
+			Status:      "active",
+		}
+		if app.Name == "" {
+			app.Name = "Client " + client.ClientID
+		}
+		if err := tx.Create(&app).Error; err != nil {
+			return err
+		}
+		client.ApplicationID = app.ID
+		return tx.Create(client).Error
+	})
+	if errors.Is(err, errInitialAccessTokenUsed) {
+		s.registrationUnauthorized(c)
+		return
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to register OAuth client")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	s.logger.WithField("client_id", client.ClientID).WithField("initial_access_token", initialToken.ID).Info("OAuth client registered")
+	response := s.registrationResponse(client)
+	if secret != "" {
+		response["client_secret"] = secret
+	}
+	response["registration_access_token"] = registrationToken
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, response)
+}
+
+// OAuth2GetRegistration returns the registration of a client (RFC 7592)
+func (s *SSOService) OAuth2GetRegistration(c *gin.Context) {
+	client, ok := s.registeredClient(c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, s.registrationResponse(client))
+}
+
+// OAuth2UpdateRegistration replaces the metadata of a registered client (RFC 7592)
+func (s *SSOService) OAuth2UpdateRegistration(c *gin.Context) {
+	client, ok := s.registeredClient(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		sso.ClientRegistration
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_client_metadata",
+			"error_description": "Request body must be a JSON object of client metadata",
+		})
+		return
+	}
+	if req.ClientID != client.ClientID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_request",
+			"error_description": "client_id does not match the registration",
+		})
+		return
+	}
+	if req.ClientSecret != "" && !sso.CheckClientSecret(client, req.ClientSecret, time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_request",
+			"error_description": "client_secret does not match the registration",
+		})
+		return
+	}
+
+	reg := req.ClientRegistration
+	if err := sso.ApplySoftwareStatement(&reg, s.softwareStatementKeys); err != nil {
+		s.registrationError(c, err)
+		return
+	}
+	usesSecret := sso.ClientUsesSecret(client)
+	// Grant types an administrator gave the client stay allowed
+	grantTypes := append([]string(nil), client.GrantTypes...)
+	if err := reg.ToClient(client); err != nil {
+		s.registrationError(c, err)
+		return
+	}
+	if err := sso.CheckRegistrationGrants(client, grantTypes); err != nil {
+		s.registrationError(c, err)
+		return
+	}
+	if sso.ClientUsesSecret(client) != usesSecret {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_client_metadata",
+			"error_description": "token_endpoint_auth_method cannot switch between secret and non-secret methods",
+		})
+		return
+	}
+	client.Metadata = registrationMetadata(&reg)
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(client).Select("redirect_uris", "scopes", "grant_types", "token_endpoint_auth_method", "jwks", "jwks_uri", "tls_client_auth_subject_dn",
+			"post_logout_redirect_uris", "frontchannel_logout_uri", "frontchannel_logout_session_required",
+			"backchannel_logout_uri", "backchannel_logout_session_required", "require_pushed_authorization_requests",
+			"dpop_bound_access_tokens", "metadata", "updated_at").Updates(client).Error; err != nil {
+			return err
+		}
+		updates := map[string]interface{}{"logo_url": reg.LogoURI}
+		if reg.ClientName != "" {
+			updates["name"] = reg.ClientName
+		}
+		return tx.Model(&models.Application{}).Where("id = ?", client.ApplicationID).Updates(updates).Error
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to update OAuth client registration")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, s.registrationResponse(client))
+}
+
+// OAuth2DeleteRegistration deregisters a client, removing its application and
+// revoking its tokens (RFC 7592)
+func (s *SSOService) OAuth2DeleteRegistration(c *gin.Context) {
+	client, ok := s.registeredClient(c)
+	if !ok {
+		return
+	}
+
+	var tokens []models.OAuthToken
+	if err := s.db.Where("client_id = ? AND revoked = ?", client.ClientID, false).Find(&tokens).Error; err == nil {
+		s.revokeTokens(c.Request.Context(), tokens)
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(client).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.Application{}, client.ApplicationID).Error
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to delete OAuth client registration")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// registeredClient authenticates the registration access token for the
+// client in the path
+func (s *SSOService) registeredClient(c *gin.Context) (*models.OAuthClient, bool) {
+	token := bearerToken(c)
+	var client models.OAuthClient
+	if token == "" || s.db.Where("client_id = ? AND registration_token_hash = ?", c.Param("client_id"), sso.HashToken(token)).First(&client).Error != nil {
+		s.registrationUnauthorized(c)
+		return nil, false
+	}
+	return &client, true
+}
+
+func (s *SSOService) findInitialAccessToken(token string) (*models.OAuthInitialAccessToken, error) {
+	if token == "" {
+		return nil, errors.New("missing initial access token")
+	}
+	var initialToken models.OAuthInitialAccessToken
+	if err := s.db.Where("token_hash = ? AND revoked = ?", sso.HashToken(token), false).First(&initialToken).Error; err != nil {
+		return nil, err
+	}
+	if initialToken.ExpiresAt != nil && initialToken.ExpiresAt.Before(time.Now()) {
+		return nil, errors.New("initial access token expired")
+	}
+	return &initialToken, nil
+}
+
+func (s *SSOService) registrationResponse(client *models.OAuthClient) gin.H {
+	response := gin.H{}
+	for k, v := range client.Metadata {
+		response[k] = v
+	}
+	response["client_id"] = client.ClientID
+	response["client_id_issued_at"] = client.CreatedAt.Unix()
+	response["redirect_uris"] = client.RedirectURIs
+	response["grant_types"] = client.GrantTypes
+	if sso.ClientUsesSecret(client) {
+		response["client_secret_expires_at"] = 0
+	}
+	response["registration_client_uri"] = fmt.Sprintf("%s/oauth2/register/%s", s.config.OIDC.Issuer, client.ClientID)
+	return response
+}
+
+func (s *SSOService) registrationError(c *gin.Context, err error) {
+	var metadataErr *sso.ClientMetadataError
+	if errors.As(err, &metadataErr) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             metadataErr.Code,
+			"error_description": metadataErr.Description,
+		})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":             "invalid_client_metadata",
+		"error_description": err.Error(),
+	})
+}
+
+func (s *SSOService) registrationUnauthorized(c *gin.Context) {
+	c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"error":             "invalid_token",
+		"error_description": "Missing, invalid or expired access token",
+	})
+}
+
+// registrationMetadata keeps the registered metadata for read requests,
+// without the fields that are stored on the client itself
+func registrationMetadata(reg *sso.ClientRegistration) models.JSONB {
+	data, _ := json.Marshal(reg)
+	metadata := models.JSONB{}
+	json.Unmarshal(data, &metadata)
+	delete(metadata, "redirect_uris")
+	delete(metadata, "grant_types")
+	return metadata
+}
+
+func generateRegistrationToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func bearerToken(c *gin.Context) string {
+	authHeader := c.GetHeader("Authorization")
+	if len(authHeader) > 7 && strings.EqualFold(authHeader[:7], "Bearer ") {
+		return strings.TrimSpace(authHeader[7:])
+	}
+	return ""
+}
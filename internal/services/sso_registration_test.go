@@ -0,0 +1,105 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSOService_RegistrationGrantTypes(t *testing.T) {
+	svcs := setupSSOTest(t)
+	_, plainToken, err := svcs.OAuthClient.CreateInitialAccessToken("apps", 0, nil, nil, nil)
+	require.NoError(t, err)
+	_, serviceToken, err := svcs.OAuthClient.CreateInitialAccessToken("services", 0, nil, []string{"client_credentials"}, nil)
+	require.NoError(t, err)
+
+	_, _, err = svcs.OAuthClient.CreateInitialAccessToken("bad", 0, nil, []string{"implicit"}, nil)
+	assert.ErrorIs(t, err, ErrUnsupportedGrantType)
+
+	send := func(handler gin.HandlerFunc, method, clientID, token string, metadata map[string]interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(metadata)
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(method, "/oauth2/register", bytes.NewReader(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+		if clientID != "" {
+			c.Params = gin.Params{{Key: "client_id", Value: clientID}}
+		}
+		handler(c)
+		return w
+	}
+	register := func(token string, grantTypes ...string) *httptest.ResponseRecorder {
+		return send(svcs.SSO.OAuth2Register, http.MethodPost, "", token, map[string]interface{}{
+			"redirect_uris": []string{"https://app.example.com/callback"},
+			"grant_types":   grantTypes,
+		})
+	}
+
+	t.Run("default grant types", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, register(plainToken).Code)
+		assert.Equal(t, http.StatusCreated, register(plainToken, "authorization_code", "refresh_token", "urn:ietf:params:oauth:grant-type:device_code").Code)
+	})
+
+	t.Run("grant types need the admin's approval", func(t *testing.T) {
+		for _, grantType := range []string{"client_credentials", "password", "urn:ietf:params:oauth:grant-type:token-exchange"} {
+			w := register(plainToken, "authorization_code", grantType)
+			assert.Equal(t, http.StatusBadRequest, w.Code, grantType)
+			assert.Equal(t, "invalid_client_metadata", decodeJSON(t, w)["error"])
+		}
+		assert.Equal(t, http.StatusCreated, register(serviceToken, "client_credentials").Code)
+		assert.Equal(t, http.StatusBadRequest, register(serviceToken, "password").Code)
+	})
+
+	t.Run("updates cannot add grant types", func(t *testing.T) {
+		registered := decodeJSON(t, register(plainToken))
+		clientID := registered["client_id"].(string)
+		registrationToken := registered["registration_access_token"].(string)
+
+		update := func(grantTypes ...string) *httptest.ResponseRecorder {
+			return send(svcs.SSO.OAuth2UpdateRegistration, http.MethodPut, clientID, registrationToken, map[string]interface{}{
+				"client_id":     clientID,
+				"redirect_uris": []string{"https://app.example.com/callback"},
+				"grant_types":   grantTypes,
+			})
+		}
+		assert.Equal(t, http.StatusBadRequest, update("authorization_code", "client_credentials").Code)
+		assert.Equal(t, http.StatusOK, update("authorization_code").Code)
+
+		// Unless an admin gave them to the client
+		require.NoError(t, svcs.DB.Model(&models.OAuthClient{}).Where("client_id = ?", clientID).
+			Update("grant_types", models.StringArray{"authorization_code", "client_credentials"}).Error)
+		assert.Equal(t, http.StatusOK, update("authorization_code", "client_credentials").Code)
+	})
+
+	t.Run("registered clients cannot use other grants", func(t *testing.T) {
+		registered := decodeJSON(t, register(plainToken))
+		clientID := registered["client_id"].(string)
+		clientSecret := registered["client_secret"].(string)
+
+		token := func(handler gin.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+			return performRequest(handler, http.MethodPost, "/oauth2/token", form, func(c *gin.Context) {
+				c.Request.SetBasicAuth(clientID, clientSecret)
+			})
+		}
+		for grantType, w := range map[string]*httptest.ResponseRecorder{
+			"client_credentials": token(svcs.SSO.OAuth2ClientCredentials, url.Values{"grant_type": {"client_credentials"}}),
+			"password": token(svcs.SSO.OAuth2PasswordCredentials, url.Values{
+				"grant_type": {"password"},
+				"username":   {"alice"},
+				"password":   {"secret"},
+			}),
+		} {
+			assert.Equal(t, http.StatusBadRequest, w.Code, grantType)
+			assert.Equal(t, "unauthorized_client", decodeJSON(t, w)["error"], grantType)
+		}
+	})
+}
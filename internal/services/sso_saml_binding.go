@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+)
+
+// samlBinding returns the binding a SAML message was received with and
+// the accessor of its parameters: the query for HTTP-Redirect, the form for
+// HTTP-POST
+func samlBinding(c *gin.Context) (string, func(string) string) {
+	if c.Request.Method == http.MethodGet {
+		return saml.HTTPRedirectBinding, c.Query
+	}
+	return saml.HTTPPostBinding, c.PostForm
+}
+
+// postSAMLResponse sends a signed response to the ACS URL with the
+// HTTP-POST binding: a form the user agent submits automatically
+func (s *SSOService) postSAMLResponse(c *gin.Context, acsURL string, response []byte, relayState string) {
+	s.renderPage(c, http.StatusOK, "saml_post", sso.SAMLPostPageData{
+		Title:      "Signing in",
+		Action:     acsURL,
+		Param:      "SAMLResponse",
+		Message:    base64.StdEncoding.EncodeToString(response),
+		RelayState: relayState,
+	})
+}
+
+// sendSAMLMessage sends a SAML message to an SP endpoint over binding,
+// signed with the application's key: a signed redirect for HTTP-Redirect,
+// or an auto-submitted form with an enveloped signature for HTTP-POST
+func (s *SSOService) sendSAMLMessage(c *gin.Context, samlConfig *models.SAMLConfig, binding, destination, param string, el *etree.Element, relayState string) error {
+	if err := s.useSAMLSigningKey(samlConfig); err != nil {
+		return err
+	}
+	signer, err := sso.NewSAMLSigner(samlConfig.Certificate, samlConfig.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid SAML signing key: %w", err)
+	}
+
+	if binding == saml.HTTPPostBinding {
+		signed, err := signer.SignEnveloped(el)
+		if err != nil {
+			return err
+		}
+		data, err := sso.MarshalSAMLElement(signed)
+		if err != nil {
+			return err
+		}
+		s.renderPage(c, http.StatusOK, "saml_post", sso.SAMLPostPageData{
+			Title:      "Signing out",
+			Action:     destination,
+			Param:      param,
+			Message:    base64.StdEncoding.EncodeToString(data),
+			RelayState: relayState,
+		})
+		return nil
+	}
+
+	redirectURL, err := signer.RedirectURL(destination, param, el, relayState)
+	if err != nil {
+		return err
+	}
+	c.Redirect(http.StatusFound, redirectURL)
+	return nil
+}
+
+// samlKeySelection picks the key pair a SAML application signs with and the
+// certificates its metadata publishes, from its key set, its own key pair
+// and the global key set
+func (s *SSOService) samlKeySelection(samlConfig *models.SAMLConfig) (*sso.SAMLKeySelection, error) {
+	appKeys, err := loadSAMLKeys(s.db, samlConfig.ApplicationID)
+	if err != nil {
+		return nil, err
+	}
+	globalKeys, err := loadSAMLKeys(s.db, 0)
+	if err != nil {
+		return nil, err
+	}
+	return sso.SelectSAMLKeys(samlConfig, appKeys, globalKeys), nil
+}
+
+// useSAMLSigningKey sets the key pair the application currently signs with
+// on samlConfig, which is not saved afterwards
+func (s *SSOService) useSAMLSigningKey(samlConfig *models.SAMLConfig) error {
+	keys, err := s.samlKeySelection(samlConfig)
+	if err != nil {
+		return err
+	}
+	samlConfig.Certificate, samlConfig.PrivateKey = keys.Certificate, keys.PrivateKey
+	return nil
+}
+
+func samlPendingKey(id string) string {
+	return fmt.Sprintf("saml:pending:%s", id)
+}
+
+// samlRedirectToLogin sends the user to the login page and back to the SAML
+// request afterwards. A Redirect binding request keeps its signed query; the
+// form of a POSTed request does not survive the redirect, so it waits in
+// Redis.
+func (s *SSOService) samlRedirectToLogin(c *gin.Context, param func(string) string) {
+	returnTo := c.Request.URL.RequestURI()
+	if c.Request.Method != http.MethodGet {
+		form := url.Values{}
+		for _, name := range []string{"SAMLRequest", "RelayState"} {
+			if value := param(name); value != "" {
+				form.Set(name, value)
+			}
+		}
+		id := uuid.New().String()
+		if err := s.redis.Set(c.Request.Context(), samlPendingKey(id), form.Encode(), loginRequestExpiry).Err(); err != nil {
+			s.logger.WithError(err).Error("Failed to store SAML request")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "internal_error",
+			})
+			return
+		}
+		query := url.Values{"app_id": {c.Query("app_id")}, "pending": {id}}
+		returnTo = c.Request.URL.Path + "?" + query.Encode()
+	}
+	c.Redirect(http.StatusFound, "/login?redirect="+url.QueryEscape(returnTo))
+}
+
+// pendingSAMLRequest loads the form of a POSTed request stored while the
+// user logged in
+func (s *SSOService) pendingSAMLRequest(ctx context.Context, id string) (url.Values, error) {
+	data, err := s.redis.Get(ctx, samlPendingKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(data)
+}
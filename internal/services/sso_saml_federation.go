@@ -0,0 +1,477 @@
+package services
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hanyouqing/openauth/internal/auth"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errSAMLAccountNotLinked = errors.New("no account is linked to this identity")
+	errSAMLLinkRefused      = errors.New("account cannot be linked by email")
+)
+
+// samlSPLogin is a login started at an external IdP, stored in Redis under
+// its RelayState until the IdP responds
+type samlSPLogin struct {
+	ProviderID uint64 `json:"provider_id"`
+	RequestID  string `json:"request_id"`
+	RedirectTo string `json:"redirect_to"`
+}
+
+func samlSPLoginKey(relayState string) string {
+	return fmt.Sprintf("saml:sp:login:%s", relayState)
+}
+
+// samlSPMFA is a federated login waiting for the user's one-time code,
+// stored in Redis under a random token until the code is posted
+type samlSPMFA struct {
+	UserID     uint64 `json:"user_id"`
+	RedirectTo string `json:"redirect_to"`
+}
+
+func samlSPMFAKey(token string) string {
+	return fmt.Sprintf("saml:sp:mfa:%s", token)
+}
+
+// samlServiceProvider loads the connection named by the idp_id parameter and
+// its SP. Logins need an active connection.
+func (s *SSOService) samlServiceProvider(c *gin.Context, active bool) (*models.SAMLIdentityProvider, *saml.ServiceProvider, bool) {
+	providerID, _ := strconv.ParseUint(c.Query("idp_id"), 10, 64)
+	var provider models.SAMLIdentityProvider
+	if err := s.db.First(&provider, providerID).Error; err != nil || (active && provider.Status != "active") {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "identity_provider_not_found",
+		})
+		return nil, nil, false
+	}
+	sp, err := sso.NewSAMLServiceProvider(sso.NewSAMLSP(s.config.OIDC.Issuer, provider.ID), &provider)
+	if err != nil {
+		s.logger.WithError(err).WithField("idp_id", provider.ID).Error("Invalid SAML identity provider")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "invalid_identity_provider",
+		})
+		return nil, nil, false
+	}
+	return &provider, sp, true
+}
+
+// SAMLSPMetadata serves the SP metadata of a connection to an external IdP,
+// for the IdP to import
+func (s *SSOService) SAMLSPMetadata(c *gin.Context) {
+	_, sp, ok := s.samlServiceProvider(c, false)
+	if !ok {
+		return
+	}
+	data, err := xml.Marshal(sso.BuildSAMLSPMetadata(sp))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal_error",
+		})
+		return
+	}
+	c.Data(http.StatusOK, "application/samlmetadata+xml", append([]byte(xml.Header), data...))
+}
+
+// SAMLSPLogin signs the user in with an external IdP: it sends an
+// AuthnRequest and remembers where to return to after the ACS
+func (s *SSOService) SAMLSPLogin(c *gin.Context) {
+	provider, sp, ok := s.samlServiceProvider(c, true)
+	if !ok {
+		return
+	}
+	redirectTo := c.Query("redirect")
+	if !localPath(redirectTo) {
+		redirectTo = "/"
+	}
+
+	binding := saml.HTTPRedirectBinding
+	if provider.SSOBinding == saml.HTTPPostBinding {
+		binding = saml.HTTPPostBinding
+	}
+	request, err := sp.MakeAuthenticationRequest(provider.SSOURL, binding, saml.HTTPPostBinding)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to build AuthnRequest")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal_error",
+		})
+		return
+	}
+
+	relayState := strings.ReplaceAll(uuid.New().String(), "-", "")
+	state, _ := json.Marshal(samlSPLogin{ProviderID: provider.ID, RequestID: request.ID, RedirectTo: redirectTo})
+	if err := s.redis.Set(c.Request.Context(), samlSPLoginKey(relayState), state, loginRequestExpiry).Err(); err != nil {
+		s.logger.WithError(err).Error("Failed to store SAML login")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal_error",
+		})
+		return
+	}
+
+	if binding == saml.HTTPPostBinding {
+		data, err := sso.MarshalSAMLElement(request.Element())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "internal_error",
+			})
+			return
+		}
+		s.renderPage(c, http.StatusOK, "saml_post", sso.SAMLPostPageData{
+			Title:      "Signing in",
+			Action:     provider.SSOURL,
+			Param:      "SAMLRequest",
+			Message:    base64.StdEncoding.EncodeToString(data),
+			RelayState: relayState,
+		})
+		return
+	}
+	redirectURL, err := request.Redirect(relayState, sp)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to sign AuthnRequest")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal_error",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, redirectURL.String())
+}
+
+// SAMLSPACS is the assertion consumer service of a connection. It validates
+// the IdP's response, finds or creates the user and starts a login session.
+// Responses to AuthnRequests are matched by RelayState; unsolicited ones
+// are accepted if the connection allows IdP-initiated login, and their
+// RelayState may name a local path to continue to.
+func (s *SSOService) SAMLSPACS(c *gin.Context) {
+	ctx := c.Request.Context()
+	provider, sp, ok := s.samlServiceProvider(c, true)
+	if !ok {
+		return
+	}
+	message, err := sso.DecodeSAMLMessage(saml.HTTPPostBinding, c.PostForm("SAMLResponse"))
+	if err != nil {
+		s.renderSAMLLoginError(c, "The identity provider's response is not valid.")
+		return
+	}
+
+	relayState := c.PostForm("RelayState")
+	login := samlSPLogin{RedirectTo: "/"}
+	if data, err := s.redis.GetDel(ctx, samlSPLoginKey(relayState)).Bytes(); err == nil {
+		if json.Unmarshal(data, &login) != nil || login.ProviderID != provider.ID {
+			s.renderSAMLLoginError(c, "The sign-in request is not valid.")
+			return
+		}
+	} else if localPath(relayState) {
+		login.RedirectTo = relayState
+	}
+
+	assertion, err := sso.ValidateSAMLAssertion(sp, message, login.RequestID)
+	if err != nil {
+		s.logger.WithError(err).WithField("idp_id", provider.ID).Warn("Rejected SAML response")
+		s.renderSAMLLoginError(c, "The identity provider's response is not valid.")
+		return
+	}
+	// Each assertion is accepted once, which matters for unsolicited responses
+	fresh, err := s.redis.SetNX(ctx, fmt.Sprintf("saml:sp:assertion:%d:%s", provider.ID, assertion.ID), 1, saml.MaxIssueDelay+saml.MaxClockSkew).Result()
+	if err != nil || !fresh {
+		s.renderSAMLLoginError(c, "The identity provider's response has already been used.")
+		return
+	}
+
+	user, err := s.federatedUser(provider, sso.NewSAMLProfile(assertion))
+	if err != nil {
+		s.logger.WithError(err).WithField("idp_id", provider.ID).Warn("SAML login failed")
+		message := "Your account could not be signed in."
+		switch {
+		case errors.Is(err, errSAMLAccountNotLinked):
+			message = "There is no account for you yet. Ask an administrator for access."
+		case errors.Is(err, errSAMLLinkRefused):
+			message = "Your account cannot be linked to this identity provider automatically. Ask an administrator for access."
+		}
+		s.renderSAMLLoginError(c, message)
+		return
+	}
+	// Users with MFA enabled present a code, as at password login
+	if user.MFAEnabled {
+		s.promptFederatedMFA(c, user, login.RedirectTo)
+		return
+	}
+	s.finishFederatedLogin(c, user, login.RedirectTo)
+}
+
+// promptFederatedMFA asks a user with MFA enabled for the code of their TOTP
+// device before the session starts. Like password login, users without a
+// verified device cannot sign in.
+func (s *SSOService) promptFederatedMFA(c *gin.Context, user *models.User, redirectTo string) {
+	if _, ok := verifiedTOTPDevice(s.db, user.ID); !ok {
+		s.renderSAMLLoginError(c, "Your account requires two-factor authentication, but no authenticator is set up.")
+		return
+	}
+	token := strings.ReplaceAll(uuid.New().String(), "-", "")
+	state, _ := json.Marshal(samlSPMFA{UserID: user.ID, RedirectTo: redirectTo})
+	if err := s.redis.Set(c.Request.Context(), samlSPMFAKey(token), state, loginRequestExpiry).Err(); err != nil {
+		s.logger.WithError(err).Error("Failed to store SAML login")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal_error",
+		})
+		return
+	}
+	s.renderPage(c, http.StatusOK, "mfa", sso.MFAPageData{
+		Title:    "Verify it's you",
+		Username: user.Username,
+		Action:   "/saml/sp/mfa",
+		Token:    token,
+	})
+}
+
+// SAMLSPMFA takes the one-time code of a federated login that needs MFA.
+// The pending login is used once, so after a wrong code the user signs in at
+// the IdP again.
+func (s *SSOService) SAMLSPMFA(c *gin.Context) {
+	var pending samlSPMFA
+	data, err := s.redis.GetDel(c.Request.Context(), samlSPMFAKey(c.PostForm("mfa_token"))).Bytes()
+	if err != nil || json.Unmarshal(data, &pending) != nil {
+		s.renderSAMLLoginError(c, "The sign-in request has expired, please sign in again.")
+		return
+	}
+	var user models.User
+	if err := s.db.First(&user, pending.UserID).Error; err != nil || user.Status != "active" {
+		s.renderSAMLLoginError(c, "Your account could not be signed in.")
+		return
+	}
+	device, ok := verifiedTOTPDevice(s.db, user.ID)
+	if !ok || !auth.ValidateTOTP(device.Secret, c.PostForm("code")) {
+		s.logger.WithField("user_id", user.ID).Warn("Invalid MFA code at SAML login")
+		s.renderSAMLLoginError(c, "The code is not valid, please sign in again.")
+		return
+	}
+	s.finishFederatedLogin(c, &user, pending.RedirectTo)
+}
+
+// finishFederatedLogin starts the session of a federated login and returns
+// to the page the login started from
+func (s *SSOService) finishFederatedLogin(c *gin.Context, user *models.User, redirectTo string) {
+	if err := s.startFederatedSession(c, user); err != nil {
+		s.logger.WithError(err).Error("Failed to start session")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal_error",
+		})
+		return
+	}
+	c.Redirect(http.StatusFound, redirectTo)
+}
+
+func (s *SSOService) renderSAMLLoginError(c *gin.Context, message string) {
+	s.renderPage(c, http.StatusBadRequest, "message", sso.MessagePageData{
+		Title:   "Sign-in failed",
+		Message: message,
+	})
+}
+
+// localPath reports whether p is a path on this server, so redirecting to
+// it cannot leave the site
+func localPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "/\\")
+}
+
+// emailInDomains reports whether the domain of email is one of domains
+func emailInDomains(email string, domains []string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	return containsString(domains, strings.ToLower(email[at+1:]))
+}
+
+// federatedUser returns the user an IdP asserted: the one linked to the
+// NameID, else with the asserted email if the connection links by email and
+// trusts the email's domain, else a new user if it provisions users just in
+// time. Accounts with administrative roles or MFA are never linked by email,
+// so an IdP cannot take them over. Transient NameIDs are never linked.
+// Mapped attributes, roles and groups are updated on every login.
+func (s *SSOService) federatedUser(provider *models.SAMLIdentityProvider, profile *sso.SAMLProfile) (*models.User, error) {
+	fields := sso.MapSAMLUser(provider.AttributeMap, profile)
+	linkable := profile.NameIDFormat != string(saml.TransientNameIDFormat)
+
+	var user models.User
+	found := false
+	if linkable {
+		var identity models.SAMLFederatedIdentity
+		if err := s.db.Where("provider_id = ? AND name_id = ?", provider.ID, profile.NameID).First(&identity).Error; err == nil {
+			found = s.db.First(&user, identity.UserID).Error == nil
+		}
+	}
+	if !found && provider.LinkByEmail && fields.Email != "" && emailInDomains(fields.Email, provider.EmailDomains) {
+		found = s.db.Where("email = ?", fields.Email).First(&user).Error == nil
+		if found && (user.MFAEnabled || s.userPrivileged(user.ID)) {
+			return nil, fmt.Errorf("%w: user %d is privileged or uses MFA", errSAMLLinkRefused, user.ID)
+		}
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if !found {
+			if !provider.JITProvisioning {
+				return errSAMLAccountNotLinked
+			}
+			if fields.Email == "" {
+				return errors.New("the IdP asserted no email for the new user")
+			}
+			var count int64
+			tx.Model(&models.User{}).Where("username = ? OR email = ?", fields.Username, fields.Email).Count(&count)
+			if count > 0 {
+				return fmt.Errorf("username %q or email %q is already taken", fields.Username, fields.Email)
+			}
+			// Federated users have no password until they set one
+			user = models.User{
+				Username:   fields.Username,
+				Email:      fields.Email,
+				Phone:      fields.Phone,
+				Status:     "active",
+				Attributes: models.JSONB(fields.Attributes),
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		} else if len(fields.Attributes) > 0 {
+			if user.Attributes == nil {
+				user.Attributes = models.JSONB{}
+			}
+			for key, value := range fields.Attributes {
+				user.Attributes[key] = value
+			}
+			if err := tx.Model(&user).Update("attributes", user.Attributes).Error; err != nil {
+				return err
+			}
+		}
+		if user.Status != "active" {
+			return errors.New("account is disabled")
+		}
+
+		if linkable {
+			now := time.Now()
+			identity := models.SAMLFederatedIdentity{ProviderID: provider.ID, NameID: profile.NameID, UserID: user.ID, LastLoginAt: &now}
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "provider_id"}, {Name: "name_id"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{"user_id": user.ID, "last_login_at": now}),
+			}).Create(&identity).Error
+			if err != nil {
+				return err
+			}
+		}
+		return s.applySAMLRoles(tx, provider, profile, user.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// applySAMLRoles grants the default roles and the roles and groups the
+// connection's mappings grant for the profile. With SyncRoles, mapped roles
+// and groups that are not granted any more are removed.
+func (s *SSOService) applySAMLRoles(tx *gorm.DB, provider *models.SAMLIdentityProvider, profile *sso.SAMLProfile, userID uint64) error {
+	roles, groups := sso.MapSAMLRoles(provider.RoleMappings, profile)
+	for _, role := range provider.DefaultRoles {
+		if !containsString(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	if len(roles) > 0 {
+		var roleIDs []uint64
+		tx.Model(&models.Role{}).Where("name IN ?", roles).Pluck("id", &roleIDs)
+		for _, roleID := range roleIDs {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.UserRole{UserID: userID, RoleID: roleID}).Error; err != nil {
+				return err
+			}
+		}
+	}
+	if len(groups) > 0 {
+		var groupIDs []uint64
+		tx.Model(&models.UserGroup{}).Where("name IN ?", groups).Pluck("id", &groupIDs)
+		for _, groupID := range groupIDs {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.UserGroupUser{UserGroupID: groupID, UserID: userID}).Error; err != nil {
+				return err
+			}
+		}
+	}
+	if !provider.SyncRoles {
+		return nil
+	}
+
+	mappedRoles, mappedGroups := sso.SAMLMappedRoles(provider.RoleMappings)
+	var revokedRoles, revokedGroups []string
+	for _, role := range mappedRoles {
+		if !containsString(roles, role) {
+			revokedRoles = append(revokedRoles, role)
+		}
+	}
+	for _, group := range mappedGroups {
+		if !containsString(groups, group) {
+			revokedGroups = append(revokedGroups, group)
+		}
+	}
+	if len(revokedRoles) > 0 {
+		err := tx.Where("user_id = ? AND role_id IN (?)", userID,
+			tx.Model(&models.Role{}).Select("id").Where("name IN ?", revokedRoles)).Delete(&models.UserRole{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	if len(revokedGroups) > 0 {
+		err := tx.Where("user_id = ? AND user_group_id IN (?)", userID,
+			tx.Model(&models.UserGroup{}).Select("id").Where("name IN ?", revokedGroups)).Delete(&models.UserGroupUser{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startFederatedSession logs the user in like a password login: a token
+// bound to a new login session, set as the session cookie. Users with MFA
+// enabled have presented their code by now; otherwise the IdP is responsible
+// for the strength of the authentication.
+func (s *SSOService) startFederatedSession(c *gin.Context, user *models.User) error {
+	var roles []string
+	s.db.Model(user).Association("Roles").Find(&user.Roles)
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+	}
+
+	sessionID := uuid.New().String()
+	accessToken, err := auth.GenerateSessionToken(user.ID, user.Username, roles, sessionID, s.config.JWT.Secret, s.config.JWT.AccessExpiry, s.config.JWT.Issuer)
+	if err != nil {
+		return fmt.Errorf("failed to generate access token: %w", err)
+	}
+	now := time.Now()
+	session := models.Session{
+		UserID:    user.ID,
+		Token:     accessToken,
+		SID:       sessionID,
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		ExpiresAt: now.Add(time.Duration(s.config.JWT.AccessExpiry) * time.Minute),
+	}
+	if err := s.db.Create(&session).Error; err != nil {
+		return err
+	}
+	s.db.Model(user).Update("last_login_at", now)
+
+	auth.SetSessionCookie(c, accessToken, s.config.JWT.AccessExpiry*60)
+	return nil
+}
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/auth"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func samlProfile(email string, attributes map[string][]string) *sso.SAMLProfile {
+	return &sso.SAMLProfile{
+		NameID:       email,
+		NameIDFormat: string(saml.EmailAddressNameIDFormat),
+		Attributes:   attributes,
+	}
+}
+
+func TestFederatedUser_LinkByEmail(t *testing.T) {
+	s := setupSSOTest(t)
+	db := s.SSO.db
+	provider := &models.SAMLIdentityProvider{
+		Name:         "corp",
+		Status:       "active",
+		EntityID:     "https://idp.corp.example.com",
+		SSOURL:       "https://idp.corp.example.com/sso",
+		LinkByEmail:  true,
+		EmailDomains: models.StringArray{"example.com"},
+	}
+	require.NoError(t, db.Create(provider).Error)
+
+	adminRole := models.Role{Name: "admin"}
+	auditorRole := models.Role{Name: "auditor"}
+	require.NoError(t, db.Create(&adminRole).Error)
+	require.NoError(t, db.Create(&auditorRole).Error)
+	permission := models.Permission{Name: "audit.read", Resource: "audit", Action: "read"}
+	require.NoError(t, db.Create(&permission).Error)
+	require.NoError(t, db.Create(&models.RolePermission{RoleID: auditorRole.ID, PermissionID: permission.ID}).Error)
+
+	alice := createTestUser(t, db, "alice")
+	root := createTestUser(t, db, "root")
+	require.NoError(t, db.Create(&models.UserRole{UserID: root.ID, RoleID: adminRole.ID}).Error)
+	auditor := createTestUser(t, db, "auditor")
+	require.NoError(t, db.Create(&models.UserRole{UserID: auditor.ID, RoleID: auditorRole.ID}).Error)
+	secure := createTestUser(t, db, "secure")
+	require.NoError(t, db.Model(secure).Update("mfa_enabled", true).Error)
+	outsider := &models.User{Username: "eve", Email: "eve@other.example.org", PasswordHash: "unused", Status: "active"}
+	require.NoError(t, db.Create(outsider).Error)
+
+	user, err := s.SSO.federatedUser(provider, samlProfile("alice@example.com", nil))
+	if assert.NoError(t, err) {
+		assert.Equal(t, alice.ID, user.ID)
+	}
+	var identity models.SAMLFederatedIdentity
+	require.NoError(t, db.Where("provider_id = ? AND name_id = ?", provider.ID, "alice@example.com").First(&identity).Error)
+	assert.Equal(t, alice.ID, identity.UserID)
+
+	// Domains the connection does not trust are not linked
+	_, err = s.SSO.federatedUser(provider, samlProfile("eve@other.example.org", nil))
+	assert.ErrorIs(t, err, errSAMLAccountNotLinked)
+
+	// Administrators, users with roles that grant permissions and users
+	// with MFA are never linked by email
+	for _, email := range []string{"root@example.com", "auditor@example.com", "secure@example.com"} {
+		_, err = s.SSO.federatedUser(provider, samlProfile(email, nil))
+		assert.ErrorIs(t, err, errSAMLLinkRefused, email)
+	}
+	var count int64
+	db.Model(&models.SAMLFederatedIdentity{}).Where("provider_id = ?", provider.ID).Count(&count)
+	assert.Equal(t, int64(1), count)
+
+	// Transient NameIDs are not linked, though the email still matches
+	transient := samlProfile("_transient-1", map[string][]string{"email": {"alice@example.com"}})
+	transient.NameIDFormat = string(saml.TransientNameIDFormat)
+	user, err = s.SSO.federatedUser(provider, transient)
+	if assert.NoError(t, err) {
+		assert.Equal(t, alice.ID, user.ID)
+	}
+	db.Model(&models.SAMLFederatedIdentity{}).Where("name_id = ?", "_transient-1").Count(&count)
+	assert.Zero(t, count)
+
+	// Just-in-time provisioning creates unknown users
+	provider.JITProvisioning = true
+	user, err = s.SSO.federatedUser(provider, samlProfile("carol@example.com", nil))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "carol@example.com", user.Email)
+		assert.NotEqual(t, alice.ID, user.ID)
+	}
+}
+
+func TestApplySAMLRoles(t *testing.T) {
+	s := setupSSOTest(t)
+	db := s.SSO.db
+	for _, name := range []string{"viewer", "editor", "manual"} {
+		require.NoError(t, db.Create(&models.Role{Name: name}).Error)
+	}
+	staff := models.UserGroup{Name: "staff"}
+	require.NoError(t, db.Create(&staff).Error)
+	user := createTestUser(t, db, "alice")
+
+	provider := &models.SAMLIdentityProvider{
+		RoleMappings: models.SAMLRoleMappings{
+			{Attribute: "memberOf", Value: "editors", Roles: []string{"editor"}},
+			{Attribute: "memberOf", Value: "staff", Groups: []string{"staff"}},
+		},
+		DefaultRoles: models.StringArray{"viewer"},
+	}
+	roles := func() []string { return s.SSO.userRoleNames(user.ID) }
+	groups := func() []string { return s.SSO.userGroupNames(user.ID) }
+
+	editor := samlProfile("alice@example.com", map[string][]string{"memberOf": {"editors", "staff"}})
+	require.NoError(t, s.SSO.applySAMLRoles(db, provider, editor, user.ID))
+	assert.Equal(t, []string{"editor", "viewer"}, roles())
+	assert.Equal(t, []string{"staff"}, groups())
+
+	// A role granted by hand is kept
+	var manual models.Role
+	require.NoError(t, db.Where("name = ?", "manual").First(&manual).Error)
+	require.NoError(t, db.Create(&models.UserRole{UserID: user.ID, RoleID: manual.ID}).Error)
+
+	// Without SyncRoles mapped roles stay when they are no longer asserted
+	plain := samlProfile("alice@example.com", map[string][]string{"memberOf": {"other"}})
+	require.NoError(t, s.SSO.applySAMLRoles(db, provider, plain, user.ID))
+	assert.Equal(t, []string{"editor", "manual", "viewer"}, roles())
+	assert.Equal(t, []string{"staff"}, groups())
+
+	// SyncRoles revokes them, but not default or unmapped roles
+	provider.SyncRoles = true
+	require.NoError(t, s.SSO.applySAMLRoles(db, provider, plain, user.ID))
+	assert.Equal(t, []string{"manual", "viewer"}, roles())
+	assert.Empty(t, groups())
+}
+
+func TestSAMLSPMFA(t *testing.T) {
+	s := setupSSOTest(t)
+	db := s.SSO.db
+	user := createTestUser(t, db, "alice")
+	require.NoError(t, db.Model(user).Update("mfa_enabled", true).Error)
+	user.MFAEnabled = true
+
+	tokenPattern := regexp.MustCompile(`name="mfa_token" value="([^"]+)"`)
+	prompt := func() string {
+		w := performRequest(func(c *gin.Context) {
+			s.SSO.promptFederatedMFA(c, user, "/dashboard")
+		}, http.MethodPost, "/saml/sp/acs", nil, nil)
+		match := tokenPattern.FindStringSubmatch(w.Body.String())
+		if match == nil {
+			return ""
+		}
+		return match[1]
+	}
+	submit := func(token, code string) *http.Response {
+		form := url.Values{"mfa_token": {token}, "code": {code}}
+		// The engine writes the header of a redirect without a body after
+		// the handler returns; a bare test context does not
+		handler := func(c *gin.Context) {
+			s.SSO.SAMLSPMFA(c)
+			c.Writer.WriteHeaderNow()
+		}
+		return performRequest(handler, http.MethodPost, "/saml/sp/mfa", form, nil).Result()
+	}
+
+	// Without a verified device the user cannot sign in
+	assert.Empty(t, prompt())
+
+	secret, _, err := auth.GenerateTOTPSecret("OpenAuth", "alice")
+	require.NoError(t, err)
+	require.NoError(t, db.Create(&models.MFADevice{UserID: user.ID, Type: "totp", Secret: secret, Verified: true}).Error)
+
+	// A wrong code uses up the pending login
+	token := prompt()
+	require.NotEmpty(t, token)
+	assert.Equal(t, http.StatusBadRequest, submit(token, "000000").StatusCode)
+	code, err := totp.GenerateCode(secret, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, submit(token, code).StatusCode)
+
+	var sessions int64
+	db.Model(&models.Session{}).Where("user_id = ?", user.ID).Count(&sessions)
+	assert.Zero(t, sessions)
+
+	// The right code starts the session
+	resp := submit(prompt(), code)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/dashboard", resp.Header.Get("Location"))
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == auth.SessionCookie {
+			cookie = c
+		}
+	}
+	assert.NotNil(t, cookie)
+	db.Model(&models.Session{}).Where("user_id = ?", user.ID).Count(&sessions)
+	assert.Equal(t, int64(1), sessions)
+}
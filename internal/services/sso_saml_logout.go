@@ -0,0 +1,299 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/auth"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"gorm.io/gorm/clause"
+)
+
+// samlLogoutTTL bounds how long an SP may take to answer a LogoutRequest
+const samlLogoutTTL = 10 * time.Minute
+
+// samlLogout is the state of a SAML front-channel logout, which sends the
+// user agent to the SPs of the ended sessions one after another. It is
+// stored under the ID of the LogoutRequest the current SP has to answer.
+type samlLogout struct {
+	Pending []models.SAMLSessionParticipant `json:"pending"`
+	Current uint64                          `json:"current,omitempty"` // application that was sent the LogoutRequest
+	Partial bool                            `json:"partial,omitempty"` // some SP could not be logged out
+	// The SP whose LogoutRequest started the logout is answered at the end
+	OriginAppID     uint64 `json:"origin_app_id,omitempty"`
+	OriginRequestID string `json:"origin_request_id,omitempty"`
+	RelayState      string `json:"relay_state,omitempty"`
+	// Otherwise the logged out page of the end session endpoint is shown
+	FrontchannelURLs []string `json:"frontchannel_urls,omitempty"`
+	RedirectURI      string   `json:"redirect_uri,omitempty"`
+}
+
+func samlLogoutKey(requestID string) string {
+	return fmt.Sprintf("saml:logout:%s", requestID)
+}
+
+// samlSessionIndex returns the session index the SP was given in the login
+// session, or a new one
+func (s *SSOService) samlSessionIndex(sessionID string, appID uint64) string {
+	if sessionID != "" {
+		var participant models.SAMLSessionParticipant
+		if err := s.db.Where("session_id = ? AND application_id = ?", sessionID, appID).First(&participant).Error; err == nil {
+			return participant.SessionIndex
+		}
+	}
+	return sso.NewSAMLID()
+}
+
+// trackSAMLParticipant records that the SP received an assertion in the
+// login session so it is sent a LogoutRequest when the session ends
+func (s *SSOService) trackSAMLParticipant(sessionID string, appID, userID uint64, sessionIndex string, nameID *saml.NameID) {
+	if sessionID == "" || nameID == nil {
+		return
+	}
+	row := models.SAMLSessionParticipant{
+		SessionID:     sessionID,
+		ApplicationID: appID,
+		UserID:        userID,
+		SessionIndex:  sessionIndex,
+		NameID:        nameID.Value,
+		NameIDFormat:  nameID.Format,
+	}
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "session_id"}, {Name: "application_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"name_id", "name_id_format"}),
+	}).Create(&row).Error
+	if err != nil {
+		s.logger.WithError(err).Warn("Failed to record SAML session participant")
+	}
+}
+
+// takeSAMLParticipants forgets the SPs of the sessions and returns those
+// other than exceptAppID, which are to be sent LogoutRequests
+func (s *SSOService) takeSAMLParticipants(sessionIDs []string, userID, exceptAppID uint64) []models.SAMLSessionParticipant {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+	var rows []models.SAMLSessionParticipant
+	if err := s.db.Where("session_id IN ? AND user_id = ?", sessionIDs, userID).Find(&rows).Error; err != nil {
+		s.logger.WithError(err).Error("Failed to load SAML session participants")
+		return nil
+	}
+	s.db.Where("session_id IN ? AND user_id = ?", sessionIDs, userID).Delete(&models.SAMLSessionParticipant{})
+
+	var pending []models.SAMLSessionParticipant
+	for _, row := range rows {
+		if row.ApplicationID != exceptAppID {
+			pending = append(pending, row)
+		}
+	}
+	return pending
+}
+
+// SAMLSLO is the SingleLogoutService of the IdP. A LogoutRequest from an SP
+// ends the login session and is propagated to the other SPs of the session,
+// whose LogoutResponses come back here. Without a message the user is sent
+// to the end session endpoint, which confirms the logout.
+func (s *SSOService) SAMLSLO(c *gin.Context) {
+	appID := c.Query("app_id")
+	if appID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "missing_app_id",
+		})
+		return
+	}
+
+	var app models.Application
+	if err := s.db.Where("id = ? AND protocol = ?", appID, "saml").First(&app).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "application_not_found",
+		})
+		return
+	}
+
+	var samlConfig models.SAMLConfig
+	if err := s.db.Where("application_id = ?", app.ID).First(&samlConfig).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "saml_config_not_found",
+		})
+		return
+	}
+
+	binding, param := samlBinding(c)
+	if request := param("SAMLRequest"); request != "" {
+		s.samlLogoutRequest(c, &samlConfig, binding, request, param("RelayState"))
+		return
+	}
+	if response := param("SAMLResponse"); response != "" {
+		s.samlLogoutResponse(c, &samlConfig, binding, response)
+		return
+	}
+	c.Redirect(http.StatusFound, "/oauth2/logout")
+}
+
+// samlLogoutRequest ends the login sessions an SP's LogoutRequest names and
+// logs the user out of the other SPs of those sessions before answering
+func (s *SSOService) samlLogoutRequest(c *gin.Context, samlConfig *models.SAMLConfig, binding, message, relayState string) {
+	idp := sso.NewSAMLIdP(s.config.OIDC.Issuer, samlConfig.ApplicationID)
+	decoded, err := sso.DecodeSAMLMessage(binding, message)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_saml_request",
+			"error_description": err.Error(),
+		})
+		return
+	}
+	request, signed, err := sso.ValidateLogoutRequest(idp, samlConfig, binding, c.Request.URL.RawQuery, decoded, time.Now())
+	if err == nil && !signed && c.GetString("session_id") == "" {
+		err = errors.New("unsigned LogoutRequest must come with the user's session")
+	}
+	if err != nil {
+		s.logger.WithError(err).WithField("app_id", samlConfig.ApplicationID).Warn("Rejected SAML LogoutRequest")
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_saml_request",
+			"error_description": err.Error(),
+		})
+		return
+	}
+
+	// The SP names the session by its session index, or else only the
+	// subject. Anyone can forge an unsigned request, so it only ends the
+	// login session of the user agent that sends it.
+	query := s.db.Where("application_id = ? AND name_id = ?", samlConfig.ApplicationID, request.NameID.Value)
+	if request.SessionIndex != nil && request.SessionIndex.Value != "" {
+		query = query.Where("session_index = ?", request.SessionIndex.Value)
+	}
+	if !signed {
+		query = query.Where("session_id = ?", c.GetString("session_id"))
+	}
+	var participants []models.SAMLSessionParticipant
+	if err := query.Find(&participants).Error; err != nil {
+		s.logger.WithError(err).Error("Failed to load SAML session participants")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal_error",
+		})
+		return
+	}
+
+	state := &samlLogout{
+		OriginAppID:     samlConfig.ApplicationID,
+		OriginRequestID: request.ID,
+		RelayState:      relayState,
+	}
+	if len(participants) > 0 {
+		userID := participants[0].UserID
+		var sessionIDs []string
+		for _, participant := range participants {
+			if !containsString(sessionIDs, participant.SessionID) {
+				sessionIDs = append(sessionIDs, participant.SessionID)
+			}
+		}
+		s.db.Where("sid IN ? AND user_id = ?", sessionIDs, userID).Delete(&models.Session{})
+		if containsString(sessionIDs, c.GetString("session_id")) {
+			auth.ClearSessionCookie(c)
+		}
+		s.endSessions(c.Request.Context(), userID, sessionIDs)
+		state.Pending = s.takeSAMLParticipants(sessionIDs, userID, samlConfig.ApplicationID)
+	}
+	s.continueSAMLLogout(c, state)
+}
+
+// samlLogoutResponse takes the answer of an SP that was sent a LogoutRequest
+// and continues with the next SP
+func (s *SSOService) samlLogoutResponse(c *gin.Context, samlConfig *models.SAMLConfig, binding, message string) {
+	idp := sso.NewSAMLIdP(s.config.OIDC.Issuer, samlConfig.ApplicationID)
+	decoded, err := sso.DecodeSAMLMessage(binding, message)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_saml_response",
+			"error_description": err.Error(),
+		})
+		return
+	}
+	response, err := sso.ValidateLogoutResponse(idp, samlConfig, binding, c.Request.URL.RawQuery, decoded, time.Now())
+	if err != nil {
+		s.logger.WithError(err).WithField("app_id", samlConfig.ApplicationID).Warn("Rejected SAML LogoutResponse")
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_saml_response",
+			"error_description": err.Error(),
+		})
+		return
+	}
+
+	var state samlLogout
+	data, err := s.redis.GetDel(c.Request.Context(), samlLogoutKey(response.InResponseTo)).Bytes()
+	if err != nil || json.Unmarshal(data, &state) != nil || state.Current != samlConfig.ApplicationID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "invalid_saml_response",
+			"error_description": "LogoutResponse does not answer a pending LogoutRequest",
+		})
+		return
+	}
+	if response.Status.StatusCode.Value != saml.StatusSuccess {
+		state.Partial = true
+	}
+	s.continueSAMLLogout(c, &state)
+}
+
+// continueSAMLLogout sends the user agent to the next SP with a
+// LogoutRequest, or finishes the logout when every SP has been visited
+func (s *SSOService) continueSAMLLogout(c *gin.Context, state *samlLogout) {
+	for len(state.Pending) > 0 {
+		participant := state.Pending[0]
+		state.Pending = state.Pending[1:]
+		if err := s.sendSAMLLogoutRequest(c, state, &participant); err != nil {
+			s.logger.WithError(err).WithField("app_id", participant.ApplicationID).Warn("Failed to propagate SAML logout")
+			state.Partial = true
+			continue
+		}
+		return
+	}
+
+	if state.OriginAppID == 0 {
+		s.renderLoggedOut(c, state.FrontchannelURLs, state.RedirectURI)
+		return
+	}
+	var samlConfig models.SAMLConfig
+	err := s.db.Where("application_id = ?", state.OriginAppID).First(&samlConfig).Error
+	if err == nil && samlConfig.SLOURL == "" {
+		err = errors.New("SP has no SingleLogoutService")
+	}
+	if err == nil {
+		idp := sso.NewSAMLIdP(s.config.OIDC.Issuer, state.OriginAppID)
+		response := sso.BuildSAMLLogoutResponse(idp, samlConfig.SLOURL, state.OriginRequestID, state.Partial)
+		err = s.sendSAMLMessage(c, &samlConfig, samlConfig.SLOBinding, samlConfig.SLOURL, "SAMLResponse", response.Element(), state.RelayState)
+	}
+	if err != nil {
+		s.logger.WithError(err).WithField("app_id", state.OriginAppID).Warn("Failed to send SAML LogoutResponse")
+		s.renderLoggedOut(c, nil, "")
+	}
+}
+
+// sendSAMLLogoutRequest sends the user agent to the participant's SP with a
+// LogoutRequest and saves the logout state until the SP answers
+func (s *SSOService) sendSAMLLogoutRequest(c *gin.Context, state *samlLogout, participant *models.SAMLSessionParticipant) error {
+	var samlConfig models.SAMLConfig
+	if err := s.db.Where("application_id = ?", participant.ApplicationID).First(&samlConfig).Error; err != nil {
+		return err
+	}
+	if samlConfig.SLOURL == "" {
+		return errors.New("SP has no SingleLogoutService")
+	}
+
+	idp := sso.NewSAMLIdP(s.config.OIDC.Issuer, participant.ApplicationID)
+	request := sso.BuildSAMLLogoutRequest(idp, samlConfig.SLOURL, participant)
+	state.Current = participant.ApplicationID
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := s.redis.Set(c.Request.Context(), samlLogoutKey(request.ID), data, samlLogoutTTL).Err(); err != nil {
+		return err
+	}
+	return s.sendSAMLMessage(c, &samlConfig, samlConfig.SLOBinding, samlConfig.SLOURL, "SAMLRequest", request.Element(), "")
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSAMLLogoutRequest(t *testing.T) {
+	s := setupSSOTest(t)
+	db := s.SSO.db
+	user := createTestUser(t, db, "alice")
+	app := &models.Application{Name: "Wiki", Protocol: "saml"}
+	require.NoError(t, db.Create(app).Error)
+	samlConfig := &models.SAMLConfig{
+		ApplicationID: app.ID,
+		EntityID:      "https://sp.example.com",
+		SSOURL:        "https://sp.example.com/acs",
+	}
+	require.NoError(t, db.Create(samlConfig).Error)
+	idp := sso.NewSAMLIdP("https://idp.example.com", app.ID)
+
+	// The user has two browser sessions, both with the SP
+	login := func(sessionID, sessionIndex string) {
+		require.NoError(t, db.Create(&models.Session{
+			UserID:    user.ID,
+			Token:     "token-" + sessionID,
+			SID:       sessionID,
+			ExpiresAt: time.Now().Add(time.Hour),
+		}).Error)
+		s.SSO.trackSAMLParticipant(sessionID, app.ID, user.ID, sessionIndex, &saml.NameID{Value: "alice@example.com"})
+	}
+	login("sid-1", "_index-1")
+	login("sid-2", "_index-2")
+
+	newRequest := func(sessionIndex string) *saml.LogoutRequest {
+		request := &saml.LogoutRequest{
+			ID:           sso.NewSAMLID(),
+			Version:      "2.0",
+			IssueInstant: saml.TimeNow(),
+			Destination:  idp.SLOURL,
+			Issuer:       &saml.Issuer{Value: samlConfig.EntityID},
+			NameID:       &saml.NameID{Value: "alice@example.com"},
+		}
+		if sessionIndex != "" {
+			request.SessionIndex = &saml.SessionIndex{Value: sessionIndex}
+		}
+		return request
+	}
+	send := func(request *saml.LogoutRequest, signer *sso.SAMLSigner, sessionID string) int {
+		el := request.Element()
+		if signer != nil {
+			var err error
+			el, err = signer.SignEnveloped(el)
+			require.NoError(t, err)
+		}
+		data, err := sso.MarshalSAMLElement(el)
+		require.NoError(t, err)
+		form := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(data)}}
+		target := fmt.Sprintf("/saml/slo?app_id=%d", app.ID)
+		w := performRequest(s.SSO.SAMLSLO, http.MethodPost, target, form, func(c *gin.Context) {
+			if sessionID != "" {
+				c.Set("user_id", user.ID)
+				c.Set("session_id", sessionID)
+			}
+		})
+		return w.Code
+	}
+
+	t.Run("unsigned without the user's session is rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, send(newRequest("_index-1"), nil, ""))
+		assert.True(t, s.SSO.sessionActive("sid-1"))
+	})
+
+	t.Run("unsigned without session index is rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, send(newRequest(""), nil, "sid-1"))
+		assert.True(t, s.SSO.sessionActive("sid-1"))
+		assert.True(t, s.SSO.sessionActive("sid-2"))
+	})
+
+	t.Run("unsigned cannot end another session", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send(newRequest("_index-2"), nil, "sid-1"))
+		assert.True(t, s.SSO.sessionActive("sid-1"))
+		assert.True(t, s.SSO.sessionActive("sid-2"))
+	})
+
+	t.Run("unsigned ends the user's own session", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send(newRequest("_index-1"), nil, "sid-1"))
+		assert.False(t, s.SSO.sessionActive("sid-1"))
+		assert.True(t, s.SSO.sessionActive("sid-2"))
+	})
+
+	key, err := sso.GenerateSAMLKey("sp.example.com", time.Hour)
+	require.NoError(t, err)
+	signer, err := sso.NewSAMLSigner(key.Certificate, key.PrivateKey)
+	require.NoError(t, err)
+	require.NoError(t, db.Model(samlConfig).Update("sp_certificates", models.StringArray{key.Certificate}).Error)
+
+	t.Run("unsigned is rejected once the SP has certificates", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, send(newRequest("_index-2"), nil, "sid-2"))
+		assert.True(t, s.SSO.sessionActive("sid-2"))
+	})
+
+	t.Run("signed ends the sessions of the subject", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send(newRequest(""), signer, ""))
+		assert.False(t, s.SSO.sessionActive("sid-2"))
+
+		var participants int64
+		db.Model(&models.SAMLSessionParticipant{}).Where("user_id = ?", user.ID).Count(&participants)
+		assert.Zero(t, participants)
+	})
+}
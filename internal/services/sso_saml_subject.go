@@ -0,0 +1,55 @@
+package services
+
+import (
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"gorm.io/gorm/clause"
+)
+
+// samlClaimSource loads the memberships the application's attributes and
+// NameID are released from
+func (s *SSOService) samlClaimSource(user *models.User, samlConfig *models.SAMLConfig) *sso.ClaimSource {
+	src := &sso.ClaimSource{User: user}
+	for _, source := range sso.SAMLSources(samlConfig) {
+		switch source {
+		case sso.SAMLSourceRoles:
+			if src.Roles == nil {
+				src.Roles = s.userRoleNames(user.ID)
+			}
+		case sso.SAMLSourceGroups:
+			if src.Groups == nil {
+				src.Groups = s.userGroupNames(user.ID)
+			}
+		case sso.SAMLSourceOrganizations, sso.SAMLSourceOrgPaths:
+			if src.OrgPaths == nil {
+				src.OrgPaths = s.userOrgPaths(user.ID)
+			}
+		}
+	}
+	return src
+}
+
+// samlPersistentID returns the user's pairwise persistent NameID at the
+// application's SP, creating it on first use. It is empty unless the
+// application sends persistent NameIDs.
+func (s *SSOService) samlPersistentID(samlConfig *models.SAMLConfig, userID uint64) (string, error) {
+	if samlConfig.NameIDFormat != sso.SAMLNameIDPersistent {
+		return "", nil
+	}
+	row := models.SAMLPersistentID{
+		ApplicationID: samlConfig.ApplicationID,
+		UserID:        userID,
+		NameID:        sso.NewSAMLID(),
+	}
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "application_id"}, {Name: "user_id"}},
+		DoNothing: true,
+	}).Create(&row).Error
+	if err != nil {
+		return "", err
+	}
+	if err := s.db.Where("application_id = ? AND user_id = ?", samlConfig.ApplicationID, userID).First(&row).Error; err != nil {
+		return "", err
+	}
+	return row.NameID, nil
+}
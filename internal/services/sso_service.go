@@ -2,8 +2,11 @@ package services
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -12,6 +15,7 @@ import (
 
 	"github.com/crewjam/saml"
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/hanyouqing/openauth/internal/auth"
 	"github.com/hanyouqing/openauth/internal/config"
@@ -23,31 +27,47 @@ import (
 )
 
 type SSOService struct {
-	db     *gorm.DB
-	redis  *redis.Client
-	config *config.Config
-	logger *logrus.Logger
+	db         *gorm.DB
+	redis      *redis.Client
+	config     *config.Config
+	logger     *logrus.Logger
+	signingKey *sso.SigningKey
+
+	softwareStatementKeys []*rsa.PublicKey
 }
 
 func NewSSOService(db *gorm.DB, redis *redis.Client, cfg *config.Config, logger *logrus.Logger) *SSOService {
-	return &SSOService{db: db, redis: redis, config: cfg, logger: logger}
+	s := &SSOService{db: db, redis: redis, config: cfg, logger: logger}
+
+	// Load the ID token signing key, falling back to an ephemeral key so
+	// development setups work without extra configuration
+	var err error
+	if cfg.OIDC.SigningKeyFile != "" {
+		s.signingKey, err = sso.LoadSigningKey(cfg.OIDC.SigningKeyFile)
+		if err != nil {
+			logger.WithError(err).Error("Failed to load OIDC signing key, generating an ephemeral key")
+		}
+	}
+	if s.signingKey == nil {
+		if s.signingKey, err = sso.GenerateSigningKey(); err != nil {
+			logger.WithError(err).Error("Failed to generate OIDC signing key")
+		} else if cfg.OIDC.SigningKeyFile == "" {
+			logger.Warn("No OIDC signing key configured, ID tokens will not verify after restart")
+		}
+	}
+
+	if len(cfg.OIDC.SoftwareStatementKeys) > 0 {
+		if s.softwareStatementKeys, err = sso.LoadSoftwareStatementKeys(cfg.OIDC.SoftwareStatementKeys); err != nil {
+			logger.WithError(err).Error("Failed to load software statement keys")
+		}
+	}
+
+	return s
 }
 
 // OAuth2/OIDC handlers
 func (s *SSOService) OAuth2Authorize(c *gin.Context) {
-	responseType := c.Query("response_type")
 	clientID := c.Query("client_id")
-	redirectURI := c.Query("redirect_uri")
-	scope := c.Query("scope")
-	state := c.Query("state")
-
-	if responseType != "code" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "unsupported_response_type",
-			"error_description": "Only authorization code flow is supported",
-		})
-		return
-	}
 
 	// Validate client
 	var oauthClient models.OAuthClient
@@ -59,6 +79,30 @@ func (s *SSOService) OAuth2Authorize(c *gin.Context) {
 		return
 	}
 
+	// Resolve pushed requests (request_uri) and signed request objects (request)
+	params, ok := s.authorizationParams(c, &oauthClient)
+	if !ok {
+		return
+	}
+	pushed := params.Get("request_uri") != "" || params.Get("request") != ""
+	responseType := params.Get("response_type")
+	redirectURI := params.Get("redirect_uri")
+	scope := params.Get("scope")
+	state := params.Get("state")
+	nonce := params.Get("nonce")
+	prompt := params.Get("prompt")
+	maxAge := params.Get("max_age")
+	codeChallenge := params.Get("code_challenge")
+	codeChallengeMethod := params.Get("code_challenge_method")
+
+	if responseType != "code" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "unsupported_response_type",
+			"error_description": "Only authorization code flow is supported",
+		})
+		return
+	}
+
 	// Validate redirect URI
 	validURI := false
 	for _, uri := range oauthClient.RedirectURIs {
@@ -75,25 +119,150 @@ func (s *SSOService) OAuth2Authorize(c *gin.Context) {
 		return
 	}
 
-	// Check if user is authenticated
+	// Validate PKCE parameters, which public clients must always send
+	if codeChallenge != "" {
+		if codeChallengeMethod == "" {
+			codeChallengeMethod = sso.CodeChallengePlain
+		}
+		if !sso.ValidCodeChallenge(codeChallenge, codeChallengeMethod) {
+			c.Redirect(http.StatusFound, sso.AppendQuery(redirectURI, url.Values{
+				"error":             {"invalid_request"},
+				"error_description": {"Invalid code_challenge or code_challenge_method"},
+				"state":             {state},
+			}))
+			return
+		}
+	} else if oauthClient.Public {
+		c.Redirect(http.StatusFound, sso.AppendQuery(redirectURI, url.Values{
+			"error":             {"invalid_request"},
+			"error_description": {"code_challenge is required for public clients"},
+			"state":             {state},
+		}))
+		return
+	}
+
+	if !sso.ValidPrompt(prompt) {
+		c.Redirect(http.StatusFound, sso.AppendQuery(redirectURI, url.Values{
+			"error":             {"invalid_request"},
+			"error_description": {"prompt=none cannot be combined with other values"},
+			"state":             {state},
+		}))
+		return
+	}
+
+	if !sso.ClientAllowsScope(&oauthClient, scope) {
+		c.Redirect(http.StatusFound, sso.AppendQuery(redirectURI, url.Values{
+			"error":             {"invalid_scope"},
+			"error_description": {"Client is not allowed to request the scope"},
+			"state":             {state},
+		}))
+		return
+	}
+
+	// Check if user is authenticated. Tokens of logged out sessions no longer count.
 	userID, exists := c.Get("user_id")
+	if sessionID := c.GetString("session_id"); exists && sessionID != "" && !s.sessionActive(sessionID) {
+		exists = false
+	}
 	if !exists {
-		// Redirect to login page
-		loginURL := fmt.Sprintf("/login?redirect=%s&client_id=%s&redirect_uri=%s&scope=%s&state=%s",
-			c.Request.URL.Path, clientID, url.QueryEscape(redirectURI), scope, state)
-		c.Redirect(http.StatusFound, loginURL)
+		if sso.HasPrompt(prompt, "none") {
+			c.Redirect(http.StatusFound, sso.AppendQuery(redirectURI, url.Values{
+				"error": {"login_required"},
+				"state": {state},
+			}))
+			return
+		}
+		if pushed {
+			s.redirectToLoginPushed(c, params)
+		} else {
+			s.redirectToLogin(c)
+		}
+		return
+	}
+
+	// Force re-authentication for prompt=login or when the session is older than max_age
+	authTime := c.GetInt64("auth_time")
+	if authTime == 0 {
+		authTime = time.Now().Unix()
+	}
+	reauthenticate := sso.HasPrompt(prompt, "login")
+	if maxAge != "" {
+		var seconds int64
+		fmt.Sscanf(maxAge, "%d", &seconds)
+		reauthenticate = reauthenticate || time.Now().Unix()-authTime > seconds
+	}
+	if reauthenticate {
+		if sso.HasPrompt(prompt, "none") {
+			c.Redirect(http.StatusFound, sso.AppendQuery(redirectURI, url.Values{
+				"error": {"login_required"},
+				"state": {state},
+			}))
+			return
+		}
+		if pushed {
+			s.redirectToLoginPushed(c, params)
+		} else {
+			s.redirectToLogin(c)
+		}
+		return
+	}
+
+	var user models.User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "user_not_found",
+		})
+		return
+	}
+	acr, amr := s.authenticationContext(&user)
+
+	// The pushed request is used up now that the user is known
+	s.consumeAuthorizationRequest(c.Request.Context(), params)
+
+	codeData := map[string]interface{}{
+		"client_id":             clientID,
+		"user_id":               userID,
+		"redirect_uri":          redirectURI,
+		"scope":                 scope,
+		"nonce":                 nonce,
+		"auth_time":             authTime,
+		"acr":                   acr,
+		"amr":                   strings.Join(amr, " "),
+		"code_challenge":        codeChallenge,
+		"code_challenge_method": codeChallengeMethod,
+		"dpop_jkt":              params.Get("dpop_jkt"),
+	}
+
+	// Ask the user to approve the client unless it is first-party or every
+	// requested scope was already granted
+	if s.consentRequired(&oauthClient, user.ID, scope, prompt) {
+		if sso.HasPrompt(prompt, "none") {
+			c.Redirect(http.StatusFound, sso.AppendQuery(redirectURI, url.Values{
+				"error": {"consent_required"},
+				"state": {state},
+			}))
+			return
+		}
+		s.showConsent(c, &oauthClient, &user, codeData, state)
 		return
 	}
 
-	// Generate authorization code
+	s.redirectWithCode(c, codeData, state)
+}
+
+// redirectWithCode stores an authorization code for the approved request and
+// sends the user agent back to the client.
+func (s *SSOService) redirectWithCode(c *gin.Context, codeData map[string]interface{}, state string) {
 	code := sso.GenerateAuthorizationCode()
 	codeKey := fmt.Sprintf("oauth2:code:%s", code)
-	codeData := map[string]interface{}{
-		"client_id":    clientID,
-		"user_id":      userID,
-		"redirect_uri":  redirectURI,
-		"scope":        scope,
-		"expires_at":   time.Now().Add(10 * time.Minute).Unix(),
+	codeData["expires_at"] = time.Now().Add(10 * time.Minute).Unix()
+
+	// Remember the client in the login session for OIDC logout
+	if sessionID := c.GetString("session_id"); sessionID != "" {
+		codeData["sid"] = sessionID
+		var userID uint64
+		fmt.Sscanf(fmt.Sprintf("%v", codeData["user_id"]), "%d", &userID)
+		s.trackSessionClient(sessionID, fmt.Sprintf("%v", codeData["client_id"]), userID)
 	}
 
 	// Store code in Redis
@@ -108,19 +277,402 @@ func (s *SSOService) OAuth2Authorize(c *gin.Context) {
 	s.redis.Expire(ctx, codeKey, 10*time.Minute)
 
 	// Redirect with authorization code
-	redirectURL := fmt.Sprintf("%s?code=%s", redirectURI, code)
+	params := url.Values{"code": {code}}
 	if state != "" {
-		redirectURL += "&state=" + state
+		params.Set("state", state)
 	}
-	c.Redirect(http.StatusFound, redirectURL)
+	c.Redirect(http.StatusFound, sso.AppendQuery(fmt.Sprintf("%v", codeData["redirect_uri"]), params))
+}
+
+// redirectToLogin sends the user to the login page and back to the current
+// authorization request afterwards. prompt=login is dropped so that the
+// request doesn't loop once the user has re-authenticated.
+func (s *SSOService) redirectToLogin(c *gin.Context) {
+	query := withoutLoginPrompt(c.Request.URL.Query())
+	returnTo := c.Request.URL.Path + "?" + query.Encode()
+	c.Redirect(http.StatusFound, "/login?redirect="+url.QueryEscape(returnTo))
+}
+
+// withoutLoginPrompt drops prompt=login and prompt=none from request parameters
+func withoutLoginPrompt(query url.Values) url.Values {
+	var prompts []string
+	for _, p := range sso.ParseScopes(query.Get("prompt")) {
+		if p != "login" && p != "none" {
+			prompts = append(prompts, p)
+		}
+	}
+	if len(prompts) > 0 {
+		query.Set("prompt", strings.Join(prompts, " "))
+	} else {
+		query.Del("prompt")
+	}
+	return query
+}
+
+// authenticationContext derives the acr and amr values for the user's session.
+// Login enforces MFA for users that enabled it, so their sessions are multi-factor.
+func (s *SSOService) authenticationContext(user *models.User) (string, []string) {
+	if user.MFAEnabled {
+		return sso.ACRMFA, []string{"pwd", "otp", "mfa"}
+	}
+	return sso.ACRPassword, []string{"pwd"}
+}
+
+// issueIDToken builds and signs an OIDC ID token. authData carries the nonce,
+// auth_time, acr, amr and sid recorded when the user authorized the client.
+func (s *SSOService) issueIDToken(user *models.User, clientID, scope, accessToken string, authData map[string]string) (string, error) {
+	if s.signingKey == nil {
+		return "", fmt.Errorf("no signing key available")
+	}
+
+	now := time.Now()
+	expiry := time.Duration(s.config.OIDC.IDTokenExpiry) * time.Minute
+	claims := jwt.MapClaims{}
+	for k, v := range s.buildUserInfo(user, scope) {
+		claims[k] = v
+	}
+	claims["iss"] = s.config.OIDC.Issuer
+	claims["sub"] = fmt.Sprintf("%d", user.ID)
+	claims["aud"] = clientID
+	claims["azp"] = clientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(expiry).Unix()
+
+	authTime := now.Unix()
+	if v := authData["auth_time"]; v != "" {
+		fmt.Sscanf(v, "%d", &authTime)
+	}
+	claims["auth_time"] = authTime
+	if nonce := authData["nonce"]; nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if acr := authData["acr"]; acr != "" {
+		claims["acr"] = acr
+	}
+	if amr := authData["amr"]; amr != "" {
+		claims["amr"] = strings.Fields(amr)
+	}
+	if sid := authData["sid"]; sid != "" {
+		claims["sid"] = sid
+	}
+	if accessToken != "" {
+		claims["at_hash"] = sso.AtHash(accessToken)
+	}
+
+	return s.signingKey.Sign(claims)
+}
+
+// OIDCDiscovery serves the OpenID Provider configuration document
+func (s *SSOService) OIDCDiscovery(c *gin.Context) {
+	doc := sso.DiscoveryDocument(s.config.OIDC.Issuer)
+	s.addRegistryScopes(doc)
+	c.JSON(http.StatusOK, doc)
+}
+
+// OIDCJWKS serves the public keys used to verify ID tokens
+func (s *SSOService) OIDCJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, sso.JWKS(s.signingKey))
+}
+
+const (
+	accessTokenExpiry  = time.Hour
+	refreshTokenExpiry = 7 * 24 * time.Hour
+)
+
+// tokenGrant describes the tokens to mint for a successful grant
+type tokenGrant struct {
+	ClientID string
+	UserID   *uint64
+	Scope    string
+	// Refresh issues a refresh token in FamilyID, starting a new family when
+	// empty. RefreshScope defaults to Scope.
+	Refresh      bool
+	RefreshScope string
+	FamilyID     string
+	// AuthData carries auth_time, acr and amr of the original authentication
+	AuthData map[string]string
+	// Token exchange: the audience and act claim of the issued token, whether
+	// it must be a JWT, and an expiry capped by the subject token's
+	Audience  string
+	Act       map[string]interface{}
+	ForceJWT  bool
+	ExpiresAt time.Time
+	// DPoPJKT binds the access token, and the refresh token of a public
+	// client, to the DPoP key with this thumbprint (RFC 9449)
+	DPoPJKT string
+}
+
+// issueTokens stores a new access token, and optionally a refresh token, in
+// Redis and records them in the database.
+func (s *SSOService) issueTokens(ctx context.Context, grant *tokenGrant) (*models.OAuthToken, error) {
+	now := time.Now()
+	oauthToken := &models.OAuthToken{
+		ClientID:    grant.ClientID,
+		UserID:      grant.UserID,
+		AccessToken: uuid.New().String(),
+		Format:      sso.AccessTokenFormatOpaque,
+		TokenType:   "Bearer",
+		ExpiresAt:   now.Add(accessTokenExpiry),
+		Scope:       grant.Scope,
+	}
+	if !grant.ExpiresAt.IsZero() && grant.ExpiresAt.Before(oauthToken.ExpiresAt) {
+		oauthToken.ExpiresAt = grant.ExpiresAt
+	}
+	if grant.DPoPJKT != "" {
+		oauthToken.TokenType = "DPoP"
+		oauthToken.JKT = grant.DPoPJKT
+	}
+
+	// Clients can opt into self-contained JWT access tokens. The jti takes the
+	// place of the opaque token in Redis and the database.
+	var oauthClient models.OAuthClient
+	if err := s.db.Where("client_id = ?", grant.ClientID).First(&oauthClient).Error; err == nil && (grant.ForceJWT || oauthClient.AccessTokenFormat == sso.AccessTokenFormatJWT) {
+		signed, err := s.signAccessToken(&oauthClient, grant, accessTokenValue(oauthToken), now, oauthToken.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign access token: %w", err)
+		}
+		oauthToken.Format = sso.AccessTokenFormatJWT
+		oauthToken.JWT = signed
+	}
+
+	// Store access token
+	tokenKey := fmt.Sprintf("oauth2:token:%s", oauthToken.AccessToken)
+	tokenData := map[string]interface{}{
+		"client_id":  grant.ClientID,
+		"scope":      grant.Scope,
+		"expires_at": oauthToken.ExpiresAt.Unix(),
+	}
+	if grant.UserID != nil {
+		tokenData["user_id"] = *grant.UserID
+	}
+	if grant.Audience != "" {
+		tokenData["aud"] = grant.Audience
+	}
+	if grant.Act != nil {
+		act, _ := json.Marshal(grant.Act)
+		tokenData["act"] = string(act)
+	}
+	if grant.DPoPJKT != "" {
+		tokenData["jkt"] = grant.DPoPJKT
+	}
+	if err := s.redis.HSet(ctx, tokenKey, tokenData).Err(); err != nil {
+		return nil, fmt.Errorf("failed to store access token: %w", err)
+	}
+	s.redis.Expire(ctx, tokenKey, time.Until(oauthToken.ExpiresAt))
+
+	// Store refresh token
+	if grant.Refresh {
+		familyID := grant.FamilyID
+		if familyID == "" {
+			familyID = uuid.New().String()
+		}
+		refreshScope := grant.RefreshScope
+		if refreshScope == "" {
+			refreshScope = grant.Scope
+		}
+		refreshToken := uuid.New().String()
+		oauthToken.RefreshToken = &refreshToken
+		oauthToken.FamilyID = familyID
+
+		refreshKey := fmt.Sprintf("oauth2:refresh:%s", refreshToken)
+		refreshData := map[string]interface{}{
+			"client_id":  grant.ClientID,
+			"scope":      refreshScope,
+			"family_id":  familyID,
+			"expires_at": now.Add(refreshTokenExpiry).Unix(),
+		}
+		if grant.UserID != nil {
+			refreshData["user_id"] = *grant.UserID
+		}
+		for _, key := range []string{"auth_time", "acr", "amr", "sid"} {
+			if v := grant.AuthData[key]; v != "" {
+				refreshData[key] = v
+			}
+		}
+		// Confidential clients authenticate when refreshing; the refresh
+		// tokens of public clients are bound to the DPoP key instead
+		if grant.DPoPJKT != "" && oauthClient.Public {
+			refreshData["jkt"] = grant.DPoPJKT
+		}
+		if err := s.redis.HSet(ctx, refreshKey, refreshData).Err(); err != nil {
+			return nil, fmt.Errorf("failed to store refresh token: %w", err)
+		}
+		s.redis.Expire(ctx, refreshKey, refreshTokenExpiry)
+	}
+
+	// Save token to database
+	if err := s.db.Create(oauthToken).Error; err != nil {
+		return nil, fmt.Errorf("failed to save token: %w", err)
+	}
+
+	return oauthToken, nil
+}
+
+// signAccessToken builds a JWT access token as profiled by RFC 9068
+func (s *SSOService) signAccessToken(client *models.OAuthClient, grant *tokenGrant, jti string, issuedAt, expiresAt time.Time) (string, error) {
+	if s.signingKey == nil {
+		return "", fmt.Errorf("no signing key available")
+	}
+
+	audience := grant.Audience
+	if audience == "" {
+		audience = client.AccessTokenAudience
+	}
+	if audience == "" {
+		audience = client.ClientID
+	}
+	claims := jwt.MapClaims{
+		"iss":       s.config.OIDC.Issuer,
+		"sub":       client.ClientID,
+		"aud":       audience,
+		"client_id": client.ClientID,
+		"iat":       issuedAt.Unix(),
+		"exp":       expiresAt.Unix(),
+		"jti":       jti,
+	}
+	if grant.Scope != "" {
+		claims["scope"] = grant.Scope
+	}
+	if acr := grant.AuthData["acr"]; acr != "" {
+		claims["acr"] = acr
+	}
+	if authTime := grant.AuthData["auth_time"]; authTime != "" {
+		var t int64
+		fmt.Sscanf(authTime, "%d", &t)
+		claims["auth_time"] = t
+	}
+	if amr := grant.AuthData["amr"]; amr != "" {
+		claims["amr"] = strings.Fields(amr)
+	}
+	if grant.Act != nil {
+		claims["act"] = grant.Act
+	}
+	if grant.DPoPJKT != "" {
+		claims["cnf"] = map[string]interface{}{"jkt": grant.DPoPJKT}
+	}
+
+	if grant.UserID != nil {
+		claims["sub"] = fmt.Sprintf("%d", *grant.UserID)
+		var user models.User
+		if err := s.db.First(&user, *grant.UserID).Error; err == nil {
+			for k, v := range sso.AccessTokenClaims(s.buildUserInfo(&user, grant.Scope)) {
+				claims[k] = v
+			}
+			// Resource servers authorize on roles, so they do not depend on
+			// the scopes requested
+			roles := s.userRoleNames(user.ID)
+			if roles == nil {
+				roles = []string{}
+			}
+			claims[sso.ClaimRoles] = roles
+		}
+	}
+
+	return s.signingKey.SignWithType(claims, sso.AccessTokenJWTType)
+}
+
+// accessTokenID maps a presented access token to the value it is stored
+// under: the jti for JWT access tokens, the token itself otherwise.
+func (s *SSOService) accessTokenID(token string) string {
+	if s.signingKey == nil || !sso.IsJWT(token) {
+		return token
+	}
+	jti, err := sso.JWTAccessTokenID(token, &s.signingKey.PrivateKey.PublicKey)
+	if err != nil {
+		return token
+	}
+	return jti
+}
+
+// accessTokenRevoked reports whether id, as returned by accessTokenID, is on
+// the denylist of revoked JWT access tokens
+func (s *SSOService) accessTokenRevoked(ctx context.Context, id string) bool {
+	revoked, err := s.redis.Exists(ctx, sso.JTIDenylistKey(id)).Result()
+	return err == nil && revoked > 0
+}
+
+// accessTokenValue is the access token as handed to the client
+func accessTokenValue(token *models.OAuthToken) string {
+	if token.JWT != "" {
+		return token.JWT
+	}
+	return token.AccessToken
+}
+
+func tokenResponse(token *models.OAuthToken) gin.H {
+	response := gin.H{
+		"access_token": accessTokenValue(token),
+		"token_type":   token.TokenType,
+		"expires_in":   int(accessTokenExpiry.Seconds()),
+		"scope":        token.Scope,
+	}
+	if token.RefreshToken != nil {
+		response["refresh_token"] = *token.RefreshToken
+	}
+	return response
+}
+
+// revokeTokens removes the given tokens from Redis and marks their rows revoked
+func (s *SSOService) revokeTokens(ctx context.Context, tokens []models.OAuthToken) {
+	if err := revokeOAuthTokens(ctx, s.db, s.redis, tokens); err != nil {
+		s.logger.WithError(err).Error("Failed to mark OAuth tokens revoked")
+	}
+}
+
+func revokeOAuthTokens(ctx context.Context, db *gorm.DB, rdb *redis.Client, tokens []models.OAuthToken) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	ids := make([]uint64, 0, len(tokens))
+	for _, token := range tokens {
+		rdb.Del(ctx, fmt.Sprintf("oauth2:token:%s", token.AccessToken))
+		if token.RefreshToken != nil {
+			rdb.Del(ctx, fmt.Sprintf("oauth2:refresh:%s", *token.RefreshToken))
+		}
+		// JWT access tokens stay verifiable until they expire, so resource
+		// servers need the jti on the denylist
+		if remaining := time.Until(token.ExpiresAt); token.Format == sso.AccessTokenFormatJWT && remaining > 0 {
+			rdb.Set(ctx, sso.JTIDenylistKey(token.AccessToken), 1, remaining)
+		}
+		ids = append(ids, token.ID)
+	}
+
+	return db.Model(&models.OAuthToken{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+		"revoked":    true,
+		"revoked_at": time.Now(),
+	}).Error
+}
+
+// revokeTokenFamily revokes every token rotated from the same original grant
+func (s *SSOService) revokeTokenFamily(ctx context.Context, familyID string) {
+	var tokens []models.OAuthToken
+	if err := s.db.Where("family_id = ? AND revoked = ?", familyID, false).Find(&tokens).Error; err != nil {
+		s.logger.WithError(err).Error("Failed to load OAuth token family")
+		return
+	}
+	s.revokeTokens(ctx, tokens)
+}
+
+// checkClientGrant rejects grant types the client is not registered for. On
+// failure the unauthorized_client error response has been written.
+func (s *SSOService) checkClientGrant(c *gin.Context, client *models.OAuthClient, grantType string) bool {
+	if sso.ClientAllowsGrant(client, grantType) {
+		return true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":             "unauthorized_client",
+		"error_description": fmt.Sprintf("Client is not allowed to use the %s grant", grantType),
+	})
+	return false
 }
 
 func (s *SSOService) OAuth2Token(c *gin.Context) {
 	grantType := c.PostForm("grant_type")
 	code := c.PostForm("code")
 	redirectURI := c.PostForm("redirect_uri")
-	clientID := c.PostForm("client_id")
-	clientSecret := c.PostForm("client_secret")
+	codeVerifier := c.PostForm("code_verifier")
 
 	if grantType != "authorization_code" {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -130,8 +682,9 @@ func (s *SSOService) OAuth2Token(c *gin.Context) {
 		return
 	}
 
-	// Validate client credentials
-	_, err := sso.ValidateClient(s.db, clientID, clientSecret)
+	// Validate client credentials. Public clients have no secret and are
+	// bound to the code through PKCE instead.
+	oauthClient, err := s.authenticateClient(c)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"error": "invalid_client",
@@ -139,6 +692,14 @@ func (s *SSOService) OAuth2Token(c *gin.Context) {
 		})
 		return
 	}
+	clientID := oauthClient.ClientID
+	if !s.checkClientGrant(c, oauthClient, "authorization_code") {
+		return
+	}
+	dpopJKT, ok := s.tokenDPoPKey(c, oauthClient)
+	if !ok {
+		return
+	}
 
 	// Retrieve authorization code
 	ctx := c.Request.Context()
@@ -160,65 +721,258 @@ func (s *SSOService) OAuth2Token(c *gin.Context) {
 		})
 		return
 	}
+	// A code requested with dpop_jkt may only be redeemed with that key
+	if bound := codeData["dpop_jkt"]; bound != "" && bound != dpopJKT {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_grant",
+			"error_description": "DPoP key does not match the authorization request",
+		})
+		return
+	}
+
+	// Claim the code (one-time use). Only the request that deletes it may
+	// redeem it, so concurrent exchanges cannot both succeed.
+	if claimed, err := s.redis.Del(ctx, codeKey).Result(); err != nil || claimed != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_grant",
+			"error_description": "Invalid or expired authorization code",
+		})
+		return
+	}
 
-	// Delete code (one-time use)
-	s.redis.Del(ctx, codeKey)
+	// Verify PKCE code_verifier
+	if challenge := codeData["code_challenge"]; challenge != "" {
+		if !sso.VerifyCodeChallenge(challenge, codeData["code_challenge_method"], codeVerifier) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid_grant",
+				"error_description": "Invalid code_verifier",
+			})
+			return
+		}
+	} else if oauthClient.Public || codeVerifier != "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_grant",
+			"error_description": "Authorization code was not issued with a code_challenge",
+		})
+		return
+	}
 
 	// Generate tokens
 	var userID uint64
 	fmt.Sscanf(codeData["user_id"], "%d", &userID)
 
-	accessToken := uuid.New().String()
-	refreshToken := uuid.New().String()
-	expiresIn := 3600 // 1 hour
+	oauthToken, err := s.issueTokens(ctx, &tokenGrant{
+		ClientID: clientID,
+		UserID:   &userID,
+		Scope:    codeData["scope"],
+		Refresh:  true,
+		AuthData: codeData,
+		DPoPJKT:  dpopJKT,
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to issue tokens")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
+	}
+	response := tokenResponse(oauthToken)
 
-	// Store access token
-	tokenKey := fmt.Sprintf("oauth2:token:%s", accessToken)
-	tokenData := map[string]interface{}{
-		"user_id":     userID,
-		"client_id":   clientID,
-		"scope":       codeData["scope"],
-		"expires_at":  time.Now().Add(time.Duration(expiresIn) * time.Second).Unix(),
+	// Issue an ID token for OpenID Connect requests
+	if sso.HasScope(codeData["scope"], "openid") {
+		var user models.User
+		if err := s.db.First(&user, userID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid_grant",
+				"error_description": "User not found",
+			})
+			return
+		}
+		idToken, err := s.issueIDToken(&user, clientID, codeData["scope"], accessTokenValue(oauthToken), codeData)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to issue ID token")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "server_error",
+			})
+			return
+		}
+		response["id_token"] = idToken
 	}
-	s.redis.HSet(ctx, tokenKey, tokenData)
-	s.redis.Expire(ctx, tokenKey, time.Duration(expiresIn)*time.Second)
 
-	// Store refresh token
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
+}
+
+// OAuth2RefreshToken handles the refresh_token grant. Refresh tokens are
+// rotated on every use; presenting one that was already rotated is treated as
+// token theft and revokes the whole family.
+func (s *SSOService) OAuth2RefreshToken(c *gin.Context) {
+	grantType := c.PostForm("grant_type")
+	refreshToken := c.PostForm("refresh_token")
+	scope := c.PostForm("scope")
+
+	if grantType != "refresh_token" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "unsupported_grant_type",
+			"error_description": "Only refresh_token grant type is supported",
+		})
+		return
+	}
+
+	if refreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_request",
+			"error_description": "refresh_token is required",
+		})
+		return
+	}
+
+	// Tokens from the password grant may not be bound to a client
+	var clientID string
+	oauthClient, err := s.authenticateClient(c)
+	if err != nil && !errors.Is(err, errNoClientCredentials) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "invalid_client",
+			"error_description": "Invalid client credentials",
+		})
+		return
+	}
+	if oauthClient != nil {
+		clientID = oauthClient.ClientID
+		if !s.checkClientGrant(c, oauthClient, "refresh_token") {
+			return
+		}
+	}
+	dpopJKT, ok := s.tokenDPoPKey(c, oauthClient)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
 	refreshKey := fmt.Sprintf("oauth2:refresh:%s", refreshToken)
-	refreshData := map[string]interface{}{
-		"user_id":    userID,
-		"client_id":  clientID,
-		"scope":      codeData["scope"],
-		"expires_at": time.Now().Add(7 * 24 * time.Hour).Unix(),
+	usedKey := fmt.Sprintf("oauth2:refresh:used:%s", refreshToken)
+	refreshData, err := s.redis.HGetAll(ctx, refreshKey).Result()
+	if err != nil || len(refreshData) == 0 {
+		// Reuse of a rotated token: revoke everything issued from the grant
+		if familyID, err := s.redis.Get(ctx, usedKey).Result(); err == nil {
+			s.logger.WithFields(logrus.Fields{
+				"client_id": clientID,
+				"family_id": familyID,
+			}).Warn("Refresh token reuse detected, revoking token family")
+			s.revokeTokenFamily(ctx, familyID)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_grant",
+			"error_description": "Invalid or expired refresh token",
+		})
+		return
+	}
+
+	if refreshData["client_id"] != clientID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_grant",
+			"error_description": "Refresh token was issued to another client",
+		})
+		return
+	}
+	if bound := refreshData["jkt"]; bound != "" && bound != dpopJKT {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_grant",
+			"error_description": "Refresh token is bound to another DPoP key",
+		})
+		return
+	}
+
+	// Requested scope may only narrow the original grant
+	grantedScope := refreshData["scope"]
+	if scope == "" {
+		scope = grantedScope
+	} else if !sso.ScopeSubset(scope, grantedScope) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_scope",
+			"error_description": "Requested scope exceeds the original grant",
+		})
+		return
+	}
+
+	// Rotate: the request that claims the used marker wins, so concurrent
+	// redemptions and any later one count as reuse
+	familyID := refreshData["family_id"]
+	var expiresAt int64
+	fmt.Sscanf(refreshData["expires_at"], "%d", &expiresAt)
+	ttl := time.Until(time.Unix(expiresAt, 0))
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	claimed, err := s.redis.SetNX(ctx, usedKey, familyID, ttl).Result()
+	if err != nil || !claimed {
+		if err == nil && familyID != "" {
+			s.logger.WithFields(logrus.Fields{
+				"client_id": clientID,
+				"family_id": familyID,
+			}).Warn("Refresh token reuse detected, revoking token family")
+			s.revokeTokenFamily(ctx, familyID)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_grant",
+			"error_description": "Invalid or expired refresh token",
+		})
+		return
+	}
+	s.redis.Del(ctx, refreshKey)
+
+	var user models.User
+	var userID *uint64
+	if refreshData["user_id"] != "" {
+		var id uint64
+		fmt.Sscanf(refreshData["user_id"], "%d", &id)
+		if err := s.db.First(&user, id).Error; err != nil || user.Status != "active" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid_grant",
+				"error_description": "User is not active",
+			})
+			return
+		}
+		userID = &user.ID
+	}
+
+	oauthToken, err := s.issueTokens(ctx, &tokenGrant{
+		ClientID:     clientID,
+		UserID:       userID,
+		Scope:        scope,
+		Refresh:      true,
+		RefreshScope: grantedScope,
+		FamilyID:     familyID,
+		AuthData:     refreshData,
+		DPoPJKT:      dpopJKT,
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to issue tokens")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
+	}
+	response := tokenResponse(oauthToken)
+
+	if userID != nil && clientID != "" && sso.HasScope(scope, "openid") {
+		idToken, err := s.issueIDToken(&user, clientID, scope, accessTokenValue(oauthToken), refreshData)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to issue ID token")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "server_error",
+			})
+			return
+		}
+		response["id_token"] = idToken
 	}
-	s.redis.HSet(ctx, refreshKey, refreshData)
-	s.redis.Expire(ctx, refreshKey, 7*24*time.Hour)
 
-	// Save token to database
-	oauthToken := models.OAuthToken{
-		ClientID:     clientID,
-		UserID:       &userID,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		TokenType:    "Bearer",
-		ExpiresAt:    time.Now().Add(time.Duration(expiresIn) * time.Second),
-		Scope:        codeData["scope"],
-	}
-	s.db.Create(&oauthToken)
-
-	c.JSON(http.StatusOK, gin.H{
-		"access_token":  accessToken,
-		"token_type":    "Bearer",
-		"expires_in":    expiresIn,
-		"refresh_token": refreshToken,
-		"scope":         codeData["scope"],
-	})
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
 }
 
 func (s *SSOService) OAuth2ClientCredentials(c *gin.Context) {
 	grantType := c.PostForm("grant_type")
-	clientID := c.PostForm("client_id")
-	clientSecret := c.PostForm("client_secret")
 	scope := c.PostForm("scope")
 
 	if grantType != "client_credentials" {
@@ -229,57 +983,50 @@ func (s *SSOService) OAuth2ClientCredentials(c *gin.Context) {
 		return
 	}
 
-	// Validate client
-	var oauthClient models.OAuthClient
-	if err := s.db.Where("client_id = ?", clientID).First(&oauthClient).Error; err != nil {
+	// Validate client. Public clients cannot keep credentials and may not use this grant.
+	oauthClient, err := s.authenticateClient(c)
+	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"error": "invalid_client",
-			"error_description": "Invalid client_id",
+			"error_description": "Invalid client credentials",
 		})
 		return
 	}
-
-	// Validate client secret
-	if oauthClient.ClientSecret != clientSecret {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "invalid_client",
-			"error_description": "Invalid client_secret",
+	clientID := oauthClient.ClientID
+	if oauthClient.Public {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "unauthorized_client",
+			"error_description": "Public clients cannot use the client_credentials grant",
 		})
 		return
 	}
-
-	// Generate access token (no refresh token for client credentials)
-	accessToken := uuid.New().String()
-	expiresIn := 3600 // 1 hour
-
-	// Store access token
-	ctx := c.Request.Context()
-	tokenKey := fmt.Sprintf("oauth2:token:%s", accessToken)
-	tokenData := map[string]interface{}{
-		"client_id":   clientID,
-		"scope":       scope,
-		"expires_at":  time.Now().Add(time.Duration(expiresIn) * time.Second).Unix(),
+	if !s.checkClientGrant(c, oauthClient, "client_credentials") {
+		return
 	}
-	s.redis.HSet(ctx, tokenKey, tokenData)
-	s.redis.Expire(ctx, tokenKey, time.Duration(expiresIn)*time.Second)
-
-	// Save token to database
-	oauthToken := models.OAuthToken{
-		ClientID:    clientID,
-		UserID:      nil, // No user for client credentials
-		AccessToken: accessToken,
-		TokenType:   "Bearer",
-		ExpiresAt:   time.Now().Add(time.Duration(expiresIn) * time.Second),
-		Scope:       scope,
+	if !s.checkClientScope(c, oauthClient, scope) {
+		return
+	}
+	dpopJKT, ok := s.tokenDPoPKey(c, oauthClient)
+	if !ok {
+		return
 	}
-	s.db.Create(&oauthToken)
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token": accessToken,
-		"token_type":   "Bearer",
-		"expires_in":   expiresIn,
-		"scope":        scope,
+	// Generate access token (no refresh token for client credentials)
+	oauthToken, err := s.issueTokens(c.Request.Context(), &tokenGrant{
+		ClientID: clientID,
+		Scope:    scope,
+		DPoPJKT:  dpopJKT,
 	})
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to issue tokens")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, tokenResponse(oauthToken))
 }
 
 func (s *SSOService) OAuth2PasswordCredentials(c *gin.Context) {
@@ -287,7 +1034,6 @@ func (s *SSOService) OAuth2PasswordCredentials(c *gin.Context) {
 	username := c.PostForm("username")
 	password := c.PostForm("password")
 	clientID := c.PostForm("client_id")
-	clientSecret := c.PostForm("client_secret")
 	scope := c.PostForm("scope")
 
 	if grantType != "password" {
@@ -298,24 +1044,39 @@ func (s *SSOService) OAuth2PasswordCredentials(c *gin.Context) {
 		return
 	}
 
-	// Validate client (optional for password grant)
-	if clientID != "" {
-		var oauthClient models.OAuthClient
-		if err := s.db.Where("client_id = ?", clientID).First(&oauthClient).Error; err != nil {
+	// Validate client (optional for password grant). A bare client_id only
+	// identifies the client; presented credentials must be valid.
+	var oauthClient *models.OAuthClient
+	if hasClientCredentials(c) {
+		var err error
+		oauthClient, err = s.authenticateClient(c)
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": "invalid_client",
-				"error_description": "Invalid client_id",
+				"error_description": "Invalid client credentials",
 			})
 			return
 		}
-
-		if clientSecret != "" && oauthClient.ClientSecret != clientSecret {
+		clientID = oauthClient.ClientID
+		if !s.checkClientGrant(c, oauthClient, "password") || !s.checkClientScope(c, oauthClient, scope) {
+			return
+		}
+	} else if clientID != "" {
+		oauthClient = &models.OAuthClient{}
+		if err := s.db.Where("client_id = ?", clientID).First(oauthClient).Error; err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": "invalid_client",
-				"error_description": "Invalid client_secret",
+				"error_description": "Invalid client_id",
 			})
 			return
 		}
+		if !s.checkClientGrant(c, oauthClient, "password") || !s.checkClientScope(c, oauthClient, scope) {
+			return
+		}
+	}
+	dpopJKT, ok := s.tokenDPoPKey(c, oauthClient)
+	if !ok {
+		return
 	}
 
 	// Authenticate user
@@ -345,66 +1106,66 @@ func (s *SSOService) OAuth2PasswordCredentials(c *gin.Context) {
 		return
 	}
 
-	// Generate access token
-	accessToken := uuid.New().String()
-	refreshToken := uuid.New().String()
-	expiresIn := 3600 // 1 hour
-
-	// Store access token
-	ctx := c.Request.Context()
-	tokenKey := fmt.Sprintf("oauth2:token:%s", accessToken)
-	tokenData := map[string]interface{}{
-		"user_id":    user.ID,
-		"client_id":  clientID,
-		"scope":      scope,
-		"expires_at": time.Now().Add(time.Duration(expiresIn) * time.Second).Unix(),
+	// Generate tokens
+	acr, amr := s.authenticationContext(&user)
+	authData := map[string]string{
+		"auth_time": fmt.Sprintf("%d", time.Now().Unix()),
+		"acr":       acr,
+		"amr":       strings.Join(amr, " "),
 	}
-	s.redis.HSet(ctx, tokenKey, tokenData)
-	s.redis.Expire(ctx, tokenKey, time.Duration(expiresIn)*time.Second)
-
-	// Store refresh token
-	refreshKey := fmt.Sprintf("oauth2:refresh:%s", refreshToken)
-	refreshData := map[string]interface{}{
-		"user_id":    user.ID,
-		"client_id":  clientID,
-		"scope":      scope,
-		"expires_at": time.Now().Add(7 * 24 * time.Hour).Unix(),
+	oauthToken, err := s.issueTokens(c.Request.Context(), &tokenGrant{
+		ClientID: clientID,
+		UserID:   &user.ID,
+		Scope:    scope,
+		Refresh:  true,
+		AuthData: authData,
+		DPoPJKT:  dpopJKT,
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to issue tokens")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
 	}
-	s.redis.HSet(ctx, refreshKey, refreshData)
-	s.redis.Expire(ctx, refreshKey, 7*24*time.Hour)
+	response := tokenResponse(oauthToken)
 
-	// Save token to database
-	oauthToken := models.OAuthToken{
-		ClientID:     clientID,
-		UserID:       &user.ID,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		TokenType:    "Bearer",
-		ExpiresAt:    time.Now().Add(time.Duration(expiresIn) * time.Second),
-		Scope:        scope,
+	if clientID != "" && sso.HasScope(scope, "openid") {
+		idToken, err := s.issueIDToken(&user, clientID, scope, accessTokenValue(oauthToken), authData)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to issue ID token")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "server_error",
+			})
+			return
+		}
+		response["id_token"] = idToken
 	}
-	s.db.Create(&oauthToken)
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token":  accessToken,
-		"token_type":    "Bearer",
-		"expires_in":    expiresIn,
-		"refresh_token": refreshToken,
-		"scope":         scope,
-	})
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
 }
 
 func (s *SSOService) OAuth2UserInfo(c *gin.Context) {
-	// Get token from Authorization header or access_token parameter
-	var accessToken string
+	// Get token from Authorization header or access_token parameter.
+	// DPoP-bound tokens use the DPoP scheme.
+	var accessToken, scheme string
 	authHeader := c.GetHeader("Authorization")
 	if strings.HasPrefix(authHeader, "Bearer ") {
 		accessToken = strings.TrimPrefix(authHeader, "Bearer ")
+	} else if strings.HasPrefix(authHeader, "DPoP ") {
+		accessToken = strings.TrimPrefix(authHeader, "DPoP ")
+		scheme = "DPoP"
 	} else {
 		accessToken = c.Query("access_token")
 	}
 
 	if accessToken == "" {
+		accessToken = c.PostForm("access_token")
+	}
+
+	if accessToken == "" {
+		c.Header("WWW-Authenticate", `Bearer realm="openauth"`)
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"error": "invalid_request",
 			"error_description": "Access token required",
@@ -414,24 +1175,51 @@ func (s *SSOService) OAuth2UserInfo(c *gin.Context) {
 
 	// Validate token
 	ctx := c.Request.Context()
+	presented := accessToken
+	accessToken = s.accessTokenID(accessToken)
+	if s.accessTokenRevoked(ctx, accessToken) {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "invalid_token",
+			"error_description": "Invalid or expired access token",
+		})
+		return
+	}
 	tokenKey := fmt.Sprintf("oauth2:token:%s", accessToken)
 	tokenData, err := s.redis.HGetAll(ctx, tokenKey).Result()
 	if err != nil || len(tokenData) == 0 {
 		// Try database
 		var oauthToken models.OAuthToken
-		if err := s.db.Where("access_token = ? AND expires_at > ?", accessToken, time.Now()).First(&oauthToken).Error; err != nil {
+		if err := s.db.Where("access_token = ? AND expires_at > ? AND revoked = ?", accessToken, time.Now(), false).First(&oauthToken).Error; err != nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": "invalid_token",
 				"error_description": "Invalid or expired access token",
 			})
 			return
 		}
+		if !s.checkTokenBinding(c, scheme, presented, oauthToken.JKT) {
+			return
+		}
 		// Return user info from token
+		if oauthToken.UserID == nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "user_not_found",
+			})
+			return
+		}
 		var user models.User
-		if oauthToken.UserID != nil {
-			s.db.First(&user, *oauthToken.UserID)
+		if err := s.db.First(&user, *oauthToken.UserID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "user_not_found",
+			})
+			return
 		}
-		c.JSON(http.StatusOK, s.buildUserInfo(&user))
+		c.JSON(http.StatusOK, s.buildUserInfo(&user, oauthToken.Scope))
+		return
+	}
+
+	if !s.checkTokenBinding(c, scheme, presented, tokenData["jkt"]) {
 		return
 	}
 
@@ -447,20 +1235,165 @@ func (s *SSOService) OAuth2UserInfo(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, s.buildUserInfo(&user))
+	c.JSON(http.StatusOK, s.buildUserInfo(&user, tokenData["scope"]))
+}
+
+// OAuth2Introspect implements token introspection (RFC 7662) for resource servers
+func (s *SSOService) OAuth2Introspect(c *gin.Context) {
+	token := c.PostForm("token")
+	tokenTypeHint := c.PostForm("token_type_hint")
+
+	oauthClient, err := s.authenticateClient(c)
+	if err != nil || oauthClient.Public {
+		c.Header("WWW-Authenticate", `Basic realm="openauth"`)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "invalid_client",
+			"error_description": "Invalid client credentials",
+		})
+		return
+	}
+
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_request",
+			"error_description": "token is required",
+		})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+
+	ctx := c.Request.Context()
+	tokenData, tokenType := s.lookupToken(ctx, token, tokenTypeHint)
+	if tokenData == nil {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+
+	var expiresAt int64
+	fmt.Sscanf(tokenData["expires_at"], "%d", &expiresAt)
+	if expiresAt != 0 && time.Now().Unix() >= expiresAt {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+
+	response := gin.H{
+		"active":     true,
+		"scope":      tokenData["scope"],
+		"client_id":  tokenData["client_id"],
+		"token_type": tokenType,
+		"exp":        expiresAt,
+		"iss":        s.config.OIDC.Issuer,
+	}
+	if userID := tokenData["user_id"]; userID != "" {
+		response["sub"] = userID
+		var user models.User
+		if err := s.db.Select("username").First(&user, userID).Error; err == nil {
+			response["username"] = user.Username
+		}
+	}
+	if aud := tokenData["aud"]; aud != "" {
+		response["aud"] = aud
+	}
+	if act := tokenData["act"]; act != "" {
+		var actClaim map[string]interface{}
+		if json.Unmarshal([]byte(act), &actClaim) == nil {
+			response["act"] = actClaim
+		}
+	}
+	if jkt := tokenData["jkt"]; jkt != "" {
+		// A resource server may forward the DPoP proof presented with the
+		// token, along with the method and URI of its request, for checking
+		if proof := c.PostForm("dpop_proof"); proof != "" {
+			verified, err := s.checkDPoPProof(c, proof, c.PostForm("dpop_method"), c.PostForm("dpop_uri"), token)
+			if err != nil || verified.JKT != jkt {
+				c.JSON(http.StatusOK, gin.H{"active": false})
+				return
+			}
+		}
+		response["cnf"] = gin.H{"jkt": jkt}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// OAuth2Revoke implements token revocation (RFC 7009). Revoking a refresh
+// token also revokes the access tokens issued from the same grant.
+func (s *SSOService) OAuth2Revoke(c *gin.Context) {
+	token := c.PostForm("token")
+	tokenTypeHint := c.PostForm("token_type_hint")
+
+	oauthClient, err := s.authenticateClient(c)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Basic realm="openauth"`)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "invalid_client",
+			"error_description": "Invalid client credentials",
+		})
+		return
+	}
+	clientID := oauthClient.ClientID
+
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_request",
+			"error_description": "token is required",
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var oauthToken models.OAuthToken
+	if err := s.db.Where("access_token = ? OR refresh_token = ?", s.accessTokenID(token), token).First(&oauthToken).Error; err != nil {
+		// Invalid tokens do not cause an error response
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if oauthToken.ClientID != clientID {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "unauthorized_client",
+			"error_description": "Token was not issued to this client",
+		})
+		return
+	}
+
+	isRefresh := oauthToken.RefreshToken != nil && *oauthToken.RefreshToken == token
+	if isRefresh && oauthToken.FamilyID != "" {
+		s.revokeTokenFamily(ctx, oauthToken.FamilyID)
+	} else if !oauthToken.Revoked {
+		s.revokeTokens(ctx, []models.OAuthToken{oauthToken})
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"client_id":       clientID,
+		"token_type_hint": tokenTypeHint,
+		"refresh_token":   isRefresh,
+	}).Info("OAuth token revoked")
+	c.Status(http.StatusOK)
 }
 
-func (s *SSOService) buildUserInfo(user *models.User) map[string]interface{} {
-	return map[string]interface{}{
-		"sub":                fmt.Sprintf("%d", user.ID),
-		"name":               user.Username,
-		"preferred_username": user.Username,
-		"email":              user.Email,
-		"email_verified":     user.EmailVerified,
-		"phone":              user.Phone,
-		"phone_verified":     user.PhoneVerified,
-		"picture":            user.Avatar,
+// lookupToken finds an access or refresh token in Redis, trying the hinted
+// type first. It returns the token data and its type.
+func (s *SSOService) lookupToken(ctx context.Context, token, hint string) (map[string]string, string) {
+	types := []string{"access_token", "refresh_token"}
+	if hint == "refresh_token" {
+		types = []string{"refresh_token", "access_token"}
+	}
+
+	for _, tokenType := range types {
+		id := s.accessTokenID(token)
+		key := fmt.Sprintf("oauth2:token:%s", id)
+		if tokenType == "refresh_token" {
+			key = fmt.Sprintf("oauth2:refresh:%s", token)
+		} else if s.accessTokenRevoked(ctx, id) {
+			continue
+		}
+		data, err := s.redis.HGetAll(ctx, key).Result()
+		if err == nil && len(data) > 0 {
+			return data, tokenType
+		}
 	}
+	return nil, ""
 }
 
 // SAML handlers
@@ -488,15 +1421,44 @@ func (s *SSOService) SAMLSSO(c *gin.Context) {
 		})
 		return
 	}
+	if err := s.useSAMLSigningKey(&samlConfig); err != nil {
+		s.logger.WithError(err).Error("Failed to load SAML keys")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal_error",
+		})
+		return
+	}
+
+	// Parse SAML request. The RelayState is returned to the SP unchanged.
+	binding, param := samlBinding(c)
+	pending := c.Query("pending")
+	if pending != "" {
+		// A POSTed request that waited for the user to log in
+		form, err := s.pendingSAMLRequest(c.Request.Context(), pending)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":             "invalid_saml_request",
+				"error_description": "SAML request expired",
+			})
+			return
+		}
+		binding, param = saml.HTTPPostBinding, form.Get
+	}
+	samlRequest := param("SAMLRequest")
+	relayState := param("RelayState")
 
-	// Check if user is authenticated
+	// Check if user is authenticated. Tokens of logged out sessions no longer count.
 	userID, exists := c.Get("user_id")
+	if sessionID := c.GetString("session_id"); exists && sessionID != "" && !s.sessionActive(sessionID) {
+		exists = false
+	}
 	if !exists {
-		// Redirect to login
-		loginURL := fmt.Sprintf("/login?redirect=%s&app_id=%s", c.Request.URL.Path, appID)
-		c.Redirect(http.StatusFound, loginURL)
+		s.samlRedirectToLogin(c, param)
 		return
 	}
+	if pending != "" {
+		s.redis.Del(c.Request.Context(), samlPendingKey(pending))
+	}
 
 	// Get user
 	var user models.User
@@ -507,17 +1469,29 @@ func (s *SSOService) SAMLSSO(c *gin.Context) {
 		return
 	}
 
-	// Parse SAML request
-	var samlRequest string
-	if c.Request.Method == "GET" {
-		samlRequest = c.Query("SAMLRequest")
-	} else {
-		samlRequest = c.PostForm("SAMLRequest")
+	idp := sso.NewSAMLIdP(s.config.OIDC.Issuer, app.ID)
+	sessionID := c.GetString("session_id")
+	sessionIndex := s.samlSessionIndex(sessionID, app.ID)
+	src := s.samlClaimSource(&user, &samlConfig)
+	_, skipped := sso.SAMLAttributeRules(samlConfig.AttributeMap)
+	for _, err := range skipped {
+		s.logger.WithError(err).WithField("app_id", app.ID).Warn("Skipping invalid SAML attribute rule")
+	}
+	persistentID, err := s.samlPersistentID(&samlConfig, user.ID)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to get SAML persistent NameID")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal_error",
+		})
+		return
 	}
-
 	if samlRequest == "" {
 		// IdP-initiated SSO
-		response, err := sso.BuildSAMLResponse(&samlConfig, &user, "")
+		response, err := sso.BuildSAMLResponse(idp, &samlConfig, src, sso.SAMLResponseOptions{
+			ACSURL:       samlConfig.SSOURL,
+			SessionIndex: sessionIndex,
+			PersistentID: persistentID,
+		})
 		if err != nil {
 			s.logger.WithError(err).Error("Failed to build SAML response")
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -526,42 +1500,48 @@ func (s *SSOService) SAMLSSO(c *gin.Context) {
 			return
 		}
 
-		// Redirect with SAML response
-		// Marshal response to XML
-		var xmlBuf bytes.Buffer
-		encoder := xml.NewEncoder(&xmlBuf)
-		if err := encoder.Encode(response); err != nil {
+		// Post the unsolicited response to the default ACS
+		xmlBytes, err := sso.SignSAMLResponse(&samlConfig, response)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to sign SAML response")
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"error": "internal_error",
 			})
 			return
 		}
 
-		encoded := base64.StdEncoding.EncodeToString(xmlBuf.Bytes())
-		redirectURL := fmt.Sprintf("%s?SAMLResponse=%s", samlConfig.SSOURL, url.QueryEscape(encoded))
-		c.Redirect(http.StatusFound, redirectURL)
+		s.trackSAMLParticipant(sessionID, app.ID, user.ID, sessionIndex, response.Assertion.Subject.NameID)
+		s.postSAMLResponse(c, samlConfig.SSOURL, xmlBytes, relayState)
 		return
 	}
 
-	// SP-initiated SSO - decode and parse request
-	decoded, err := base64.StdEncoding.DecodeString(samlRequest)
+	// SP-initiated SSO - decode the request and validate it against the SP settings
+	decoded, err := sso.DecodeSAMLMessage(binding, samlRequest)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "invalid_saml_request",
+			"error":             "invalid_saml_request",
+			"error_description": err.Error(),
 		})
 		return
 	}
 
-	var authnRequest saml.AuthnRequest
-	if err := xml.Unmarshal(decoded, &authnRequest); err != nil {
+	authnRequest, acsURL, err := sso.ValidateAuthnRequest(idp, &samlConfig, binding, c.Request.URL.RawQuery, decoded, time.Now())
+	if err != nil {
+		s.logger.WithError(err).WithField("app_id", app.ID).Warn("Rejected SAML AuthnRequest")
 		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "invalid_saml_request",
+			"error":             "invalid_saml_request",
+			"error_description": err.Error(),
 		})
 		return
 	}
 
 	// Build response
-	response, err := sso.BuildSAMLResponse(&samlConfig, &user, authnRequest.ID)
+	response, err := sso.BuildSAMLResponse(idp, &samlConfig, src, sso.SAMLResponseOptions{
+		InResponseTo: authnRequest.ID,
+		ACSURL:       acsURL,
+		SessionIndex: sessionIndex,
+		PersistentID: persistentID,
+	})
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to build SAML response")
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -571,37 +1551,27 @@ func (s *SSOService) SAMLSSO(c *gin.Context) {
 	}
 
 	// Return response (POST binding)
-	xmlBytes, err := xml.Marshal(response)
+	xmlBytes, err := sso.SignSAMLResponse(&samlConfig, response)
 	if err != nil {
+		s.logger.WithError(err).Error("Failed to sign SAML response")
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "internal_error",
 		})
 		return
 	}
 
-	encoded := base64.StdEncoding.EncodeToString(xmlBytes)
-	relayState := c.Query("RelayState")
-	if relayState == "" {
-		relayState = c.PostForm("RelayState")
-	}
-
-	// Render SAML POST form
-	c.Header("Content-Type", "text/html")
-	c.String(http.StatusOK, fmt.Sprintf(`
-		<html>
-		<body>
-			<form method="POST" action="%s" id="saml-form">
-				<input type="hidden" name="SAMLResponse" value="%s" />
-				<input type="hidden" name="RelayState" value="%s" />
-			</form>
-			<script>document.getElementById('saml-form').submit();</script>
-		</body>
-		</html>
-	`, samlConfig.SSOURL, encoded, relayState))
+	s.trackSAMLParticipant(sessionID, app.ID, user.ID, sessionIndex, response.Assertion.Subject.NameID)
+	s.postSAMLResponse(c, acsURL, xmlBytes, relayState)
 }
 
+// SAMLMetadata serves the IdP metadata of a SAML application, at
+// /saml/metadata/:app_id or, as its entity ID, /saml/metadata?app_id=. It
+// publishes the signing certificate and the next ones of a key rollover.
 func (s *SSOService) SAMLMetadata(c *gin.Context) {
-	appID := c.Query("app_id")
+	appID := c.Param("app_id")
+	if appID == "" {
+		appID = c.Query("app_id")
+	}
 	if appID == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": "missing_app_id",
@@ -625,9 +1595,17 @@ func (s *SSOService) SAMLMetadata(c *gin.Context) {
 		return
 	}
 
-	// Parse certificate
-	cert, err := sso.ParseCertificate(samlConfig.Certificate)
+	// Parse the published certificates
+	keys, err := s.samlKeySelection(&samlConfig)
 	if err != nil {
+		s.logger.WithError(err).Error("Failed to load SAML keys")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "internal_error",
+		})
+		return
+	}
+	certs, err := sso.ParseSAMLCertificates(keys.Certificates)
+	if err != nil || len(certs) == 0 {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "invalid_certificate",
 		})
@@ -635,11 +1613,12 @@ func (s *SSOService) SAMLMetadata(c *gin.Context) {
 	}
 
 	// Build metadata
+	idp := sso.NewSAMLIdP(s.config.OIDC.Issuer, app.ID)
 	metadata, err := sso.BuildSAMLMetadata(
-		samlConfig.EntityID,
-		samlConfig.SSOURL,
-		samlConfig.SLOURL,
-		cert,
+		idp.EntityID,
+		idp.SSOURL,
+		idp.SLOURL,
+		certs...,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -647,108 +1626,41 @@ func (s *SSOService) SAMLMetadata(c *gin.Context) {
 		})
 		return
 	}
+	metadata.IDPSSODescriptors[0].WantAuthnRequestsSigned = &samlConfig.AuthnRequestsSigned
+	metadata.ValidUntil = saml.TimeNow().Add(sso.SAMLMetadataValidity)
+	metadata.CacheDuration = sso.SAMLMetadataCacheDuration
+	metadata.IDPSSODescriptors[0].ValidUntil = &metadata.ValidUntil
 
-	// Marshal to XML
+	// Marshal to XML, signed with the signing key if the application asks for it
 	var xmlBuf bytes.Buffer
 	xmlBuf.WriteString(`<?xml version="1.0"?>`)
-	encoder := xml.NewEncoder(&xmlBuf)
-	if err := encoder.Encode(metadata); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "internal_error",
-		})
-		return
+	if samlConfig.SignMetadata {
+		signer, err := sso.NewSAMLSigner(keys.Certificate, keys.PrivateKey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "invalid_certificate",
+			})
+			return
+		}
+		signed, err := sso.SignSAMLMetadata(signer, metadata)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to sign SAML metadata")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "internal_error",
+			})
+			return
+		}
+		xmlBuf.Write(signed)
+	} else {
+		encoder := xml.NewEncoder(&xmlBuf)
+		if err := encoder.Encode(metadata); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "internal_error",
+			})
+			return
+		}
 	}
 
 	c.Header("Content-Type", "application/samlmetadata+xml")
 	c.Data(http.StatusOK, "application/samlmetadata+xml", xmlBuf.Bytes())
 }
-
-func (s *SSOService) SAMLSLO(c *gin.Context) {
-	appID := c.Query("app_id")
-	if appID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "missing_app_id",
-		})
-		return
-	}
-
-	var app models.Application
-	if err := s.db.Where("id = ? AND protocol = ?", appID, "saml").First(&app).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "application_not_found",
-		})
-		return
-	}
-
-	var samlConfig models.SAMLConfig
-	if err := s.db.Where("application_id = ?", app.ID).First(&samlConfig).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "saml_config_not_found",
-		})
-		return
-	}
-
-	// Parse SAML LogoutRequest
-	var logoutRequest string
-	if c.Request.Method == "GET" {
-		logoutRequest = c.Query("SAMLRequest")
-	} else {
-		logoutRequest = c.PostForm("SAMLRequest")
-	}
-
-	if logoutRequest == "" {
-		// IdP-initiated logout
-		// In a real implementation, you would invalidate all sessions for the user
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Logout successful",
-		})
-		return
-	}
-
-	// SP-initiated logout - decode and parse request
-	decoded, err := base64.StdEncoding.DecodeString(logoutRequest)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "invalid_saml_request",
-		})
-		return
-	}
-
-	// Parse logout request (simplified)
-	// In production, use proper SAML library to parse LogoutRequest
-	_ = decoded
-
-	// Build logout response
-	now := saml.TimeNow()
-	logoutResponse := &saml.LogoutResponse{
-		ID:           fmt.Sprintf("logout-response-%d", time.Now().UnixNano()),
-		InResponseTo: logoutRequest,
-		IssueInstant: now,
-		Version:      "2.0",
-		Issuer: &saml.Issuer{
-			Value: samlConfig.EntityID,
-		},
-		Status: saml.Status{
-			StatusCode: saml.StatusCode{
-				Value: saml.StatusSuccess,
-			},
-		},
-		Destination: samlConfig.SLOURL,
-	}
-
-	relayState := c.Query("RelayState")
-	if relayState == "" {
-		relayState = c.PostForm("RelayState")
-	}
-
-	// Use library methods for redirect/post
-	if c.Request.Method == "GET" {
-		redirectURL := logoutResponse.Redirect(relayState)
-		c.Redirect(http.StatusFound, redirectURL.String())
-	} else {
-		// POST binding
-		postData := logoutResponse.Post(relayState)
-		c.Header("Content-Type", "text/html")
-		c.Data(http.StatusOK, "text/html", postData)
-	}
-}
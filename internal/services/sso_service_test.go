@@ -0,0 +1,487 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hanyouqing/openauth/internal/auth"
+	"github.com/hanyouqing/openauth/internal/config"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// setupSSOTest wires all services against SQLite and an in-memory Redis
+func setupSSOTest(t *testing.T) *Services {
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	require.NoError(t, err)
+	// Every connection of an in-memory database is a new database
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+
+	require.NoError(t, db.AutoMigrate(
+		&models.User{},
+		&models.Application{},
+		&models.Role{},
+		&models.Permission{},
+		&models.UserRole{},
+		&models.RolePermission{},
+		&models.MFADevice{},
+		&models.OAuthClient{},
+		&models.OAuthToken{},
+		&models.OAuthConsent{},
+		&models.OAuthScope{},
+		&models.OAuthInitialAccessToken{},
+		&models.OIDCSessionClient{},
+		&models.OIDCLogoutDelivery{},
+		&models.SAMLConfig{},
+		&models.SAMLSessionParticipant{},
+		&models.SAMLPersistentID{},
+		&models.SAMLKey{},
+		&models.SAMLIdentityProvider{},
+		&models.SAMLFederatedIdentity{},
+		&models.CASServiceConfig{},
+		&models.AuditLog{},
+		&models.Session{},
+		&models.MFAPolicy{},
+		&models.Organization{},
+		&models.UserGroup{},
+		&models.UserOrganization{},
+		&models.UserGroupUser{},
+		&models.UserGroupRole{},
+	))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	cfg := &config.Config{
+		JWT: config.JWTConfig{
+			Secret:        "test-secret-key",
+			AccessExpiry:  15,
+			RefreshExpiry: 7,
+			Issuer:        "https://idp.example.com",
+		},
+		OIDC: config.OIDCConfig{
+			Issuer:        "https://idp.example.com",
+			IDTokenExpiry: 60,
+		},
+	}
+	return New(db, setupTestRedis(t), cfg, logger)
+}
+
+// performRequest runs handler on a request built from method, target and the
+// form body. setup may put middleware values on the context first.
+func performRequest(handler gin.HandlerFunc, method, target string, form url.Values, setup func(c *gin.Context)) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	c.Request = httptest.NewRequest(method, target, body)
+	if form != nil {
+		c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if setup != nil {
+		setup(c)
+	}
+	handler(c)
+	return w
+}
+
+func createTestUser(t *testing.T, db *gorm.DB, username string) *models.User {
+	user := &models.User{
+		Username:     username,
+		Email:        username + "@example.com",
+		PasswordHash: "unused",
+		Status:       "active",
+	}
+	require.NoError(t, db.Create(user).Error)
+	return user
+}
+
+func createPublicClient(t *testing.T, db *gorm.DB, clientID string) *models.OAuthClient {
+	client := &models.OAuthClient{
+		ApplicationID:           1,
+		ClientID:                clientID,
+		RedirectURIs:            models.StringArray{"https://app.example.com/callback"},
+		GrantTypes:              models.StringArray{"authorization_code", "refresh_token"},
+		Public:                  true,
+		TokenEndpointAuthMethod: "none",
+	}
+	require.NoError(t, db.Create(client).Error)
+	return client
+}
+
+func createConfidentialClient(t *testing.T, db *gorm.DB, clientID, secret string) *models.OAuthClient {
+	hash, err := auth.HashPassword(secret)
+	require.NoError(t, err)
+	client := &models.OAuthClient{
+		ApplicationID: 1,
+		ClientID:      clientID,
+		ClientSecret:  hash,
+		RedirectURIs:  models.StringArray{"https://" + clientID + ".example.com/callback"},
+		GrantTypes:    models.StringArray{"authorization_code", "refresh_token", "client_credentials"},
+	}
+	require.NoError(t, db.Create(client).Error)
+	return client
+}
+
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return body
+}
+
+func TestSSOService_RefreshTokenReuse(t *testing.T) {
+	svcs := setupSSOTest(t)
+	user := createTestUser(t, svcs.DB, "alice")
+	createPublicClient(t, svcs.DB, "spa")
+
+	issued, err := svcs.SSO.issueTokens(t.Context(), &tokenGrant{
+		ClientID: "spa",
+		UserID:   &user.ID,
+		Scope:    "profile",
+		Refresh:  true,
+	})
+	require.NoError(t, err)
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		return performRequest(svcs.SSO.OAuth2RefreshToken, http.MethodPost, "/oauth2/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {token},
+			"client_id":     {"spa"},
+		}, nil)
+	}
+
+	// Concurrent redemptions of one token: exactly one is rotated
+	var wg sync.WaitGroup
+	codes := make([]int, 4)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = refresh(*issued.RefreshToken).Code
+		}(i)
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			succeeded++
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+
+	// Any later reuse revokes the whole family, including the rotated token
+	assert.Equal(t, http.StatusBadRequest, refresh(*issued.RefreshToken).Code)
+	var tokens []models.OAuthToken
+	require.NoError(t, svcs.DB.Where("family_id = ?", issued.FamilyID).Find(&tokens).Error)
+	require.Len(t, tokens, 2)
+	for _, token := range tokens {
+		assert.True(t, token.Revoked)
+		assert.Equal(t, http.StatusBadRequest, refresh(*token.RefreshToken).Code)
+	}
+}
+
+// afterCommandHook runs after each Redis command the client processes
+type afterCommandHook func(ctx context.Context, cmd redis.Cmder)
+
+func (h afterCommandHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h afterCommandHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		h(ctx, cmd)
+		return err
+	}
+}
+
+func (h afterCommandHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestSSOService_AuthorizationCodeReuse(t *testing.T) {
+	svcs := setupSSOTest(t)
+	user := createTestUser(t, svcs.DB, "alice")
+	createConfidentialClient(t, svcs.DB, "web", "web-secret")
+
+	code := sso.GenerateAuthorizationCode()
+	require.NoError(t, svcs.Redis.HSet(t.Context(), "oauth2:code:"+code, map[string]interface{}{
+		"client_id":    "web",
+		"user_id":      user.ID,
+		"redirect_uri": "https://web.example.com/callback",
+		"scope":        "profile",
+	}).Err())
+	exchange := func() *httptest.ResponseRecorder {
+		return performRequest(svcs.SSO.OAuth2Token, http.MethodPost, "/oauth2/token", url.Values{
+			"grant_type":   {"authorization_code"},
+			"code":         {code},
+			"redirect_uri": {"https://web.example.com/callback"},
+		}, func(c *gin.Context) {
+			c.Request.SetBasicAuth("web", "web-secret")
+		})
+	}
+
+	// A second exchange redeems the code after the first has read it: only
+	// the one that claims the code gets tokens
+	var concurrent *httptest.ResponseRecorder
+	raced := false
+	svcs.Redis.AddHook(afterCommandHook(func(ctx context.Context, cmd redis.Cmder) {
+		if cmd.Name() == "hgetall" && !raced {
+			raced = true
+			concurrent = exchange()
+		}
+	}))
+	w := exchange()
+	require.NotNil(t, concurrent)
+	assert.Equal(t, http.StatusOK, concurrent.Code)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_grant", decodeJSON(t, w)["error"])
+
+	var tokens int64
+	svcs.DB.Model(&models.OAuthToken{}).Where("client_id = ?", "web").Count(&tokens)
+	assert.Equal(t, int64(1), tokens)
+}
+
+func TestSSOService_IntrospectAndRevoke(t *testing.T) {
+	svcs := setupSSOTest(t)
+	user := createTestUser(t, svcs.DB, "alice")
+	createConfidentialClient(t, svcs.DB, "web", "web-secret")
+	createConfidentialClient(t, svcs.DB, "api", "api-secret")
+	createPublicClient(t, svcs.DB, "spa")
+
+	issued, err := svcs.SSO.issueTokens(t.Context(), &tokenGrant{
+		ClientID: "web",
+		UserID:   &user.ID,
+		Scope:    "profile",
+		Refresh:  true,
+	})
+	require.NoError(t, err)
+	accessToken := accessTokenValue(issued)
+
+	introspect := func(token string, credentials url.Values) *httptest.ResponseRecorder {
+		form := url.Values{"token": {token}}
+		for k, v := range credentials {
+			form[k] = v
+		}
+		return performRequest(svcs.SSO.OAuth2Introspect, http.MethodPost, "/oauth2/introspect", form, nil)
+	}
+	revoke := func(token string, credentials url.Values) *httptest.ResponseRecorder {
+		form := url.Values{"token": {token}}
+		for k, v := range credentials {
+			form[k] = v
+		}
+		return performRequest(svcs.SSO.OAuth2Revoke, http.MethodPost, "/oauth2/revoke", form, nil)
+	}
+	web := url.Values{"client_id": {"web"}, "client_secret": {"web-secret"}}
+	api := url.Values{"client_id": {"api"}, "client_secret": {"api-secret"}}
+
+	t.Run("client must authenticate", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, introspect(accessToken, nil).Code)
+		assert.Equal(t, http.StatusUnauthorized, introspect(accessToken, url.Values{"client_id": {"web"}, "client_secret": {"wrong"}}).Code)
+		assert.Equal(t, http.StatusUnauthorized, introspect(accessToken, url.Values{"client_id": {"spa"}}).Code)
+	})
+
+	t.Run("active token", func(t *testing.T) {
+		w := introspect(accessToken, web)
+		require.Equal(t, http.StatusOK, w.Code)
+		body := decodeJSON(t, w)
+		assert.Equal(t, true, body["active"])
+		assert.Equal(t, "web", body["client_id"])
+		assert.Equal(t, "profile", body["scope"])
+		assert.Equal(t, "alice", body["username"])
+
+		// Resource servers introspect tokens issued to other clients
+		body = decodeJSON(t, introspect(accessToken, api))
+		assert.Equal(t, true, body["active"])
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		body := decodeJSON(t, introspect("unknown", web))
+		assert.Equal(t, map[string]interface{}{"active": false}, body)
+
+		// RFC 7009: unknown tokens are not an error
+		w := revoke("unknown", web)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("foreign client cannot revoke", func(t *testing.T) {
+		w := revoke(accessToken, api)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "unauthorized_client", decodeJSON(t, w)["error"])
+		assert.Equal(t, true, decodeJSON(t, introspect(accessToken, web))["active"])
+	})
+
+	t.Run("revoked refresh token", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, revoke(*issued.RefreshToken, web).Code)
+
+		body := decodeJSON(t, introspect(*issued.RefreshToken, web))
+		assert.Equal(t, map[string]interface{}{"active": false}, body)
+		// Revoking the refresh token also ends the access tokens of the grant
+		body = decodeJSON(t, introspect(accessToken, web))
+		assert.Equal(t, map[string]interface{}{"active": false}, body)
+		// Revoking again still succeeds
+		assert.Equal(t, http.StatusOK, revoke(*issued.RefreshToken, web).Code)
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		expired, err := svcs.SSO.issueTokens(t.Context(), &tokenGrant{
+			ClientID: "web",
+			UserID:   &user.ID,
+			Scope:    "profile",
+		})
+		require.NoError(t, err)
+		svcs.Redis.HSet(t.Context(), "oauth2:token:"+expired.AccessToken, "expires_at", time.Now().Add(-time.Minute).Unix())
+
+		body := decodeJSON(t, introspect(accessTokenValue(expired), web))
+		assert.Equal(t, map[string]interface{}{"active": false}, body)
+	})
+}
+
+func TestSSOService_RevokedJWTAccessToken(t *testing.T) {
+	svcs := setupSSOTest(t)
+	user := createTestUser(t, svcs.DB, "alice")
+	client := createConfidentialClient(t, svcs.DB, "web", "web-secret")
+	client.AccessTokenFormat = sso.AccessTokenFormatJWT
+	require.NoError(t, svcs.DB.Save(client).Error)
+	web := url.Values{"client_id": {"web"}, "client_secret": {"web-secret"}}
+
+	issue := func() *models.OAuthToken {
+		issued, err := svcs.SSO.issueTokens(t.Context(), &tokenGrant{
+			ClientID: "web",
+			UserID:   &user.ID,
+			Scope:    "openid profile",
+		})
+		require.NoError(t, err)
+		require.Equal(t, sso.AccessTokenFormatJWT, issued.Format)
+		return issued
+	}
+	introspect := func(token string) map[string]interface{} {
+		form := url.Values{"token": {token}}
+		for k, v := range web {
+			form[k] = v
+		}
+		return decodeJSON(t, performRequest(svcs.SSO.OAuth2Introspect, http.MethodPost, "/oauth2/introspect", form, nil))
+	}
+	userinfo := func(token string) int {
+		return performRequest(svcs.SSO.OAuth2UserInfo, http.MethodGet, "/oauth2/userinfo", nil, func(c *gin.Context) {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
+		}).Code
+	}
+
+	issued := issue()
+	jwtToken := accessTokenValue(issued)
+	assert.Equal(t, true, introspect(jwtToken)["active"])
+	assert.Equal(t, http.StatusOK, userinfo(jwtToken))
+
+	form := url.Values{"token": {jwtToken}}
+	for k, v := range web {
+		form[k] = v
+	}
+	require.Equal(t, http.StatusOK, performRequest(svcs.SSO.OAuth2Revoke, http.MethodPost, "/oauth2/revoke", form, nil).Code)
+	assert.Equal(t, map[string]interface{}{"active": false}, introspect(jwtToken))
+	assert.Equal(t, http.StatusUnauthorized, userinfo(jwtToken))
+
+	// The denylist alone is enough to end a token
+	issued = issue()
+	jwtToken = accessTokenValue(issued)
+	svcs.Redis.Set(t.Context(), sso.JTIDenylistKey(issued.AccessToken), 1, time.Minute)
+	assert.Equal(t, map[string]interface{}{"active": false}, introspect(jwtToken))
+	assert.Equal(t, http.StatusUnauthorized, userinfo(jwtToken))
+}
+
+func TestSSOService_TokenGrantTypes(t *testing.T) {
+	svcs := setupSSOTest(t)
+	user := createTestUser(t, svcs.DB, "alice")
+	hash, err := auth.HashPassword("Password123!")
+	require.NoError(t, err)
+	require.NoError(t, svcs.DB.Model(user).Update("password_hash", hash).Error)
+	client := createConfidentialClient(t, svcs.DB, "web", "web-secret")
+	require.NoError(t, svcs.DB.Model(client).Updates(map[string]interface{}{
+		"grant_types":                models.StringArray{"authorization_code", "refresh_token", "client_credentials", "password"},
+		"token_endpoint_auth_method": sso.AuthMethodClientSecretPost,
+	}).Error)
+
+	credentials := url.Values{"client_id": {"web"}, "client_secret": {"web-secret"}}
+	token := func(handler gin.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+		for k, v := range credentials {
+			form[k] = v
+		}
+		return performRequest(handler, http.MethodPost, "/oauth2/token", form, nil)
+	}
+	clientCredentials := func() *httptest.ResponseRecorder {
+		return token(svcs.SSO.OAuth2ClientCredentials, url.Values{"grant_type": {"client_credentials"}})
+	}
+	password := func() *httptest.ResponseRecorder {
+		return token(svcs.SSO.OAuth2PasswordCredentials, url.Values{
+			"grant_type": {"password"},
+			"username":   {"alice"},
+			"password":   {"Password123!"},
+		})
+	}
+	refresh := func() *httptest.ResponseRecorder {
+		issued, err := svcs.SSO.issueTokens(t.Context(), &tokenGrant{ClientID: "web", UserID: &user.ID, Refresh: true})
+		require.NoError(t, err)
+		return token(svcs.SSO.OAuth2RefreshToken, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {*issued.RefreshToken}})
+	}
+
+	assert.Equal(t, http.StatusOK, clientCredentials().Code)
+	assert.Equal(t, http.StatusOK, password().Code)
+	assert.Equal(t, http.StatusOK, refresh().Code)
+
+	// Removing grant types from the client takes effect at once
+	grantTypes := []string{"authorization_code"}
+	_, err = svcs.OAuthClient.Update(1, "web", &OAuthClientUpdate{GrantTypes: &grantTypes})
+	require.NoError(t, err)
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"client_credentials": clientCredentials(),
+		"password":           password(),
+		"refresh_token":      refresh(),
+	} {
+		assert.Equal(t, http.StatusBadRequest, w.Code, name)
+		assert.Equal(t, "unauthorized_client", decodeJSON(t, w)["error"], name)
+	}
+}
+
+func TestSSOService_JWTAccessTokenRoles(t *testing.T) {
+	svcs := setupSSOTest(t)
+	user := createTestUser(t, svcs.DB, "alice")
+	role := models.Role{Name: "editor"}
+	require.NoError(t, svcs.DB.Create(&role).Error)
+	require.NoError(t, svcs.DB.Create(&models.UserRole{UserID: user.ID, RoleID: role.ID}).Error)
+	client := createConfidentialClient(t, svcs.DB, "web", "web-secret")
+	client.AccessTokenFormat = sso.AccessTokenFormatJWT
+	require.NoError(t, svcs.DB.Save(client).Error)
+
+	// Roles are carried without a scope that releases them
+	issued, err := svcs.SSO.issueTokens(t.Context(), &tokenGrant{
+		ClientID: "web",
+		UserID:   &user.ID,
+		Scope:    "openid",
+	})
+	require.NoError(t, err)
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(accessTokenValue(issued), claims, func(*jwt.Token) (interface{}, error) {
+		return &svcs.SSO.signingKey.PrivateKey.PublicKey, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"editor"}, claims["roles"])
+}
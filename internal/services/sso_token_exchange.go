@@ -0,0 +1,252 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/hanyouqing/openauth/internal/utils"
+)
+
+// The permission (resource and action) a user needs to act as another user
+// through requested_subject
+const (
+	impersonationResource = "users"
+	impersonationAction   = "impersonate"
+)
+
+// OAuth2TokenExchange handles the token exchange grant (RFC 8693). A client
+// exchanges a subject token, optionally with an actor token, for a token
+// with narrowed scope and audience whose act claim records who is acting.
+// Clients allowed to impersonate may instead name the user with
+// requested_subject, which requires an actor token of a user holding the
+// users:impersonate permission and is audited.
+func (s *SSOService) OAuth2TokenExchange(c *gin.Context) {
+	oauthClient, err := s.authenticateClient(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":             "invalid_client",
+			"error_description": "Invalid client credentials",
+		})
+		return
+	}
+	if oauthClient.Public || !sso.ClientAllowsGrant(oauthClient, sso.GrantTypeTokenExchange) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":             "unauthorized_client",
+			"error_description": "Client is not allowed to use token exchange",
+		})
+		return
+	}
+	dpopJKT, ok := s.tokenDPoPKey(c, oauthClient)
+	if !ok {
+		return
+	}
+
+	requestedType := c.PostForm("requested_token_type")
+	if requestedType != "" && requestedType != sso.TokenTypeAccessToken && requestedType != sso.TokenTypeJWT {
+		s.exchangeError(c, "invalid_request", "Unsupported requested_token_type")
+		return
+	}
+
+	audience := c.PostForm("audience")
+	if audience == "" {
+		audience = c.PostForm("resource")
+	}
+	if audience != "" && !sso.ClientMayTargetAudience(oauthClient, audience) {
+		s.exchangeError(c, "invalid_target", "Client may not request tokens for this audience")
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// The actor token identifies who acts on behalf of the subject. It must
+	// have been issued to the exchanging client.
+	var actor map[string]string
+	if actorToken := c.PostForm("actor_token"); actorToken != "" {
+		if !validSubjectTokenType(c.PostForm("actor_token_type")) {
+			s.exchangeError(c, "invalid_request", "Unsupported actor_token_type")
+			return
+		}
+		actor = s.activeAccessToken(ctx, actorToken)
+		if actor == nil || actor["client_id"] != oauthClient.ClientID {
+			s.exchangeError(c, "invalid_grant", "actor_token is invalid")
+			return
+		}
+		if !dpopKeyMatches(actor, dpopJKT) {
+			s.exchangeError(c, "invalid_grant", "actor_token is bound to a different DPoP key")
+			return
+		}
+	} else if c.PostForm("actor_token_type") != "" {
+		s.exchangeError(c, "invalid_request", "actor_token_type requires actor_token")
+		return
+	}
+
+	grant := &tokenGrant{
+		ClientID: oauthClient.ClientID,
+		Audience: audience,
+		ForceJWT: requestedType == sso.TokenTypeJWT,
+		DPoPJKT:  dpopJKT,
+	}
+	var priorAct map[string]interface{}
+	requestedSubject := c.PostForm("requested_subject")
+
+	switch {
+	case requestedSubject != "":
+		if !oauthClient.TokenExchangeImpersonation {
+			s.exchangeError(c, "unauthorized_client", "Client is not allowed to impersonate users")
+			return
+		}
+		if actor == nil || actor["user_id"] == "" {
+			s.exchangeError(c, "invalid_request", "Impersonation requires a user actor_token")
+			return
+		}
+		actorID, _ := strconv.ParseUint(actor["user_id"], 10, 64)
+		if !s.userHasPermission(actorID, impersonationResource, impersonationAction) {
+			s.exchangeError(c, "invalid_grant", "The actor is not allowed to impersonate users")
+			return
+		}
+		userID, err := strconv.ParseUint(requestedSubject, 10, 64)
+		var user models.User
+		if err == nil {
+			err = s.db.Where("status = ?", "active").First(&user, userID).Error
+		}
+		if err != nil {
+			s.exchangeError(c, "invalid_request", "requested_subject is not an active user")
+			return
+		}
+		// Impersonation may not gain privileges, e.g. act as an admin
+		actorRoles := s.userRoleNames(actorID)
+		for _, role := range s.userRoleNames(user.ID) {
+			if !containsString(actorRoles, role) {
+				s.exchangeError(c, "invalid_grant", "requested_subject has roles the actor does not have")
+				return
+			}
+		}
+		if grant.Scope, err = sso.ExchangeScope(c.PostForm("scope"), strings.Join(oauthClient.Scopes, " "), nil); err != nil {
+			s.exchangeError(c, "invalid_scope", err.Error())
+			return
+		}
+		grant.UserID = &user.ID
+
+	default:
+		subjectToken := c.PostForm("subject_token")
+		if subjectToken == "" || !validSubjectTokenType(c.PostForm("subject_token_type")) {
+			s.exchangeError(c, "invalid_request", "subject_token and a supported subject_token_type are required")
+			return
+		}
+		subject := s.activeAccessToken(ctx, subjectToken)
+		if subject == nil {
+			s.exchangeError(c, "invalid_grant", "subject_token is invalid")
+			return
+		}
+		if !dpopKeyMatches(subject, dpopJKT) {
+			s.exchangeError(c, "invalid_grant", "subject_token is bound to a different DPoP key")
+			return
+		}
+		if !sso.ClientMayExchangeSubject(oauthClient, subject["client_id"]) {
+			s.exchangeError(c, "invalid_grant", "Client may not exchange tokens of this subject")
+			return
+		}
+		if grant.Scope, err = sso.ExchangeScope(c.PostForm("scope"), subject["scope"], oauthClient.Scopes); err != nil {
+			s.exchangeError(c, "invalid_scope", err.Error())
+			return
+		}
+		if userID, err := strconv.ParseUint(subject["user_id"], 10, 64); err == nil {
+			grant.UserID = &userID
+		}
+		// The exchanged token does not outlive the subject token
+		var expiresAt int64
+		fmt.Sscanf(subject["expires_at"], "%d", &expiresAt)
+		if expiresAt != 0 {
+			grant.ExpiresAt = time.Unix(expiresAt, 0)
+		}
+		if act := subject["act"]; act != "" {
+			json.Unmarshal([]byte(act), &priorAct)
+		}
+	}
+
+	if !sso.ClientAllowsScope(oauthClient, grant.Scope) {
+		s.exchangeError(c, "invalid_scope", "Client is not allowed to request the scope")
+		return
+	}
+
+	// Without an actor token the exchanging client is the actor
+	if actor != nil && actor["user_id"] != "" {
+		grant.Act = sso.ActClaim(actor["user_id"], actor["client_id"], priorAct)
+	} else {
+		grant.Act = sso.ActClaim(oauthClient.ClientID, oauthClient.ClientID, priorAct)
+	}
+
+	oauthToken, err := s.issueTokens(ctx, grant)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to issue exchanged token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	details := map[string]interface{}{
+		"client_id":     oauthClient.ClientID,
+		"audience":      audience,
+		"scope":         grant.Scope,
+		"act":           grant.Act,
+		"impersonation": requestedSubject != "",
+	}
+	if err := utils.LogAudit(s.db, grant.UserID, "oauth2.token_exchange", "oauth_client", &oauthClient.ID, c.ClientIP(), c.GetHeader("User-Agent"), details); err != nil {
+		s.logger.WithError(err).Warn("Failed to record token exchange audit log")
+	}
+
+	issuedType := sso.TokenTypeAccessToken
+	if grant.ForceJWT {
+		issuedType = sso.TokenTypeJWT
+	}
+	response := tokenResponse(oauthToken)
+	response["issued_token_type"] = issuedType
+	response["expires_in"] = int(time.Until(oauthToken.ExpiresAt).Seconds())
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
+}
+
+// activeAccessToken returns the stored data of an unexpired access token
+func (s *SSOService) activeAccessToken(ctx context.Context, token string) map[string]string {
+	id := s.accessTokenID(token)
+	if s.accessTokenRevoked(ctx, id) {
+		return nil
+	}
+	data, err := s.redis.HGetAll(ctx, fmt.Sprintf("oauth2:token:%s", id)).Result()
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	var expiresAt int64
+	fmt.Sscanf(data["expires_at"], "%d", &expiresAt)
+	if expiresAt != 0 && time.Now().Unix() >= expiresAt {
+		return nil
+	}
+	return data
+}
+
+// dpopKeyMatches reports whether the request's DPoP proof, with thumbprint
+// jkt, proves possession of the key a stored token is bound to. Bearer tokens
+// need no proof.
+func dpopKeyMatches(tokenData map[string]string, jkt string) bool {
+	bound := tokenData["jkt"]
+	return bound == "" || bound == jkt
+}
+
+func (s *SSOService) exchangeError(c *gin.Context, code, description string) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// validSubjectTokenType accepts the token types issued by this server
+func validSubjectTokenType(tokenType string) bool {
+	return tokenType == sso.TokenTypeAccessToken || tokenType == sso.TokenTypeJWT
+}
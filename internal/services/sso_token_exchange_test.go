@@ -0,0 +1,177 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/hanyouqing/openauth/internal/sso"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSOService_TokenExchangeImpersonation(t *testing.T) {
+	svcs := setupSSOTest(t)
+	db := svcs.DB
+	client := createConfidentialClient(t, db, "gateway", "gateway-secret")
+	client.GrantTypes = models.StringArray{sso.GrantTypeTokenExchange}
+	client.Scopes = models.StringArray{"profile"}
+	client.TokenExchangeImpersonation = true
+	require.NoError(t, db.Save(client).Error)
+
+	support := createTestUser(t, db, "support")
+	bob := createTestUser(t, db, "bob")
+	root := createTestUser(t, db, "root")
+
+	adminRole := models.Role{Name: "admin"}
+	supportRole := models.Role{Name: "support"}
+	require.NoError(t, db.Create(&adminRole).Error)
+	require.NoError(t, db.Create(&supportRole).Error)
+	require.NoError(t, db.Create(&models.UserRole{UserID: root.ID, RoleID: adminRole.ID}).Error)
+	require.NoError(t, db.Create(&models.UserRole{UserID: support.ID, RoleID: supportRole.ID}).Error)
+
+	actorToken, err := svcs.SSO.issueTokens(t.Context(), &tokenGrant{ClientID: "gateway", UserID: &support.ID, Scope: "profile"})
+	require.NoError(t, err)
+
+	impersonate := func(subject *models.User) map[string]interface{} {
+		w := performRequest(svcs.SSO.OAuth2TokenExchange, http.MethodPost, "/oauth2/token", url.Values{
+			"grant_type":        {sso.GrantTypeTokenExchange},
+			"client_id":         {"gateway"},
+			"client_secret":     {"gateway-secret"},
+			"requested_subject": {fmt.Sprintf("%d", subject.ID)},
+			"actor_token":       {accessTokenValue(actorToken)},
+			"actor_token_type":  {sso.TokenTypeAccessToken},
+			"scope":             {"profile"},
+		}, nil)
+		return decodeJSON(t, w)
+	}
+
+	t.Run("actor without the permission", func(t *testing.T) {
+		body := impersonate(bob)
+		assert.Equal(t, "invalid_grant", body["error"])
+		assert.Nil(t, body["access_token"])
+	})
+
+	permission := models.Permission{Name: "users.impersonate", Resource: "users", Action: "impersonate"}
+	require.NoError(t, db.Create(&permission).Error)
+	require.NoError(t, db.Create(&models.RolePermission{RoleID: supportRole.ID, PermissionID: permission.ID}).Error)
+
+	t.Run("actor with the permission", func(t *testing.T) {
+		body := impersonate(bob)
+		require.NotNil(t, body["access_token"], body)
+		data := svcs.SSO.activeAccessToken(t.Context(), body["access_token"].(string))
+		assert.Equal(t, fmt.Sprintf("%d", bob.ID), data["user_id"])
+		assert.Contains(t, data["act"], fmt.Sprintf(`"sub":"%d"`, support.ID))
+	})
+
+	t.Run("subject with more privileges", func(t *testing.T) {
+		body := impersonate(root)
+		assert.Equal(t, "invalid_grant", body["error"])
+		assert.Nil(t, body["access_token"])
+	})
+
+	t.Run("actor holding the subject's roles", func(t *testing.T) {
+		require.NoError(t, db.Create(&models.UserRole{UserID: support.ID, RoleID: adminRole.ID}).Error)
+		assert.NotNil(t, impersonate(root)["access_token"])
+	})
+}
+
+// dpopKey is a client's DPoP key pair
+type dpopKey struct {
+	private *ecdsa.PrivateKey
+	jwk     map[string]interface{}
+	jkt     string
+}
+
+func newDPoPKey(t *testing.T) *dpopKey {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	jwk := map[string]interface{}{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(private.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(private.Y.FillBytes(make([]byte, 32))),
+	}
+	jkt, err := sso.PublicJWKThumbprint(jwk)
+	require.NoError(t, err)
+	return &dpopKey{private: private, jwk: jwk, jkt: jkt}
+}
+
+// proof signs a DPoP proof for a request to uri
+func (k *dpopKey) proof(t *testing.T, method, uri string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"jti": uuid.New().String(),
+		"htm": method,
+		"htu": uri,
+		"iat": time.Now().Unix(),
+	})
+	token.Header["typ"] = sso.DPoPProofType
+	token.Header["jwk"] = k.jwk
+	proof, err := token.SignedString(k.private)
+	require.NoError(t, err)
+	return proof
+}
+
+func TestSSOService_TokenExchangeDPoPBound(t *testing.T) {
+	svcs := setupSSOTest(t)
+	db := svcs.DB
+	client := createConfidentialClient(t, db, "gateway", "gateway-secret")
+	client.GrantTypes = models.StringArray{sso.GrantTypeTokenExchange}
+	client.Scopes = models.StringArray{"profile"}
+	require.NoError(t, db.Save(client).Error)
+	user := createTestUser(t, db, "alice")
+
+	key := newDPoPKey(t)
+	other := newDPoPKey(t)
+	bound, err := svcs.SSO.issueTokens(t.Context(), &tokenGrant{ClientID: "gateway", UserID: &user.ID, Scope: "profile", DPoPJKT: key.jkt})
+	require.NoError(t, err)
+	bearer, err := svcs.SSO.issueTokens(t.Context(), &tokenGrant{ClientID: "gateway", UserID: &user.ID, Scope: "profile"})
+	require.NoError(t, err)
+
+	exchange := func(subject, actor *models.OAuthToken, proofKey *dpopKey) map[string]interface{} {
+		form := url.Values{
+			"grant_type":         {sso.GrantTypeTokenExchange},
+			"client_id":          {"gateway"},
+			"client_secret":      {"gateway-secret"},
+			"subject_token":      {accessTokenValue(subject)},
+			"subject_token_type": {sso.TokenTypeAccessToken},
+		}
+		if actor != nil {
+			form.Set("actor_token", accessTokenValue(actor))
+			form.Set("actor_token_type", sso.TokenTypeAccessToken)
+		}
+		w := performRequest(svcs.SSO.OAuth2TokenExchange, http.MethodPost, "/oauth2/token", form, func(c *gin.Context) {
+			if proofKey != nil {
+				c.Request.Header.Set("DPoP", proofKey.proof(t, http.MethodPost, "https://idp.example.com/oauth2/token"))
+			}
+		})
+		return decodeJSON(t, w)
+	}
+
+	t.Run("subject token without proof of possession", func(t *testing.T) {
+		assert.Equal(t, "invalid_grant", exchange(bound, nil, nil)["error"])
+		assert.Equal(t, "invalid_grant", exchange(bound, nil, other)["error"])
+	})
+
+	t.Run("actor token without proof of possession", func(t *testing.T) {
+		assert.Equal(t, "invalid_grant", exchange(bearer, bound, nil)["error"])
+		assert.Equal(t, "invalid_grant", exchange(bearer, bound, other)["error"])
+	})
+
+	t.Run("proof with the bound key", func(t *testing.T) {
+		body := exchange(bound, nil, key)
+		require.NotNil(t, body["access_token"], body)
+		assert.Equal(t, "DPoP", body["token_type"])
+		assert.NotNil(t, exchange(bearer, bound, key)["access_token"])
+	})
+}
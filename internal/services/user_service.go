@@ -94,6 +94,9 @@ func (s *UserService) Update(id uint64, data map[string]interface{}) (*models.Us
 		return nil, err
 	}
 
+	// Attributes are released as claims and only change through SetAttributes
+	delete(data, "attributes")
+
 	if err := s.db.Model(&user).Updates(data).Error; err != nil {
 		return nil, err
 	}
@@ -197,3 +200,18 @@ func (s *UserService) UploadAvatar(userID uint64, avatarURL string) error {
 
 	return nil
 }
+
+// SetAttributes replaces the user's custom attributes, which scopes in the
+// scope registry can release as claims
+func (s *UserService) SetAttributes(userID uint64, attributes models.JSONB) (*models.User, error) {
+	var user models.User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+
+	user.Attributes = attributes
+	if err := s.db.Model(&user).Select("attributes").Updates(&user).Error; err != nil {
+		return nil, fmt.Errorf("failed to update attributes: %w", err)
+	}
+	return &user, nil
+}
@@ -70,7 +70,7 @@ func TestUserService_List(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			users, total, err := service.List(tt.page, tt.pageSize)
 			assert.NoError(t, err)
-			assert.Equal(t, 5, total)
+			assert.Equal(t, int64(5), total)
 			assert.LessOrEqual(t, len(users), tt.pageSize)
 		})
 	}
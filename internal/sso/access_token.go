@@ -0,0 +1,50 @@
+package sso
+
+import (
+	"crypto/rsa"
+	"errors"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Access token formats a client can opt into
+const (
+	AccessTokenFormatOpaque = "opaque"
+	AccessTokenFormatJWT    = "jwt"
+)
+
+// AccessTokenJWTType is the typ header of JWT access tokens (RFC 9068 section 2.1)
+const AccessTokenJWTType = "at+jwt"
+
+// IsJWT reports whether a token has the shape of a compact JWS
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// JWTAccessTokenID verifies the signature of a JWT access token and returns
+// its jti. Expiry is not checked so expired and revoked tokens can still be
+// identified.
+func JWTAccessTokenID(token string, key *rsa.PublicKey) (string, error) {
+	claims := jwt.MapClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return key, nil
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithoutClaimsValidation())
+	if err != nil {
+		return "", err
+	}
+	if typ, _ := parsed.Header["typ"].(string); !strings.EqualFold(typ, AccessTokenJWTType) && !strings.EqualFold(typ, "application/"+AccessTokenJWTType) {
+		return "", errors.New("not a JWT access token")
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return "", errors.New("access token has no jti")
+	}
+	return jti, nil
+}
+
+// JTIDenylistKey is the Redis key that marks a JWT access token as revoked
+// until it expires. Resource servers verifying tokens locally should check it.
+func JTIDenylistKey(jti string) string {
+	return "oauth2:jwt:denylist:" + jti
+}
@@ -0,0 +1,39 @@
+package sso
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWTAccessTokenID(t *testing.T) {
+	key, err := GenerateSigningKey()
+	assert.NoError(t, err)
+	pub := &key.PrivateKey.PublicKey
+
+	// Expired tokens are still identified so they can be revoked
+	token, err := key.SignWithType(jwt.MapClaims{
+		"jti": "abc",
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	}, AccessTokenJWTType)
+	assert.NoError(t, err)
+	assert.True(t, IsJWT(token))
+	jti, err := JWTAccessTokenID(token, pub)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", jti)
+
+	// ID tokens are not accepted as access tokens
+	idToken, err := key.Sign(jwt.MapClaims{"jti": "abc"})
+	assert.NoError(t, err)
+	_, err = JWTAccessTokenID(idToken, pub)
+	assert.Error(t, err)
+
+	other, err := GenerateSigningKey()
+	assert.NoError(t, err)
+	_, err = JWTAccessTokenID(token, &other.PrivateKey.PublicKey)
+	assert.Error(t, err)
+
+	assert.False(t, IsJWT("3f2b6c1e-5d0a-4c1b-9a8e-7d6c5b4a3f2e"))
+}
@@ -0,0 +1,392 @@
+package sso
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanyouqing/openauth/internal/models"
+)
+
+// CAS ticket prefixes
+const (
+	CASServiceTicketPrefix          = "ST-"
+	CASProxyTicketPrefix            = "PT-"
+	CASProxyGrantingTicketPrefix    = "PGT-"
+	CASProxyGrantingTicketIOUPrefix = "PGTIOU-"
+)
+
+// Attributes CAS 3.0 releases about the authentication itself
+const (
+	CASAuthenticationDateAttribute     = "authenticationDate"
+	CASIsFromNewLoginAttribute         = "isFromNewLogin"
+	CASLongTermAuthenticationAttribute = "longTermAuthenticationRequestTokenUsed"
+)
+
+const casNamespace = "http://www.yale.edu/tp/cas"
+
+// CAS error codes (CAS Protocol 3.0, section 2.5.3 and 2.7.2)
+const (
+	CASInvalidRequest           = "INVALID_REQUEST"
+	CASInvalidTicketSpec        = "INVALID_TICKET_SPEC"
+	CASUnauthorizedServiceProxy = "UNAUTHORIZED_SERVICE_PROXY"
+	CASInvalidProxyCallback     = "INVALID_PROXY_CALLBACK"
+	CASInvalidTicket            = "INVALID_TICKET"
+	CASInvalidService           = "INVALID_SERVICE"
+	CASUnauthorizedService      = "UNAUTHORIZED_SERVICE"
+	CASInternalError            = "INTERNAL_ERROR"
+)
+
+// NewCASTicket returns a new unguessable ticket with the given prefix
+func NewCASTicket(prefix string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return prefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// CASTicket is what a service or proxy ticket stands for: the user, the
+// service it was issued for and, for proxy tickets, the proxy callback URLs
+// it went through, the last proxy first
+type CASTicket struct {
+	UserID   uint64    `json:"user_id"`
+	Service  string    `json:"service"`
+	AuthTime time.Time `json:"auth_time"`
+	// Primary is set when the user presented credentials for this ticket
+	// rather than using an existing single sign-on session
+	Primary bool     `json:"primary,omitempty"`
+	Proxies []string `json:"proxies,omitempty"`
+}
+
+// CASProxyGrantingTicket lets a proxy obtain proxy tickets for the user.
+// Proxies is the chain of proxy callback URLs, the one it was sent to first.
+type CASProxyGrantingTicket struct {
+	UserID   uint64    `json:"user_id"`
+	AuthTime time.Time `json:"auth_time"`
+	Proxies  []string  `json:"proxies"`
+}
+
+// ValidCASProxyCallback checks a pgtUrl: proxy-granting tickets are only
+// sent to absolute https URLs on public addresses
+func ValidCASProxyCallback(pgtURL string) error {
+	u, err := url.Parse(pgtURL)
+	if err != nil || u.Host == "" {
+		return errors.New("pgtUrl must be an absolute URL")
+	}
+	if u.Scheme != "https" {
+		return errors.New("pgtUrl must use https")
+	}
+	if err := ValidatePublicURL(pgtURL); err != nil {
+		return fmt.Errorf("pgtUrl %v", err)
+	}
+	return nil
+}
+
+// ValidateCASProxyCallbackPattern checks the proxy callback pattern of a
+// registered service, a regex matched against the whole pgtUrl
+func ValidateCASProxyCallbackPattern(pattern string) error {
+	if _, err := casPatternRegexp(pattern); err != nil {
+		return fmt.Errorf("proxy_callback_pattern is not a valid regular expression: %v", err)
+	}
+	return nil
+}
+
+// MatchCASProxyCallback reports whether pgtURL matches the proxy callback
+// pattern of a registered service. An empty pattern matches nothing.
+func MatchCASProxyCallback(pattern, pgtURL string) bool {
+	if pattern == "" {
+		return false
+	}
+	re, err := casPatternRegexp(pattern)
+	return err == nil && re.MatchString(pgtURL)
+}
+
+// ValidCASService checks that a service identifier is an absolute http(s) URL
+func ValidCASService(service string) bool {
+	u, err := url.Parse(service)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// casAttributeName matches attribute names that are valid XML element names
+var casAttributeName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// DefaultCASAttributes are released to registered services without an
+// attribute map
+var DefaultCASAttributes = models.JSONB{
+	"email":    SAMLSourceEmail,
+	"username": SAMLSourceUsername,
+}
+
+// ValidateCASAttributeMap checks an attribute map: each released attribute
+// name maps to a source, with the same sources as SAML attributes except
+// static values
+func ValidateCASAttributeMap(attributeMap models.JSONB) error {
+	for name, value := range attributeMap {
+		if !casAttributeName.MatchString(name) {
+			return fmt.Errorf("invalid attribute name %q", name)
+		}
+		source, ok := value.(string)
+		if !ok || source == SAMLSourceStatic {
+			return fmt.Errorf("attribute %q: source must be a string", name)
+		}
+		if err := validSAMLSource(source); err != nil {
+			return fmt.Errorf("attribute %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// CASSources lists the sources an attribute map releases from, so the
+// memberships it needs can be looked up
+func CASSources(attributeMap models.JSONB) []string {
+	var sources []string
+	for _, value := range attributeMap {
+		if source, ok := value.(string); ok {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// CASAttribute is a released attribute with its values
+type CASAttribute struct {
+	Name   string
+	Values []string
+}
+
+// BuildCASAttributes releases the attributes of the map the user has values
+// for, ordered by name, followed by the CAS 3.0 authentication attributes
+func BuildCASAttributes(attributeMap models.JSONB, src *ClaimSource, ticket *CASTicket) []CASAttribute {
+	var attributes []CASAttribute
+	for name, value := range attributeMap {
+		source, _ := value.(string)
+		if values := SAMLSourceValues(src, source); len(values) > 0 {
+			attributes = append(attributes, CASAttribute{Name: name, Values: values})
+		}
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].Name < attributes[j].Name })
+	return append(attributes,
+		CASAttribute{Name: CASAuthenticationDateAttribute, Values: []string{ticket.AuthTime.UTC().Format(time.RFC3339)}},
+		CASAttribute{Name: CASIsFromNewLoginAttribute, Values: []string{strconv.FormatBool(ticket.Primary)}},
+		CASAttribute{Name: CASLongTermAuthenticationAttribute, Values: []string{"false"}},
+	)
+}
+
+// CASAuthenticationSuccess is the result of a successful ticket validation
+type CASAuthenticationSuccess struct {
+	User                string
+	Attributes          []CASAttribute
+	ProxyGrantingTicket string // the PGTIOU
+	Proxies             []string
+}
+
+// CASServiceResponse is the response of the validation and proxy
+// endpoints. Exactly one of its parts is set.
+type CASServiceResponse struct {
+	Success      *CASAuthenticationSuccess
+	Failure      *CASFailure
+	ProxyTicket  string
+	ProxyFailure *CASFailure
+}
+
+// CASFailure is an error code with a description
+type CASFailure struct {
+	Code        string
+	Description string
+}
+
+// NewCASFailure returns an authentication failure response
+func NewCASFailure(code, format string, args ...interface{}) *CASServiceResponse {
+	return &CASServiceResponse{Failure: &CASFailure{Code: code, Description: fmt.Sprintf(format, args...)}}
+}
+
+// NewCASProxyFailure returns a proxy failure response
+func NewCASProxyFailure(code, format string, args ...interface{}) *CASServiceResponse {
+	return &CASServiceResponse{ProxyFailure: &CASFailure{Code: code, Description: fmt.Sprintf(format, args...)}}
+}
+
+type casXMLFailure struct {
+	Code        string `xml:"code,attr"`
+	Description string `xml:",chardata"`
+}
+
+type casXMLAttributes struct {
+	Attributes []CASAttribute
+}
+
+// MarshalXML writes each value as a cas:<name> element
+func (a casXMLAttributes) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, attribute := range a.Attributes {
+		for _, value := range attribute.Values {
+			if err := e.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: "cas:" + attribute.Name}}); err != nil {
+				return err
+			}
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+type casXMLSuccess struct {
+	User                string            `xml:"cas:user"`
+	Attributes          *casXMLAttributes `xml:"cas:attributes,omitempty"`
+	ProxyGrantingTicket string            `xml:"cas:proxyGrantingTicket,omitempty"`
+	Proxies             *casXMLProxies    `xml:"cas:proxies,omitempty"`
+}
+
+type casXMLProxies struct {
+	Proxy []string `xml:"cas:proxy"`
+}
+
+type casXMLProxySuccess struct {
+	ProxyTicket string `xml:"cas:proxyTicket"`
+}
+
+type casXMLResponse struct {
+	XMLName      xml.Name            `xml:"cas:serviceResponse"`
+	XMLNS        string              `xml:"xmlns:cas,attr"`
+	Success      *casXMLSuccess      `xml:"cas:authenticationSuccess,omitempty"`
+	Failure      *casXMLFailure      `xml:"cas:authenticationFailure,omitempty"`
+	ProxySuccess *casXMLProxySuccess `xml:"cas:proxySuccess,omitempty"`
+	ProxyFailure *casXMLFailure      `xml:"cas:proxyFailure,omitempty"`
+}
+
+// XML serializes the response in the CAS namespace
+func (r *CASServiceResponse) XML() ([]byte, error) {
+	out := casXMLResponse{XMLNS: casNamespace}
+	if r.Success != nil {
+		out.Success = &casXMLSuccess{User: r.Success.User, ProxyGrantingTicket: r.Success.ProxyGrantingTicket}
+		if len(r.Success.Attributes) > 0 {
+			out.Success.Attributes = &casXMLAttributes{Attributes: r.Success.Attributes}
+		}
+		if len(r.Success.Proxies) > 0 {
+			out.Success.Proxies = &casXMLProxies{Proxy: r.Success.Proxies}
+		}
+	}
+	if r.Failure != nil {
+		out.Failure = &casXMLFailure{Code: r.Failure.Code, Description: r.Failure.Description}
+	}
+	if r.ProxyTicket != "" {
+		out.ProxySuccess = &casXMLProxySuccess{ProxyTicket: r.ProxyTicket}
+	}
+	if r.ProxyFailure != nil {
+		out.ProxyFailure = &casXMLFailure{Code: r.ProxyFailure.Code, Description: r.ProxyFailure.Description}
+	}
+	return xml.MarshalIndent(out, "", "  ")
+}
+
+// JSON serializes the response in the CAS 3.0 JSON format
+func (r *CASServiceResponse) JSON() ([]byte, error) {
+	response := map[string]interface{}{}
+	if r.Success != nil {
+		success := map[string]interface{}{"user": r.Success.User}
+		if len(r.Success.Attributes) > 0 {
+			attributes := map[string]interface{}{}
+			for _, attribute := range r.Success.Attributes {
+				attributes[attribute.Name] = attribute.Values
+			}
+			success["attributes"] = attributes
+		}
+		if r.Success.ProxyGrantingTicket != "" {
+			success["proxyGrantingTicket"] = r.Success.ProxyGrantingTicket
+		}
+		if len(r.Success.Proxies) > 0 {
+			success["proxies"] = r.Success.Proxies
+		}
+		response["authenticationSuccess"] = success
+	}
+	if r.Failure != nil {
+		response["authenticationFailure"] = map[string]string{"code": r.Failure.Code, "description": r.Failure.Description}
+	}
+	if r.ProxyTicket != "" {
+		response["proxySuccess"] = map[string]string{"proxyTicket": r.ProxyTicket}
+	}
+	if r.ProxyFailure != nil {
+		response["proxyFailure"] = map[string]string{"code": r.ProxyFailure.Code, "description": r.ProxyFailure.Description}
+	}
+	return json.Marshal(map[string]interface{}{"serviceResponse": response})
+}
+
+// How the pattern of a registered CAS service matches service URLs
+const (
+	CASMatchExact  = "exact"
+	CASMatchPrefix = "prefix"
+	CASMatchRegex  = "regex"
+)
+
+// ValidateCASServicePattern checks the pattern of a registered service.
+// Exact and prefix patterns are absolute http(s) URLs, regex patterns must
+// compile.
+func ValidateCASServicePattern(matchType, pattern string) error {
+	switch matchType {
+	case CASMatchExact, CASMatchPrefix:
+		if !ValidCASService(pattern) {
+			return errors.New("pattern must be an absolute http or https URL")
+		}
+	case CASMatchRegex:
+		if _, err := casPatternRegexp(pattern); err != nil {
+			return fmt.Errorf("pattern is not a valid regular expression: %v", err)
+		}
+	default:
+		return errors.New("match_type must be exact, prefix or regex")
+	}
+	return nil
+}
+
+// casPatternRegexp compiles a regex pattern, which must match the whole URL
+func casPatternRegexp(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(`^(?:` + pattern + `)$`)
+}
+
+// MatchCASService returns the registered service a service URL belongs to,
+// or nil. An exact match wins over the longest matching prefix, which wins
+// over the first matching regex. A prefix matches the URL itself and the
+// URLs that continue it with a path, query or fragment, so that
+// https://app.example.com does not match https://app.example.com.evil.com.
+func MatchCASService(configs []models.CASServiceConfig, service string) *models.CASServiceConfig {
+	var prefix, regex *models.CASServiceConfig
+	for i := range configs {
+		config := &configs[i]
+		switch config.MatchType {
+		case CASMatchExact:
+			if config.Pattern == service {
+				return config
+			}
+		case CASMatchPrefix:
+			if casPrefixMatch(config.Pattern, service) && (prefix == nil || len(config.Pattern) > len(prefix.Pattern)) {
+				prefix = config
+			}
+		case CASMatchRegex:
+			if regex != nil {
+				continue
+			}
+			if re, err := casPatternRegexp(config.Pattern); err == nil && re.MatchString(service) {
+				regex = config
+			}
+		}
+	}
+	if prefix != nil {
+		return prefix
+	}
+	return regex
+}
+
+func casPrefixMatch(pattern, service string) bool {
+	if pattern == "" || !strings.HasPrefix(service, pattern) {
+		return false
+	}
+	if len(service) == len(pattern) || strings.HasSuffix(pattern, "/") {
+		return true
+	}
+	return strings.ContainsRune("/?#", rune(service[len(pattern)]))
+}
@@ -0,0 +1,147 @@
+package sso
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCASTicket(t *testing.T) {
+	ticket := NewCASTicket(CASServiceTicketPrefix)
+	assert.True(t, strings.HasPrefix(ticket, "ST-"))
+	assert.Len(t, ticket, len("ST-")+43)
+	assert.NotEqual(t, ticket, NewCASTicket(CASServiceTicketPrefix))
+}
+
+func TestValidCASProxyCallback(t *testing.T) {
+	assert.NoError(t, ValidCASProxyCallback("https://portal.example.com/pgt"))
+	assert.Error(t, ValidCASProxyCallback("http://portal.example.com/pgt"))
+	assert.Error(t, ValidCASProxyCallback("/pgt"))
+	assert.Error(t, ValidCASProxyCallback("https://localhost/pgt"))
+	assert.Error(t, ValidCASProxyCallback("https://10.0.0.5/pgt"))
+}
+
+func TestMatchCASProxyCallback(t *testing.T) {
+	assert.NoError(t, ValidateCASProxyCallbackPattern(`https://portal\.example\.com/pgt(/.*)?`))
+	assert.Error(t, ValidateCASProxyCallbackPattern(`https://(`))
+
+	pattern := `https://portal\.example\.com/pgt(/.*)?`
+	assert.True(t, MatchCASProxyCallback(pattern, "https://portal.example.com/pgt"))
+	assert.True(t, MatchCASProxyCallback(pattern, "https://portal.example.com/pgt/callback"))
+	assert.False(t, MatchCASProxyCallback(pattern, "https://portal.example.com/pgtx"))
+	assert.False(t, MatchCASProxyCallback(pattern, "https://evil.example.com/?https://portal.example.com/pgt"))
+	assert.False(t, MatchCASProxyCallback("", "https://portal.example.com/pgt"))
+}
+
+func TestValidateCASAttributeMap(t *testing.T) {
+	assert.NoError(t, ValidateCASAttributeMap(models.JSONB{"mail": "email", "memberOf": "groups", "dept": "attribute:department"}))
+	assert.Error(t, ValidateCASAttributeMap(models.JSONB{"1mail": "email"}))
+	assert.Error(t, ValidateCASAttributeMap(models.JSONB{"mail": "nickname"}))
+	assert.Error(t, ValidateCASAttributeMap(models.JSONB{"mail": "static"}))
+	assert.Error(t, ValidateCASAttributeMap(models.JSONB{"mail": 1}))
+}
+
+func TestBuildCASAttributes(t *testing.T) {
+	src := &ClaimSource{User: &models.User{ID: 7, Username: "alice", Email: "alice@example.com"}, Groups: []string{"dev", "ops"}}
+	authTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	attributes := BuildCASAttributes(models.JSONB{"memberOf": "groups", "mail": "email", "tel": "phone"}, src, &CASTicket{AuthTime: authTime, Primary: true})
+
+	// Attributes without a value are left out
+	assert.Equal(t, []CASAttribute{
+		{Name: "mail", Values: []string{"alice@example.com"}},
+		{Name: "memberOf", Values: []string{"dev", "ops"}},
+		{Name: CASAuthenticationDateAttribute, Values: []string{"2024-05-01T12:00:00Z"}},
+		{Name: CASIsFromNewLoginAttribute, Values: []string{"true"}},
+		{Name: CASLongTermAuthenticationAttribute, Values: []string{"false"}},
+	}, attributes)
+}
+
+func TestCASServiceResponseXML(t *testing.T) {
+	response := &CASServiceResponse{Success: &CASAuthenticationSuccess{
+		User:                "alice",
+		Attributes:          []CASAttribute{{Name: "memberOf", Values: []string{"dev", "ops"}}},
+		ProxyGrantingTicket: "PGTIOU-1",
+		Proxies:             []string{"https://proxy2.example.com/pgt", "https://proxy1.example.com/pgt"},
+	}}
+	data, err := response.XML()
+	if !assert.NoError(t, err) {
+		return
+	}
+	xml := string(data)
+	assert.Contains(t, xml, `<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">`)
+	assert.Contains(t, xml, `<cas:user>alice</cas:user>`)
+	assert.Contains(t, xml, `<cas:memberOf>dev</cas:memberOf>`)
+	assert.Contains(t, xml, `<cas:memberOf>ops</cas:memberOf>`)
+	assert.Contains(t, xml, `<cas:proxyGrantingTicket>PGTIOU-1</cas:proxyGrantingTicket>`)
+	assert.Contains(t, xml, `<cas:proxy>https://proxy2.example.com/pgt</cas:proxy>`)
+	assert.NotContains(t, xml, "authenticationFailure")
+
+	data, err = NewCASFailure(CASInvalidTicket, "ticket %s not recognized", "ST-<1>").XML()
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `<cas:authenticationFailure code="INVALID_TICKET">ticket ST-&lt;1&gt; not recognized</cas:authenticationFailure>`)
+
+	data, err = (&CASServiceResponse{ProxyTicket: "PT-1"}).XML()
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `<cas:proxySuccess>`)
+	assert.Contains(t, string(data), `<cas:proxyTicket>PT-1</cas:proxyTicket>`)
+}
+
+func TestCASServiceResponseJSON(t *testing.T) {
+	response := &CASServiceResponse{Success: &CASAuthenticationSuccess{
+		User:       "alice",
+		Attributes: []CASAttribute{{Name: "mail", Values: []string{"alice@example.com"}}},
+	}}
+	data, err := response.JSON()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.JSONEq(t, `{"serviceResponse":{"authenticationSuccess":{"user":"alice","attributes":{"mail":["alice@example.com"]}}}}`, string(data))
+
+	data, err = NewCASProxyFailure(CASInvalidTicket, "bad pgt").JSON()
+	assert.NoError(t, err)
+	var parsed map[string]map[string]map[string]string
+	assert.NoError(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, "INVALID_TICKET", parsed["serviceResponse"]["proxyFailure"]["code"])
+}
+
+func TestValidateCASServicePattern(t *testing.T) {
+	assert.NoError(t, ValidateCASServicePattern(CASMatchExact, "https://portal.example.com/login"))
+	assert.NoError(t, ValidateCASServicePattern(CASMatchPrefix, "https://portal.example.com/"))
+	assert.NoError(t, ValidateCASServicePattern(CASMatchRegex, `https://[a-z]+\.example\.com/.*`))
+	assert.Error(t, ValidateCASServicePattern(CASMatchPrefix, "portal.example.com"))
+	assert.Error(t, ValidateCASServicePattern(CASMatchRegex, "https://(portal"))
+	assert.Error(t, ValidateCASServicePattern("glob", "https://*.example.com"))
+}
+
+func TestMatchCASService(t *testing.T) {
+	configs := []models.CASServiceConfig{
+		{ID: 1, MatchType: CASMatchPrefix, Pattern: "https://portal.example.com"},
+		{ID: 2, MatchType: CASMatchPrefix, Pattern: "https://portal.example.com/admin/"},
+		{ID: 3, MatchType: CASMatchExact, Pattern: "https://portal.example.com/admin/login"},
+		{ID: 4, MatchType: CASMatchRegex, Pattern: `https://[a-z]+\.apps\.example\.com/.*`},
+		{ID: 5, MatchType: CASMatchRegex, Pattern: `https://.*`},
+	}
+	match := func(service string) uint64 {
+		if config := MatchCASService(configs, service); config != nil {
+			return config.ID
+		}
+		return 0
+	}
+	assert.Equal(t, uint64(1), match("https://portal.example.com"))
+	assert.Equal(t, uint64(1), match("https://portal.example.com/home?x=1"))
+	assert.Equal(t, uint64(1), match("https://portal.example.com?x=1"))
+	assert.Equal(t, uint64(2), match("https://portal.example.com/admin/users"))
+	assert.Equal(t, uint64(3), match("https://portal.example.com/admin/login"))
+	assert.Equal(t, uint64(4), match("https://wiki.apps.example.com/"))
+	assert.Equal(t, uint64(5), match("https://portal.example.com.evil.com/"))
+
+	// Regex patterns match the whole URL
+	configs = configs[:4]
+	assert.Equal(t, uint64(0), match("https://portal.example.com.evil.com/"))
+	assert.Equal(t, uint64(0), match("https://evil.com/?https://wiki.apps.example.com/"))
+	assert.Equal(t, uint64(0), match("http://wiki.apps.example.com/"))
+}
@@ -0,0 +1,166 @@
+package sso
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hanyouqing/openauth/internal/models"
+)
+
+// Claims derived from the user's roles, groups and organizations
+const (
+	ClaimRoles   = "roles"
+	ClaimGroups  = "groups"
+	ClaimOrgPath = "org_path"
+)
+
+// StandardScopes are the scopes defined by OpenID Connect. Clients without
+// registered scopes may request these only.
+var StandardScopes = []string{"openid", "profile", "email", "phone", "offline_access"}
+
+// StandardScopeClaims are the claims released by the OpenID Connect scopes
+// (OIDC Core section 5.4). The scope registry may redefine them.
+var StandardScopeClaims = map[string][]string{
+	"profile": {"name", "preferred_username", "picture", "updated_at"},
+	"email":   {"email", "email_verified"},
+	"phone":   {"phone_number", "phone_number_verified"},
+}
+
+// reservedScopes carry no claims and cannot be defined in the registry
+var reservedScopes = []string{"openid", "offline_access"}
+
+// userClaims are read from the user record. Claims that are neither these
+// nor derived from memberships come from the user's custom attributes.
+var userClaims = []string{
+	"name", "preferred_username", "picture", "updated_at",
+	"email", "email_verified", "phone_number", "phone_number_verified",
+}
+
+// protocolClaims are set by the token issuer and cannot be released by scopes
+var protocolClaims = []string{
+	"sub", "iss", "aud", "exp", "iat", "nbf", "jti", "auth_time", "nonce", "acr", "amr",
+	"azp", "at_hash", "sid", "client_id", "scope", "act", "cnf", "events",
+}
+
+// ValidateScopeDefinition checks a scope registry entry
+func ValidateScopeDefinition(name string, claims []string) error {
+	if !validScopeToken(name) {
+		return fmt.Errorf("invalid scope name %q", name)
+	}
+	if containsString(reservedScopes, name) {
+		return fmt.Errorf("scope %q cannot be redefined", name)
+	}
+	if len(claims) == 0 {
+		return errors.New("a scope must release at least one claim")
+	}
+	for _, claim := range claims {
+		if claim == "" || strings.ContainsAny(claim, " \t\r\n") {
+			return fmt.Errorf("invalid claim name %q", claim)
+		}
+		if containsString(protocolClaims, claim) {
+			return fmt.Errorf("claim %q is set by the issuer and cannot be released by a scope", claim)
+		}
+	}
+	return nil
+}
+
+// ScopeClaims returns the claims covered by the granted scope. definitions
+// holds the registry's scopes, which take precedence over the standard ones.
+func ScopeClaims(scope string, definitions map[string][]string) []string {
+	var claims []string
+	for _, s := range ParseScopes(scope) {
+		scopeClaims, ok := definitions[s]
+		if !ok {
+			scopeClaims = StandardScopeClaims[s]
+		}
+		for _, claim := range scopeClaims {
+			if !containsString(claims, claim) {
+				claims = append(claims, claim)
+			}
+		}
+	}
+	return claims
+}
+
+// ClaimSource holds what claims are released from: the user record and the
+// memberships looked up for the requested claims
+type ClaimSource struct {
+	User     *models.User
+	Roles    []string
+	Groups   []string
+	OrgPaths []string
+}
+
+// ReleaseClaims returns sub and those of the claims the user has a value for
+func ReleaseClaims(src *ClaimSource, claims []string) map[string]interface{} {
+	user := src.User
+	info := map[string]interface{}{
+		"sub": fmt.Sprintf("%d", user.ID),
+	}
+	for _, claim := range claims {
+		switch claim {
+		case "name", "preferred_username":
+			info[claim] = user.Username
+		case "picture":
+			if user.Avatar != "" {
+				info[claim] = user.Avatar
+			}
+		case "updated_at":
+			info[claim] = user.UpdatedAt.Unix()
+		case "email":
+			info[claim] = user.Email
+		case "email_verified":
+			info[claim] = user.EmailVerified
+		case "phone_number":
+			if user.Phone != "" {
+				info[claim] = user.Phone
+			}
+		case "phone_number_verified":
+			if user.Phone != "" {
+				info[claim] = user.PhoneVerified
+			}
+		case ClaimRoles:
+			info[claim] = nonNil(src.Roles)
+		case ClaimGroups:
+			info[claim] = nonNil(src.Groups)
+		case ClaimOrgPath:
+			info[claim] = nonNil(src.OrgPaths)
+		default:
+			if value, ok := user.Attributes[claim]; ok {
+				info[claim] = value
+			}
+		}
+	}
+	return info
+}
+
+// AccessTokenClaims selects the released claims that JWT access tokens carry:
+// memberships and custom attributes, but not the user's profile, email or
+// phone, which clients obtain from the ID token or UserInfo.
+func AccessTokenClaims(released map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{}
+	for name, value := range released {
+		if name != "sub" && !containsString(userClaims, name) {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+// ClientAllowsScope reports whether the client may request every scope in
+// scope: those it registered, or the standard scopes if it registered none.
+func ClientAllowsScope(client *models.OAuthClient, scope string) bool {
+	allowed := client.Scopes
+	if len(allowed) == 0 {
+		allowed = StandardScopes
+	}
+	return ScopeSubset(scope, strings.Join(allowed, " "))
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
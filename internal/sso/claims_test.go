@@ -0,0 +1,74 @@
+package sso
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopeClaims(t *testing.T) {
+	assert.Empty(t, ScopeClaims("openid", nil))
+	assert.Equal(t, []string{"email", "email_verified"}, ScopeClaims("openid email", nil))
+
+	definitions := map[string][]string{
+		"hr":    {"roles", "org_path", "employee_id"},
+		"email": {"email"},
+	}
+	// Registry definitions take precedence over the standard scopes
+	assert.Equal(t, []string{"email", "roles", "org_path", "employee_id"}, ScopeClaims("openid email hr", definitions))
+	assert.Empty(t, ScopeClaims("orders:read", definitions))
+}
+
+func TestReleaseClaims(t *testing.T) {
+	user := &models.User{
+		ID:            7,
+		Username:      "alice",
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		UpdatedAt:     time.Unix(1700000000, 0),
+		Attributes:    models.JSONB{"employee_id": "E1024"},
+	}
+	src := &ClaimSource{User: user, Roles: []string{"finance"}, OrgPaths: []string{"/Acme/Finance"}}
+
+	claims := ReleaseClaims(src, []string{"email", "phone_number", "roles", "groups", "org_path", "employee_id", "cost_center"})
+	assert.Equal(t, map[string]interface{}{
+		"sub":         "7",
+		"email":       "alice@example.com",
+		"roles":       []string{"finance"},
+		"groups":      []string{},
+		"org_path":    []string{"/Acme/Finance"},
+		"employee_id": "E1024",
+	}, claims)
+
+	// Only the sub is released without scopes
+	assert.Equal(t, map[string]interface{}{"sub": "7"}, ReleaseClaims(src, nil))
+
+	assert.Equal(t, map[string]interface{}{
+		"roles":       []string{"finance"},
+		"employee_id": "E1024",
+	}, AccessTokenClaims(ReleaseClaims(src, []string{"name", "email", "roles", "employee_id"})))
+}
+
+func TestValidateScopeDefinition(t *testing.T) {
+	assert.NoError(t, ValidateScopeDefinition("hr", []string{"roles", "employee_id"}))
+	assert.NoError(t, ValidateScopeDefinition("profile", []string{"name", "org_path"}))
+	assert.Error(t, ValidateScopeDefinition("openid", []string{"name"}))
+	assert.Error(t, ValidateScopeDefinition("h r", []string{"roles"}))
+	assert.Error(t, ValidateScopeDefinition("hr", nil))
+	assert.Error(t, ValidateScopeDefinition("hr", []string{"sub"}))
+	assert.Error(t, ValidateScopeDefinition("hr", []string{"employee id"}))
+}
+
+func TestClientAllowsScope(t *testing.T) {
+	client := &models.OAuthClient{Scopes: []string{"openid", "hr"}}
+	assert.True(t, ClientAllowsScope(client, "openid hr"))
+	assert.True(t, ClientAllowsScope(client, ""))
+	assert.False(t, ClientAllowsScope(client, "openid email"))
+
+	// Clients without registered scopes get the standard scopes
+	client.Scopes = nil
+	assert.True(t, ClientAllowsScope(client, "openid profile email offline_access"))
+	assert.False(t, ClientAllowsScope(client, "openid hr"))
+}
@@ -0,0 +1,236 @@
+package sso
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hanyouqing/openauth/internal/auth"
+	"github.com/hanyouqing/openauth/internal/models"
+)
+
+// SupportedGrantTypes lists the grant types a client may register for
+var SupportedGrantTypes = []string{
+	"authorization_code",
+	"refresh_token",
+	"client_credentials",
+	"password",
+	GrantTypeDeviceCode,
+	GrantTypeTokenExchange,
+}
+
+// ClientMetadataError describes client metadata rejected on write. Code uses
+// the RFC 7591 error codes so it can be returned as-is by registration.
+type ClientMetadataError struct {
+	Code        string
+	Description string
+}
+
+func (e *ClientMetadataError) Error() string {
+	return e.Description
+}
+
+func invalidMetadata(format string, args ...interface{}) error {
+	return &ClientMetadataError{Code: "invalid_client_metadata", Description: fmt.Sprintf(format, args...)}
+}
+
+func GenerateClientID() string {
+	return uuid.New().String()
+}
+
+// GenerateClientSecret returns a new random secret and its hash for storage
+func GenerateClientSecret() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	hash, err := auth.HashPassword(secret)
+	if err != nil {
+		return "", "", err
+	}
+	return secret, hash, nil
+}
+
+// CheckClientSecret verifies a presented secret against the current secret and,
+// while its overlap window lasts, the secret replaced by the last rotation.
+func CheckClientSecret(client *models.OAuthClient, secret string, now time.Time) bool {
+	if secret == "" {
+		return false
+	}
+	if checkSecretHash(client.ClientSecret, secret) {
+		return true
+	}
+	if client.PreviousClientSecret != "" && client.PreviousSecretExpiresAt != nil && now.Before(*client.PreviousSecretExpiresAt) {
+		return checkSecretHash(client.PreviousClientSecret, secret)
+	}
+	return false
+}
+
+func checkSecretHash(stored, secret string) bool {
+	if stored == "" {
+		return false
+	}
+	if !IsHashedSecret(stored) {
+		// Rows inserted before secrets were hashed hold the plaintext
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(secret)) == 1
+	}
+	return auth.CheckPassword(secret, stored)
+}
+
+// IsHashedSecret reports whether a stored secret is a bcrypt hash
+func IsHashedSecret(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// ValidateClientMetadata checks redirect and logout URIs, grant types,
+// scopes, the authentication method and the access token format of a client
+// before it is written, filling in defaults.
+func ValidateClientMetadata(client *models.OAuthClient) error {
+	if len(client.GrantTypes) == 0 {
+		client.GrantTypes = []string{"authorization_code", "refresh_token"}
+	}
+	for _, grantType := range client.GrantTypes {
+		if !containsString(SupportedGrantTypes, grantType) {
+			return invalidMetadata("unsupported grant type %q", grantType)
+		}
+		if client.Public && (grantType == "client_credentials" || grantType == GrantTypeTokenExchange) {
+			return invalidMetadata("public clients cannot use the %s grant", grantType)
+		}
+	}
+
+	if ClientAllowsGrant(client, "authorization_code") && len(client.RedirectURIs) == 0 {
+		return &ClientMetadataError{Code: "invalid_redirect_uri", Description: "at least one redirect URI is required for the authorization_code grant"}
+	}
+	for _, uri := range client.RedirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return err
+		}
+	}
+
+	for _, scope := range client.Scopes {
+		if !validScopeToken(scope) {
+			return invalidMetadata("invalid scope %q", scope)
+		}
+	}
+
+	if err := validateAuthMethod(client); err != nil {
+		return err
+	}
+	if err := validateLogoutURIs(client); err != nil {
+		return err
+	}
+
+	switch client.AccessTokenFormat {
+	case "":
+		client.AccessTokenFormat = AccessTokenFormatOpaque
+	case AccessTokenFormatOpaque, AccessTokenFormatJWT:
+	default:
+		return invalidMetadata("unsupported access token format %q", client.AccessTokenFormat)
+	}
+	return nil
+}
+
+// validateAuthMethod checks the token endpoint authentication method and
+// the key material it needs, defaulting to client_secret_basic.
+func validateAuthMethod(client *models.OAuthClient) error {
+	switch {
+	case client.TokenEndpointAuthMethod == "" && client.Public:
+		client.TokenEndpointAuthMethod = AuthMethodNone
+	case client.TokenEndpointAuthMethod == "":
+		client.TokenEndpointAuthMethod = AuthMethodClientSecretBasic
+	case !containsString(SupportedAuthMethods, client.TokenEndpointAuthMethod):
+		return invalidMetadata("unsupported token_endpoint_auth_method %q", client.TokenEndpointAuthMethod)
+	}
+	if client.Public != (client.TokenEndpointAuthMethod == AuthMethodNone) {
+		return invalidMetadata("public clients must use token_endpoint_auth_method none")
+	}
+
+	// Keys also verify request objects, so any client may register them
+	if len(client.JWKS) > 0 && client.JWKSURI != "" {
+		return invalidMetadata("jwks and jwks_uri are mutually exclusive")
+	}
+	if len(client.JWKS) > 0 {
+		if err := ValidateJWKS(client.JWKS); err != nil {
+			return invalidMetadata("invalid jwks: %v", err)
+		}
+	} else if client.JWKSURI != "" {
+		if err := ValidatePublicURL(client.JWKSURI); err != nil {
+			return invalidMetadata("jwks_uri must be an https URL of a public host")
+		}
+	}
+
+	switch client.TokenEndpointAuthMethod {
+	case AuthMethodPrivateKeyJWT:
+		if len(client.JWKS) == 0 && client.JWKSURI == "" {
+			return invalidMetadata("private_key_jwt requires jwks or an https jwks_uri")
+		}
+	case AuthMethodTLSClientAuth:
+		if client.TLSClientAuthSubjectDN == "" {
+			return invalidMetadata("tls_client_auth requires tls_client_auth_subject_dn")
+		}
+	}
+	return nil
+}
+
+// validateRedirectURI requires an absolute URI without fragment (RFC 6749
+// section 3.1.2). Plain http is only accepted for loopback addresses; other
+// schemes are allowed for native apps using private-use URI schemes.
+func validateRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" || !u.IsAbs() {
+		return &ClientMetadataError{Code: "invalid_redirect_uri", Description: fmt.Sprintf("redirect URI %q must be an absolute URI", uri)}
+	}
+	if u.Fragment != "" || strings.Contains(uri, "#") {
+		return &ClientMetadataError{Code: "invalid_redirect_uri", Description: fmt.Sprintf("redirect URI %q must not contain a fragment", uri)}
+	}
+	switch u.Scheme {
+	case "https":
+		if u.Host == "" {
+			return &ClientMetadataError{Code: "invalid_redirect_uri", Description: fmt.Sprintf("redirect URI %q has no host", uri)}
+		}
+	case "http":
+		if !isLoopbackHost(u.Hostname()) {
+			return &ClientMetadataError{Code: "invalid_redirect_uri", Description: fmt.Sprintf("redirect URI %q must use https", uri)}
+		}
+	case "javascript", "data", "file":
+		return &ClientMetadataError{Code: "invalid_redirect_uri", Description: fmt.Sprintf("redirect URI scheme %q is not allowed", u.Scheme)}
+	}
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validScopeToken checks the scope-token syntax of RFC 6749 section 3.3
+func validScopeToken(scope string) bool {
+	if scope == "" {
+		return false
+	}
+	for _, r := range scope {
+		if r < 0x21 || r > 0x7e || r == '"' || r == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,269 @@
+package sso
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hanyouqing/openauth/internal/models"
+)
+
+// Token endpoint authentication methods a client can register with
+const (
+	AuthMethodClientSecretBasic = "client_secret_basic"
+	AuthMethodClientSecretPost  = "client_secret_post"
+	AuthMethodPrivateKeyJWT     = "private_key_jwt"
+	AuthMethodTLSClientAuth     = "tls_client_auth"
+	AuthMethodNone              = "none"
+)
+
+// SupportedAuthMethods lists the token endpoint authentication methods
+var SupportedAuthMethods = []string{
+	AuthMethodClientSecretBasic,
+	AuthMethodClientSecretPost,
+	AuthMethodPrivateKeyJWT,
+	AuthMethodTLSClientAuth,
+	AuthMethodNone,
+}
+
+// ClientAssertionType is the client_assertion_type of private_key_jwt (RFC 7523)
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// ClientAssertionAlgs are the signing algorithms accepted for client assertions
+var ClientAssertionAlgs = []string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "ES512"}
+
+// maxAssertionLifetime bounds how far in the future a client assertion may
+// expire, which also bounds the size of the jti replay cache.
+const maxAssertionLifetime = time.Hour
+
+// ClientUsesSecret reports whether the client authenticates with a client
+// secret. Clients that predate token_endpoint_auth_method have an empty method.
+func ClientUsesSecret(client *models.OAuthClient) bool {
+	switch client.TokenEndpointAuthMethod {
+	case AuthMethodClientSecretBasic, AuthMethodClientSecretPost:
+		return true
+	case "":
+		return !client.Public
+	}
+	return false
+}
+
+// ClientAllowsAuthMethod reports whether the client may authenticate with
+// the method it used. Clients without a declared method accept both secret
+// methods, as they did before the method was recorded.
+func ClientAllowsAuthMethod(client *models.OAuthClient, method string) bool {
+	if client.TokenEndpointAuthMethod == "" {
+		if client.Public {
+			return method == AuthMethodNone
+		}
+		return method == AuthMethodClientSecretBasic || method == AuthMethodClientSecretPost
+	}
+	return client.TokenEndpointAuthMethod == method
+}
+
+// ParseBasicCredentials decodes client credentials from an HTTP Basic
+// header. Both values are form-urlencoded first (RFC 6749 section 2.3.1).
+func ParseBasicCredentials(username, password string) (string, string, error) {
+	clientID, err := url.QueryUnescape(username)
+	if err != nil {
+		return "", "", err
+	}
+	clientSecret, err := url.QueryUnescape(password)
+	if err != nil {
+		return "", "", err
+	}
+	return clientID, clientSecret, nil
+}
+
+// ClientAssertionClaims are the verified claims of a private_key_jwt assertion
+type ClientAssertionClaims struct {
+	JTI       string
+	ExpiresAt time.Time
+}
+
+// VerifyClientAssertion checks a private_key_jwt client assertion (RFC 7523
+// section 3) against the client's JWKS. audiences are the accepted aud values.
+func VerifyClientAssertion(assertion, clientID string, jwks map[string]interface{}, audiences []string, now time.Time) (*ClientAssertionClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(assertion, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return findJWK(jwks, kid, token.Method.Alg())
+	},
+		jwt.WithValidMethods(ClientAssertionAlgs),
+		jwt.WithIssuer(clientID),
+		jwt.WithSubject(clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client assertion: %w", err)
+	}
+
+	aud, _ := claims.GetAudience()
+	audienceOK := false
+	for _, a := range aud {
+		if containsString(audiences, strings.TrimSuffix(a, "/")) {
+			audienceOK = true
+			break
+		}
+	}
+	if !audienceOK {
+		return nil, errors.New("invalid client assertion: audience does not match")
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, errors.New("invalid client assertion: jti is required")
+	}
+	exp, _ := claims.GetExpirationTime()
+	if exp.Sub(now) > maxAssertionLifetime {
+		return nil, errors.New("invalid client assertion: expires too far in the future")
+	}
+	return &ClientAssertionClaims{JTI: jti, ExpiresAt: exp.Time}, nil
+}
+
+// findJWK selects the verification key from a JWK Set by kid, or the only
+// key usable with alg when the assertion carries no kid.
+func findJWK(jwks map[string]interface{}, kid, alg string) (crypto.PublicKey, error) {
+	keys, _ := jwks["keys"].([]interface{})
+	var candidates []crypto.PublicKey
+	for _, k := range keys {
+		jwk, ok := k.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if use, _ := jwk["use"].(string); use != "" && use != "sig" {
+			continue
+		}
+		if kid != "" {
+			if id, _ := jwk["kid"].(string); id != kid {
+				continue
+			}
+		}
+		key, err := JWKPublicKey(jwk)
+		if err != nil {
+			continue
+		}
+		if _, isRSA := key.(*rsa.PublicKey); isRSA == strings.HasPrefix(alg, "ES") {
+			continue
+		}
+		candidates = append(candidates, key)
+	}
+	if len(candidates) != 1 {
+		return nil, errors.New("no unique matching key in client JWKS")
+	}
+	return candidates[0], nil
+}
+
+// JWKPublicKey converts an RSA or EC public JWK to a Go public key
+func JWKPublicKey(jwk map[string]interface{}) (crypto.PublicKey, error) {
+	decode := func(name string) (*big.Int, error) {
+		v, _ := jwk[name].(string)
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid JWK member %q", name)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch jwk["kty"] {
+	case "RSA":
+		n, err := decode("n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode("e")
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk["crv"] {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", jwk["crv"])
+		}
+		x, err := decode("x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode("y")
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %v", jwk["kty"])
+}
+
+// ValidateJWKS checks that a JWK Set contains at least one usable public key
+func ValidateJWKS(jwks map[string]interface{}) error {
+	keys, _ := jwks["keys"].([]interface{})
+	for _, k := range keys {
+		jwk, ok := k.(map[string]interface{})
+		if !ok {
+			return errors.New("JWKS keys must be objects")
+		}
+		if _, hasPrivate := jwk["d"]; hasPrivate {
+			return errors.New("JWKS must not contain private keys")
+		}
+		if _, err := JWKPublicKey(jwk); err != nil {
+			return err
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS has no keys")
+	}
+	return nil
+}
+
+// ParseClientCertificate decodes a client certificate forwarded by a TLS
+// terminating proxy as URL-escaped PEM (e.g. nginx $ssl_client_escaped_cert).
+func ParseClientCertificate(header string) (*x509.Certificate, error) {
+	data, err := url.QueryUnescape(header)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("client certificate is not PEM encoded")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// MatchSubjectDN compares the certificate subject with the registered
+// tls_client_auth_subject_dn (RFC 8705 section 2.1.2).
+func MatchSubjectDN(cert *x509.Certificate, subjectDN string) bool {
+	return subjectDN != "" && normalizeDN(cert.Subject.String()) == normalizeDN(subjectDN)
+}
+
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, part := range parts {
+		if k, v, ok := strings.Cut(strings.TrimSpace(part), "="); ok {
+			parts[i] = strings.ToUpper(strings.TrimSpace(k)) + "=" + strings.TrimSpace(v)
+		}
+	}
+	return strings.Join(parts, ",")
+}
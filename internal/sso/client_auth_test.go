@@ -0,0 +1,115 @@
+package sso
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyClientAssertion(t *testing.T) {
+	rsaKey, err := GenerateSigningKey()
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwks := map[string]interface{}{"keys": []interface{}{
+		rsaKey.PublicJWK(),
+		map[string]interface{}{
+			"kty": "EC",
+			"crv": "P-256",
+			"kid": "ec-1",
+			"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+	}}
+	assert.NoError(t, ValidateJWKS(jwks))
+
+	now := time.Now()
+	audiences := []string{"https://auth.example.com", "https://auth.example.com/oauth2/token"}
+	claims := func(aud, jti string) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "client-1",
+			"sub": "client-1",
+			"aud": aud,
+			"jti": jti,
+			"exp": now.Add(time.Minute).Unix(),
+		}
+	}
+
+	assertion, err := rsaKey.Sign(claims("https://auth.example.com/oauth2/token", "a1"))
+	assert.NoError(t, err)
+	verified, err := VerifyClientAssertion(assertion, "client-1", jwks, audiences, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "a1", verified.JTI)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims("https://auth.example.com", "a2"))
+	token.Header["kid"] = "ec-1"
+	assertion, err = token.SignedString(ecKey)
+	assert.NoError(t, err)
+	_, err = VerifyClientAssertion(assertion, "client-1", jwks, audiences, now)
+	assert.NoError(t, err)
+
+	// Wrong client, audience and missing jti are rejected
+	_, err = VerifyClientAssertion(assertion, "client-2", jwks, audiences, now)
+	assert.Error(t, err)
+	assertion, _ = rsaKey.Sign(claims("https://other.example.com", "a3"))
+	_, err = VerifyClientAssertion(assertion, "client-1", jwks, audiences, now)
+	assert.Error(t, err)
+	assertion, _ = rsaKey.Sign(claims("https://auth.example.com", ""))
+	_, err = VerifyClientAssertion(assertion, "client-1", jwks, audiences, now)
+	assert.Error(t, err)
+
+	// Assertions signed by an unknown key are rejected
+	other, _ := GenerateSigningKey()
+	assertion, _ = other.Sign(claims("https://auth.example.com", "a4"))
+	_, err = VerifyClientAssertion(assertion, "client-1", jwks, audiences, now)
+	assert.Error(t, err)
+
+	assert.Error(t, ValidateJWKS(map[string]interface{}{"keys": []interface{}{map[string]interface{}{"kty": "RSA", "n": "AQAB", "e": "AQAB", "d": "AQAB"}}}))
+}
+
+func TestClientAllowsAuthMethod(t *testing.T) {
+	legacy := &models.OAuthClient{}
+	assert.True(t, ClientAllowsAuthMethod(legacy, AuthMethodClientSecretBasic))
+	assert.True(t, ClientAllowsAuthMethod(legacy, AuthMethodClientSecretPost))
+	assert.False(t, ClientAllowsAuthMethod(legacy, AuthMethodNone))
+	assert.True(t, ClientUsesSecret(legacy))
+
+	public := &models.OAuthClient{Public: true}
+	assert.True(t, ClientAllowsAuthMethod(public, AuthMethodNone))
+	assert.False(t, ClientUsesSecret(public))
+
+	jwtClient := &models.OAuthClient{TokenEndpointAuthMethod: AuthMethodPrivateKeyJWT}
+	assert.True(t, ClientAllowsAuthMethod(jwtClient, AuthMethodPrivateKeyJWT))
+	assert.False(t, ClientAllowsAuthMethod(jwtClient, AuthMethodClientSecretBasic))
+	assert.False(t, ClientUsesSecret(jwtClient))
+}
+
+func TestMatchSubjectDN(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client-1", Organization: []string{"Example"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	assert.True(t, MatchSubjectDN(cert, "CN=client-1,O=Example"))
+	assert.True(t, MatchSubjectDN(cert, "cn=client-1, o=Example"))
+	assert.False(t, MatchSubjectDN(cert, "CN=client-2,O=Example"))
+	assert.False(t, MatchSubjectDN(cert, ""))
+}
@@ -0,0 +1,73 @@
+package sso
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckClientSecret(t *testing.T) {
+	secret, hash, err := GenerateClientSecret()
+	assert.NoError(t, err)
+	assert.True(t, IsHashedSecret(hash))
+
+	client := &models.OAuthClient{ClientSecret: hash}
+	now := time.Now()
+	assert.True(t, CheckClientSecret(client, secret, now))
+	assert.False(t, CheckClientSecret(client, "wrong", now))
+	assert.False(t, CheckClientSecret(client, "", now))
+
+	// After rotation both secrets work until the overlap window ends
+	newSecret, newHash, err := GenerateClientSecret()
+	assert.NoError(t, err)
+	expiresAt := now.Add(time.Hour)
+	client.PreviousClientSecret = client.ClientSecret
+	client.PreviousSecretExpiresAt = &expiresAt
+	client.ClientSecret = newHash
+
+	assert.True(t, CheckClientSecret(client, newSecret, now))
+	assert.True(t, CheckClientSecret(client, secret, now))
+	assert.False(t, CheckClientSecret(client, secret, now.Add(2*time.Hour)))
+
+	// Legacy rows hold the plaintext secret
+	legacy := &models.OAuthClient{ClientSecret: "plain-secret"}
+	assert.True(t, CheckClientSecret(legacy, "plain-secret", now))
+	assert.False(t, CheckClientSecret(legacy, "plain", now))
+}
+
+func TestValidateClientMetadata(t *testing.T) {
+	client := &models.OAuthClient{RedirectURIs: []string{"https://app.example.com/cb"}, Scopes: []string{"openid", "profile"}}
+	assert.NoError(t, ValidateClientMetadata(client))
+	assert.Equal(t, models.StringArray{"authorization_code", "refresh_token"}, client.GrantTypes)
+	assert.Equal(t, AccessTokenFormatOpaque, client.AccessTokenFormat)
+
+	tests := []struct {
+		name   string
+		client models.OAuthClient
+		code   string
+	}{
+		{"missing redirect URI", models.OAuthClient{GrantTypes: []string{"authorization_code"}}, "invalid_redirect_uri"},
+		{"relative redirect URI", models.OAuthClient{RedirectURIs: []string{"/cb"}}, "invalid_redirect_uri"},
+		{"fragment", models.OAuthClient{RedirectURIs: []string{"https://app.example.com/cb#x"}}, "invalid_redirect_uri"},
+		{"plain http", models.OAuthClient{RedirectURIs: []string{"http://app.example.com/cb"}}, "invalid_redirect_uri"},
+		{"unknown grant", models.OAuthClient{GrantTypes: []string{"implicit"}}, "invalid_client_metadata"},
+		{"public client_credentials", models.OAuthClient{Public: true, GrantTypes: []string{"client_credentials"}}, "invalid_client_metadata"},
+		{"unknown token format", models.OAuthClient{GrantTypes: []string{"client_credentials"}, AccessTokenFormat: "macaroon"}, "invalid_client_metadata"},
+		{"bad scope", models.OAuthClient{GrantTypes: []string{"client_credentials"}, Scopes: []string{"read write"}}, "invalid_client_metadata"},
+		{"plain http jwks_uri", models.OAuthClient{GrantTypes: []string{"client_credentials"}, JWKSURI: "http://app.example.com/jwks"}, "invalid_client_metadata"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateClientMetadata(&tt.client)
+			var metadataErr *ClientMetadataError
+			assert.True(t, errors.As(err, &metadataErr))
+			assert.Equal(t, tt.code, metadataErr.Code)
+		})
+	}
+
+	loopback := &models.OAuthClient{Public: true, RedirectURIs: []string{"http://127.0.0.1:8400/cb", "com.example.app:/oauth2redirect"}}
+	assert.NoError(t, ValidateClientMetadata(loopback))
+}
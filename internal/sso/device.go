@@ -0,0 +1,47 @@
+package sso
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+
+	"github.com/hanyouqing/openauth/internal/models"
+)
+
+const GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+// User codes avoid vowels and look-alike characters (RFC 8628 section 6.1)
+const userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+
+// GenerateUserCode returns an 8 character code formatted as XXXX-XXXX
+func GenerateUserCode() string {
+	b := make([]byte, 8)
+	max := big.NewInt(int64(len(userCodeCharset)))
+	for i := range b {
+		n, _ := rand.Int(rand.Reader, max)
+		b[i] = userCodeCharset[n.Int64()]
+	}
+	return string(b[:4]) + "-" + string(b[4:])
+}
+
+// NormalizeUserCode strips separators and whitespace and upper-cases the code
+// so users can type it in any form.
+func NormalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// ClientAllowsGrant reports whether the grant type is registered for the client
+func ClientAllowsGrant(client *models.OAuthClient, grantType string) bool {
+	for _, g := range client.GrantTypes {
+		if g == grantType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package sso
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DPoPProofType is the typ header of DPoP proofs (RFC 9449 section 4.2)
+const DPoPProofType = "dpop+jwt"
+
+// DPoPProofMaxAge is how long after its iat a proof is accepted. Proof jtis
+// are remembered for this long to detect replays.
+const DPoPProofMaxAge = 5 * time.Minute
+
+// DPoPNonceLifetime is how long a server-issued nonce is accepted
+const DPoPNonceLifetime = 5 * time.Minute
+
+// dpopLeeway allows for clock skew between client and server
+const dpopLeeway = 30 * time.Second
+
+// DPoPProof holds the verified contents of a DPoP proof
+type DPoPProof struct {
+	JTI string
+	// JKT is the RFC 7638 thumbprint of the proof's public key
+	JKT      string
+	IssuedAt time.Time
+	Nonce    string
+}
+
+// VerifyDPoPProof checks a DPoP proof JWT for a request with the given method
+// and URI. accessToken is the token the proof accompanies at a resource, and
+// empty at the token endpoint. Nonces are checked by the caller.
+func VerifyDPoPProof(proof, method, uri, accessToken string, now time.Time) (*DPoPProof, error) {
+	var jwk map[string]interface{}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(proof, claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != DPoPProofType {
+			return nil, fmt.Errorf("typ must be %s", DPoPProofType)
+		}
+		jwk, _ = token.Header["jwk"].(map[string]interface{})
+		if jwk == nil {
+			return nil, errors.New("jwk header is required")
+		}
+		if _, hasPrivate := jwk["d"]; hasPrivate {
+			return nil, errors.New("jwk must be a public key")
+		}
+		key, err := JWKPublicKey(jwk)
+		if err != nil {
+			return nil, err
+		}
+		if _, isRSA := key.(*rsa.PublicKey); isRSA == strings.HasPrefix(token.Method.Alg(), "ES") {
+			return nil, errors.New("jwk does not match alg")
+		}
+		return key, nil
+	},
+		jwt.WithValidMethods(ClientAssertionAlgs),
+		jwt.WithIssuedAt(),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+		jwt.WithLeeway(dpopLeeway),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DPoP proof: %w", err)
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return nil, errors.New("invalid DPoP proof: jti is required")
+	}
+	iat, _ := claims.GetIssuedAt()
+	if iat == nil {
+		return nil, errors.New("invalid DPoP proof: iat is required")
+	}
+	if now.Sub(iat.Time) > DPoPProofMaxAge {
+		return nil, errors.New("invalid DPoP proof: proof is too old")
+	}
+	if htm, _ := claims["htm"].(string); htm != method {
+		return nil, errors.New("invalid DPoP proof: htm does not match the request method")
+	}
+	htu, _ := claims["htu"].(string)
+	if htu == "" || normalizeHTU(htu) != normalizeHTU(uri) {
+		return nil, errors.New("invalid DPoP proof: htu does not match the request URI")
+	}
+	if accessToken != "" {
+		ath, _ := claims["ath"].(string)
+		if subtle.ConstantTimeCompare([]byte(ath), []byte(DPoPAccessTokenHash(accessToken))) != 1 {
+			return nil, errors.New("invalid DPoP proof: ath does not match the access token")
+		}
+	}
+
+	jkt, err := PublicJWKThumbprint(jwk)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DPoP proof: %w", err)
+	}
+	nonce, _ := claims["nonce"].(string)
+	return &DPoPProof{JTI: jti, JKT: jkt, IssuedAt: iat.Time, Nonce: nonce}, nil
+}
+
+// normalizeHTU compares URIs without query and fragment, with case-insensitive
+// scheme and host (RFC 9449 section 4.3)
+func normalizeHTU(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.EscapedPath()
+}
+
+// DPoPAccessTokenHash computes the ath claim for an access token
+func DPoPAccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// PublicJWKThumbprint computes the RFC 7638 SHA-256 thumbprint of an RSA or
+// EC public JWK
+func PublicJWKThumbprint(jwk map[string]interface{}) (string, error) {
+	var members []string
+	switch jwk["kty"] {
+	case "RSA":
+		members = []string{"e", "kty", "n"}
+	case "EC":
+		members = []string{"crv", "kty", "x", "y"}
+	default:
+		return "", fmt.Errorf("unsupported key type %v", jwk["kty"])
+	}
+	required := make(map[string]string, len(members))
+	for _, name := range members {
+		v, ok := jwk[name].(string)
+		if !ok || v == "" {
+			return "", fmt.Errorf("invalid JWK member %q", name)
+		}
+		required[name] = v
+	}
+	// Maps marshal with sorted keys and no whitespace, as RFC 7638 requires
+	canonical, err := json.Marshal(required)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// NewDPoPNonce issues a nonce for DPoP proofs. Nonces are stateless: the
+// issue time authenticated with key, so any server instance can check them.
+func NewDPoPNonce(key []byte, now time.Time) string {
+	b := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(b, uint64(now.Unix()))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b))
+}
+
+// CheckDPoPNonce reports whether nonce was issued with key and has not expired
+func CheckDPoPNonce(key []byte, nonce string, now time.Time) bool {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil), b[8:]) {
+		return false
+	}
+	issuedAt := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	return !issuedAt.After(now.Add(dpopLeeway)) && now.Sub(issuedAt) <= DPoPNonceLifetime
+}
@@ -0,0 +1,96 @@
+package sso
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyDPoPProof(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwk := map[string]interface{}{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+	now := time.Now()
+	sign := func(typ string, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["typ"] = typ
+		token.Header["jwk"] = jwk
+		proof, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return proof
+	}
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"jti": "p1",
+			"htm": "POST",
+			"htu": "https://auth.example.com/oauth2/token",
+			"iat": now.Unix(),
+		}
+	}
+
+	proof, err := VerifyDPoPProof(sign(DPoPProofType, claims()), "POST", "https://AUTH.example.com/oauth2/token?x=1", "", now)
+	assert.NoError(t, err)
+	assert.Equal(t, "p1", proof.JTI)
+	jkt, _ := PublicJWKThumbprint(jwk)
+	assert.Equal(t, jkt, proof.JKT)
+
+	// Wrong typ, method, URI and stale proofs are rejected
+	_, err = VerifyDPoPProof(sign("JWT", claims()), "POST", "https://auth.example.com/oauth2/token", "", now)
+	assert.Error(t, err)
+	_, err = VerifyDPoPProof(sign(DPoPProofType, claims()), "GET", "https://auth.example.com/oauth2/token", "", now)
+	assert.Error(t, err)
+	_, err = VerifyDPoPProof(sign(DPoPProofType, claims()), "POST", "https://auth.example.com/oauth2/userinfo", "", now)
+	assert.Error(t, err)
+	_, err = VerifyDPoPProof(sign(DPoPProofType, claims()), "POST", "https://auth.example.com/oauth2/token", "", now.Add(10*time.Minute))
+	assert.Error(t, err)
+
+	// At a resource the proof must carry the hash of the access token
+	withAth := claims()
+	withAth["ath"] = DPoPAccessTokenHash("token-1")
+	withAth["nonce"] = "n1"
+	proof, err = VerifyDPoPProof(sign(DPoPProofType, withAth), "POST", "https://auth.example.com/oauth2/token", "token-1", now)
+	assert.NoError(t, err)
+	assert.Equal(t, "n1", proof.Nonce)
+	_, err = VerifyDPoPProof(sign(DPoPProofType, withAth), "POST", "https://auth.example.com/oauth2/token", "token-2", now)
+	assert.Error(t, err)
+	_, err = VerifyDPoPProof(sign(DPoPProofType, claims()), "POST", "https://auth.example.com/oauth2/token", "token-1", now)
+	assert.Error(t, err)
+}
+
+func TestPublicJWKThumbprint(t *testing.T) {
+	// Example from RFC 7638 section 3.1
+	jwk := map[string]interface{}{
+		"kty": "RSA",
+		"n":   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		"e":   "AQAB",
+		"alg": "RS256",
+		"kid": "2011-04-29",
+	}
+	jkt, err := PublicJWKThumbprint(jwk)
+	assert.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", jkt)
+
+	_, err = PublicJWKThumbprint(map[string]interface{}{"kty": "oct", "k": "c2VjcmV0"})
+	assert.Error(t, err)
+}
+
+func TestDPoPNonce(t *testing.T) {
+	key := []byte("nonce-key")
+	now := time.Now()
+	nonce := NewDPoPNonce(key, now)
+	assert.True(t, CheckDPoPNonce(key, nonce, now.Add(time.Minute)))
+	assert.False(t, CheckDPoPNonce(key, nonce, now.Add(DPoPNonceLifetime+time.Minute)))
+	assert.False(t, CheckDPoPNonce([]byte("other-key"), nonce, now))
+	assert.False(t, CheckDPoPNonce(key, "", now))
+}
@@ -0,0 +1,117 @@
+package sso
+
+import (
+	"crypto/rsa"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/hanyouqing/openauth/internal/models"
+)
+
+// BackchannelLogoutEvent is the events member of a logout token
+// (OpenID Connect Back-Channel Logout 1.0 section 2.4)
+const BackchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// LogoutTokenType is the typ header of logout tokens
+const LogoutTokenType = "logout+jwt"
+
+// MaxLogoutAttempts bounds the deliveries of one back-channel logout token
+const MaxLogoutAttempts = 6
+
+// LogoutTokenClaims builds the claims of a back-channel logout token. sid is
+// omitted when the client does not require it and the session is unknown.
+func LogoutTokenClaims(issuer, clientID, subject, sid string, now time.Time) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"iss":    issuer,
+		"aud":    clientID,
+		"iat":    now.Unix(),
+		"exp":    now.Add(2 * time.Minute).Unix(),
+		"jti":    uuid.New().String(),
+		"sub":    subject,
+		"events": map[string]interface{}{BackchannelLogoutEvent: map[string]interface{}{}},
+	}
+	if sid != "" {
+		claims["sid"] = sid
+	}
+	return claims
+}
+
+// ParseIDTokenHint verifies an id_token_hint issued by this provider. Expired
+// tokens are accepted, as RPs typically only keep the last ID token.
+func ParseIDTokenHint(token string, key *rsa.PublicKey, issuer string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		// Access and logout tokens are signed with the same key
+		if typ, _ := t.Header["typ"].(string); typ != "" && typ != "JWT" {
+			return nil, errors.New("id_token_hint is not an ID token")
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithoutClaimsValidation())
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != issuer {
+		return nil, errors.New("id_token_hint was not issued by this provider")
+	}
+	return claims, nil
+}
+
+// FrontchannelLogoutURL adds iss and sid to the client's front-channel
+// logout URI when the client requires them.
+func FrontchannelLogoutURL(client *models.OAuthClient, issuer, sid string) string {
+	if !client.FrontchannelLogoutSessionRequired || sid == "" {
+		return client.FrontchannelLogoutURI
+	}
+	return AppendQuery(client.FrontchannelLogoutURI, url.Values{"iss": {issuer}, "sid": {sid}})
+}
+
+// ValidatePostLogoutRedirectURI reports whether the URI exactly matches one
+// registered by the client.
+func ValidatePostLogoutRedirectURI(client *models.OAuthClient, uri string) bool {
+	return uri != "" && containsString(client.PostLogoutRedirectURIs, uri)
+}
+
+// LogoutRetryDelay is the backoff before retrying a failed back-channel
+// delivery: 30s, 1m, 2m, 4m and so on, capped at one hour.
+func LogoutRetryDelay(attempts int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// validateLogoutURIs checks the logout URIs of a client like redirect URIs.
+// Logout notifications carry session identifiers, so they need https except
+// on loopback.
+func validateLogoutURIs(client *models.OAuthClient) error {
+	for _, uri := range client.PostLogoutRedirectURIs {
+		if err := validateRedirectURI(uri); err != nil {
+			return invalidMetadata("invalid post_logout_redirect_uri %q", uri)
+		}
+	}
+	if uri := client.FrontchannelLogoutURI; uri != "" {
+		u, err := url.Parse(uri)
+		if err != nil || u.Fragment != "" || u.Host == "" || (u.Scheme != "https" && !(u.Scheme == "http" && isLoopbackHost(u.Hostname()))) {
+			return invalidMetadata("frontchannel_logout_uri must be an https URL without fragment")
+		}
+	}
+	// The server itself posts to the back-channel URI, so it may not point
+	// at loopback or internal addresses
+	if uri := client.BackchannelLogoutURI; uri != "" {
+		u, err := url.Parse(uri)
+		if err != nil || u.Fragment != "" {
+			return invalidMetadata("backchannel_logout_uri must be an https URL without fragment")
+		}
+		if err := ValidatePublicURL(uri); err != nil {
+			return invalidMetadata("backchannel_logout_uri %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package sso
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogoutTokenClaims(t *testing.T) {
+	now := time.Now()
+	claims := LogoutTokenClaims("https://auth.example.com", "web", "42", "sid-1", now)
+	assert.Equal(t, "web", claims["aud"])
+	assert.Equal(t, "42", claims["sub"])
+	assert.Equal(t, "sid-1", claims["sid"])
+	assert.NotEmpty(t, claims["jti"])
+	assert.Contains(t, claims["events"], BackchannelLogoutEvent)
+	// Logout tokens must never carry a nonce
+	assert.NotContains(t, claims, "nonce")
+
+	claims = LogoutTokenClaims("https://auth.example.com", "web", "42", "", now)
+	assert.NotContains(t, claims, "sid")
+}
+
+func TestParseIDTokenHint(t *testing.T) {
+	key, err := GenerateSigningKey()
+	assert.NoError(t, err)
+	pub := &key.PrivateKey.PublicKey
+	issuer := "https://auth.example.com"
+
+	// Expired ID tokens are accepted as hints
+	idToken, err := key.Sign(jwt.MapClaims{"iss": issuer, "sub": "42", "aud": "web", "exp": time.Now().Add(-time.Hour).Unix()})
+	assert.NoError(t, err)
+	claims, err := ParseIDTokenHint(idToken, pub, issuer)
+	assert.NoError(t, err)
+	assert.Equal(t, "42", claims["sub"])
+
+	_, err = ParseIDTokenHint(idToken, pub, "https://other.example.com")
+	assert.Error(t, err)
+
+	accessToken, err := key.SignWithType(jwt.MapClaims{"iss": issuer, "sub": "42"}, AccessTokenJWTType)
+	assert.NoError(t, err)
+	_, err = ParseIDTokenHint(accessToken, pub, issuer)
+	assert.Error(t, err)
+}
+
+func TestFrontchannelLogoutURL(t *testing.T) {
+	client := &models.OAuthClient{FrontchannelLogoutURI: "https://app.example.com/logout?from=idp"}
+	assert.Equal(t, "https://app.example.com/logout?from=idp", FrontchannelLogoutURL(client, "https://auth.example.com", "sid-1"))
+
+	client.FrontchannelLogoutSessionRequired = true
+	assert.Equal(t, "https://app.example.com/logout?from=idp&iss=https%3A%2F%2Fauth.example.com&sid=sid-1", FrontchannelLogoutURL(client, "https://auth.example.com", "sid-1"))
+}
+
+func TestValidatePostLogoutRedirectURI(t *testing.T) {
+	client := &models.OAuthClient{PostLogoutRedirectURIs: []string{"https://app.example.com/bye"}}
+	assert.True(t, ValidatePostLogoutRedirectURI(client, "https://app.example.com/bye"))
+	assert.False(t, ValidatePostLogoutRedirectURI(client, "https://app.example.com/bye/"))
+	assert.False(t, ValidatePostLogoutRedirectURI(client, ""))
+}
+
+func TestLogoutRetryDelay(t *testing.T) {
+	assert.Equal(t, 30*time.Second, LogoutRetryDelay(1))
+	assert.Equal(t, time.Minute, LogoutRetryDelay(2))
+	assert.Equal(t, 4*time.Minute, LogoutRetryDelay(4))
+	assert.Equal(t, time.Hour, LogoutRetryDelay(20))
+}
+
+func TestValidateLogoutURIs(t *testing.T) {
+	client := &models.OAuthClient{
+		RedirectURIs:           []string{"https://app.example.com/cb"},
+		PostLogoutRedirectURIs: []string{"https://app.example.com/bye"},
+		FrontchannelLogoutURI:  "https://app.example.com/frontchannel",
+		BackchannelLogoutURI:   "https://app.example.com/backchannel",
+	}
+	assert.NoError(t, ValidateClientMetadata(client))
+
+	for _, bad := range []models.OAuthClient{
+		{RedirectURIs: []string{"https://app.example.com/cb"}, PostLogoutRedirectURIs: []string{"/bye"}},
+		{RedirectURIs: []string{"https://app.example.com/cb"}, FrontchannelLogoutURI: "http://app.example.com/logout"},
+		{RedirectURIs: []string{"https://app.example.com/cb"}, BackchannelLogoutURI: "https://app.example.com/logout#x"},
+		{RedirectURIs: []string{"https://app.example.com/cb"}, BackchannelLogoutURI: "http://localhost:8080/backchannel"},
+		{RedirectURIs: []string{"https://app.example.com/cb"}, BackchannelLogoutURI: "https://10.0.0.5/backchannel"},
+		{RedirectURIs: []string{"https://app.example.com/cb"}, BackchannelLogoutURI: "https://169.254.169.254/backchannel"},
+	} {
+		err := ValidateClientMetadata(&bad)
+		var metadataErr *ClientMetadataError
+		assert.True(t, errors.As(err, &metadataErr))
+	}
+}
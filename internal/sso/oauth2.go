@@ -4,9 +4,11 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"net/url"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/hanyouqing/openauth/internal/auth"
 	"github.com/hanyouqing/openauth/internal/models"
 	"gorm.io/gorm"
 )
@@ -28,9 +30,19 @@ func GenerateAuthorizationCode() string {
 
 func ValidateClient(db *gorm.DB, clientID, clientSecret string) (*models.OAuthClient, error) {
 	var client models.OAuthClient
-	if err := db.Where("client_id = ? AND client_secret = ?", clientID, clientSecret).First(&client).Error; err != nil {
+	if err := db.Where("client_id = ?", clientID).First(&client).Error; err != nil {
 		return nil, errors.New("invalid client credentials")
 	}
+	if !CheckClientSecret(&client, clientSecret, time.Now()) {
+		return nil, errors.New("invalid client credentials")
+	}
+
+	// Hash secrets of clients created before secrets were stored hashed
+	if !IsHashedSecret(client.ClientSecret) {
+		if hash, err := auth.HashPassword(client.ClientSecret); err == nil {
+			db.Model(&client).Update("client_secret", hash)
+		}
+	}
 	return &client, nil
 }
 
@@ -43,6 +55,25 @@ func ValidateRedirectURI(client *models.OAuthClient, redirectURI string) bool {
 	return false
 }
 
+// AppendQuery adds params to a redirect URI, preserving any query it already has.
+// Empty values are skipped.
+func AppendQuery(uri string, params url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	q := u.Query()
+	for k, values := range params {
+		for _, v := range values {
+			if v != "" {
+				q.Add(k, v)
+			}
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
 func CreateAuthorizationCode(db *gorm.DB, clientID string, userID uint64, redirectURI, scope string) (string, error) {
 	code := GenerateAuthorizationCode()
 	_ = AuthorizationCode{
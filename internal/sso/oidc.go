@@ -0,0 +1,202 @@
+package sso
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Authentication context class references advertised in discovery and
+// returned in the acr claim of ID tokens.
+const (
+	ACRPassword = "urn:openauth:acr:password"
+	ACRMFA      = "urn:openauth:acr:mfa"
+)
+
+// SigningKey is the RSA key used to sign ID tokens. The key ID is the RFC 7638
+// thumbprint of the public key so it stays stable across restarts.
+type SigningKey struct {
+	KeyID      string
+	PrivateKey *rsa.PrivateKey
+}
+
+func NewSigningKey(key *rsa.PrivateKey) *SigningKey {
+	return &SigningKey{KeyID: JWKThumbprint(&key.PublicKey), PrivateKey: key}
+}
+
+func LoadSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	key, err := ParsePrivateKey(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey(key), nil
+}
+
+func GenerateSigningKey() (*SigningKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	return NewSigningKey(key), nil
+}
+
+// Sign returns a compact RS256 JWS of the given claims with the kid header set.
+func (k *SigningKey) Sign(claims jwt.Claims) (string, error) {
+	return k.SignWithType(claims, "")
+}
+
+// SignWithType is Sign with an explicit typ header, e.g. "at+jwt".
+func (k *SigningKey) SignWithType(claims jwt.Claims, typ string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = k.KeyID
+	if typ != "" {
+		token.Header["typ"] = typ
+	}
+	return token.SignedString(k.PrivateKey)
+}
+
+// PublicJWK returns the public half of the key as a JWK.
+func (k *SigningKey) PublicJWK() map[string]interface{} {
+	jwk := RSAPublicJWK(&k.PrivateKey.PublicKey)
+	jwk["kid"] = k.KeyID
+	jwk["use"] = "sig"
+	jwk["alg"] = "RS256"
+	return jwk
+}
+
+func RSAPublicJWK(pub *rsa.PublicKey) map[string]interface{} {
+	return map[string]interface{}{
+		"kty": "RSA",
+		"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// JWKThumbprint computes the RFC 7638 SHA-256 thumbprint of an RSA public key.
+func JWKThumbprint(pub *rsa.PublicKey) string {
+	jwk := RSAPublicJWK(pub)
+	// Members must be in lexicographic order with no whitespace
+	canonical := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk["e"], jwk["n"])
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// JWKS builds a JSON Web Key Set from the given keys.
+func JWKS(keys ...*SigningKey) map[string]interface{} {
+	set := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		if key != nil {
+			set = append(set, key.PublicJWK())
+		}
+	}
+	return map[string]interface{}{"keys": set}
+}
+
+// AtHash computes the at_hash claim for an access token signed with RS256.
+func AtHash(accessToken string) string {
+	return leftHalfHash(crypto.SHA256, accessToken)
+}
+
+func leftHalfHash(hash crypto.Hash, value string) string {
+	h := hash.New()
+	h.Write([]byte(value))
+	sum := h.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+// ParseScopes splits a space delimited scope string.
+func ParseScopes(scope string) []string {
+	return strings.Fields(scope)
+}
+
+// ScopeSubset reports whether every scope in requested is also in granted
+func ScopeSubset(requested, granted string) bool {
+	for _, s := range ParseScopes(requested) {
+		if !HasScope(granted, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func HasScope(scope, want string) bool {
+	for _, s := range ParseScopes(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPrompt reports whether the space delimited OIDC prompt parameter
+// contains value.
+func HasPrompt(prompt, value string) bool {
+	return HasScope(prompt, value)
+}
+
+// ValidPrompt reports whether the prompt parameter is well formed: none may
+// not be combined with any other value (OpenID Connect Core section 3.1.2.1)
+func ValidPrompt(prompt string) bool {
+	values := ParseScopes(prompt)
+	return len(values) <= 1 || !HasPrompt(prompt, "none")
+}
+
+// DiscoveryDocument builds the OpenID Provider metadata served at
+// /.well-known/openid-configuration.
+func DiscoveryDocument(issuer string) map[string]interface{} {
+	return map[string]interface{}{
+		"issuer":                                           issuer,
+		"authorization_endpoint":                           issuer + "/oauth2/authorize",
+		"token_endpoint":                                   issuer + "/oauth2/token",
+		"userinfo_endpoint":                                issuer + "/oauth2/userinfo",
+		"jwks_uri":                                         issuer + "/jwks.json",
+		"introspection_endpoint":                           issuer + "/oauth2/introspect",
+		"revocation_endpoint":                              issuer + "/oauth2/revoke",
+		"device_authorization_endpoint":                    issuer + "/oauth2/device_authorization",
+		"registration_endpoint":                            issuer + "/oauth2/register",
+		"pushed_authorization_request_endpoint":            issuer + "/oauth2/par",
+		"end_session_endpoint":                             issuer + "/oauth2/logout",
+		"scopes_supported":                                 append([]string(nil), StandardScopes...),
+		"response_types_supported":                         []string{"code"},
+		"response_modes_supported":                         []string{"query"},
+		"grant_types_supported":                            []string{"authorization_code", "refresh_token", "client_credentials", "password", GrantTypeDeviceCode, GrantTypeTokenExchange},
+		"subject_types_supported":                          []string{"public"},
+		"id_token_signing_alg_values_supported":            []string{"RS256"},
+		"token_endpoint_auth_methods_supported":            SupportedAuthMethods,
+		"token_endpoint_auth_signing_alg_values_supported": ClientAssertionAlgs,
+		"code_challenge_methods_supported":                 []string{CodeChallengeS256, CodeChallengePlain},
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "acr", "amr", "at_hash",
+			"name", "preferred_username", "picture", "updated_at",
+			"email", "email_verified", "phone_number", "phone_number_verified",
+		},
+		"acr_values_supported":            []string{ACRPassword, ACRMFA},
+		"prompt_values_supported":         []string{"none", "login", "consent"},
+		"claims_parameter_supported":      false,
+		"request_parameter_supported":     true,
+		"request_uri_parameter_supported": true,
+
+		"require_request_uri_registration":            false,
+		"require_pushed_authorization_requests":       false,
+		"request_object_signing_alg_values_supported": ClientAssertionAlgs,
+
+		"dpop_signing_alg_values_supported": ClientAssertionAlgs,
+
+		"frontchannel_logout_supported":         true,
+		"frontchannel_logout_session_supported": true,
+		"backchannel_logout_supported":          true,
+		"backchannel_logout_session_supported":  true,
+	}
+}
@@ -0,0 +1,72 @@
+package sso
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWKThumbprint(t *testing.T) {
+	// Example key from RFC 7638 section 3.1
+	n, _ := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", JWKThumbprint(pub))
+}
+
+func TestAtHash(t *testing.T) {
+	// Example from OpenID Connect Core 1.0 appendix A.3
+	assert.Equal(t, "77QmUPtjPfzWtF2AnpK9RQ", AtHash("jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y"))
+}
+
+func TestSigningKey_Sign(t *testing.T) {
+	key, err := GenerateSigningKey()
+	assert.NoError(t, err)
+
+	signed, err := key.Sign(jwt.MapClaims{"sub": "42", "nonce": "abc"})
+	assert.NoError(t, err)
+
+	token, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, key.KeyID, token.Header["kid"])
+		return &key.PrivateKey.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	assert.NoError(t, err)
+	assert.True(t, token.Valid)
+
+	claims := token.Claims.(jwt.MapClaims)
+	assert.Equal(t, "42", claims["sub"])
+	assert.Equal(t, "abc", claims["nonce"])
+
+	jwks := JWKS(key)
+	keys := jwks["keys"].([]map[string]interface{})
+	assert.Len(t, keys, 1)
+	assert.Equal(t, key.KeyID, keys[0]["kid"])
+}
+
+func TestHasScope(t *testing.T) {
+	assert.True(t, HasScope("openid profile", "openid"))
+	assert.False(t, HasScope("openid profile", "email"))
+	assert.False(t, HasScope("", "openid"))
+
+	assert.True(t, ScopeSubset("openid", "openid profile"))
+	assert.True(t, ScopeSubset("", "openid profile"))
+	assert.False(t, ScopeSubset("openid email", "openid profile"))
+
+	assert.True(t, HasPrompt("login consent", "consent"))
+	assert.False(t, HasPrompt("login", "consent"))
+
+	assert.True(t, ValidPrompt(""))
+	assert.True(t, ValidPrompt("none"))
+	assert.True(t, ValidPrompt("login consent"))
+	assert.False(t, ValidPrompt("none login"))
+	assert.False(t, ValidPrompt("consent none"))
+}
+
+func TestAppendQuery(t *testing.T) {
+	assert.Equal(t, "https://app.example.com/cb?code=xyz&foo=bar",
+		AppendQuery("https://app.example.com/cb?foo=bar", map[string][]string{"code": {"xyz"}, "state": {""}}))
+}
@@ -0,0 +1,41 @@
+package sso
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fc00::1", "::ffff:127.0.0.1"} {
+		assert.False(t, IsPublicIP(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"93.184.216.34", "8.8.8.8", "2606:4700:4700::1111"} {
+		assert.True(t, IsPublicIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestValidatePublicURL(t *testing.T) {
+	assert.NoError(t, ValidatePublicURL("https://rp.example.com/logout"))
+	assert.Error(t, ValidatePublicURL("http://rp.example.com/logout"))
+	assert.Error(t, ValidatePublicURL("https://localhost/logout"))
+	assert.Error(t, ValidatePublicURL("https://127.0.0.1/logout"))
+	assert.Error(t, ValidatePublicURL("https://[::1]/logout"))
+	assert.Error(t, ValidatePublicURL("https://169.254.169.254/latest/meta-data"))
+	assert.Error(t, ValidatePublicURL("not a url"))
+}
+
+func TestPublicHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer server.Close()
+
+	_, err := PublicHTTPClient(time.Second).Get(server.URL)
+	assert.True(t, errors.Is(err, ErrNonPublicAddress), "%v", err)
+}
@@ -0,0 +1,194 @@
+package sso
+
+import (
+	"html/template"
+	"io"
+)
+
+// Minimal server-rendered pages for browser steps of the OAuth flows that
+// cannot be handled by the SPA (device verification, consent, etc.).
+const pageLayout = `{{define "layout"}}<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<title>{{.Title}} - OpenAuth</title>
+	<style>
+		body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; background: #f5f5f5; margin: 0; }
+		.card { max-width: 420px; margin: 80px auto; background: #fff; padding: 32px; border-radius: 8px; box-shadow: 0 2px 8px rgba(0,0,0,.1); }
+		h1 { font-size: 20px; margin-top: 0; }
+		input[type=text] { width: 100%; box-sizing: border-box; padding: 10px; font-size: 18px; letter-spacing: 2px; text-transform: uppercase; }
+		button { padding: 10px 20px; margin-top: 16px; margin-right: 8px; border: 0; border-radius: 4px; cursor: pointer; }
+		.primary { background: #1677ff; color: #fff; }
+		.error { color: #cf1322; }
+		ul { padding-left: 20px; }
+	</style>
+</head>
+<body><div class="card">{{template "content" .}}</div></body>
+</html>{{end}}`
+
+const devicePage = `{{define "content"}}
+<h1>Connect a device</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .ClientName}}
+<p><strong>{{.ClientName}}</strong> is requesting access to your account.</p>
+{{if .Scopes}}<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<form method="POST" action="/oauth2/device">
+	<input type="hidden" name="user_code" value="{{.UserCode}}">
+	<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+	<button class="primary" name="action" value="approve">Allow</button>
+	<button name="action" value="deny">Deny</button>
+</form>
+{{else}}
+<p>Enter the code displayed on your device.</p>
+<form method="GET" action="/oauth2/device">
+	<input type="text" name="user_code" value="{{.UserCode}}" autocomplete="off" autofocus>
+	<button class="primary">Continue</button>
+</form>
+{{end}}
+{{end}}`
+
+const consentPage = `{{define "content"}}
+<h1>Authorize {{.ClientName}}</h1>
+<p><strong>{{.ClientName}}</strong> would like to access your account{{if .Username}} as <strong>{{.Username}}</strong>{{end}}.</p>
+{{if .Scopes}}<p>It is requesting permission to:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<form method="POST" action="/oauth2/consent">
+	<input type="hidden" name="consent_id" value="{{.ConsentID}}">
+	<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+	<button class="primary" name="action" value="approve">Allow</button>
+	<button name="action" value="deny">Deny</button>
+</form>
+{{end}}`
+
+// The one-time code page completes a login of a user with MFA enabled
+const mfaPage = `{{define "content"}}
+<h1>Verify it's you</h1>
+{{if .Username}}<p>Signed in as <strong>{{.Username}}</strong>.</p>{{end}}
+<p>Enter the code from your authenticator app.</p>
+<form method="POST" action="{{.Action}}">
+	<input type="hidden" name="mfa_token" value="{{.Token}}">
+	<input type="text" name="code" inputmode="numeric" autocomplete="one-time-code" autofocus>
+	<button class="primary">Verify</button>
+</form>
+{{end}}`
+
+const messagePage = `{{define "content"}}
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{end}}`
+
+const logoutPage = `{{define "content"}}
+<h1>Sign out</h1>
+<p>Do you want to sign out{{if .Username}} <strong>{{.Username}}</strong>{{end}}{{if .ClientName}} and return to <strong>{{.ClientName}}</strong>{{end}}?</p>
+<form method="POST" action="/oauth2/logout">
+	<input type="hidden" name="client_id" value="{{.ClientID}}">
+	<input type="hidden" name="post_logout_redirect_uri" value="{{.PostLogoutRedirectURI}}">
+	<input type="hidden" name="state" value="{{.State}}">
+	<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+	<button class="primary" name="action" value="logout">Sign out</button>
+	<button name="action" value="cancel">Stay signed in</button>
+</form>
+{{end}}`
+
+// The front-channel logout URIs of the clients are loaded in hidden iframes
+// before the user agent continues to the post logout redirect URI.
+const loggedOutPage = `{{define "content"}}
+<h1>{{.Title}}</h1>
+<p>{{if .Message}}{{.Message}}{{else}}You have been signed out.{{end}}</p>
+{{range .FrontchannelURLs}}<iframe src="{{.}}" style="display:none"></iframe>{{end}}
+{{if .RedirectURI}}<p><a href="{{.RedirectURI}}">Continue</a></p>
+{{if not .Message}}<script>setTimeout(function () { window.location.replace({{.RedirectURI}}); }, {{if .FrontchannelURLs}}2000{{else}}0{{end}});</script>{{end}}{{end}}
+{{end}}`
+
+// SAML messages for the HTTP-POST binding are posted by the user agent
+const samlPostPage = `{{define "content"}}
+<h1>{{.Title}}</h1>
+<form method="POST" action="{{.Action}}">
+	<input type="hidden" name="{{.Param}}" value="{{.Message}}">
+	{{if .RelayState}}<input type="hidden" name="RelayState" value="{{.RelayState}}">{{end}}
+	<noscript><button class="primary">Continue</button></noscript>
+</form>
+<script>document.forms[0].submit();</script>
+{{end}}`
+
+var pageTemplates = map[string]*template.Template{
+	"device":     template.Must(template.Must(template.New("device").Parse(pageLayout)).Parse(devicePage)),
+	"consent":    template.Must(template.Must(template.New("consent").Parse(pageLayout)).Parse(consentPage)),
+	"message":    template.Must(template.Must(template.New("message").Parse(pageLayout)).Parse(messagePage)),
+	"mfa":        template.Must(template.Must(template.New("mfa").Parse(pageLayout)).Parse(mfaPage)),
+	"logout":     template.Must(template.Must(template.New("logout").Parse(pageLayout)).Parse(logoutPage)),
+	"logged_out": template.Must(template.Must(template.New("logged_out").Parse(pageLayout)).Parse(loggedOutPage)),
+	"saml_post":  template.Must(template.Must(template.New("saml_post").Parse(pageLayout)).Parse(samlPostPage)),
+}
+
+// RenderPage renders one of the built-in pages with the given data
+func RenderPage(w io.Writer, name string, data interface{}) error {
+	return pageTemplates[name].ExecuteTemplate(w, "layout", data)
+}
+
+// DevicePageData is rendered by the device verification page
+type DevicePageData struct {
+	Title      string
+	Error      string
+	UserCode   string
+	ClientName string
+	Scopes     []string
+	CSRFToken  string
+}
+
+// ConsentPageData is rendered by the consent screen of the authorization endpoint
+type ConsentPageData struct {
+	Title      string
+	ClientName string
+	Username   string
+	Scopes     []string
+	ConsentID  string
+	CSRFToken  string
+}
+
+// MFAPageData is rendered to ask for the one-time code of a login. Token
+// names the pending login and Action is where the code is posted.
+type MFAPageData struct {
+	Title    string
+	Username string
+	Action   string
+	Token    string
+}
+
+// MessagePageData is rendered by the generic result page
+type MessagePageData struct {
+	Title   string
+	Message string
+}
+
+// LogoutPageData is rendered by the logout confirmation of the end session endpoint
+type LogoutPageData struct {
+	Title                 string
+	Username              string
+	ClientName            string
+	ClientID              string
+	PostLogoutRedirectURI string
+	State                 string
+	CSRFToken             string
+}
+
+// LoggedOutPageData is rendered after logout. RedirectURI is the validated
+// post logout redirect URI including state. A Message replaces the signed out
+// notice and keeps the page from redirecting automatically.
+type LoggedOutPageData struct {
+	Title            string
+	Message          string
+	FrontchannelURLs []string
+	RedirectURI      string
+}
+
+// SAMLPostPageData is rendered to send a SAML message with the HTTP-POST
+// binding. Param is SAMLRequest or SAMLResponse and Message the base64 XML.
+type SAMLPostPageData struct {
+	Title      string
+	Action     string
+	Param      string
+	Message    string
+	RelayState string
+}
@@ -0,0 +1,40 @@
+package sso
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"regexp"
+)
+
+// PKCE code challenge methods (RFC 7636)
+const (
+	CodeChallengeS256  = "S256"
+	CodeChallengePlain = "plain"
+)
+
+// Verifiers and challenges use the unreserved URI characters, 43 to 128 long
+var pkceValuePattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+func ValidCodeChallenge(challenge, method string) bool {
+	if method != CodeChallengeS256 && method != CodeChallengePlain {
+		return false
+	}
+	return pkceValuePattern.MatchString(challenge)
+}
+
+// VerifyCodeChallenge checks a code_verifier against the stored challenge
+func VerifyCodeChallenge(challenge, method, verifier string) bool {
+	if !pkceValuePattern.MatchString(verifier) {
+		return false
+	}
+
+	computed := verifier
+	if method == CodeChallengeS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		computed = base64.RawURLEncoding.EncodeToString(sum[:])
+	} else if method != CodeChallengePlain {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
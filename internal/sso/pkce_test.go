@@ -0,0 +1,34 @@
+package sso
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// Example from RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	tests := []struct {
+		name      string
+		challenge string
+		method    string
+		verifier  string
+		expected  bool
+	}{
+		{"S256 valid", challenge, CodeChallengeS256, verifier, true},
+		{"S256 wrong verifier", challenge, CodeChallengeS256, verifier + "x", false},
+		{"plain valid", verifier, CodeChallengePlain, verifier, true},
+		{"plain mismatch", verifier, CodeChallengePlain, challenge, false},
+		{"unknown method", challenge, "S512", verifier, false},
+		{"short verifier", "short", CodeChallengePlain, "short", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, VerifyCodeChallenge(tt.challenge, tt.method, tt.verifier))
+		})
+	}
+}
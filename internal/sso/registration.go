@@ -0,0 +1,184 @@
+package sso
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hanyouqing/openauth/internal/models"
+)
+
+// ClientRegistration is the client metadata of RFC 7591 section 2 accepted by
+// the dynamic registration endpoint.
+type ClientRegistration struct {
+	RedirectURIs            []string `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	ClientName              string   `json:"client_name,omitempty"`
+	ClientURI               string   `json:"client_uri,omitempty"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+	Contacts                []string `json:"contacts,omitempty"`
+	TOSURI                  string   `json:"tos_uri,omitempty"`
+	PolicyURI               string   `json:"policy_uri,omitempty"`
+	SoftwareID              string   `json:"software_id,omitempty"`
+	SoftwareVersion         string   `json:"software_version,omitempty"`
+	SoftwareStatement       string   `json:"software_statement,omitempty"`
+
+	JWKS                   map[string]interface{} `json:"jwks,omitempty"`
+	JWKSURI                string                 `json:"jwks_uri,omitempty"`
+	TLSClientAuthSubjectDN string                 `json:"tls_client_auth_subject_dn,omitempty"`
+
+	PostLogoutRedirectURIs            []string `json:"post_logout_redirect_uris,omitempty"`
+	FrontchannelLogoutURI             string   `json:"frontchannel_logout_uri,omitempty"`
+	FrontchannelLogoutSessionRequired bool     `json:"frontchannel_logout_session_required,omitempty"`
+	BackchannelLogoutURI              string   `json:"backchannel_logout_uri,omitempty"`
+	BackchannelLogoutSessionRequired  bool     `json:"backchannel_logout_session_required,omitempty"`
+
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests,omitempty"`
+	DPoPBoundAccessTokens              bool `json:"dpop_bound_access_tokens,omitempty"`
+}
+
+// HashToken returns the SHA-256 hex digest used to look up high-entropy
+// bearer tokens such as initial and registration access tokens.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadSoftwareStatementKeys reads the PEM public keys trusted to sign
+// software statements.
+func LoadSoftwareStatementKeys(paths []string) ([]*rsa.PublicKey, error) {
+	keys := make([]*rsa.PublicKey, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read software statement key: %w", err)
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse software statement key %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// ApplySoftwareStatement verifies the software statement of the registration
+// against the trusted keys and overrides the plain metadata with its claims,
+// as required by RFC 7591 section 2.3.
+func ApplySoftwareStatement(reg *ClientRegistration, keys []*rsa.PublicKey) error {
+	if reg.SoftwareStatement == "" {
+		return nil
+	}
+	statement := reg.SoftwareStatement
+
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256"}))
+	claims := jwt.MapClaims{}
+	if _, _, err := parser.ParseUnverified(statement, claims); err != nil {
+		return &ClientMetadataError{Code: "invalid_software_statement", Description: "software statement is not a valid JWT"}
+	}
+
+	var verified bool
+	for _, key := range keys {
+		if _, err := parser.ParseWithClaims(statement, jwt.MapClaims{}, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		}); err == nil {
+			verified = true
+			break
+		} else if !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			return &ClientMetadataError{Code: "invalid_software_statement", Description: fmt.Sprintf("software statement rejected: %v", err)}
+		}
+	}
+	if !verified {
+		return &ClientMetadataError{Code: "unapproved_software_statement", Description: "software statement is not signed by a trusted issuer"}
+	}
+
+	// Claims in the statement take precedence over the plain metadata values
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return &ClientMetadataError{Code: "invalid_software_statement", Description: "software statement has invalid claims"}
+	}
+	if err := json.Unmarshal(data, reg); err != nil {
+		return &ClientMetadataError{Code: "invalid_software_statement", Description: "software statement has invalid client metadata"}
+	}
+	reg.SoftwareStatement = statement
+	return nil
+}
+
+// RegistrationGrantTypes are the grant types any dynamically registered
+// client may use. The others act without a user in the loop or on behalf of
+// other clients, so an administrator has to allow them on the initial
+// access token.
+var RegistrationGrantTypes = []string{"authorization_code", "refresh_token", GrantTypeDeviceCode}
+
+// CheckRegistrationGrants rejects grant types of a registered client beyond
+// RegistrationGrantTypes and the additional grant types allowed
+func CheckRegistrationGrants(client *models.OAuthClient, allowed []string) error {
+	for _, grantType := range client.GrantTypes {
+		if !containsString(RegistrationGrantTypes, grantType) && !containsString(allowed, grantType) {
+			return invalidMetadata("grant type %q is not allowed for dynamically registered clients", grantType)
+		}
+	}
+	return nil
+}
+
+// ToClient validates the registration metadata and fills in the client fields
+// derived from it.
+func (reg *ClientRegistration) ToClient(client *models.OAuthClient) error {
+	if reg.TokenEndpointAuthMethod == "" {
+		reg.TokenEndpointAuthMethod = AuthMethodClientSecretBasic
+	}
+
+	for _, responseType := range reg.ResponseTypes {
+		if responseType != "code" {
+			return invalidMetadata("unsupported response type %q", responseType)
+		}
+	}
+
+	for name, uri := range map[string]string{
+		"client_uri": reg.ClientURI,
+		"logo_uri":   reg.LogoURI,
+		"tos_uri":    reg.TOSURI,
+		"policy_uri": reg.PolicyURI,
+	} {
+		if uri == "" {
+			continue
+		}
+		if u, err := url.Parse(uri); err != nil || u.Scheme != "https" || u.Host == "" {
+			return invalidMetadata("%s must be an https URL", name)
+		}
+	}
+
+	client.RedirectURIs = reg.RedirectURIs
+	client.GrantTypes = reg.GrantTypes
+	client.Scopes = ParseScopes(reg.Scope)
+	client.Public = reg.TokenEndpointAuthMethod == AuthMethodNone
+	client.TokenEndpointAuthMethod = reg.TokenEndpointAuthMethod
+	client.JWKS = reg.JWKS
+	client.JWKSURI = reg.JWKSURI
+	client.TLSClientAuthSubjectDN = reg.TLSClientAuthSubjectDN
+	client.PostLogoutRedirectURIs = reg.PostLogoutRedirectURIs
+	client.FrontchannelLogoutURI = reg.FrontchannelLogoutURI
+	client.FrontchannelLogoutSessionRequired = reg.FrontchannelLogoutSessionRequired
+	client.BackchannelLogoutURI = reg.BackchannelLogoutURI
+	client.BackchannelLogoutSessionRequired = reg.BackchannelLogoutSessionRequired
+	client.RequirePushedAuthorizationRequests = reg.RequirePushedAuthorizationRequests
+	client.DPoPBoundAccessTokens = reg.DPoPBoundAccessTokens
+	if err := ValidateClientMetadata(client); err != nil {
+		return err
+	}
+
+	reg.GrantTypes = client.GrantTypes
+	if len(reg.ResponseTypes) == 0 && ClientAllowsGrant(client, "authorization_code") {
+		reg.ResponseTypes = []string{"code"}
+	}
+	return nil
+}
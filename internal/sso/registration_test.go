@@ -0,0 +1,77 @@
+package sso
+
+import (
+	"crypto/rsa"
+	"errors"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplySoftwareStatement(t *testing.T) {
+	trusted, err := GenerateSigningKey()
+	assert.NoError(t, err)
+	untrusted, err := GenerateSigningKey()
+	assert.NoError(t, err)
+	keys := []*rsa.PublicKey{&trusted.PrivateKey.PublicKey}
+
+	statement, err := trusted.Sign(jwt.MapClaims{
+		"iss":           "https://platform.example.com",
+		"software_id":   "preview-env",
+		"client_name":   "Preview environment",
+		"redirect_uris": []string{"https://preview.example.com/cb"},
+	})
+	assert.NoError(t, err)
+
+	// Statement claims take precedence over the plain metadata
+	reg := &ClientRegistration{ClientName: "Spoofed", SoftwareStatement: statement}
+	assert.NoError(t, ApplySoftwareStatement(reg, keys))
+	assert.Equal(t, "Preview environment", reg.ClientName)
+	assert.Equal(t, "preview-env", reg.SoftwareID)
+	assert.Equal(t, []string{"https://preview.example.com/cb"}, reg.RedirectURIs)
+
+	forged, err := untrusted.Sign(jwt.MapClaims{"software_id": "preview-env"})
+	assert.NoError(t, err)
+	var metadataErr *ClientMetadataError
+	err = ApplySoftwareStatement(&ClientRegistration{SoftwareStatement: forged}, keys)
+	assert.True(t, errors.As(err, &metadataErr))
+	assert.Equal(t, "unapproved_software_statement", metadataErr.Code)
+
+	err = ApplySoftwareStatement(&ClientRegistration{SoftwareStatement: "not-a-jwt"}, keys)
+	assert.True(t, errors.As(err, &metadataErr))
+	assert.Equal(t, "invalid_software_statement", metadataErr.Code)
+}
+
+func TestCheckRegistrationGrants(t *testing.T) {
+	client := &models.OAuthClient{GrantTypes: models.StringArray{"authorization_code", "refresh_token", GrantTypeDeviceCode}}
+	assert.NoError(t, CheckRegistrationGrants(client, nil))
+
+	client.GrantTypes = models.StringArray{"authorization_code", "client_credentials"}
+	assert.Error(t, CheckRegistrationGrants(client, nil))
+	assert.NoError(t, CheckRegistrationGrants(client, []string{"client_credentials"}))
+
+	client.GrantTypes = models.StringArray{GrantTypeTokenExchange}
+	assert.Error(t, CheckRegistrationGrants(client, []string{"client_credentials"}))
+}
+
+func TestClientRegistration_ToClient(t *testing.T) {
+	reg := &ClientRegistration{RedirectURIs: []string{"https://app.example.com/cb"}, Scope: "openid profile"}
+	client := &models.OAuthClient{}
+	assert.NoError(t, reg.ToClient(client))
+	assert.False(t, client.Public)
+	assert.Equal(t, models.StringArray{"openid", "profile"}, client.Scopes)
+	assert.Equal(t, AuthMethodClientSecretBasic, reg.TokenEndpointAuthMethod)
+	assert.Equal(t, []string{"code"}, reg.ResponseTypes)
+
+	public := &ClientRegistration{RedirectURIs: []string{"http://localhost:3000/cb"}, TokenEndpointAuthMethod: AuthMethodNone}
+	client = &models.OAuthClient{}
+	assert.NoError(t, public.ToClient(client))
+	assert.True(t, client.Public)
+
+	assert.Error(t, (&ClientRegistration{TokenEndpointAuthMethod: "client_secret_jwt"}).ToClient(&models.OAuthClient{}))
+	assert.Error(t, (&ClientRegistration{RedirectURIs: []string{"https://app.example.com/cb"}, TokenEndpointAuthMethod: AuthMethodPrivateKeyJWT}).ToClient(&models.OAuthClient{}))
+	assert.Error(t, (&ClientRegistration{RedirectURIs: []string{"https://app.example.com/cb"}, ResponseTypes: []string{"token"}}).ToClient(&models.OAuthClient{}))
+	assert.Error(t, (&ClientRegistration{RedirectURIs: []string{"https://app.example.com/cb"}, LogoURI: "http://example.com/logo.png"}).ToClient(&models.OAuthClient{}))
+}
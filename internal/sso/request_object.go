@@ -0,0 +1,106 @@
+package sso
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RequestURIPrefix starts the request_uri values issued by the pushed
+// authorization request endpoint (RFC 9126 section 2.2)
+const RequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+
+// PushedRequestExpiry is how long a pushed authorization request may be used
+const PushedRequestExpiry = 90 * time.Second
+
+// maxRequestObjectLifetime bounds how far in the future a request object may
+// expire, as it can be replayed until then.
+const maxRequestObjectLifetime = time.Hour
+
+// requestObjectClaims are JWT claims of a request object that are not
+// authorization request parameters
+var requestObjectClaims = []string{"iss", "aud", "exp", "iat", "nbf", "jti", "sub"}
+
+// GenerateRequestURI returns a new unguessable request_uri
+func GenerateRequestURI() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return RequestURIPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseRequestObject verifies a signed request object (RFC 9101) against the
+// client's JWK Set and returns the authorization request parameters it
+// carries. Unsigned request objects are rejected.
+func ParseRequestObject(requestObject, clientID, issuer string, jwks map[string]interface{}, now time.Time) (url.Values, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(requestObject, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return findJWK(jwks, kid, token.Method.Alg())
+	},
+		jwt.WithValidMethods(ClientAssertionAlgs),
+		jwt.WithIssuer(clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+		jwt.WithLeeway(30*time.Second),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request object: %w", err)
+	}
+
+	aud, _ := claims.GetAudience()
+	audienceOK := false
+	for _, a := range aud {
+		if strings.TrimSuffix(a, "/") == issuer {
+			audienceOK = true
+			break
+		}
+	}
+	if !audienceOK {
+		return nil, errors.New("invalid request object: audience does not match")
+	}
+	exp, _ := claims.GetExpirationTime()
+	if exp.Sub(now) > maxRequestObjectLifetime {
+		return nil, errors.New("invalid request object: expires too far in the future")
+	}
+	if id, ok := claims["client_id"]; ok && id != clientID {
+		return nil, errors.New("invalid request object: client_id does not match")
+	}
+	if _, ok := claims["request"]; ok {
+		return nil, errors.New("invalid request object: request objects cannot be nested")
+	}
+	if _, ok := claims["request_uri"]; ok {
+		return nil, errors.New("invalid request object: request objects cannot be nested")
+	}
+
+	params := url.Values{}
+	for name, value := range claims {
+		if containsString(requestObjectClaims, name) {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			params.Set(name, v)
+		case float64:
+			params.Set(name, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			params.Set(name, strconv.FormatBool(v))
+		default:
+			// Structured parameters such as claims are JSON in query form
+			data, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid request object: parameter %s", name)
+			}
+			params.Set(name, string(data))
+		}
+	}
+	params.Set("client_id", clientID)
+	return params, nil
+}
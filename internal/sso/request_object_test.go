@@ -0,0 +1,84 @@
+package sso
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRequestObject(t *testing.T) {
+	key, err := GenerateSigningKey()
+	assert.NoError(t, err)
+	jwks := map[string]interface{}{"keys": []interface{}{key.PublicJWK()}}
+
+	now := time.Now()
+	issuer := "https://auth.example.com"
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":           "finance",
+			"aud":           issuer,
+			"exp":           now.Add(5 * time.Minute).Unix(),
+			"client_id":     "finance",
+			"response_type": "code",
+			"redirect_uri":  "https://finance.example.com/cb",
+			"scope":         "openid payments",
+			"max_age":       300,
+			"claims":        map[string]interface{}{"id_token": map[string]interface{}{"acr": nil}},
+		}
+	}
+
+	requestObject, err := key.Sign(claims())
+	assert.NoError(t, err)
+	params, err := ParseRequestObject(requestObject, "finance", issuer, jwks, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "code", params.Get("response_type"))
+	assert.Equal(t, "https://finance.example.com/cb", params.Get("redirect_uri"))
+	assert.Equal(t, "300", params.Get("max_age"))
+	assert.Equal(t, `{"id_token":{"acr":null}}`, params.Get("claims"))
+	assert.Equal(t, "finance", params.Get("client_id"))
+	assert.Empty(t, params.Get("iss"))
+	assert.Empty(t, params.Get("exp"))
+
+	// Another client's request object
+	_, err = ParseRequestObject(requestObject, "payroll", issuer, jwks, now)
+	assert.Error(t, err)
+
+	tampered := claims()
+	tampered["aud"] = "https://other.example.com"
+	requestObject, _ = key.Sign(tampered)
+	_, err = ParseRequestObject(requestObject, "finance", issuer, jwks, now)
+	assert.Error(t, err)
+
+	tampered = claims()
+	delete(tampered, "exp")
+	requestObject, _ = key.Sign(tampered)
+	_, err = ParseRequestObject(requestObject, "finance", issuer, jwks, now)
+	assert.Error(t, err)
+
+	tampered = claims()
+	tampered["request_uri"] = "https://evil.example.com/request"
+	requestObject, _ = key.Sign(tampered)
+	_, err = ParseRequestObject(requestObject, "finance", issuer, jwks, now)
+	assert.Error(t, err)
+
+	// Unsigned request objects are never accepted
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	assert.NoError(t, err)
+	_, err = ParseRequestObject(unsigned, "finance", issuer, jwks, now)
+	assert.Error(t, err)
+
+	other, err := GenerateSigningKey()
+	assert.NoError(t, err)
+	requestObject, _ = other.Sign(claims())
+	_, err = ParseRequestObject(requestObject, "finance", issuer, jwks, now)
+	assert.Error(t, err)
+}
+
+func TestGenerateRequestURI(t *testing.T) {
+	uri := GenerateRequestURI()
+	assert.True(t, strings.HasPrefix(uri, RequestURIPrefix))
+	assert.NotEqual(t, uri, GenerateRequestURI())
+}
@@ -47,26 +47,54 @@ func ParsePrivateKey(keyPEM string) (*rsa.PrivateKey, error) {
 	return key, nil
 }
 
-func BuildSAMLResponse(samlConfig *models.SAMLConfig, user *models.User, requestID string) (*saml.Response, error) {
-	_, err := ParseCertificate(samlConfig.Certificate)
-	if err != nil {
-		return nil, err
+// SAMLIdP names the IdP side of a SAML application: its entity ID and the
+// endpoints published in its metadata
+type SAMLIdP struct {
+	EntityID string
+	SSOURL   string
+	SLOURL   string
+}
+
+// NewSAMLIdP returns the IdP of application appID served at issuer
+func NewSAMLIdP(issuer string, appID uint64) *SAMLIdP {
+	return &SAMLIdP{
+		EntityID: fmt.Sprintf("%s/saml/metadata?app_id=%d", issuer, appID),
+		SSOURL:   fmt.Sprintf("%s/saml/sso?app_id=%d", issuer, appID),
+		SLOURL:   fmt.Sprintf("%s/saml/slo?app_id=%d", issuer, appID),
 	}
+}
+
+// SAMLResponseOptions are the per-request parts of a response
+type SAMLResponseOptions struct {
+	InResponseTo string // ID of the AuthnRequest, empty for IdP-initiated SSO
+	ACSURL       string // where the response is posted
+	SessionIndex string // names the login session to the SP for logout
+	PersistentID string // the user's pairwise NameID for the persistent format
+}
 
-	_, err = ParsePrivateKey(samlConfig.PrivateKey)
+// BuildSAMLResponse builds the unsigned response for a user, whose
+// memberships in src are those the application's attributes need. It is
+// signed with SignSAMLResponse before it is sent.
+func BuildSAMLResponse(idp *SAMLIdP, samlConfig *models.SAMLConfig, src *ClaimSource, opts SAMLResponseOptions) (*saml.Response, error) {
+	if opts.SessionIndex == "" {
+		opts.SessionIndex = NewSAMLID()
+	}
+	nameID, err := BuildSAMLNameID(idp, samlConfig, src, opts.PersistentID)
 	if err != nil {
 		return nil, err
 	}
-
+	// Rules that no longer validate are left out rather than failing the
+	// login; the caller warns about them
+	rules, _ := SAMLAttributeRules(samlConfig.AttributeMap)
 	now := saml.TimeNow()
 	response := &saml.Response{
-		Destination:  samlConfig.SSOURL,
+		Destination:  opts.ACSURL,
 		ID:           fmt.Sprintf("id-%d", time.Now().UnixNano()),
-		InResponseTo: requestID,
+		InResponseTo: opts.InResponseTo,
 		IssueInstant: now,
 		Version:      "2.0",
 		Issuer: &saml.Issuer{
-			Value: samlConfig.EntityID,
+			Value: idp.EntityID,
 		},
 		Status: saml.Status{
 			StatusCode: saml.StatusCode{
@@ -81,19 +109,17 @@ func BuildSAMLResponse(samlConfig *models.SAMLConfig, user *models.User, request
 		IssueInstant: now,
 		Version:      "2.0",
 		Issuer: saml.Issuer{
-			Value: samlConfig.EntityID,
+			Value: idp.EntityID,
 		},
 		Subject: &saml.Subject{
-			NameID: &saml.NameID{
-				Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress",
-				Value:  user.Email,
-			},
+			NameID: nameID,
 			SubjectConfirmations: []saml.SubjectConfirmation{
 				{
 					Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
 					SubjectConfirmationData: &saml.SubjectConfirmationData{
+						InResponseTo: opts.InResponseTo,
 						NotOnOrAfter: now.Add(5 * time.Minute),
-						Recipient:    samlConfig.SSOURL,
+						Recipient:    opts.ACSURL,
 					},
 				},
 			},
@@ -112,7 +138,7 @@ func BuildSAMLResponse(samlConfig *models.SAMLConfig, user *models.User, request
 		AuthnStatements: []saml.AuthnStatement{
 			{
 				AuthnInstant: now,
-				SessionIndex: fmt.Sprintf("session-%d", time.Now().UnixNano()),
+				SessionIndex: opts.SessionIndex,
 				SubjectLocality: &saml.SubjectLocality{
 					Address: "127.0.0.1",
 				},
@@ -126,28 +152,7 @@ func BuildSAMLResponse(samlConfig *models.SAMLConfig, user *models.User, request
 	}
 
 	// Add attributes based on attribute map
-	if samlConfig.AttributeMap != nil {
-		attributes := []saml.Attribute{}
-		for samlAttr, userAttr := range samlConfig.AttributeMap {
-			var value string
-			switch userAttr {
-			case "email":
-				value = user.Email
-			case "username":
-				value = user.Username
-			case "name":
-				value = user.Username
-			default:
-				continue
-			}
-			attributes = append(attributes, saml.Attribute{
-				Name:       samlAttr,
-				NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
-				Values: []saml.AttributeValue{
-					{Value: value},
-				},
-			})
-		}
+	if attributes := BuildSAMLAttributes(rules, src); len(attributes) > 0 {
 		assertion.AttributeStatements = []saml.AttributeStatement{
 			{
 				Attributes: attributes,
@@ -160,7 +165,31 @@ func BuildSAMLResponse(samlConfig *models.SAMLConfig, user *models.User, request
 	return response, nil
 }
 
-func BuildSAMLMetadata(entityID, ssoURL, sloURL string, cert *x509.Certificate) (*saml.EntityDescriptor, error) {
+// SignSAMLResponse signs a response with the application's key pair, as
+// selected by its signature target, encrypts the assertion if the
+// application asks for it, and serializes the response.
+func SignSAMLResponse(samlConfig *models.SAMLConfig, response *saml.Response) ([]byte, error) {
+	signer, err := NewSAMLSigner(samlConfig.Certificate, samlConfig.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAML signing key: %w", err)
+	}
+	var encrypter *SAMLEncrypter
+	if samlConfig.EncryptAssertions {
+		encrypter, err = NewSAMLEncrypter(samlConfig.EncryptionCertificate, samlConfig.EncryptionMethod)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SAML encryption certificate: %w", err)
+		}
+	}
+	el, err := signer.SignResponse(response, samlConfig.SignatureTarget, encrypter)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalSAMLElement(el)
+}
+
+// BuildSAMLMetadata builds IdP metadata with a signing KeyDescriptor per
+// certificate, so SPs trust every key of a rollover
+func BuildSAMLMetadata(entityID, ssoURL, sloURL string, certs ...*x509.Certificate) (*saml.EntityDescriptor, error) {
 	// Build SAML metadata
 	metadata := &saml.EntityDescriptor{
 		EntityID: entityID,
@@ -189,22 +218,23 @@ func BuildSAMLMetadata(entityID, ssoURL, sloURL string, cert *x509.Certificate)
 		}
 	}
 
-	// Add certificate to key descriptor
-	if cert != nil {
-		metadata.IDPSSODescriptors[0].KeyDescriptors = []saml.KeyDescriptor{
-			{
-				Use: "signing",
-				KeyInfo: saml.KeyInfo{
-					X509Data: saml.X509Data{
-						X509Certificates: []saml.X509Certificate{
-							{
-								Data: base64.StdEncoding.EncodeToString(cert.Raw),
-							},
+	// Add certificates to key descriptors
+	for _, cert := range certs {
+		if cert == nil {
+			continue
+		}
+		metadata.IDPSSODescriptors[0].KeyDescriptors = append(metadata.IDPSSODescriptors[0].KeyDescriptors, saml.KeyDescriptor{
+			Use: "signing",
+			KeyInfo: saml.KeyInfo{
+				X509Data: saml.X509Data{
+					X509Certificates: []saml.X509Certificate{
+						{
+							Data: base64.StdEncoding.EncodeToString(cert.Raw),
 						},
 					},
 				},
 			},
-		}
+		})
 	}
 
 	return metadata, nil
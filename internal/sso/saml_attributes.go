@@ -0,0 +1,368 @@
+package sso
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/models"
+)
+
+// Sources of SAML attribute values and NameIDs. Custom user attributes are
+// named attribute:<key>.
+const (
+	SAMLSourceID            = "id"
+	SAMLSourceUsername      = "username"
+	SAMLSourceEmail         = "email"
+	SAMLSourceName          = "name"
+	SAMLSourcePhone         = "phone"
+	SAMLSourceRoles         = "roles"
+	SAMLSourceGroups        = "groups"
+	SAMLSourceOrganizations = "organizations"
+	SAMLSourceOrgPaths      = "org_paths"
+	SAMLSourceStatic        = "static"
+
+	samlAttributeSourcePrefix = "attribute:"
+)
+
+var samlSources = []string{
+	SAMLSourceID, SAMLSourceUsername, SAMLSourceEmail, SAMLSourceName, SAMLSourcePhone,
+	SAMLSourceRoles, SAMLSourceGroups, SAMLSourceOrganizations, SAMLSourceOrgPaths, SAMLSourceStatic,
+}
+
+// samlNameFormats are the short names of the attribute NameFormats
+var samlNameFormats = map[string]string{
+	"basic":       "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+	"uri":         "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+	"unspecified": "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified",
+}
+
+// NameID formats an application can send
+const (
+	SAMLNameIDEmail       = "email"
+	SAMLNameIDPersistent  = "persistent"
+	SAMLNameIDTransient   = "transient"
+	SAMLNameIDUnspecified = "unspecified"
+)
+
+var samlNameIDFormats = map[string]saml.NameIDFormat{
+	SAMLNameIDEmail:       saml.EmailAddressNameIDFormat,
+	SAMLNameIDPersistent:  saml.PersistentNameIDFormat,
+	SAMLNameIDTransient:   saml.TransientNameIDFormat,
+	SAMLNameIDUnspecified: saml.UnspecifiedNameIDFormat,
+}
+
+// SAMLAttributeRule releases one attribute. The attribute map of an
+// application holds a rule per attribute name, either just the source:
+//
+//	"mail": "email"
+//
+// or an object:
+//
+//	"memberOf": {"source": "groups", "name_format": "uri", "friendly_name": "memberOf"}
+//	"department": {"source": "static", "values": ["Engineering"]}
+//	"roles": {"source": "roles", "separator": ","}
+//
+// Multi-valued sources are sent as one AttributeValue per value unless a
+// separator joins them into one.
+type SAMLAttributeRule struct {
+	Name         string
+	Source       string
+	Values       []string // of the static source
+	NameFormat   string   // basic (default), uri, unspecified or a URI
+	FriendlyName string
+	Separator    string
+}
+
+// ParseSAMLAttributeMap reads the rules of an attribute map, sorted by
+// attribute name. Any invalid rule is an error, as when the map is saved.
+func ParseSAMLAttributeMap(attributeMap models.JSONB) ([]SAMLAttributeRule, error) {
+	rules, skipped := SAMLAttributeRules(attributeMap)
+	if len(skipped) > 0 {
+		return nil, skipped[0]
+	}
+	return rules, nil
+}
+
+// SAMLAttributeRules reads the valid rules of a stored attribute map, sorted
+// by attribute name, and returns the errors of the rules it skipped. A map
+// saved before a source was removed still releases its other attributes.
+func SAMLAttributeRules(attributeMap models.JSONB) ([]SAMLAttributeRule, []error) {
+	rules := make([]SAMLAttributeRule, 0, len(attributeMap))
+	var skipped []error
+	for name, value := range attributeMap {
+		rule, err := parseSAMLAttributeRule(name, value)
+		if err != nil {
+			skipped = append(skipped, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].Error() < skipped[j].Error() })
+	return rules, skipped
+}
+
+func parseSAMLAttributeRule(name string, value interface{}) (SAMLAttributeRule, error) {
+	rule := SAMLAttributeRule{Name: name}
+	switch v := value.(type) {
+	case string:
+		rule.Source = v
+	case map[string]interface{}:
+		var err error
+		if rule.Source, err = ruleString(v, "source"); err != nil {
+			return rule, fmt.Errorf("attribute %q: %w", name, err)
+		}
+		if rule.NameFormat, err = ruleString(v, "name_format"); err != nil {
+			return rule, fmt.Errorf("attribute %q: %w", name, err)
+		}
+		if rule.FriendlyName, err = ruleString(v, "friendly_name"); err != nil {
+			return rule, fmt.Errorf("attribute %q: %w", name, err)
+		}
+		if rule.Separator, err = ruleString(v, "separator"); err != nil {
+			return rule, fmt.Errorf("attribute %q: %w", name, err)
+		}
+		rule.Values = attributeValueStrings(v["values"])
+	default:
+		return rule, fmt.Errorf("attribute %q must map to a source or a rule object", name)
+	}
+	if err := rule.validate(); err != nil {
+		return rule, fmt.Errorf("attribute %q: %w", name, err)
+	}
+	return rule, nil
+}
+
+func ruleString(rule map[string]interface{}, key string) (string, error) {
+	value, ok := rule[key]
+	if !ok || value == nil {
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", key)
+	}
+	return s, nil
+}
+
+func (r *SAMLAttributeRule) validate() error {
+	if r.Name == "" {
+		return errors.New("attribute name is empty")
+	}
+	if err := validSAMLSource(r.Source); err != nil {
+		return err
+	}
+	if r.Source == SAMLSourceStatic && len(r.Values) == 0 {
+		return errors.New("static attributes need values")
+	}
+	if r.NameFormat != "" && samlNameFormats[r.NameFormat] == "" && !strings.Contains(r.NameFormat, ":") {
+		return fmt.Errorf("unknown name_format %q", r.NameFormat)
+	}
+	return nil
+}
+
+func validSAMLSource(source string) error {
+	if strings.HasPrefix(source, samlAttributeSourcePrefix) && len(source) > len(samlAttributeSourcePrefix) {
+		return nil
+	}
+	if containsString(samlSources, source) {
+		return nil
+	}
+	return fmt.Errorf("unknown source %q", source)
+}
+
+// SAMLSources lists the sources an application releases from, so the
+// memberships it needs can be looked up
+func SAMLSources(samlConfig *models.SAMLConfig) []string {
+	rules, _ := SAMLAttributeRules(samlConfig.AttributeMap)
+	sources := []string{samlNameIDSource(samlConfig)}
+	for _, rule := range rules {
+		sources = append(sources, rule.Source)
+	}
+	return sources
+}
+
+// SAMLSourceValues returns the values of a source for the user
+func SAMLSourceValues(src *ClaimSource, source string) []string {
+	user := src.User
+	switch source {
+	case SAMLSourceID:
+		return []string{strconv.FormatUint(user.ID, 10)}
+	case SAMLSourceUsername:
+		return nonEmpty(user.Username)
+	case SAMLSourceEmail:
+		return nonEmpty(user.Email)
+	case SAMLSourceName:
+		return nonEmpty(userDisplayName(user))
+	case SAMLSourcePhone:
+		return nonEmpty(user.Phone)
+	case SAMLSourceRoles:
+		return src.Roles
+	case SAMLSourceGroups:
+		return src.Groups
+	case SAMLSourceOrgPaths:
+		return src.OrgPaths
+	case SAMLSourceOrganizations:
+		var names []string
+		for _, orgPath := range src.OrgPaths {
+			if name := path.Base(orgPath); name != "/" && !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	if key, ok := strings.CutPrefix(source, samlAttributeSourcePrefix); ok {
+		return attributeValueStrings(user.Attributes[key])
+	}
+	return nil
+}
+
+// userDisplayName is the name custom attribute, or the given and family
+// names, falling back to the username
+func userDisplayName(user *models.User) string {
+	if name := attributeValueStrings(user.Attributes["name"]); len(name) > 0 {
+		return name[0]
+	}
+	var parts []string
+	for _, key := range []string{"given_name", "family_name"} {
+		if value := attributeValueStrings(user.Attributes[key]); len(value) > 0 {
+			parts = append(parts, value[0])
+		}
+	}
+	if len(parts) > 0 {
+		return strings.Join(parts, " ")
+	}
+	return user.Username
+}
+
+// attributeValueStrings converts a JSON value to attribute values: arrays
+// are multi-valued, null and empty strings have no value
+func attributeValueStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return nonEmpty(v)
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, attributeValueStrings(item)...)
+		}
+		return values
+	case []string:
+		var values []string
+		for _, item := range v {
+			values = append(values, nonEmpty(item)...)
+		}
+		return values
+	}
+	return []string{fmt.Sprint(value)}
+}
+
+func nonEmpty(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
+
+// BuildSAMLAttributes releases the attributes of the rules the user has
+// values for
+func BuildSAMLAttributes(rules []SAMLAttributeRule, src *ClaimSource) []saml.Attribute {
+	var attributes []saml.Attribute
+	for _, rule := range rules {
+		values := rule.Values
+		if rule.Source != SAMLSourceStatic {
+			values = SAMLSourceValues(src, rule.Source)
+		}
+		if len(values) == 0 {
+			continue
+		}
+		if rule.Separator != "" {
+			values = []string{strings.Join(values, rule.Separator)}
+		}
+
+		nameFormat := samlNameFormats["basic"]
+		if rule.NameFormat != "" {
+			nameFormat = samlNameFormats[rule.NameFormat]
+			if nameFormat == "" {
+				nameFormat = rule.NameFormat
+			}
+		}
+		attribute := saml.Attribute{
+			Name:         rule.Name,
+			FriendlyName: rule.FriendlyName,
+			NameFormat:   nameFormat,
+		}
+		for _, value := range values {
+			attribute.Values = append(attribute.Values, saml.AttributeValue{Type: "xs:string", Value: value})
+		}
+		attributes = append(attributes, attribute)
+	}
+	return attributes
+}
+
+// ValidSAMLNameID checks the NameID format and source of an application.
+// The source is used by the email and unspecified formats.
+func ValidSAMLNameID(format, source string) error {
+	if _, ok := samlNameIDFormats[format]; !ok && format != "" {
+		return fmt.Errorf("unknown name_id_format %q", format)
+	}
+	if source == "" {
+		return nil
+	}
+	if source == SAMLSourceStatic {
+		return errors.New("name_id_source cannot be static")
+	}
+	return validSAMLSource(source)
+}
+
+func samlNameIDFormat(samlConfig *models.SAMLConfig) string {
+	if samlConfig.NameIDFormat == "" {
+		return SAMLNameIDEmail
+	}
+	return samlConfig.NameIDFormat
+}
+
+func samlNameIDSource(samlConfig *models.SAMLConfig) string {
+	if samlConfig.NameIDSource != "" {
+		return samlConfig.NameIDSource
+	}
+	if samlNameIDFormat(samlConfig) == SAMLNameIDUnspecified {
+		return SAMLSourceUsername
+	}
+	return SAMLSourceEmail
+}
+
+// BuildSAMLNameID returns the subject's NameID for the application.
+// persistentID is the user's pairwise identifier for the SP, used by the
+// persistent format; transient NameIDs are new in every assertion.
+func BuildSAMLNameID(idp *SAMLIdP, samlConfig *models.SAMLConfig, src *ClaimSource, persistentID string) (*saml.NameID, error) {
+	format := samlNameIDFormat(samlConfig)
+	nameID := &saml.NameID{Format: string(samlNameIDFormats[format])}
+	switch format {
+	case SAMLNameIDPersistent:
+		if persistentID == "" {
+			return nil, errors.New("no persistent NameID for the user")
+		}
+		nameID.Value = persistentID
+		nameID.NameQualifier = idp.EntityID
+		nameID.SPNameQualifier = samlConfig.EntityID
+	case SAMLNameIDTransient:
+		nameID.Value = NewSAMLID()
+	default:
+		values := SAMLSourceValues(src, samlNameIDSource(samlConfig))
+		if len(values) == 0 {
+			return nil, fmt.Errorf("user has no %s for the NameID", samlNameIDSource(samlConfig))
+		}
+		nameID.Value = values[0]
+	}
+	return nameID, nil
+}
@@ -0,0 +1,188 @@
+package sso
+
+import (
+	"testing"
+
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSAMLAttributeMap(t *testing.T) {
+	rules, err := ParseSAMLAttributeMap(models.JSONB{
+		"mail": "email",
+		"memberOf": map[string]interface{}{
+			"source":        "groups",
+			"name_format":   "uri",
+			"friendly_name": "memberOf",
+		},
+		"tier": map[string]interface{}{"source": "static", "values": []interface{}{"gold"}},
+	})
+	if assert.NoError(t, err) && assert.Len(t, rules, 3) {
+		assert.Equal(t, SAMLAttributeRule{Name: "mail", Source: "email"}, rules[0])
+		assert.Equal(t, "memberOf", rules[1].FriendlyName)
+		assert.Equal(t, []string{"gold"}, rules[2].Values)
+	}
+
+	for _, attributeMap := range []models.JSONB{
+		{"mail": "mail"},
+		{"mail": 1},
+		{"tier": map[string]interface{}{"source": "static"}},
+		{"mail": map[string]interface{}{"source": "email", "name_format": "short"}},
+		{"mail": map[string]interface{}{"source": "email", "separator": 1}},
+		{"extra": "attribute:"},
+	} {
+		_, err := ParseSAMLAttributeMap(attributeMap)
+		assert.Error(t, err, "%v", attributeMap)
+	}
+}
+
+func TestSAMLAttributeRulesSkipsInvalid(t *testing.T) {
+	attributeMap := models.JSONB{
+		"mail":  "email",
+		"dept":  "department",
+		"level": map[string]interface{}{"source": "attribute:level", "separator": 1},
+	}
+	rules, skipped := SAMLAttributeRules(attributeMap)
+	if assert.Len(t, rules, 1) {
+		assert.Equal(t, "mail", rules[0].Name)
+	}
+	assert.Len(t, skipped, 2)
+
+	// A stored map with an unknown source still yields a response
+	samlConfig := &models.SAMLConfig{EntityID: "https://sp.example.com", SSOURL: "https://sp.example.com/acs", AttributeMap: attributeMap}
+	src := &ClaimSource{User: &models.User{ID: 7, Email: "alice@example.com"}}
+	response, err := BuildSAMLResponse(testSAMLIdP, samlConfig, src, SAMLResponseOptions{InResponseTo: "req-1", ACSURL: samlConfig.SSOURL})
+	if assert.NoError(t, err) {
+		attributes := response.Assertion.AttributeStatements[0].Attributes
+		if assert.Len(t, attributes, 1) {
+			assert.Equal(t, "mail", attributes[0].Name)
+		}
+	}
+}
+
+func TestBuildSAMLAttributes(t *testing.T) {
+	sp, samlConfig, _ := testLogoutSP(t)
+	samlConfig.AttributeMap = models.JSONB{
+		"mail":        "email",
+		"displayName": "name",
+		"phone":       "phone",
+		"roles":       "roles",
+		"groups":      map[string]interface{}{"source": "groups", "separator": ","},
+		"orgs":        "organizations",
+		"orgPaths":    "org_paths",
+		"department":  "attribute:department",
+		"badges":      "attribute:badges",
+		"level":       "attribute:level",
+		"missing":     "attribute:missing",
+		"urn:oid:2.5.4.10": map[string]interface{}{
+			"source":        "static",
+			"values":        []interface{}{"Acme", "Acme Health"},
+			"name_format":   "uri",
+			"friendly_name": "o",
+		},
+	}
+	src := &ClaimSource{
+		User: &models.User{
+			ID:       7,
+			Username: "alice",
+			Email:    "alice@example.com",
+			Attributes: models.JSONB{
+				"given_name":  "Alice",
+				"family_name": "Liddell",
+				"department":  "Radiology",
+				"badges":      []interface{}{"a", "b"},
+				"level":       float64(3),
+			},
+		},
+		Roles:    []string{"admin", "viewer"},
+		Groups:   []string{"staff", "oncall"},
+		OrgPaths: []string{"/Acme/Radiology"},
+	}
+	// The NameID source comes first
+	sources := SAMLSources(samlConfig)
+	assert.Equal(t, SAMLSourceEmail, sources[0])
+	assert.Contains(t, sources, SAMLSourceRoles)
+	assert.Contains(t, sources, SAMLSourceOrganizations)
+
+	response, err := BuildSAMLResponse(testSAMLIdP, samlConfig, src, SAMLResponseOptions{InResponseTo: "req-1", ACSURL: samlConfig.SSOURL})
+	assert.NoError(t, err)
+	signed, err := SignSAMLResponse(samlConfig, response)
+	assert.NoError(t, err)
+	assertion, err := sp.ParseXMLResponse(signed, []string{"req-1"}, sp.AcsURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	values := map[string][]string{}
+	formats := map[string]string{}
+	for _, attribute := range assertion.AttributeStatements[0].Attributes {
+		formats[attribute.Name] = attribute.NameFormat
+		for _, value := range attribute.Values {
+			values[attribute.Name] = append(values[attribute.Name], value.Value)
+		}
+	}
+	assert.Equal(t, []string{"alice@example.com"}, values["mail"])
+	assert.Equal(t, []string{"Alice Liddell"}, values["displayName"])
+	assert.Equal(t, []string{"admin", "viewer"}, values["roles"])
+	assert.Equal(t, []string{"staff,oncall"}, values["groups"])
+	assert.Equal(t, []string{"Radiology"}, values["orgs"])
+	assert.Equal(t, []string{"/Acme/Radiology"}, values["orgPaths"])
+	assert.Equal(t, []string{"Radiology"}, values["department"])
+	assert.Equal(t, []string{"a", "b"}, values["badges"])
+	assert.Equal(t, []string{"3"}, values["level"])
+	assert.Equal(t, []string{"Acme", "Acme Health"}, values["urn:oid:2.5.4.10"])
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:attrname-format:uri", formats["urn:oid:2.5.4.10"])
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:attrname-format:basic", formats["mail"])
+	// Attributes without values are left out
+	assert.NotContains(t, values, "phone")
+	assert.NotContains(t, values, "missing")
+}
+
+func TestBuildSAMLNameID(t *testing.T) {
+	samlConfig := &models.SAMLConfig{EntityID: "https://sp.example.com"}
+	src := &ClaimSource{User: &models.User{
+		ID:         7,
+		Username:   "alice",
+		Email:      "alice@example.com",
+		Attributes: models.JSONB{"employee_id": "E-100"},
+	}}
+	nameID := func() *saml.NameID {
+		nameID, err := BuildSAMLNameID(testSAMLIdP, samlConfig, src, "_pairwise-1")
+		assert.NoError(t, err)
+		return nameID
+	}
+
+	assert.Equal(t, &saml.NameID{Format: string(saml.EmailAddressNameIDFormat), Value: "alice@example.com"}, nameID())
+
+	samlConfig.NameIDFormat = SAMLNameIDUnspecified
+	assert.Equal(t, &saml.NameID{Format: string(saml.UnspecifiedNameIDFormat), Value: "alice"}, nameID())
+	samlConfig.NameIDSource = "attribute:employee_id"
+	assert.Equal(t, "E-100", nameID().Value)
+
+	samlConfig.NameIDFormat = SAMLNameIDPersistent
+	assert.Equal(t, &saml.NameID{
+		Format:          string(saml.PersistentNameIDFormat),
+		Value:           "_pairwise-1",
+		NameQualifier:   testSAMLIdP.EntityID,
+		SPNameQualifier: "https://sp.example.com",
+	}, nameID())
+	_, err := BuildSAMLNameID(testSAMLIdP, samlConfig, src, "")
+	assert.Error(t, err)
+
+	samlConfig.NameIDFormat = SAMLNameIDTransient
+	first := nameID()
+	assert.Equal(t, string(saml.TransientNameIDFormat), first.Format)
+	assert.NotEqual(t, first.Value, nameID().Value)
+
+	// The user must have a value for the NameID
+	samlConfig.NameIDFormat = SAMLNameIDEmail
+	samlConfig.NameIDSource = "attribute:missing"
+	_, err = BuildSAMLNameID(testSAMLIdP, samlConfig, src, "")
+	assert.Error(t, err)
+
+	assert.NoError(t, ValidSAMLNameID("", ""))
+	assert.NoError(t, ValidSAMLNameID(SAMLNameIDUnspecified, "attribute:employee_id"))
+	assert.Error(t, ValidSAMLNameID("x509", ""))
+	assert.Error(t, ValidSAMLNameID(SAMLNameIDEmail, SAMLSourceStatic))
+}
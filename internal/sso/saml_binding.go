@@ -0,0 +1,39 @@
+package sso
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/crewjam/saml"
+)
+
+// maxSAMLMessageSize bounds an inflated HTTP-Redirect message
+const maxSAMLMessageSize = 1 << 20
+
+// DecodeSAMLMessage decodes the SAMLRequest or SAMLResponse parameter of a
+// binding: base64 for HTTP-POST, and base64 of DEFLATE for HTTP-Redirect
+// (SAML bindings 3.4.4.1 and 3.5.4)
+func DecodeSAMLMessage(binding, encoded string) ([]byte, error) {
+	// Some SPs wrap the base64 of POSTed messages
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+	if binding != saml.HTTPRedirectBinding {
+		return data, nil
+	}
+
+	message, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), maxSAMLMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DEFLATE encoding: %w", err)
+	}
+	if len(message) > maxSAMLMessageSize {
+		return nil, errors.New("message is too large")
+	}
+	return message, nil
+}
@@ -0,0 +1,114 @@
+package sso
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeSAMLMessageRedirect(t *testing.T) {
+	sp, samlConfig := testSigningSP(t)
+	request, err := sp.MakeAuthenticationRequest(testSAMLIdP.SSOURL, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	assert.NoError(t, err)
+	redirectURL, err := request.Redirect("https://sp.example.com/after?x=1", sp)
+	assert.NoError(t, err)
+
+	// The SP's redirect is inflated and its RelayState and signature checked
+	query := redirectURL.Query()
+	message, err := DecodeSAMLMessage(saml.HTTPRedirectBinding, query.Get("SAMLRequest"))
+	assert.NoError(t, err)
+	parsed, _, err := ValidateAuthnRequest(testSAMLIdP, samlConfig, saml.HTTPRedirectBinding, redirectURL.RawQuery, message, time.Now())
+	if assert.NoError(t, err) {
+		assert.Equal(t, request.ID, parsed.ID)
+	}
+	assert.Equal(t, "https://sp.example.com/after?x=1", query.Get("RelayState"))
+
+	// Redirect messages must be compressed
+	plain, _ := MarshalSAMLElement(request.Element())
+	_, err = DecodeSAMLMessage(saml.HTTPRedirectBinding, base64.StdEncoding.EncodeToString(plain))
+	assert.Error(t, err)
+	_, err = DecodeSAMLMessage(saml.HTTPRedirectBinding, "not base64!")
+	assert.Error(t, err)
+
+	// Inflating is bounded
+	var compressed bytes.Buffer
+	writer, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	writer.Write(make([]byte, 2*maxSAMLMessageSize))
+	writer.Close()
+	_, err = DecodeSAMLMessage(saml.HTTPRedirectBinding, base64.StdEncoding.EncodeToString(compressed.Bytes()))
+	assert.Error(t, err)
+}
+
+func TestDecodeSAMLMessagePOST(t *testing.T) {
+	sp, samlConfig := testSigningSP(t)
+	request, err := sp.MakeAuthenticationRequest(testSAMLIdP.SSOURL, saml.HTTPPostBinding, saml.HTTPPostBinding)
+	assert.NoError(t, err)
+	form := request.Post("state-1")
+	value := regexp.MustCompile(`name="SAMLRequest" value="([^"]+)"`).FindSubmatch(form)
+	if !assert.NotNil(t, value) {
+		return
+	}
+
+	message, err := DecodeSAMLMessage(saml.HTTPPostBinding, html.UnescapeString(string(value[1])))
+	assert.NoError(t, err)
+	_, _, err = ValidateAuthnRequest(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now())
+	assert.NoError(t, err)
+
+	// Line-wrapped base64 is accepted
+	encoded := base64.StdEncoding.EncodeToString(message)
+	var wrapped []string
+	for len(encoded) > 76 {
+		wrapped = append(wrapped, encoded[:76])
+		encoded = encoded[76:]
+	}
+	wrapped = append(wrapped, encoded)
+	decoded, err := DecodeSAMLMessage(saml.HTTPPostBinding, strings.Join(wrapped, "\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, message, decoded)
+}
+
+func TestSAMLPostPage(t *testing.T) {
+	sp, samlConfig, _ := testLogoutSP(t)
+	src := &ClaimSource{User: &models.User{ID: 7, Username: "alice", Email: "alice@example.com"}}
+	response, err := BuildSAMLResponse(testSAMLIdP, samlConfig, src, SAMLResponseOptions{InResponseTo: "req-1", ACSURL: samlConfig.SSOURL})
+	assert.NoError(t, err)
+	signed, err := SignSAMLResponse(samlConfig, response)
+	assert.NoError(t, err)
+
+	relayState := `"><script>alert(1)</script>`
+	var page bytes.Buffer
+	assert.NoError(t, RenderPage(&page, "saml_post", SAMLPostPageData{
+		Title:      "Signing in",
+		Action:     samlConfig.SSOURL,
+		Param:      "SAMLResponse",
+		Message:    base64.StdEncoding.EncodeToString(signed),
+		RelayState: relayState,
+	}))
+	assert.NotContains(t, page.String(), "<script>alert")
+	assert.Contains(t, page.String(), `<form method="POST" action="https://sp.example.com/saml/acs">`)
+
+	// The SP receives what the user agent submits
+	form := url.Values{}
+	for _, input := range regexp.MustCompile(`name="([^"]+)" value="([^"]*)"`).FindAllStringSubmatch(page.String(), -1) {
+		form.Set(input[1], html.UnescapeString(input[2]))
+	}
+	assert.Equal(t, relayState, form.Get("RelayState"))
+	req, _ := http.NewRequest(http.MethodPost, samlConfig.SSOURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.NoError(t, req.ParseForm())
+	assertion, err := sp.ParseResponse(req, []string{"req-1"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice@example.com", assertion.Subject.NameID.Value)
+	}
+}
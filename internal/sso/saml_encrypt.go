@@ -0,0 +1,184 @@
+package sso
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml/xmlenc"
+)
+
+// SAML assertion encryption methods: the block cipher that encrypts the
+// assertion. Its key is transported with RSA-OAEP.
+const (
+	SAMLEncryptAES128GCM = "aes128-gcm"
+	SAMLEncryptAES256GCM = "aes256-gcm"
+	SAMLEncryptAES128CBC = "aes128-cbc"
+	SAMLEncryptAES192CBC = "aes192-cbc"
+	SAMLEncryptAES256CBC = "aes256-cbc"
+)
+
+var samlBlockCiphers = map[string]xmlenc.BlockCipher{
+	SAMLEncryptAES128GCM: samlGCM{keySize: 16, algorithm: "http://www.w3.org/2009/xmlenc11#aes128-gcm"},
+	SAMLEncryptAES256GCM: samlGCM{keySize: 32, algorithm: "http://www.w3.org/2009/xmlenc11#aes256-gcm"},
+	SAMLEncryptAES128CBC: xmlenc.AES128CBC,
+	SAMLEncryptAES192CBC: xmlenc.AES192CBC,
+	SAMLEncryptAES256CBC: xmlenc.AES256CBC,
+}
+
+func init() {
+	// xmlenc only decrypts AES-128-GCM
+	xmlenc.RegisterDecrypter(samlBlockCiphers[SAMLEncryptAES256GCM])
+}
+
+// ValidSAMLEncryptionMethod reports whether method is a known encryption
+// method. Empty selects the default, AES-128-GCM.
+func ValidSAMLEncryptionMethod(method string) bool {
+	_, ok := samlBlockCiphers[method]
+	return ok || method == ""
+}
+
+// samlEncryptionMethod returns the encryption method of an xmlenc algorithm
+// URI from SP metadata, or "" if it is not supported
+func samlEncryptionMethod(algorithm string) string {
+	for method, cipher := range samlBlockCiphers {
+		if cipher.Algorithm() == algorithm {
+			return method
+		}
+	}
+	return ""
+}
+
+// SAMLEncrypter encrypts assertions to an SP's encryption certificate
+type SAMLEncrypter struct {
+	Certificate *x509.Certificate
+	Method      string
+}
+
+// NewSAMLEncrypter parses the SP's PEM encryption certificate, which must
+// hold an RSA key
+func NewSAMLEncrypter(certPEM, method string) (*SAMLEncrypter, error) {
+	if !ValidSAMLEncryptionMethod(method) {
+		return nil, fmt.Errorf("unknown encryption method %q", method)
+	}
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+		return nil, errors.New("encryption certificate does not hold an RSA key")
+	}
+	if method == "" {
+		method = SAMLEncryptAES128GCM
+	}
+	return &SAMLEncrypter{Certificate: cert, Method: method}, nil
+}
+
+// Encrypt returns an EncryptedAssertion holding assertionEl. The key is
+// transported with RSA-OAEP-MGF1P and SHA-1 in the EncryptedData KeyInfo.
+func (e *SAMLEncrypter) Encrypt(assertionEl *etree.Element) (*etree.Element, error) {
+	plaintext, err := MarshalSAMLElement(assertionEl.Copy())
+	if err != nil {
+		return nil, err
+	}
+	encrypter := xmlenc.OAEP()
+	encrypter.BlockCipher = samlBlockCiphers[e.Method]
+	encrypter.DigestMethod = &xmlenc.SHA1
+	encryptedData, err := encrypter.Encrypt(e.Certificate, plaintext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt assertion: %w", err)
+	}
+	encryptedData.CreateAttr("Type", "http://www.w3.org/2001/04/xmlenc#Element")
+
+	encryptedAssertion := etree.NewElement("saml:EncryptedAssertion")
+	encryptedAssertion.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	encryptedAssertion.AddChild(encryptedData)
+	return encryptedAssertion, nil
+}
+
+// samlGCM is AES-GCM as XML Encryption 1.1 specifies it: the CipherValue is
+// the 96 bit nonce followed by the ciphertext and the 128 bit tag. The
+// xmlenc package can decrypt AES-128-GCM but not encrypt it.
+type samlGCM struct {
+	keySize   int
+	algorithm string
+}
+
+func (g samlGCM) KeySize() int {
+	return g.keySize
+}
+
+func (g samlGCM) Algorithm() string {
+	return g.algorithm
+}
+
+// Encrypt returns an EncryptedData element holding plaintext encrypted with
+// key, which must be a []byte of KeySize bytes
+func (g samlGCM) Encrypt(key interface{}, plaintext []byte, _ []byte) (*etree.Element, error) {
+	aead, err := g.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	encryptedData := etree.NewElement("xenc:EncryptedData")
+	encryptedData.CreateAttr("xmlns:xenc", "http://www.w3.org/2001/04/xmlenc#")
+	encryptedData.CreateAttr("Id", fmt.Sprintf("_%x", id))
+	encryptedData.CreateElement("xenc:EncryptionMethod").CreateAttr("Algorithm", g.algorithm)
+	cipherData := encryptedData.CreateElement("xenc:CipherData")
+	cipherData.CreateElement("xenc:CipherValue").SetText(base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)))
+	return encryptedData, nil
+}
+
+// Decrypt decrypts an EncryptedData element. key is the RSA private key if
+// the element carries an EncryptedKey, else the AES key.
+func (g samlGCM) Decrypt(key interface{}, ciphertextEl *etree.Element) ([]byte, error) {
+	if encryptedKey := ciphertextEl.FindElement("./KeyInfo/EncryptedKey"); encryptedKey != nil {
+		var err error
+		if key, err = xmlenc.Decrypt(key, encryptedKey); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := g.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	cipherValue := ciphertextEl.FindElement("./CipherData/CipherValue")
+	if cipherValue == nil {
+		return nil, errors.New("EncryptedData has no CipherValue")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cipherValue.Text()))
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+}
+
+func (g samlGCM) aead(key interface{}) (cipher.AEAD, error) {
+	keyBuf, ok := key.([]byte)
+	if !ok || len(keyBuf) != g.keySize {
+		return nil, fmt.Errorf("AES-GCM key must be %d bytes", g.keySize)
+	}
+	block, err := aes.NewCipher(keyBuf)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,65 @@
+package sso
+
+import (
+	"testing"
+
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptSAMLAssertion(t *testing.T) {
+	sp, samlConfig, _ := testLogoutSP(t)
+	samlConfig.EncryptAssertions = true
+	src := &ClaimSource{User: &models.User{ID: 7, Username: "alice", Email: "alice@example.com"}}
+
+	methods := []string{"", SAMLEncryptAES128GCM, SAMLEncryptAES256GCM, SAMLEncryptAES128CBC, SAMLEncryptAES192CBC, SAMLEncryptAES256CBC}
+	for _, method := range methods {
+		for _, target := range []string{SAMLSignAssertion, SAMLSignResponse, SAMLSignBoth} {
+			samlConfig.EncryptionMethod = method
+			samlConfig.SignatureTarget = target
+			response, err := BuildSAMLResponse(testSAMLIdP, samlConfig, src, SAMLResponseOptions{InResponseTo: "req-1", ACSURL: samlConfig.SSOURL})
+			assert.NoError(t, err)
+			signed, err := SignSAMLResponse(samlConfig, response)
+			assert.NoError(t, err)
+			assert.Contains(t, string(signed), "EncryptedAssertion")
+			assert.NotContains(t, string(signed), "alice@example.com")
+			assert.Contains(t, string(signed), "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p")
+			// The assertion is left in the response for the caller
+			assert.NotNil(t, response.Assertion)
+
+			assertion, err := sp.ParseXMLResponse(signed, []string{"req-1"}, sp.AcsURL)
+			if assert.NoError(t, err, "method %q, signature target %q", method, target) {
+				assert.Equal(t, "alice@example.com", assertion.Subject.NameID.Value)
+			}
+		}
+	}
+
+	// Only the SP's key decrypts the assertion
+	other, _, _ := testLogoutSP(t)
+	other.IDPMetadata = sp.IDPMetadata
+	other.EntityID = sp.EntityID
+	samlConfig.EncryptionMethod = ""
+	response, _ := BuildSAMLResponse(testSAMLIdP, samlConfig, src, SAMLResponseOptions{InResponseTo: "req-1", ACSURL: samlConfig.SSOURL})
+	signed, err := SignSAMLResponse(samlConfig, response)
+	assert.NoError(t, err)
+	_, err = other.ParseXMLResponse(signed, []string{"req-1"}, other.AcsURL)
+	assert.Error(t, err)
+	assert.Contains(t, string(signed), "http://www.w3.org/2009/xmlenc11#aes128-gcm")
+}
+
+func TestNewSAMLEncrypter(t *testing.T) {
+	certPEM, _ := testSAMLKeyPair(t)
+	encrypter, err := NewSAMLEncrypter(certPEM, "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, SAMLEncryptAES128GCM, encrypter.Method)
+	}
+	_, err = NewSAMLEncrypter(certPEM, "tripledes-cbc")
+	assert.Error(t, err)
+	_, err = NewSAMLEncrypter("", SAMLEncryptAES256CBC)
+	assert.Error(t, err)
+
+	assert.True(t, ValidSAMLEncryptionMethod(""))
+	assert.False(t, ValidSAMLEncryptionMethod("none"))
+	assert.Equal(t, SAMLEncryptAES256GCM, samlEncryptionMethod("http://www.w3.org/2009/xmlenc11#aes256-gcm"))
+	assert.Empty(t, samlEncryptionMethod("http://www.w3.org/2001/04/xmlenc#tripledes-cbc"))
+}
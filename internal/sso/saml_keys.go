@@ -0,0 +1,175 @@
+package sso
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/models"
+)
+
+// SAML key states: next keys are published ahead of use, the active key
+// signs, retired keys are no longer used
+const (
+	SAMLKeyNext    = "next"
+	SAMLKeyActive  = "active"
+	SAMLKeyRetired = "retired"
+)
+
+// IdP metadata stays valid for SAMLMetadataValidity; SPs should refetch it
+// every SAMLMetadataCacheDuration so they learn of next keys in time
+const (
+	SAMLMetadataValidity      = 7 * 24 * time.Hour
+	SAMLMetadataCacheDuration = 24 * time.Hour
+)
+
+// GenerateSAMLKey returns a next key: a new RSA key pair with a self-signed
+// certificate for commonName that is valid for validity
+func GenerateSAMLKey(commonName string, validity time.Duration) (*models.SAMLKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	fingerprint := sha256.Sum256(der)
+	return &models.SAMLKey{
+		Status:      SAMLKeyNext,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		NotAfter:    template.NotAfter,
+	}, nil
+}
+
+// PromoteSAMLKeys activates the next keys whose switch-over is due and
+// retires the keys they replace. When several are due the last scheduled
+// one wins. It reports whether any key changed.
+func PromoteSAMLKeys(keys []models.SAMLKey, now time.Time) bool {
+	promote := -1
+	for i := range keys {
+		if keys[i].Status != SAMLKeyNext || keys[i].ActivatesAt == nil || keys[i].ActivatesAt.After(now) {
+			continue
+		}
+		if promote < 0 || keys[i].ActivatesAt.After(*keys[promote].ActivatesAt) {
+			promote = i
+		}
+	}
+	if promote < 0 {
+		return false
+	}
+	ActivateSAMLKey(keys, promote, now)
+	return true
+}
+
+// ActivateSAMLKey makes keys[index] the active key. The key it replaces, and
+// next keys scheduled no later than it, are retired.
+func ActivateSAMLKey(keys []models.SAMLKey, index int, now time.Time) {
+	activated := &keys[index]
+	for i := range keys {
+		key := &keys[i]
+		if i == index {
+			continue
+		}
+		superseded := key.Status == SAMLKeyNext && key.ActivatesAt != nil && activated.ActivatesAt != nil &&
+			!key.ActivatesAt.After(*activated.ActivatesAt)
+		if key.Status == SAMLKeyActive || superseded {
+			key.Status = SAMLKeyRetired
+			key.ActivatesAt = nil
+			retiredAt := now
+			key.RetiredAt = &retiredAt
+		}
+	}
+	activated.Status = SAMLKeyActive
+	activated.ActivatesAt = nil
+	activatedAt := now
+	activated.ActivatedAt = &activatedAt
+}
+
+// SAMLKeySelection is the key pair a SAML application signs with and the
+// certificates its metadata publishes, the signing one first
+type SAMLKeySelection struct {
+	Certificate  string
+	PrivateKey   string
+	Certificates []string
+}
+
+// SelectSAMLKeys picks the signing key of a SAML application: the active
+// key of its key set, else its own key pair, else the active key of the
+// global key set. Next keys of the application, and of the global set when
+// it signs, are published alongside so SPs trust them before the switch.
+func SelectSAMLKeys(samlConfig *models.SAMLConfig, appKeys, globalKeys []models.SAMLKey) *SAMLKeySelection {
+	selection := &SAMLKeySelection{}
+	if active := activeSAMLKey(appKeys); active != nil {
+		selection.Certificate, selection.PrivateKey = active.Certificate, active.PrivateKey
+	} else if samlConfig.Certificate != "" {
+		selection.Certificate, selection.PrivateKey = samlConfig.Certificate, samlConfig.PrivateKey
+	} else if active := activeSAMLKey(globalKeys); active != nil {
+		selection.Certificate, selection.PrivateKey = active.Certificate, active.PrivateKey
+		appKeys = append(append([]models.SAMLKey{}, appKeys...), globalKeys...)
+	}
+	if selection.Certificate != "" {
+		selection.Certificates = append(selection.Certificates, selection.Certificate)
+	}
+	for _, key := range appKeys {
+		if key.Status == SAMLKeyNext {
+			selection.Certificates = append(selection.Certificates, key.Certificate)
+		}
+	}
+	return selection
+}
+
+func activeSAMLKey(keys []models.SAMLKey) *models.SAMLKey {
+	for i := range keys {
+		if keys[i].Status == SAMLKeyActive {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// SignSAMLMetadata serializes metadata with an enveloped signature, which
+// the schema places first in the EntityDescriptor
+func SignSAMLMetadata(signer *SAMLSigner, metadata *saml.EntityDescriptor) ([]byte, error) {
+	if metadata.ID == "" {
+		metadata.ID = NewSAMLID()
+	}
+	data, err := xml.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, err
+	}
+	signed, err := signer.SignEnveloped(doc.Root())
+	if err != nil {
+		return nil, err
+	}
+	return MarshalSAMLElement(signed)
+}
@@ -0,0 +1,149 @@
+package sso
+
+import (
+	"crypto/x509"
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/models"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateSAMLKey(t *testing.T) {
+	key, err := GenerateSAMLKey("OpenAuth SAML test", 48*time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, SAMLKeyNext, key.Status)
+	assert.Len(t, key.Fingerprint, 64)
+	assert.WithinDuration(t, time.Now().Add(48*time.Hour), key.NotAfter, time.Minute)
+
+	signer, err := NewSAMLSigner(key.Certificate, key.PrivateKey)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "OpenAuth SAML test", signer.Certificate.Subject.CommonName)
+	}
+}
+
+func TestPromoteSAMLKeys(t *testing.T) {
+	now := time.Now()
+	past, earlier, future := now.Add(-time.Hour), now.Add(-2*time.Hour), now.Add(time.Hour)
+	keys := []models.SAMLKey{
+		{ID: 1, Status: SAMLKeyActive},
+		{ID: 2, Status: SAMLKeyNext, ActivatesAt: &earlier},
+		{ID: 3, Status: SAMLKeyNext, ActivatesAt: &past},
+		{ID: 4, Status: SAMLKeyNext, ActivatesAt: &future},
+		{ID: 5, Status: SAMLKeyNext},
+	}
+	assert.True(t, PromoteSAMLKeys(keys, now))
+
+	// The last due key wins and replaces the active one and the earlier one
+	var statuses []string
+	for _, key := range keys {
+		statuses = append(statuses, key.Status)
+	}
+	assert.Equal(t, []string{SAMLKeyRetired, SAMLKeyRetired, SAMLKeyActive, SAMLKeyNext, SAMLKeyNext}, statuses)
+	assert.NotNil(t, keys[0].RetiredAt)
+	assert.NotNil(t, keys[2].ActivatedAt)
+	assert.Nil(t, keys[2].ActivatesAt)
+	assert.Equal(t, &future, keys[3].ActivatesAt)
+
+	assert.False(t, PromoteSAMLKeys(keys, now))
+	assert.True(t, PromoteSAMLKeys(keys, future))
+	assert.Equal(t, SAMLKeyRetired, keys[2].Status)
+	assert.Equal(t, SAMLKeyActive, keys[3].Status)
+}
+
+func TestSelectSAMLKeys(t *testing.T) {
+	samlConfig := &models.SAMLConfig{Certificate: "own-cert", PrivateKey: "own-key"}
+	appKeys := []models.SAMLKey{
+		{Status: SAMLKeyRetired, Certificate: "app-retired"},
+		{Status: SAMLKeyNext, Certificate: "app-next"},
+	}
+	globalKeys := []models.SAMLKey{
+		{Status: SAMLKeyActive, Certificate: "global-active", PrivateKey: "global-key"},
+		{Status: SAMLKeyNext, Certificate: "global-next"},
+	}
+
+	// The application's own key pair signs until its next key is activated
+	selection := SelectSAMLKeys(samlConfig, appKeys, globalKeys)
+	assert.Equal(t, "own-key", selection.PrivateKey)
+	assert.Equal(t, []string{"own-cert", "app-next"}, selection.Certificates)
+
+	// Without one the global key set signs
+	selection = SelectSAMLKeys(&models.SAMLConfig{}, appKeys, globalKeys)
+	assert.Equal(t, "global-key", selection.PrivateKey)
+	assert.Equal(t, []string{"global-active", "app-next", "global-next"}, selection.Certificates)
+
+	appKeys[1].Status = SAMLKeyActive
+	appKeys[1].PrivateKey = "app-key"
+	selection = SelectSAMLKeys(samlConfig, appKeys, globalKeys)
+	assert.Equal(t, "app-key", selection.PrivateKey)
+	assert.Equal(t, []string{"app-next"}, selection.Certificates)
+
+	assert.Empty(t, SelectSAMLKeys(&models.SAMLConfig{}, nil, nil).Certificates)
+}
+
+func TestSAMLKeyRollover(t *testing.T) {
+	active, err := GenerateSAMLKey("active", 48*time.Hour)
+	assert.NoError(t, err)
+	next, err := GenerateSAMLKey("next", 48*time.Hour)
+	assert.NoError(t, err)
+	certs, err := ParseSAMLCertificates([]string{active.Certificate, next.Certificate})
+	assert.NoError(t, err)
+	metadata, err := BuildSAMLMetadata(testSAMLIdP.EntityID, testSAMLIdP.SSOURL, testSAMLIdP.SLOURL, certs...)
+	assert.NoError(t, err)
+	assert.Len(t, metadata.IDPSSODescriptors[0].KeyDescriptors, 2)
+
+	// An SP with the published metadata accepts responses signed by either key
+	for _, key := range []*models.SAMLKey{active, next} {
+		samlConfig := &models.SAMLConfig{
+			EntityID:    "https://sp.example.com",
+			SSOURL:      "https://sp.example.com/acs",
+			Certificate: key.Certificate,
+			PrivateKey:  key.PrivateKey,
+		}
+		sp := testServiceProvider(t, samlConfig)
+		sp.IDPMetadata = metadata
+		response, err := BuildSAMLResponse(testSAMLIdP, samlConfig, &ClaimSource{User: &models.User{ID: 7, Email: "alice@example.com"}}, SAMLResponseOptions{InResponseTo: "req-1", ACSURL: samlConfig.SSOURL})
+		assert.NoError(t, err)
+		signed, err := SignSAMLResponse(samlConfig, response)
+		assert.NoError(t, err)
+		_, err = sp.ParseXMLResponse(signed, []string{"req-1"}, sp.AcsURL)
+		assert.NoError(t, err)
+	}
+}
+
+func TestSignSAMLMetadata(t *testing.T) {
+	certPEM, keyPEM := testSAMLKeyPair(t)
+	signer, err := NewSAMLSigner(certPEM, keyPEM)
+	assert.NoError(t, err)
+	metadata, err := BuildSAMLMetadata(testSAMLIdP.EntityID, testSAMLIdP.SSOURL, "", signer.Certificate)
+	assert.NoError(t, err)
+	metadata.ValidUntil = saml.TimeNow().Add(SAMLMetadataValidity)
+
+	data, err := SignSAMLMetadata(signer, metadata)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc := etree.NewDocument()
+	assert.NoError(t, doc.ReadFromBytes(data))
+	assert.Equal(t, "Signature", doc.Root().ChildElements()[0].Tag)
+
+	// The signature verifies and the metadata still parses
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{signer.Certificate}})
+	_, err = ctx.Validate(doc.Root())
+	assert.NoError(t, err)
+	var parsed saml.EntityDescriptor
+	assert.NoError(t, xml.Unmarshal(data, &parsed))
+	assert.Equal(t, testSAMLIdP.EntityID, parsed.EntityID)
+	assert.WithinDuration(t, metadata.ValidUntil, parsed.ValidUntil, time.Second)
+
+	// Tampering breaks the signature
+	doc.Root().CreateAttr("entityID", "https://evil.example.com")
+	_, err = ctx.Validate(doc.Root())
+	assert.Error(t, err)
+}
@@ -0,0 +1,129 @@
+package sso
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/google/uuid"
+	"github.com/hanyouqing/openauth/internal/models"
+)
+
+// SAMLLogoutLifetime bounds how long a LogoutRequest sent to an SP is valid
+const SAMLLogoutLifetime = 5 * time.Minute
+
+// NewSAMLID returns a fresh identifier for a SAML message or session index
+func NewSAMLID() string {
+	return "_" + uuid.New().String()
+}
+
+// BuildSAMLLogoutRequest builds the LogoutRequest that ends a participant's
+// session at its SP. It is signed when it is sent.
+func BuildSAMLLogoutRequest(idp *SAMLIdP, destination string, participant *models.SAMLSessionParticipant) *saml.LogoutRequest {
+	now := saml.TimeNow()
+	notOnOrAfter := now.Add(SAMLLogoutLifetime)
+	return &saml.LogoutRequest{
+		ID:           NewSAMLID(),
+		Version:      "2.0",
+		IssueInstant: now,
+		NotOnOrAfter: &notOnOrAfter,
+		Destination:  destination,
+		Issuer:       &saml.Issuer{Value: idp.EntityID},
+		NameID: &saml.NameID{
+			Format: participant.NameIDFormat,
+			Value:  participant.NameID,
+		},
+		SessionIndex: &saml.SessionIndex{Value: participant.SessionIndex},
+	}
+}
+
+// BuildSAMLLogoutResponse builds the answer to an SP's LogoutRequest. partial
+// reports that logout could not be propagated to every other SP.
+func BuildSAMLLogoutResponse(idp *SAMLIdP, destination, inResponseTo string, partial bool) *saml.LogoutResponse {
+	status := saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}}
+	if partial {
+		status.StatusCode.StatusCode = &saml.StatusCode{Value: saml.StatusPartialLogout}
+	}
+	return &saml.LogoutResponse{
+		ID:           NewSAMLID(),
+		InResponseTo: inResponseTo,
+		Version:      "2.0",
+		IssueInstant: saml.TimeNow(),
+		Destination:  destination,
+		Issuer:       &saml.Issuer{Value: idp.EntityID},
+		Status:       status,
+	}
+}
+
+// ValidateLogoutRequest checks a LogoutRequest from the application's SP and
+// reports whether it was signed. It must be signed when the SP has signing
+// certificates, so third parties cannot end sessions. An unsigned request
+// must name the SessionIndex it ends; the caller only honours it for the
+// user agent's own login session.
+func ValidateLogoutRequest(idp *SAMLIdP, samlConfig *models.SAMLConfig, binding, rawQuery string, message []byte, now time.Time) (*saml.LogoutRequest, bool, error) {
+	el, signed, err := readSPMessage(samlConfig, binding, "SAMLRequest", rawQuery, message)
+	if err != nil {
+		return nil, false, err
+	}
+	if !signed && len(samlConfig.SPCertificates) > 0 {
+		return nil, false, errors.New("LogoutRequest must be signed")
+	}
+
+	var request saml.LogoutRequest
+	if err := unmarshalSAMLElement(el, &request); err != nil {
+		return nil, false, fmt.Errorf("invalid LogoutRequest: %w", err)
+	}
+	if err := checkSPMessage(idp, samlConfig, request.Version, request.Issuer, request.Destination, signed, request.IssueInstant, now); err != nil {
+		return nil, false, fmt.Errorf("LogoutRequest %w", err)
+	}
+	if request.NotOnOrAfter != nil && !now.Before(*request.NotOnOrAfter) {
+		return nil, false, errors.New("LogoutRequest is expired")
+	}
+	if request.NameID == nil || request.NameID.Value == "" {
+		return nil, false, errors.New("LogoutRequest has no NameID")
+	}
+	if !signed && (request.SessionIndex == nil || request.SessionIndex.Value == "") {
+		return nil, false, errors.New("unsigned LogoutRequest has no SessionIndex")
+	}
+	return &request, signed, nil
+}
+
+// ValidateLogoutResponse checks the answer of the application's SP to a
+// LogoutRequest it was sent
+func ValidateLogoutResponse(idp *SAMLIdP, samlConfig *models.SAMLConfig, binding, rawQuery string, message []byte, now time.Time) (*saml.LogoutResponse, error) {
+	el, signed, err := readSPMessage(samlConfig, binding, "SAMLResponse", rawQuery, message)
+	if err != nil {
+		return nil, err
+	}
+	if !signed && len(samlConfig.SPCertificates) > 0 {
+		return nil, errors.New("LogoutResponse must be signed")
+	}
+
+	var response saml.LogoutResponse
+	if err := unmarshalSAMLElement(el, &response); err != nil {
+		return nil, fmt.Errorf("invalid LogoutResponse: %w", err)
+	}
+	if err := checkSPMessage(idp, samlConfig, response.Version, response.Issuer, response.Destination, signed, response.IssueInstant, now); err != nil {
+		return nil, fmt.Errorf("LogoutResponse %w", err)
+	}
+	return &response, nil
+}
+
+// checkSPMessage checks the version, issuer, destination and age of a
+// logout message from the application's SP
+func checkSPMessage(idp *SAMLIdP, samlConfig *models.SAMLConfig, version string, issuer *saml.Issuer, destination string, signed bool, issueInstant, now time.Time) error {
+	if version != "2.0" {
+		return fmt.Errorf("has unsupported SAML version %q", version)
+	}
+	if issuer == nil || issuer.Value != samlConfig.EntityID {
+		return errors.New("is not issued by the application's SP")
+	}
+	if (signed || destination != "") && destination != idp.SLOURL {
+		return fmt.Errorf("destination is not %s", idp.SLOURL)
+	}
+	if !samlIssuedRecently(issueInstant, now) {
+		return errors.New("is expired")
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package sso
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// testLogoutSP is a signing crewjam SP that trusts the IdP key of its
+// application
+func testLogoutSP(t *testing.T) (*saml.ServiceProvider, *models.SAMLConfig, *x509.Certificate) {
+	sp, samlConfig := testSigningSP(t)
+	samlConfig.Certificate, samlConfig.PrivateKey = testSAMLKeyPair(t)
+	cert, err := ParseCertificate(samlConfig.Certificate)
+	assert.NoError(t, err)
+	sp.IDPMetadata, err = BuildSAMLMetadata(testSAMLIdP.EntityID, testSAMLIdP.SSOURL, testSAMLIdP.SLOURL, cert)
+	assert.NoError(t, err)
+	return sp, samlConfig, cert
+}
+
+func TestValidateLogoutRequest(t *testing.T) {
+	sp, samlConfig, _ := testLogoutSP(t)
+	request, err := sp.MakeLogoutRequest(testSAMLIdP.SLOURL, "alice@example.com")
+	assert.NoError(t, err)
+	message, err := MarshalSAMLElement(request.Element())
+	assert.NoError(t, err)
+
+	parsed, signed, err := ValidateLogoutRequest(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice@example.com", parsed.NameID.Value)
+		assert.True(t, signed)
+	}
+	_, _, err = ValidateLogoutRequest(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now().Add(10*time.Minute))
+	assert.Error(t, err)
+
+	// Unsigned requests are rejected when the SP has certificates
+	request.Signature = nil
+	request.SessionIndex = &saml.SessionIndex{Value: "_index-1"}
+	message, _ = MarshalSAMLElement(request.Element())
+	_, _, err = ValidateLogoutRequest(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now())
+	assert.Error(t, err)
+	samlConfig.SPCertificates = nil
+	_, signed, err = ValidateLogoutRequest(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, signed)
+
+	// and must name a session index
+	request.SessionIndex = nil
+	message, _ = MarshalSAMLElement(request.Element())
+	_, _, err = ValidateLogoutRequest(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now())
+	assert.Error(t, err)
+	request.SessionIndex = &saml.SessionIndex{Value: "_index-1"}
+
+	request.Destination = "https://other.example.com/slo"
+	message, _ = MarshalSAMLElement(request.Element())
+	_, _, err = ValidateLogoutRequest(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now())
+	assert.Error(t, err)
+	request.Destination = testSAMLIdP.SLOURL
+	request.NameID = nil
+	message, _ = MarshalSAMLElement(request.Element())
+	_, _, err = ValidateLogoutRequest(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now())
+	assert.Error(t, err)
+}
+
+func TestValidateLogoutResponse(t *testing.T) {
+	sp, samlConfig, _ := testLogoutSP(t)
+	response, err := sp.MakeLogoutResponse(testSAMLIdP.SLOURL, "_request-1")
+	assert.NoError(t, err)
+	message, err := MarshalSAMLElement(response.Element())
+	assert.NoError(t, err)
+
+	parsed, err := ValidateLogoutResponse(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "_request-1", parsed.InResponseTo)
+	}
+
+	// Responses from another SP are rejected
+	other, _, _ := testLogoutSP(t)
+	response, _ = other.MakeLogoutResponse(testSAMLIdP.SLOURL, "_request-1")
+	message, _ = MarshalSAMLElement(response.Element())
+	_, err = ValidateLogoutResponse(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now())
+	assert.Error(t, err)
+}
+
+func TestSAMLLogoutMessagesPOST(t *testing.T) {
+	sp, samlConfig, _ := testLogoutSP(t)
+	signer, err := NewSAMLSigner(samlConfig.Certificate, samlConfig.PrivateKey)
+	assert.NoError(t, err)
+
+	for _, partial := range []bool{false, true} {
+		response := BuildSAMLLogoutResponse(testSAMLIdP, sp.SloURL.String(), "id-1", partial)
+		signed, err := signer.SignEnveloped(response.Element())
+		assert.NoError(t, err)
+		data, err := MarshalSAMLElement(signed)
+		assert.NoError(t, err)
+		assert.NoError(t, sp.ValidateLogoutResponseForm(base64.StdEncoding.EncodeToString(data)))
+		assert.Equal(t, partial, bytes.Contains(data, []byte(saml.StatusPartialLogout)))
+
+		tampered := bytes.Replace(data, []byte("id-1"), []byte("id-2"), 1)
+		assert.Error(t, sp.ValidateLogoutResponseForm(base64.StdEncoding.EncodeToString(tampered)))
+	}
+}
+
+func TestSAMLSignerRedirectURL(t *testing.T) {
+	_, samlConfig, cert := testLogoutSP(t)
+	signer, err := NewSAMLSigner(samlConfig.Certificate, samlConfig.PrivateKey)
+	assert.NoError(t, err)
+	participant := &models.SAMLSessionParticipant{NameID: "alice@example.com", SessionIndex: "_index-1"}
+	request := BuildSAMLLogoutRequest(testSAMLIdP, "https://sp.example.com/saml/slo?tenant=1", participant)
+
+	redirectURL, err := signer.RedirectURL(request.Destination, "SAMLRequest", request.Element(), "state-1")
+	assert.NoError(t, err)
+	parsed, err := url.Parse(redirectURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "1", parsed.Query().Get("tenant"))
+	assert.Equal(t, "state-1", parsed.Query().Get("RelayState"))
+
+	signed, err := VerifySAMLRedirectSignature(parsed.RawQuery, "SAMLRequest", []*x509.Certificate{cert})
+	assert.True(t, signed)
+	assert.NoError(t, err)
+
+	// The message is DEFLATE compressed
+	compressed, err := base64.StdEncoding.DecodeString(parsed.Query().Get("SAMLRequest"))
+	assert.NoError(t, err)
+	message, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	assert.NoError(t, err)
+	assert.Contains(t, string(message), "_index-1")
+	assert.Contains(t, string(message), "alice@example.com")
+}
@@ -0,0 +1,391 @@
+package sso
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/models"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// samlSignatureHashes are the SigAlg values accepted with the Redirect binding
+var samlSignatureHashes = map[string]crypto.Hash{
+	dsig.RSASHA1SignatureMethod:   crypto.SHA1,
+	dsig.RSASHA256SignatureMethod: crypto.SHA256,
+	dsig.RSASHA384SignatureMethod: crypto.SHA384,
+	dsig.RSASHA512SignatureMethod: crypto.SHA512,
+}
+
+// SAMLSPMetadata is what an SP's metadata says about it
+type SAMLSPMetadata struct {
+	EntityID            string
+	ACSEndpoints        models.SAMLEndpoints
+	SLOURL              string
+	SLOBinding          string
+	Certificates        []string // signing certificates, PEM
+	NameIDFormats       []string
+	AuthnRequestsSigned bool
+	// The first encryption certificate and the first supported encryption
+	// method it lists
+	EncryptionCertificate string
+	EncryptionMethod      string
+}
+
+// ParseSAMLSPMetadata reads an SP from an EntityDescriptor, or from an
+// EntitiesDescriptor that describes exactly one SP
+func ParseSAMLSPMetadata(data []byte) (*SAMLSPMetadata, error) {
+	if err := xrv.Validate(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("invalid metadata XML: %w", err)
+	}
+	entities, err := samlEntities(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var entity *saml.EntityDescriptor
+	for i := range entities {
+		if len(entities[i].SPSSODescriptors) == 0 {
+			continue
+		}
+		if entity != nil {
+			return nil, errors.New("metadata describes more than one SP")
+		}
+		entity = &entities[i]
+	}
+	if entity == nil {
+		return nil, errors.New("metadata has no SPSSODescriptor")
+	}
+	if entity.EntityID == "" {
+		return nil, errors.New("metadata has no entityID")
+	}
+
+	descriptor := entity.SPSSODescriptors[0]
+	metadata := &SAMLSPMetadata{
+		EntityID:            entity.EntityID,
+		AuthnRequestsSigned: descriptor.AuthnRequestsSigned != nil && *descriptor.AuthnRequestsSigned,
+	}
+	for _, acs := range descriptor.AssertionConsumerServices {
+		metadata.ACSEndpoints = append(metadata.ACSEndpoints, models.SAMLEndpoint{
+			Binding:   acs.Binding,
+			Location:  acs.Location,
+			Index:     acs.Index,
+			IsDefault: acs.IsDefault != nil && *acs.IsDefault,
+		})
+	}
+	for _, slo := range descriptor.SingleLogoutServices {
+		if slo.Binding == saml.HTTPRedirectBinding || slo.Binding == saml.HTTPPostBinding {
+			metadata.SLOURL = slo.Location
+			metadata.SLOBinding = slo.Binding
+			break
+		}
+	}
+	for _, keyDescriptor := range descriptor.KeyDescriptors {
+		for _, cert := range keyDescriptor.KeyInfo.X509Data.X509Certificates {
+			certPEM, err := metadataCertificatePEM(cert.Data)
+			if err != nil {
+				return nil, err
+			}
+			// A key without a use is for both signing and encryption
+			if keyDescriptor.Use != "encryption" {
+				metadata.Certificates = append(metadata.Certificates, certPEM)
+			}
+			if keyDescriptor.Use != "signing" && metadata.EncryptionCertificate == "" {
+				metadata.EncryptionCertificate = certPEM
+				for _, method := range keyDescriptor.EncryptionMethods {
+					if metadata.EncryptionMethod = samlEncryptionMethod(method.Algorithm); metadata.EncryptionMethod != "" {
+						break
+					}
+				}
+			}
+		}
+	}
+	for _, format := range descriptor.NameIDFormats {
+		metadata.NameIDFormats = append(metadata.NameIDFormats, strings.TrimSpace(string(format)))
+	}
+	return metadata, nil
+}
+
+func samlEntities(data []byte) ([]saml.EntityDescriptor, error) {
+	var entity saml.EntityDescriptor
+	if err := xml.Unmarshal(data, &entity); err == nil {
+		return []saml.EntityDescriptor{entity}, nil
+	}
+	var entities saml.EntitiesDescriptor
+	if err := xml.Unmarshal(data, &entities); err != nil {
+		return nil, errors.New("metadata is neither an EntityDescriptor nor an EntitiesDescriptor")
+	}
+	var flatten func(*saml.EntitiesDescriptor) []saml.EntityDescriptor
+	flatten = func(group *saml.EntitiesDescriptor) []saml.EntityDescriptor {
+		result := group.EntityDescriptors
+		for i := range group.EntitiesDescriptors {
+			result = append(result, flatten(&group.EntitiesDescriptors[i])...)
+		}
+		return result
+	}
+	return flatten(&entities), nil
+}
+
+// metadataCertificatePEM converts the base64 DER of an X509Certificate
+// element to PEM
+func metadataCertificatePEM(data string) (string, error) {
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+	if err != nil {
+		return "", fmt.Errorf("invalid certificate in metadata: %w", err)
+	}
+	if _, err := x509.ParseCertificate(der); err != nil {
+		return "", fmt.Errorf("invalid certificate in metadata: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+// DefaultACSURL returns the location of the default HTTP-POST endpoint: the
+// one marked isDefault, else the first
+func DefaultACSURL(endpoints models.SAMLEndpoints) string {
+	location := ""
+	for _, endpoint := range endpoints {
+		if endpoint.Binding != saml.HTTPPostBinding {
+			continue
+		}
+		if endpoint.IsDefault {
+			return endpoint.Location
+		}
+		if location == "" {
+			location = endpoint.Location
+		}
+	}
+	return location
+}
+
+// ParseSAMLCertificates parses the PEM signing certificates of an SP
+func ParseSAMLCertificates(certPEMs []string) ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, 0, len(certPEMs))
+	for _, certPEM := range certPEMs {
+		cert, err := ParseCertificate(certPEM)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// VerifySAMLRedirectSignature checks the signature of a message sent with
+// the HTTP-Redirect binding, computed over the raw query parameters param
+// (SAMLRequest or SAMLResponse), RelayState and SigAlg. Some SPs sign the
+// whole query string before the Signature instead, which is accepted too.
+// It reports whether the message was signed.
+func VerifySAMLRedirectSignature(rawQuery, param string, certs []*x509.Certificate) (bool, error) {
+	raw := map[string]string{}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		key, value, _ := strings.Cut(pair, "=")
+		if _, ok := raw[key]; !ok {
+			raw[key] = value
+		}
+	}
+	if raw["Signature"] == "" {
+		return false, nil
+	}
+
+	signed := param + "=" + raw[param]
+	if relayState, ok := raw["RelayState"]; ok {
+		signed += "&RelayState=" + relayState
+	}
+	signed += "&SigAlg=" + raw["SigAlg"]
+
+	sigAlg, err := url.QueryUnescape(raw["SigAlg"])
+	if err != nil {
+		return true, errors.New("invalid SigAlg")
+	}
+	hash, ok := samlSignatureHashes[sigAlg]
+	if !ok {
+		return true, fmt.Errorf("unsupported SigAlg %q", sigAlg)
+	}
+	encoded, err := url.QueryUnescape(raw["Signature"])
+	if err != nil {
+		return true, errors.New("invalid Signature")
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return true, errors.New("invalid Signature")
+	}
+
+	candidates := []string{signed}
+	if i := strings.Index(rawQuery, "&Signature="); i > 0 && rawQuery[:i] != signed &&
+		strings.Contains("&"+rawQuery[:i], "&"+param+"=") {
+		candidates = append(candidates, rawQuery[:i])
+	}
+	for _, candidate := range candidates {
+		h := hash.New()
+		h.Write([]byte(candidate))
+		digest := h.Sum(nil)
+		for _, cert := range certs {
+			pub, ok := cert.PublicKey.(*rsa.PublicKey)
+			if ok && rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil {
+				return true, nil
+			}
+		}
+	}
+	return true, errors.New("signature does not match any SP signing certificate")
+}
+
+// VerifySAMLXMLSignature checks the enveloped signature of el against the SP
+// signing certificates and returns the signed content
+func VerifySAMLXMLSignature(el *etree.Element, certs []*x509.Certificate) (*etree.Element, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("no SP signing certificate is configured")
+	}
+	var lastErr error
+	for _, cert := range certs {
+		ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+			Roots: []*x509.Certificate{cert},
+		})
+		ctx.IdAttribute = "ID"
+		verified, err := ctx.Validate(el)
+		if err == nil {
+			return verified, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("invalid signature: %w", lastErr)
+}
+
+// ReadSAMLMessage parses a SAML protocol message received with binding and
+// verifies its signature, if any. param names the query parameter that
+// carried it with the Redirect binding. It returns the signed content of
+// signed messages and reports whether the message was signed.
+func ReadSAMLMessage(binding, param, rawQuery string, message []byte, certs []*x509.Certificate) (*etree.Element, bool, error) {
+	if err := xrv.Validate(bytes.NewReader(message)); err != nil {
+		return nil, false, fmt.Errorf("invalid XML: %w", err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(message); err != nil {
+		return nil, false, fmt.Errorf("invalid XML: %w", err)
+	}
+	root := doc.Root()
+	if root == nil {
+		return nil, false, errors.New("empty message")
+	}
+
+	switch binding {
+	case saml.HTTPRedirectBinding:
+		signed, err := VerifySAMLRedirectSignature(rawQuery, param, certs)
+		if err != nil {
+			return nil, signed, err
+		}
+		return root, signed, nil
+	case saml.HTTPPostBinding:
+		if root.FindElement("./Signature") == nil {
+			return root, false, nil
+		}
+		verified, err := VerifySAMLXMLSignature(root, certs)
+		if err != nil {
+			return nil, true, err
+		}
+		return verified, true, nil
+	}
+	return nil, false, fmt.Errorf("unsupported binding %q", binding)
+}
+
+// unmarshalSAMLElement decodes el into v with encoding/xml
+func unmarshalSAMLElement(el *etree.Element, v interface{}) error {
+	data, err := MarshalSAMLElement(el.Copy())
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, v)
+}
+
+// ValidateAuthnRequest checks an AuthnRequest received with binding against
+// the application's SP settings: its signature, issuer, destination and age.
+// It returns the request and the ACS URL to post the response to.
+func ValidateAuthnRequest(idp *SAMLIdP, samlConfig *models.SAMLConfig, binding, rawQuery string, message []byte, now time.Time) (*saml.AuthnRequest, string, error) {
+	el, signed, err := readSPMessage(samlConfig, binding, "SAMLRequest", rawQuery, message)
+	if err != nil {
+		return nil, "", err
+	}
+	if !signed && samlConfig.AuthnRequestsSigned {
+		return nil, "", errors.New("AuthnRequest must be signed")
+	}
+
+	var request saml.AuthnRequest
+	if err := unmarshalSAMLElement(el, &request); err != nil {
+		return nil, "", fmt.Errorf("invalid AuthnRequest: %w", err)
+	}
+	if request.Version != "2.0" {
+		return nil, "", fmt.Errorf("unsupported SAML version %q", request.Version)
+	}
+	if request.Issuer == nil || request.Issuer.Value != samlConfig.EntityID {
+		return nil, "", errors.New("AuthnRequest is not issued by the application's SP")
+	}
+	// Signed requests must name the endpoint they were sent to (SAML bindings 3.4.5.2)
+	if (signed || request.Destination != "") && request.Destination != idp.SSOURL {
+		return nil, "", fmt.Errorf("AuthnRequest destination is not %s", idp.SSOURL)
+	}
+	if !samlIssuedRecently(request.IssueInstant, now) {
+		return nil, "", errors.New("AuthnRequest is expired")
+	}
+	if request.ProtocolBinding != "" && request.ProtocolBinding != saml.HTTPPostBinding {
+		return nil, "", fmt.Errorf("unsupported response binding %q", request.ProtocolBinding)
+	}
+
+	acsURL, err := resolveACSURL(samlConfig, &request)
+	if err != nil {
+		return nil, "", err
+	}
+	return &request, acsURL, nil
+}
+
+// readSPMessage reads a message from the application's SP and verifies its
+// signature with the SP signing certificates
+func readSPMessage(samlConfig *models.SAMLConfig, binding, param, rawQuery string, message []byte) (*etree.Element, bool, error) {
+	certs, err := ParseSAMLCertificates(samlConfig.SPCertificates)
+	if err != nil {
+		return nil, false, err
+	}
+	return ReadSAMLMessage(binding, param, rawQuery, message, certs)
+}
+
+// samlIssuedRecently reports whether a message issued at issueInstant is
+// still fresh
+func samlIssuedRecently(issueInstant, now time.Time) bool {
+	return now.Sub(issueInstant) <= saml.MaxIssueDelay && !issueInstant.After(now.Add(saml.MaxClockSkew))
+}
+
+// resolveACSURL picks the HTTP-POST ACS endpoint the request asks for, by
+// index or by URL, or the default one
+func resolveACSURL(samlConfig *models.SAMLConfig, request *saml.AuthnRequest) (string, error) {
+	if request.AssertionConsumerServiceIndex == "" && request.AssertionConsumerServiceURL == "" {
+		return samlConfig.SSOURL, nil
+	}
+	endpoints := samlConfig.ACSEndpoints
+	if len(endpoints) == 0 {
+		endpoints = models.SAMLEndpoints{{Binding: saml.HTTPPostBinding, Location: samlConfig.SSOURL}}
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Binding != saml.HTTPPostBinding {
+			continue
+		}
+		if request.AssertionConsumerServiceIndex != "" {
+			if strconv.Itoa(endpoint.Index) == request.AssertionConsumerServiceIndex {
+				return endpoint.Location, nil
+			}
+		} else if endpoint.Location == request.AssertionConsumerServiceURL {
+			return endpoint.Location, nil
+		}
+	}
+	return "", errors.New("AssertionConsumerService is not registered for the SP")
+}
@@ -0,0 +1,208 @@
+package sso
+
+import (
+	"encoding/xml"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/models"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSigningSP is a crewjam SP that signs its AuthnRequests, and the SAML
+// settings imported from its metadata
+func testSigningSP(t *testing.T) (*saml.ServiceProvider, *models.SAMLConfig) {
+	certPEM, keyPEM := testSAMLKeyPair(t)
+	cert, err := ParseCertificate(certPEM)
+	assert.NoError(t, err)
+	key, err := ParsePrivateKey(keyPEM)
+	assert.NoError(t, err)
+	acsURL, _ := url.Parse("https://sp.example.com/saml/acs")
+	sloURL, _ := url.Parse("https://sp.example.com/saml/slo")
+	sp := &saml.ServiceProvider{
+		EntityID:        "https://sp.example.com/saml/metadata",
+		Key:             key,
+		Certificate:     cert,
+		AcsURL:          *acsURL,
+		SloURL:          *sloURL,
+		LogoutBindings:  []string{saml.HTTPRedirectBinding},
+		SignatureMethod: dsig.RSASHA256SignatureMethod,
+	}
+
+	data, err := xml.Marshal(sp.Metadata())
+	assert.NoError(t, err)
+	metadata, err := ParseSAMLSPMetadata(data)
+	assert.NoError(t, err)
+	return sp, &models.SAMLConfig{
+		EntityID:            metadata.EntityID,
+		SSOURL:              DefaultACSURL(metadata.ACSEndpoints),
+		SLOURL:              metadata.SLOURL,
+		ACSEndpoints:        metadata.ACSEndpoints,
+		SPCertificates:      metadata.Certificates,
+		NameIDFormats:       metadata.NameIDFormats,
+		AuthnRequestsSigned: metadata.AuthnRequestsSigned,
+		// Encryption is off until a test turns it on
+		EncryptionCertificate: metadata.EncryptionCertificate,
+		EncryptionMethod:      metadata.EncryptionMethod,
+	}
+}
+
+func TestParseSAMLSPMetadata(t *testing.T) {
+	sp, samlConfig := testSigningSP(t)
+	assert.Equal(t, "https://sp.example.com/saml/metadata", samlConfig.EntityID)
+	assert.Equal(t, "https://sp.example.com/saml/acs", samlConfig.SSOURL)
+	assert.Equal(t, "https://sp.example.com/saml/slo", samlConfig.SLOURL)
+	assert.Len(t, samlConfig.ACSEndpoints, 2)
+	assert.Equal(t, saml.HTTPArtifactBinding, samlConfig.ACSEndpoints[1].Binding)
+	assert.True(t, samlConfig.AuthnRequestsSigned)
+	// Only the signing key descriptor is used
+	assert.Len(t, samlConfig.SPCertificates, 1)
+	// The encryption key descriptor lists the CBC ciphers
+	assert.Equal(t, samlConfig.SPCertificates[0], samlConfig.EncryptionCertificate)
+	assert.Equal(t, SAMLEncryptAES128CBC, samlConfig.EncryptionMethod)
+
+	// An EntitiesDescriptor with one SP
+	entities := saml.EntitiesDescriptor{EntityDescriptors: []saml.EntityDescriptor{*sp.Metadata()}}
+	data, err := xml.Marshal(entities)
+	assert.NoError(t, err)
+	metadata, err := ParseSAMLSPMetadata(data)
+	if assert.NoError(t, err) {
+		assert.Equal(t, samlConfig.EntityID, metadata.EntityID)
+	}
+
+	_, err = ParseSAMLSPMetadata([]byte("<EntityDescriptor/>"))
+	assert.Error(t, err)
+	idpMetadata, _ := BuildSAMLMetadata(testSAMLIdP.EntityID, testSAMLIdP.SSOURL, "", nil)
+	data, _ = xml.Marshal(idpMetadata)
+	_, err = ParseSAMLSPMetadata(data)
+	assert.Error(t, err)
+}
+
+func TestValidateAuthnRequestPOST(t *testing.T) {
+	sp, samlConfig := testSigningSP(t)
+	request, err := sp.MakeAuthenticationRequest(testSAMLIdP.SSOURL, saml.HTTPPostBinding, saml.HTTPPostBinding)
+	assert.NoError(t, err)
+	message, err := MarshalSAMLElement(request.Element())
+	assert.NoError(t, err)
+
+	parsed, acsURL, err := ValidateAuthnRequest(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now())
+	if assert.NoError(t, err) {
+		assert.Equal(t, request.ID, parsed.ID)
+		assert.Equal(t, "https://sp.example.com/saml/acs", acsURL)
+	}
+
+	// The signature covers the ACS URL
+	tampered := strings.Replace(string(message), "https://sp.example.com/saml/acs", "https://evil.example.com/acs", 1)
+	_, _, err = ValidateAuthnRequest(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", []byte(tampered), time.Now())
+	assert.Error(t, err)
+
+	// Another SP key is not trusted
+	other, _ := testSigningSP(t)
+	request, _ = other.MakeAuthenticationRequest(testSAMLIdP.SSOURL, saml.HTTPPostBinding, saml.HTTPPostBinding)
+	message, _ = MarshalSAMLElement(request.Element())
+	_, _, err = ValidateAuthnRequest(testSAMLIdP, samlConfig, saml.HTTPPostBinding, "", message, time.Now())
+	assert.Error(t, err)
+}
+
+func TestValidateAuthnRequestRedirect(t *testing.T) {
+	sp, samlConfig := testSigningSP(t)
+	request, err := sp.MakeAuthenticationRequest(testSAMLIdP.SSOURL, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	assert.NoError(t, err)
+	assert.Nil(t, request.Signature)
+	message, err := MarshalSAMLElement(request.Element())
+	assert.NoError(t, err)
+	redirectURL, err := request.Redirect("state-1", sp)
+	assert.NoError(t, err)
+
+	_, acsURL, err := ValidateAuthnRequest(testSAMLIdP, samlConfig, saml.HTTPRedirectBinding, redirectURL.RawQuery, message, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp.example.com/saml/acs", acsURL)
+
+	// Changing the RelayState breaks the signature
+	tampered := strings.Replace(redirectURL.RawQuery, "RelayState=state-1", "RelayState=state-2", 1)
+	_, _, err = ValidateAuthnRequest(testSAMLIdP, samlConfig, saml.HTTPRedirectBinding, tampered, message, time.Now())
+	assert.Error(t, err)
+
+	// Unsigned requests are rejected when the SP signs its requests
+	unsigned := redirectURL.Query()
+	unsigned.Del("Signature")
+	unsigned.Del("SigAlg")
+	_, _, err = ValidateAuthnRequest(testSAMLIdP, samlConfig, saml.HTTPRedirectBinding, unsigned.Encode(), message, time.Now())
+	assert.Error(t, err)
+	samlConfig.AuthnRequestsSigned = false
+	_, _, err = ValidateAuthnRequest(testSAMLIdP, samlConfig, saml.HTTPRedirectBinding, unsigned.Encode(), message, time.Now())
+	assert.NoError(t, err)
+}
+
+func TestValidateAuthnRequestChecks(t *testing.T) {
+	sp, samlConfig := testSigningSP(t)
+	samlConfig.AuthnRequestsSigned = false
+	validate := func(mutate func(*saml.AuthnRequest), now time.Time) (string, error) {
+		request, err := sp.MakeAuthenticationRequest(testSAMLIdP.SSOURL, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+		assert.NoError(t, err)
+		mutate(request)
+		message, err := MarshalSAMLElement(request.Element())
+		assert.NoError(t, err)
+		_, acsURL, err := ValidateAuthnRequest(testSAMLIdP, samlConfig, saml.HTTPRedirectBinding, "", message, now)
+		return acsURL, err
+	}
+
+	acsURL, err := validate(func(r *saml.AuthnRequest) { r.AssertionConsumerServiceURL = "" }, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, samlConfig.SSOURL, acsURL)
+
+	acsURL, err = validate(func(r *saml.AuthnRequest) {
+		r.AssertionConsumerServiceURL = ""
+		r.AssertionConsumerServiceIndex = "1"
+	}, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp.example.com/saml/acs", acsURL)
+
+	// The artifact endpoint cannot receive POSTed responses
+	_, err = validate(func(r *saml.AuthnRequest) {
+		r.AssertionConsumerServiceURL = ""
+		r.AssertionConsumerServiceIndex = "2"
+	}, time.Now())
+	assert.Error(t, err)
+
+	_, err = validate(func(r *saml.AuthnRequest) { r.AssertionConsumerServiceURL = "https://evil.example.com/acs" }, time.Now())
+	assert.Error(t, err)
+	_, err = validate(func(r *saml.AuthnRequest) { r.Issuer.Value = "https://other.example.com" }, time.Now())
+	assert.Error(t, err)
+	_, err = validate(func(r *saml.AuthnRequest) { r.Destination = "https://other.example.com/sso" }, time.Now())
+	assert.Error(t, err)
+	_, err = validate(func(r *saml.AuthnRequest) {}, time.Now().Add(10*time.Minute))
+	assert.Error(t, err)
+}
+
+func TestVerifySAMLRedirectSignature(t *testing.T) {
+	sp, samlConfig := testSigningSP(t)
+	certs, err := ParseSAMLCertificates(samlConfig.SPCertificates)
+	assert.NoError(t, err)
+
+	signed, err := VerifySAMLRedirectSignature("SAMLRequest=abc&RelayState=x", "SAMLRequest", certs)
+	assert.False(t, signed)
+	assert.NoError(t, err)
+
+	request, _ := sp.MakeAuthenticationRequest(testSAMLIdP.SSOURL, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	redirectURL, err := request.Redirect("", sp)
+	assert.NoError(t, err)
+	signed, err = VerifySAMLRedirectSignature(redirectURL.RawQuery, "SAMLRequest", certs)
+	assert.True(t, signed)
+	assert.NoError(t, err)
+
+	sp.SignatureMethod = dsig.RSASHA512SignatureMethod
+	redirectURL, _ = request.Redirect("", sp)
+	signed, err = VerifySAMLRedirectSignature(redirectURL.RawQuery, "SAMLRequest", certs)
+	assert.True(t, signed)
+	assert.NoError(t, err)
+
+	// Unsupported algorithms are rejected
+	tampered := strings.Replace(redirectURL.RawQuery, url.QueryEscape(dsig.RSASHA512SignatureMethod), "unknown", 1)
+	_, err = VerifySAMLRedirectSignature(tampered, "SAMLRequest", certs)
+	assert.Error(t, err)
+}
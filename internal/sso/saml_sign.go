@@ -0,0 +1,187 @@
+package sso
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// SAML signature targets: which parts of a response an application signs
+const (
+	SAMLSignAssertion = "assertion"
+	SAMLSignResponse  = "response"
+	SAMLSignBoth      = "both"
+)
+
+// ValidSAMLSignatureTarget reports whether target is a known signature
+// target. Empty selects the default, the assertion.
+func ValidSAMLSignatureTarget(target string) bool {
+	switch target {
+	case "", SAMLSignAssertion, SAMLSignResponse, SAMLSignBoth:
+		return true
+	}
+	return false
+}
+
+// SAMLSigner signs SAML messages with an application's key pair
+type SAMLSigner struct {
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// NewSAMLSigner parses a PEM certificate and the matching RSA private key
+func NewSAMLSigner(certPEM, keyPEM string) (*SAMLSigner, error) {
+	cert, err := ParseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || pub.N.Cmp(key.N) != 0 || pub.E != key.E {
+		return nil, errors.New("private key does not match the certificate")
+	}
+	return &SAMLSigner{Key: key, Certificate: cert}, nil
+}
+
+// Sign returns an enveloped XML signature of el, which must carry an ID
+// attribute. It uses RSA-SHA256 over exclusive C14N and embeds the
+// certificate in KeyInfo.
+func (s *SAMLSigner) Sign(el *etree.Element) (*etree.Element, error) {
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(tls.Certificate{
+		Certificate: [][]byte{s.Certificate.Raw},
+		PrivateKey:  s.Key,
+		Leaf:        s.Certificate,
+	}))
+	// Some SPs mishandle inclusive namespace prefix lists, so use none
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	if err := ctx.SetSignatureMethod(dsig.RSASHA256SignatureMethod); err != nil {
+		return nil, err
+	}
+	signed, err := ctx.SignEnveloped(el)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign %s: %w", el.Tag, err)
+	}
+	children := signed.ChildElements()
+	return children[len(children)-1], nil
+}
+
+// SignResponse signs the assertion, the response or both as selected by
+// target and returns the response element. Signatures are placed after the
+// Issuer as the SAML schema requires. With an encrypter the signed assertion
+// is sent as an EncryptedAssertion, which the response signature covers.
+func (s *SAMLSigner) SignResponse(response *saml.Response, target string, encrypter *SAMLEncrypter) (*etree.Element, error) {
+	if target == "" {
+		target = SAMLSignAssertion
+	}
+	if !ValidSAMLSignatureTarget(target) {
+		return nil, fmt.Errorf("unknown signature target %q", target)
+	}
+
+	if response.Assertion != nil && (target == SAMLSignAssertion || target == SAMLSignBoth) {
+		signature, err := s.Sign(response.Assertion.Element())
+		if err != nil {
+			return nil, err
+		}
+		response.Assertion.Signature = signature
+	}
+
+	// The assertion stays in response for the caller
+	out := *response
+	if encrypter != nil && response.Assertion != nil {
+		encrypted, err := encrypter.Encrypt(response.Assertion.Element())
+		if err != nil {
+			return nil, err
+		}
+		out.Assertion = nil
+		out.EncryptedAssertion = encrypted
+	}
+
+	responseEl := out.Element()
+	if target == SAMLSignResponse || target == SAMLSignBoth {
+		signature, err := s.Sign(responseEl)
+		if err != nil {
+			return nil, err
+		}
+		response.Signature = signature
+		out.Signature = signature
+		responseEl = out.Element()
+	}
+	return responseEl, nil
+}
+
+// SignEnveloped returns a copy of el with an enveloped signature placed
+// after its Issuer, as the SAML schema requires
+func (s *SAMLSigner) SignEnveloped(el *etree.Element) (*etree.Element, error) {
+	signature, err := s.Sign(el)
+	if err != nil {
+		return nil, err
+	}
+	signed := el.Copy()
+	index := 0
+	if issuer := signed.FindElement("./Issuer"); issuer != nil {
+		index = issuer.Index() + 1
+	}
+	signed.InsertChildAt(index, signature)
+	return signed, nil
+}
+
+// RedirectURL encodes el as query parameter param of destination for the
+// HTTP-Redirect binding (DEFLATE and base64) and signs the query with
+// RSA-SHA256 (SAML bindings 3.4.4.1)
+func (s *SAMLSigner) RedirectURL(destination, param string, el *etree.Element, relayState string) (string, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(el.Copy())
+	var compressed bytes.Buffer
+	writer, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := doc.WriteTo(writer); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	query := param + "=" + url.QueryEscape(base64.StdEncoding.EncodeToString(compressed.Bytes()))
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	query += "&SigAlg=" + url.QueryEscape(dsig.RSASHA256SignatureMethod)
+	digest := sha256.Sum256([]byte(query))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+
+	if strings.Contains(destination, "?") {
+		return destination + "&" + query, nil
+	}
+	return destination + "?" + query, nil
+}
+
+// MarshalSAMLElement serializes a signed element. The signed elements must
+// not be re-encoded with encoding/xml, which would break the signatures.
+func MarshalSAMLElement(el *etree.Element) ([]byte, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	return doc.WriteToBytes()
+}
@@ -0,0 +1,504 @@
+package sso
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/xmlenc"
+	"github.com/hanyouqing/openauth/internal/models"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// SAMLSP names the SP side of a connection to an external IdP: its entity
+// ID, which is also the URL of its metadata, and its ACS URL
+type SAMLSP struct {
+	EntityID string
+	ACSURL   string
+}
+
+// NewSAMLSP returns the SP of IdP connection providerID served at issuer
+func NewSAMLSP(issuer string, providerID uint64) *SAMLSP {
+	return &SAMLSP{
+		EntityID: fmt.Sprintf("%s/saml/sp/metadata?idp_id=%d", issuer, providerID),
+		ACSURL:   fmt.Sprintf("%s/saml/sp/acs?idp_id=%d", issuer, providerID),
+	}
+}
+
+// SAMLIdPMetadata is what an IdP's metadata says about it
+type SAMLIdPMetadata struct {
+	EntityID   string
+	SSOURL     string
+	SSOBinding string
+	// Signing certificates, PEM
+	Certificates            []string
+	NameIDFormats           []string
+	WantAuthnRequestsSigned bool
+}
+
+// ParseSAMLIdPMetadata reads an IdP from an EntityDescriptor, or from an
+// EntitiesDescriptor that describes exactly one IdP. The HTTP-Redirect SSO
+// endpoint is preferred over the HTTP-POST one.
+func ParseSAMLIdPMetadata(data []byte) (*SAMLIdPMetadata, error) {
+	if err := xrv.Validate(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("invalid metadata XML: %w", err)
+	}
+	entities, err := samlEntities(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var entity *saml.EntityDescriptor
+	for i := range entities {
+		if len(entities[i].IDPSSODescriptors) == 0 {
+			continue
+		}
+		if entity != nil {
+			return nil, errors.New("metadata describes more than one IdP")
+		}
+		entity = &entities[i]
+	}
+	if entity == nil {
+		return nil, errors.New("metadata has no IDPSSODescriptor")
+	}
+	if entity.EntityID == "" {
+		return nil, errors.New("metadata has no entityID")
+	}
+
+	descriptor := entity.IDPSSODescriptors[0]
+	metadata := &SAMLIdPMetadata{
+		EntityID:                entity.EntityID,
+		WantAuthnRequestsSigned: descriptor.WantAuthnRequestsSigned != nil && *descriptor.WantAuthnRequestsSigned,
+	}
+	for _, binding := range []string{saml.HTTPRedirectBinding, saml.HTTPPostBinding} {
+		for _, endpoint := range descriptor.SingleSignOnServices {
+			if endpoint.Binding == binding && metadata.SSOURL == "" {
+				metadata.SSOURL = endpoint.Location
+				metadata.SSOBinding = binding
+			}
+		}
+	}
+	if metadata.SSOURL == "" {
+		return nil, errors.New("metadata has no HTTP-Redirect or HTTP-POST SingleSignOnService")
+	}
+	for _, keyDescriptor := range descriptor.KeyDescriptors {
+		if keyDescriptor.Use == "encryption" {
+			continue
+		}
+		for _, cert := range keyDescriptor.KeyInfo.X509Data.X509Certificates {
+			certPEM, err := metadataCertificatePEM(cert.Data)
+			if err != nil {
+				return nil, err
+			}
+			metadata.Certificates = append(metadata.Certificates, certPEM)
+		}
+	}
+	if len(metadata.Certificates) == 0 {
+		return nil, errors.New("metadata has no signing certificate")
+	}
+	for _, format := range descriptor.NameIDFormats {
+		metadata.NameIDFormats = append(metadata.NameIDFormats, strings.TrimSpace(string(format)))
+	}
+	return metadata, nil
+}
+
+// NewSAMLServiceProvider returns the crewjam SP of a connection, which
+// makes AuthnRequests to the IdP and validates its responses. The SP key is
+// optional unless AuthnRequests are signed; without it encrypted assertions
+// cannot be read.
+func NewSAMLServiceProvider(sp *SAMLSP, provider *models.SAMLIdentityProvider) (*saml.ServiceProvider, error) {
+	certs, err := ParseSAMLCertificates(provider.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no IdP signing certificate is configured")
+	}
+	if provider.SSOBinding != "" && provider.SSOBinding != saml.HTTPRedirectBinding && provider.SSOBinding != saml.HTTPPostBinding {
+		return nil, fmt.Errorf("unsupported SSO binding %q", provider.SSOBinding)
+	}
+	format, ok := samlNameIDFormats[provider.NameIDFormat]
+	if !ok && provider.NameIDFormat != "" {
+		return nil, fmt.Errorf("unknown name_id_format %q", provider.NameIDFormat)
+	}
+	if provider.NameIDFormat == "" {
+		format = saml.UnspecifiedNameIDFormat
+	}
+	acsURL, err := url.Parse(sp.ACSURL)
+	if err != nil {
+		return nil, err
+	}
+	metadataURL, err := url.Parse(sp.EntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptor := saml.IDPSSODescriptor{
+		SingleSignOnServices: []saml.Endpoint{{Binding: samlSSOBinding(provider), Location: provider.SSOURL}},
+	}
+	for _, cert := range certs {
+		descriptor.KeyDescriptors = append(descriptor.KeyDescriptors, saml.KeyDescriptor{
+			Use: "signing",
+			KeyInfo: saml.KeyInfo{X509Data: saml.X509Data{X509Certificates: []saml.X509Certificate{
+				{Data: base64.StdEncoding.EncodeToString(cert.Raw)},
+			}}},
+		})
+	}
+	serviceProvider := &saml.ServiceProvider{
+		EntityID:          sp.EntityID,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		AuthnNameIDFormat: format,
+		AllowIDPInitiated: provider.AllowIDPInitiated,
+		IDPMetadata: &saml.EntityDescriptor{
+			EntityID:          provider.EntityID,
+			IDPSSODescriptors: []saml.IDPSSODescriptor{descriptor},
+		},
+	}
+	if provider.Certificate != "" || provider.PrivateKey != "" {
+		signer, err := NewSAMLSigner(provider.Certificate, provider.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		serviceProvider.Key = signer.Key
+		serviceProvider.Certificate = signer.Certificate
+	}
+	if provider.SignAuthnRequests {
+		if serviceProvider.Key == nil {
+			return nil, errors.New("signed AuthnRequests need an SP key pair")
+		}
+		serviceProvider.SignatureMethod = dsig.RSASHA256SignatureMethod
+	}
+	return serviceProvider, nil
+}
+
+// samlSSOBinding is the binding AuthnRequests are sent to the IdP with
+func samlSSOBinding(provider *models.SAMLIdentityProvider) string {
+	if provider.SSOBinding == "" {
+		return saml.HTTPRedirectBinding
+	}
+	return provider.SSOBinding
+}
+
+// BuildSAMLSPMetadata returns the metadata of a connection's SP: its ACS,
+// which takes responses with the HTTP-POST binding, and its certificate for
+// signing and encryption
+func BuildSAMLSPMetadata(sp *saml.ServiceProvider) *saml.EntityDescriptor {
+	metadata := sp.Metadata()
+	descriptor := &metadata.SPSSODescriptors[0]
+	// crewjam also lists an HTTP-Artifact ACS, which is not served
+	descriptor.AssertionConsumerServices = descriptor.AssertionConsumerServices[:1]
+	for i := range descriptor.KeyDescriptors {
+		if descriptor.KeyDescriptors[i].Use == "encryption" {
+			for _, method := range []string{SAMLEncryptAES128GCM, SAMLEncryptAES256GCM} {
+				descriptor.KeyDescriptors[i].EncryptionMethods = append(descriptor.KeyDescriptors[i].EncryptionMethods,
+					saml.EncryptionMethod{Algorithm: samlBlockCiphers[method].Algorithm()})
+			}
+		}
+	}
+	return metadata
+}
+
+// ValidateSAMLAssertion checks a Response posted by the connection's IdP:
+// the signature of the response or of its assertions, the issuer,
+// destination, status, InResponseTo, the conditions and the audience.
+// Encrypted assertions are decrypted with the SP key. requestID is the ID of
+// the AuthnRequest, or "" for an unsolicited response, which the connection
+// must allow.
+func ValidateSAMLAssertion(sp *saml.ServiceProvider, message []byte, requestID string) (*saml.Assertion, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(message); err != nil || doc.Root() == nil {
+		return nil, errors.New("invalid XML")
+	}
+	validator := *sp
+	var requestIDs []string
+	if requestID == "" {
+		if !sp.AllowIDPInitiated {
+			return nil, errors.New("unsolicited responses are not accepted from the IdP")
+		}
+		if doc.Root().SelectAttrValue("InResponseTo", "") != "" {
+			return nil, errors.New("response answers a request that was not made here")
+		}
+	} else {
+		validator.AllowIDPInitiated = false
+		requestIDs = []string{requestID}
+	}
+	if err := checkSAMLAssertionElements(sp, doc.Root()); err != nil {
+		return nil, err
+	}
+
+	assertion, err := validator.ParseXMLResponse(message, requestIDs, validator.AcsURL)
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) && invalid.PrivateErr != nil {
+			err = invalid.PrivateErr
+		}
+		return nil, err
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, errors.New("assertion has no NameID")
+	}
+	return assertion, nil
+}
+
+// checkSAMLAssertionElements makes sure each assertion of a response has the
+// Subject, SubjectConfirmationData and Conditions that crewjam reads without
+// checking they are present. Encrypted assertions are decrypted to look.
+func checkSAMLAssertionElements(sp *saml.ServiceProvider, response *etree.Element) error {
+	for _, el := range response.ChildElements() {
+		switch el.Tag {
+		case "Assertion":
+		case "EncryptedAssertion":
+			var err error
+			if el, err = decryptSAMLAssertion(sp, el); err != nil {
+				return fmt.Errorf("failed to decrypt EncryptedAssertion: %w", err)
+			}
+		default:
+			continue
+		}
+		var assertion saml.Assertion
+		if err := unmarshalSAMLElement(el, &assertion); err != nil {
+			return fmt.Errorf("invalid assertion: %w", err)
+		}
+		if assertion.Subject == nil {
+			return errors.New("assertion has no Subject")
+		}
+		for _, confirmation := range assertion.Subject.SubjectConfirmations {
+			if confirmation.SubjectConfirmationData == nil {
+				return errors.New("assertion SubjectConfirmation has no SubjectConfirmationData")
+			}
+		}
+		if assertion.Conditions == nil {
+			return errors.New("assertion has no Conditions")
+		}
+	}
+	return nil
+}
+
+// decryptSAMLAssertion decrypts an EncryptedAssertion with the SP key the
+// way crewjam does: the key is in an EncryptedKey next to the EncryptedData
+// or in its KeyInfo
+func decryptSAMLAssertion(sp *saml.ServiceProvider, encrypted *etree.Element) (*etree.Element, error) {
+	encryptedData := encrypted.FindElement("./EncryptedData")
+	if encryptedData == nil {
+		return nil, errors.New("no EncryptedData")
+	}
+	var key interface{} = sp.Key
+	if keyEl := encrypted.FindElement("./EncryptedKey"); keyEl != nil {
+		var err error
+		if key, err = xmlenc.Decrypt(sp.Key, keyEl); err != nil {
+			return nil, err
+		}
+	}
+	plaintext, err := xmlenc.Decrypt(key, encryptedData)
+	if err != nil {
+		return nil, err
+	}
+	if err := xrv.Validate(bytes.NewReader(plaintext)); err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(plaintext); err != nil || doc.Root() == nil {
+		return nil, errors.New("invalid XML")
+	}
+	return doc.Root(), nil
+}
+
+// SAMLProfile is what an IdP asserted about a user
+type SAMLProfile struct {
+	NameID       string
+	NameIDFormat string
+	SessionIndex string
+	// Values by attribute Name and FriendlyName
+	Attributes map[string][]string
+}
+
+// NewSAMLProfile reads the subject and attributes of a validated assertion
+func NewSAMLProfile(assertion *saml.Assertion) *SAMLProfile {
+	profile := &SAMLProfile{
+		NameID:       assertion.Subject.NameID.Value,
+		NameIDFormat: assertion.Subject.NameID.Format,
+		Attributes:   map[string][]string{},
+	}
+	for _, statement := range assertion.AuthnStatements {
+		if statement.SessionIndex != "" {
+			profile.SessionIndex = statement.SessionIndex
+			break
+		}
+	}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			var values []string
+			for _, value := range attribute.Values {
+				if v := strings.TrimSpace(value.Value); v != "" {
+					values = append(values, v)
+				}
+			}
+			profile.Attributes[attribute.Name] = append(profile.Attributes[attribute.Name], values...)
+			if attribute.FriendlyName != "" && attribute.FriendlyName != attribute.Name {
+				profile.Attributes[attribute.FriendlyName] = append(profile.Attributes[attribute.FriendlyName], values...)
+			}
+		}
+	}
+	return profile
+}
+
+// Value returns the first value of an attribute
+func (p *SAMLProfile) Value(name string) string {
+	if values := p.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// User fields that can be read from a profile. Custom user attributes are
+// named attribute:<key>.
+const (
+	SAMLUserUsername = "username"
+	SAMLUserEmail    = "email"
+	SAMLUserPhone    = "phone"
+)
+
+// samlUserAttributes are the attribute names a user field is read from when
+// the attribute map of the connection does not name one
+var samlUserAttributes = map[string][]string{
+	SAMLUserUsername: {"username", "uid", "urn:oid:0.9.2342.19200300.100.1.1"},
+	SAMLUserEmail: {"email", "mail", "urn:oid:0.9.2342.19200300.100.1.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"},
+	SAMLUserPhone: {"phone", "telephoneNumber", "urn:oid:2.5.4.20"},
+}
+
+// SAMLUserFields are the user fields read from a profile
+type SAMLUserFields struct {
+	Username   string
+	Email      string
+	Phone      string
+	Attributes map[string]interface{}
+}
+
+// ValidateSAMLUserAttributeMap checks the attribute map of a connection,
+// which maps user fields to SAML attribute names:
+//
+//	"email": "urn:oid:0.9.2342.19200300.100.1.3"
+//	"attribute:department": "department"
+func ValidateSAMLUserAttributeMap(attributeMap models.JSONB) error {
+	for field, value := range attributeMap {
+		if name, ok := value.(string); !ok || name == "" {
+			return fmt.Errorf("field %q must map to an attribute name", field)
+		}
+		if _, ok := samlUserAttributes[field]; ok {
+			continue
+		}
+		if key, ok := strings.CutPrefix(field, samlAttributeSourcePrefix); !ok || key == "" {
+			return fmt.Errorf("unknown user field %q", field)
+		}
+	}
+	return nil
+}
+
+// MapSAMLUser reads the user fields from a profile. The email falls back to
+// an emailAddress NameID, the username to the email and then the NameID.
+func MapSAMLUser(attributeMap models.JSONB, profile *SAMLProfile) *SAMLUserFields {
+	field := func(name string) string {
+		if attribute, ok := attributeMap[name].(string); ok {
+			return profile.Value(attribute)
+		}
+		for _, attribute := range samlUserAttributes[name] {
+			if value := profile.Value(attribute); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	fields := &SAMLUserFields{
+		Username:   field(SAMLUserUsername),
+		Email:      field(SAMLUserEmail),
+		Phone:      field(SAMLUserPhone),
+		Attributes: map[string]interface{}{},
+	}
+	if fields.Email == "" && profile.NameIDFormat == string(saml.EmailAddressNameIDFormat) {
+		fields.Email = profile.NameID
+	}
+	if fields.Username == "" {
+		fields.Username = fields.Email
+	}
+	if fields.Username == "" {
+		fields.Username = profile.NameID
+	}
+	for name, value := range attributeMap {
+		key, ok := strings.CutPrefix(name, samlAttributeSourcePrefix)
+		attribute, _ := value.(string)
+		if !ok || attribute == "" {
+			continue
+		}
+		switch values := profile.Attributes[attribute]; len(values) {
+		case 0:
+		case 1:
+			fields.Attributes[key] = values[0]
+		default:
+			list := make([]interface{}, len(values))
+			for i, v := range values {
+				list[i] = v
+			}
+			fields.Attributes[key] = list
+		}
+	}
+	return fields
+}
+
+// ValidateSAMLRoleMappings checks the role mappings of a connection
+func ValidateSAMLRoleMappings(mappings models.SAMLRoleMappings) error {
+	for _, mapping := range mappings {
+		if mapping.Attribute == "" {
+			return errors.New("role mappings need an attribute")
+		}
+		if len(mapping.Roles) == 0 && len(mapping.Groups) == 0 {
+			return fmt.Errorf("role mapping of %q grants no roles or groups", mapping.Attribute)
+		}
+	}
+	return nil
+}
+
+// MapSAMLRoles returns the roles and groups the mappings grant for a
+// profile, sorted
+func MapSAMLRoles(mappings models.SAMLRoleMappings, profile *SAMLProfile) ([]string, []string) {
+	var roles, groups []string
+	for _, mapping := range mappings {
+		values := profile.Attributes[mapping.Attribute]
+		if len(values) == 0 || (mapping.Value != "" && !containsString(values, mapping.Value)) {
+			continue
+		}
+		roles = appendMissing(roles, mapping.Roles...)
+		groups = appendMissing(groups, mapping.Groups...)
+	}
+	sort.Strings(roles)
+	sort.Strings(groups)
+	return roles, groups
+}
+
+// SAMLMappedRoles returns every role and group the mappings can grant
+func SAMLMappedRoles(mappings models.SAMLRoleMappings) ([]string, []string) {
+	var roles, groups []string
+	for _, mapping := range mappings {
+		roles = appendMissing(roles, mapping.Roles...)
+		groups = appendMissing(groups, mapping.Groups...)
+	}
+	return roles, groups
+}
+
+func appendMissing(list []string, values ...string) []string {
+	for _, value := range values {
+		if !containsString(list, value) {
+			list = append(list, value)
+		}
+	}
+	return list
+}
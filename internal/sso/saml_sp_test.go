@@ -0,0 +1,249 @@
+package sso
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSAMLSP = NewSAMLSP("https://auth.example.com", 3)
+
+// testFederation connects the SP of a connection to the IdP of the test
+// application: it returns the connection and the application the IdP
+// answers with
+func testFederation(t *testing.T) (*models.SAMLIdentityProvider, *models.SAMLConfig) {
+	idpCert, idpKey := testSAMLKeyPair(t)
+	spCert, spKey := testSAMLKeyPair(t)
+	cert, err := ParseCertificate(idpCert)
+	assert.NoError(t, err)
+	idpMetadata, err := BuildSAMLMetadata(testSAMLIdP.EntityID, testSAMLIdP.SSOURL, testSAMLIdP.SLOURL, cert)
+	assert.NoError(t, err)
+	data, err := xml.Marshal(idpMetadata)
+	assert.NoError(t, err)
+	metadata, err := ParseSAMLIdPMetadata(data)
+	assert.NoError(t, err)
+
+	provider := &models.SAMLIdentityProvider{
+		ID:           3,
+		EntityID:     metadata.EntityID,
+		SSOURL:       metadata.SSOURL,
+		SSOBinding:   metadata.SSOBinding,
+		Certificates: metadata.Certificates,
+		Certificate:  spCert,
+		PrivateKey:   spKey,
+	}
+	return provider, &models.SAMLConfig{
+		EntityID:              testSAMLSP.EntityID,
+		SSOURL:                testSAMLSP.ACSURL,
+		Certificate:           idpCert,
+		PrivateKey:            idpKey,
+		EncryptionCertificate: spCert,
+		AttributeMap: models.JSONB{
+			"mail":     "email",
+			"memberOf": map[string]interface{}{"source": "groups", "friendly_name": "groups"},
+		},
+	}
+}
+
+func testFederatedResponse(t *testing.T, samlConfig *models.SAMLConfig, inResponseTo string) []byte {
+	src := &ClaimSource{
+		User:   &models.User{ID: 7, Username: "alice", Email: "alice@example.com"},
+		Groups: []string{"staff", "oncall"},
+	}
+	response, err := BuildSAMLResponse(testSAMLIdP, samlConfig, src, SAMLResponseOptions{InResponseTo: inResponseTo, ACSURL: samlConfig.SSOURL})
+	assert.NoError(t, err)
+	signed, err := SignSAMLResponse(samlConfig, response)
+	assert.NoError(t, err)
+	return signed
+}
+
+func TestParseSAMLIdPMetadata(t *testing.T) {
+	provider, _ := testFederation(t)
+	assert.Equal(t, testSAMLIdP.EntityID, provider.EntityID)
+	assert.Equal(t, testSAMLIdP.SSOURL, provider.SSOURL)
+	assert.Equal(t, saml.HTTPRedirectBinding, provider.SSOBinding)
+	assert.Len(t, provider.Certificates, 1)
+
+	// SP metadata does not describe an IdP
+	sp, _ := testSigningSP(t)
+	data, _ := xml.Marshal(sp.Metadata())
+	_, err := ParseSAMLIdPMetadata(data)
+	assert.Error(t, err)
+}
+
+func TestBuildSAMLSPMetadata(t *testing.T) {
+	provider, _ := testFederation(t)
+	provider.SignAuthnRequests = true
+	sp, err := NewSAMLServiceProvider(testSAMLSP, provider)
+	assert.NoError(t, err)
+
+	data, err := xml.Marshal(BuildSAMLSPMetadata(sp))
+	assert.NoError(t, err)
+	metadata, err := ParseSAMLSPMetadata(data)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testSAMLSP.EntityID, metadata.EntityID)
+		assert.Equal(t, models.SAMLEndpoints{{Binding: saml.HTTPPostBinding, Location: testSAMLSP.ACSURL, Index: 1}}, metadata.ACSEndpoints)
+		assert.True(t, metadata.AuthnRequestsSigned)
+		assert.Equal(t, provider.Certificate, metadata.EncryptionCertificate)
+		assert.Equal(t, []string{provider.Certificate}, metadata.Certificates)
+	}
+
+	// Signing needs the SP key
+	provider.PrivateKey = ""
+	_, err = NewSAMLServiceProvider(testSAMLSP, provider)
+	assert.Error(t, err)
+	provider.Certificate = ""
+	_, err = NewSAMLServiceProvider(testSAMLSP, provider)
+	assert.Error(t, err)
+}
+
+func TestValidateSAMLAssertion(t *testing.T) {
+	provider, samlConfig := testFederation(t)
+	provider.SignAuthnRequests = true
+	sp, err := NewSAMLServiceProvider(testSAMLSP, provider)
+	assert.NoError(t, err)
+	request, err := sp.MakeAuthenticationRequest(provider.SSOURL, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	assert.NoError(t, err)
+	redirectURL, err := request.Redirect("state-1", sp)
+	assert.NoError(t, err)
+
+	// The IdP accepts the signed request
+	samlConfig.SPCertificates = []string{provider.Certificate}
+	samlConfig.AuthnRequestsSigned = true
+	message, err := DecodeSAMLMessage(saml.HTTPRedirectBinding, redirectURL.Query().Get("SAMLRequest"))
+	assert.NoError(t, err)
+	_, acsURL, err := ValidateAuthnRequest(testSAMLIdP, samlConfig, saml.HTTPRedirectBinding, redirectURL.RawQuery, message, saml.TimeNow())
+	assert.NoError(t, err)
+	assert.Equal(t, testSAMLSP.ACSURL, acsURL)
+
+	response := testFederatedResponse(t, samlConfig, request.ID)
+	assertion, err := ValidateSAMLAssertion(sp, response, request.ID)
+	if assert.NoError(t, err) {
+		profile := NewSAMLProfile(assertion)
+		assert.Equal(t, "alice@example.com", profile.NameID)
+		assert.Equal(t, []string{"staff", "oncall"}, profile.Attributes["memberOf"])
+		assert.Equal(t, []string{"staff", "oncall"}, profile.Attributes["groups"])
+		assert.NotEmpty(t, profile.SessionIndex)
+	}
+
+	// Responses to other requests are rejected
+	_, err = ValidateSAMLAssertion(sp, response, "id-other")
+	assert.Error(t, err)
+	_, err = ValidateSAMLAssertion(sp, response, "")
+	assert.Error(t, err)
+
+	// Unsolicited responses need the connection to allow them
+	unsolicited := testFederatedResponse(t, samlConfig, "")
+	_, err = ValidateSAMLAssertion(sp, unsolicited, "")
+	assert.Error(t, err)
+	sp.AllowIDPInitiated = true
+	_, err = ValidateSAMLAssertion(sp, unsolicited, "")
+	assert.NoError(t, err)
+	_, err = ValidateSAMLAssertion(sp, response, "")
+	assert.Error(t, err)
+
+	// Encrypted assertions are decrypted with the SP key
+	samlConfig.EncryptAssertions = true
+	encrypted := testFederatedResponse(t, samlConfig, request.ID)
+	assert.NotContains(t, string(encrypted), "alice@example.com")
+	assertion, err = ValidateSAMLAssertion(sp, encrypted, request.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice@example.com", assertion.Subject.NameID.Value)
+	}
+
+	// Responses signed by another key or for another SP are rejected
+	_, other := testFederation(t)
+	_, err = ValidateSAMLAssertion(sp, testFederatedResponse(t, other, request.ID), request.ID)
+	assert.Error(t, err)
+	samlConfig.EncryptAssertions = false
+	samlConfig.EntityID = "https://other.example.com"
+	_, err = ValidateSAMLAssertion(sp, testFederatedResponse(t, samlConfig, request.ID), request.ID)
+	assert.Error(t, err)
+}
+
+func TestValidateSAMLAssertionMissingElements(t *testing.T) {
+	provider, samlConfig := testFederation(t)
+	sp, err := NewSAMLServiceProvider(testSAMLSP, provider)
+	assert.NoError(t, err)
+	src := &ClaimSource{User: &models.User{ID: 7, Username: "alice", Email: "alice@example.com"}}
+
+	// crewjam would dereference these; they are rejected as errors instead
+	for name, strip := range map[string]func(*saml.Assertion){
+		"subject":                   func(a *saml.Assertion) { a.Subject = nil },
+		"subject confirmation data": func(a *saml.Assertion) { a.Subject.SubjectConfirmations[0].SubjectConfirmationData = nil },
+		"conditions":                func(a *saml.Assertion) { a.Conditions = nil },
+	} {
+		for _, encrypt := range []bool{false, true} {
+			samlConfig.EncryptAssertions = encrypt
+			response, err := BuildSAMLResponse(testSAMLIdP, samlConfig, src, SAMLResponseOptions{InResponseTo: "req-1", ACSURL: samlConfig.SSOURL})
+			assert.NoError(t, err)
+			strip(response.Assertion)
+			signed, err := SignSAMLResponse(samlConfig, response)
+			if !assert.NoError(t, err, name) {
+				continue
+			}
+			_, err = ValidateSAMLAssertion(sp, signed, "req-1")
+			assert.Error(t, err, "%s encrypted=%v", name, encrypt)
+		}
+	}
+}
+
+func TestMapSAMLUser(t *testing.T) {
+	profile := &SAMLProfile{
+		NameID:       "alice@example.com",
+		NameIDFormat: string(saml.EmailAddressNameIDFormat),
+		Attributes: map[string][]string{
+			"uid":        {"alice"},
+			"department": {"Radiology"},
+			"badges":     {"a", "b"},
+			"memberOf":   {"staff", "admins"},
+		},
+	}
+	fields := MapSAMLUser(nil, profile)
+	assert.Equal(t, "alice", fields.Username)
+	assert.Equal(t, "alice@example.com", fields.Email)
+	assert.Empty(t, fields.Attributes)
+
+	attributeMap := models.JSONB{
+		"username":             "mail",
+		"attribute:department": "department",
+		"attribute:badges":     "badges",
+		"attribute:missing":    "missing",
+	}
+	assert.NoError(t, ValidateSAMLUserAttributeMap(attributeMap))
+	fields = MapSAMLUser(attributeMap, profile)
+	// The username falls back to the email
+	assert.Equal(t, "alice@example.com", fields.Username)
+	assert.Equal(t, map[string]interface{}{"department": "Radiology", "badges": []interface{}{"a", "b"}}, fields.Attributes)
+
+	assert.Error(t, ValidateSAMLUserAttributeMap(models.JSONB{"password": "pw"}))
+	assert.Error(t, ValidateSAMLUserAttributeMap(models.JSONB{"email": 1}))
+	assert.Error(t, ValidateSAMLUserAttributeMap(models.JSONB{"attribute:": "x"}))
+}
+
+func TestMapSAMLRoles(t *testing.T) {
+	mappings := models.SAMLRoleMappings{
+		{Attribute: "memberOf", Value: "admins", Roles: []string{"admin"}, Groups: []string{"ops"}},
+		{Attribute: "memberOf", Value: "staff", Roles: []string{"viewer"}},
+		{Attribute: "department", Groups: []string{"employees", "ops"}},
+		{Attribute: "memberOf", Value: "auditors", Roles: []string{"auditor"}},
+	}
+	assert.NoError(t, ValidateSAMLRoleMappings(mappings))
+
+	roles, groups := MapSAMLRoles(mappings, &SAMLProfile{Attributes: map[string][]string{
+		"memberOf":   {"staff", "admins"},
+		"department": {"Radiology"},
+	}})
+	assert.Equal(t, []string{"admin", "viewer"}, roles)
+	assert.Equal(t, []string{"employees", "ops"}, groups)
+
+	roles, groups = SAMLMappedRoles(mappings)
+	assert.Equal(t, []string{"admin", "viewer", "auditor"}, roles)
+	assert.Equal(t, []string{"ops", "employees"}, groups)
+
+	assert.Error(t, ValidateSAMLRoleMappings(models.SAMLRoleMappings{{Roles: []string{"admin"}}}))
+	assert.Error(t, ValidateSAMLRoleMappings(models.SAMLRoleMappings{{Attribute: "memberOf"}}))
+}
@@ -0,0 +1,109 @@
+package sso
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSAMLKeyPair returns a self-signed certificate and its private key as PEM
+func testSAMLKeyPair(t *testing.T) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "openauth-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return string(certPEM), string(keyPEM)
+}
+
+// testSAMLIdP is the IdP of the test application
+var testSAMLIdP = NewSAMLIdP("https://idp.example.com", 1)
+
+// testServiceProvider is a crewjam SP that trusts the application's certificate
+func testServiceProvider(t *testing.T, samlConfig *models.SAMLConfig) *saml.ServiceProvider {
+	cert, err := ParseCertificate(samlConfig.Certificate)
+	assert.NoError(t, err)
+	idpMetadata, err := BuildSAMLMetadata(testSAMLIdP.EntityID, testSAMLIdP.SSOURL, testSAMLIdP.SLOURL, cert)
+	assert.NoError(t, err)
+	acsURL, _ := url.Parse(samlConfig.SSOURL)
+	return &saml.ServiceProvider{
+		EntityID:    samlConfig.EntityID,
+		AcsURL:      *acsURL,
+		IDPMetadata: idpMetadata,
+	}
+}
+
+func TestSignSAMLResponse(t *testing.T) {
+	certPEM, keyPEM := testSAMLKeyPair(t)
+	samlConfig := &models.SAMLConfig{
+		EntityID:    "https://sp.example.com",
+		SSOURL:      "https://sp.example.com/acs",
+		Certificate: certPEM,
+		PrivateKey:  keyPEM,
+	}
+	src := &ClaimSource{User: &models.User{ID: 7, Username: "alice", Email: "alice@example.com"}}
+	sp := testServiceProvider(t, samlConfig)
+	acsURL := sp.AcsURL
+
+	for _, target := range []string{"", SAMLSignAssertion, SAMLSignResponse, SAMLSignBoth} {
+		samlConfig.SignatureTarget = target
+		response, err := BuildSAMLResponse(testSAMLIdP, samlConfig, src, SAMLResponseOptions{InResponseTo: "req-1", ACSURL: samlConfig.SSOURL})
+		assert.NoError(t, err)
+		signed, err := SignSAMLResponse(samlConfig, response)
+		assert.NoError(t, err)
+
+		assertion, err := sp.ParseXMLResponse(signed, []string{"req-1"}, acsURL)
+		if assert.NoError(t, err, "signature target %q", target) {
+			assert.Equal(t, "alice@example.com", assertion.Subject.NameID.Value)
+		}
+		assert.Contains(t, string(signed), "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256")
+		assert.Contains(t, string(signed), "http://www.w3.org/2001/10/xml-exc-c14n#")
+
+		// Any change to the signed content is detected
+		tampered := bytes.Replace(signed, []byte("alice@example.com"), []byte("admin@example.com"), 1)
+		_, err = sp.ParseXMLResponse(tampered, []string{"req-1"}, acsURL)
+		assert.Error(t, err)
+	}
+
+	// Responses signed with another key are rejected
+	otherCert, otherKey := testSAMLKeyPair(t)
+	response, _ := BuildSAMLResponse(testSAMLIdP, samlConfig, src, SAMLResponseOptions{InResponseTo: "req-1", ACSURL: samlConfig.SSOURL})
+	signed, err := SignSAMLResponse(&models.SAMLConfig{Certificate: otherCert, PrivateKey: otherKey}, response)
+	assert.NoError(t, err)
+	_, err = sp.ParseXMLResponse(signed, []string{"req-1"}, acsURL)
+	assert.Error(t, err)
+}
+
+func TestNewSAMLSigner(t *testing.T) {
+	certPEM, keyPEM := testSAMLKeyPair(t)
+	_, err := NewSAMLSigner(certPEM, keyPEM)
+	assert.NoError(t, err)
+
+	_, otherKey := testSAMLKeyPair(t)
+	_, err = NewSAMLSigner(certPEM, otherKey)
+	assert.Error(t, err)
+	_, err = NewSAMLSigner("", keyPEM)
+	assert.Error(t, err)
+
+	assert.True(t, ValidSAMLSignatureTarget(""))
+	assert.True(t, ValidSAMLSignatureTarget(SAMLSignBoth))
+	assert.False(t, ValidSAMLSignatureTarget("none"))
+}
@@ -0,0 +1,62 @@
+package sso
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/hanyouqing/openauth/internal/models"
+)
+
+// GrantTypeTokenExchange is the grant type of OAuth 2.0 Token Exchange (RFC 8693)
+const GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+// Token type identifiers of RFC 8693 section 3
+const (
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// ClientMayExchangeSubject reports whether the client may exchange a subject
+// token that was issued to subjectClientID. Clients may always exchange
+// their own tokens; "*" in the policy allows tokens of any client.
+func ClientMayExchangeSubject(client *models.OAuthClient, subjectClientID string) bool {
+	if subjectClientID == client.ClientID {
+		return true
+	}
+	return containsString(client.TokenExchangeSubjectClients, "*") || containsString(client.TokenExchangeSubjectClients, subjectClientID)
+}
+
+// ClientMayTargetAudience reports whether the client may request a token for
+// the audience, which is either itself or one listed in its policy.
+func ClientMayTargetAudience(client *models.OAuthClient, audience string) bool {
+	return audience == client.ClientID || containsString(client.TokenExchangeAudiences, strings.TrimSuffix(audience, "/"))
+}
+
+// ExchangeScope returns the scope of the exchanged token. The requested scope
+// may only narrow the subject token's scope and, when the client has
+// registered scopes, those as well. An empty request keeps the subject scope.
+func ExchangeScope(requested, subjectScope string, clientScopes []string) (string, error) {
+	if requested == "" {
+		requested = subjectScope
+	}
+	if !ScopeSubset(requested, subjectScope) {
+		return "", errors.New("requested scope exceeds the subject token's scope")
+	}
+	if len(clientScopes) > 0 && !ScopeSubset(requested, strings.Join(clientScopes, " ")) {
+		return "", errors.New("requested scope exceeds the client's scopes")
+	}
+	return requested, nil
+}
+
+// ActClaim builds the act claim of RFC 8693 section 4.1 for a new actor,
+// nesting the act claim of the subject token so the delegation chain is kept.
+func ActClaim(actorSub, actorClientID string, prior map[string]interface{}) map[string]interface{} {
+	act := map[string]interface{}{"sub": actorSub}
+	if actorClientID != "" {
+		act["client_id"] = actorClientID
+	}
+	if len(prior) > 0 {
+		act["act"] = prior
+	}
+	return act
+}
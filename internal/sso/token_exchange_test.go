@@ -0,0 +1,51 @@
+package sso
+
+import (
+	"testing"
+
+	"github.com/hanyouqing/openauth/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenExchangePolicy(t *testing.T) {
+	client := &models.OAuthClient{
+		ClientID:                    "orders",
+		TokenExchangeSubjectClients: []string{"web"},
+		TokenExchangeAudiences:      []string{"https://billing.example.com"},
+	}
+	assert.True(t, ClientMayExchangeSubject(client, "orders"))
+	assert.True(t, ClientMayExchangeSubject(client, "web"))
+	assert.False(t, ClientMayExchangeSubject(client, "mobile"))
+
+	assert.True(t, ClientMayTargetAudience(client, "orders"))
+	assert.True(t, ClientMayTargetAudience(client, "https://billing.example.com/"))
+	assert.False(t, ClientMayTargetAudience(client, "https://payroll.example.com"))
+
+	client.TokenExchangeSubjectClients = []string{"*"}
+	assert.True(t, ClientMayExchangeSubject(client, "mobile"))
+}
+
+func TestExchangeScope(t *testing.T) {
+	scope, err := ExchangeScope("", "openid orders:read orders:write", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "openid orders:read orders:write", scope)
+
+	scope, err = ExchangeScope("orders:read", "openid orders:read orders:write", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "orders:read", scope)
+
+	_, err = ExchangeScope("orders:admin", "openid orders:read", nil)
+	assert.Error(t, err)
+	_, err = ExchangeScope("", "openid orders:read", []string{"orders:read"})
+	assert.Error(t, err)
+}
+
+func TestActClaim(t *testing.T) {
+	first := ActClaim("orders", "orders", nil)
+	assert.Equal(t, map[string]interface{}{"sub": "orders", "client_id": "orders"}, first)
+
+	// A second exchange nests the previous actor
+	second := ActClaim("42", "support", first)
+	assert.Equal(t, "42", second["sub"])
+	assert.Equal(t, first, second["act"])
+}
@@ -4,6 +4,17 @@ import { UserOutlined, LockOutlined } from '@ant-design/icons'
 import { useTranslation } from 'react-i18next'
 import { authService } from '@/services/authService'
 
+// Protocol endpoints (authorize, SAML and CAS login) send users here with
+// ?redirect= set to the request to resume. Only same-origin paths are
+// followed so the login page can't be used as an open redirect.
+function redirectTarget(): string {
+  const redirect = new URLSearchParams(window.location.search).get('redirect')
+  if (!redirect || !redirect.startsWith('/') || redirect.startsWith('//') || redirect.startsWith('/\\')) {
+    return '/'
+  }
+  return redirect
+}
+
 function LoginPage() {
   const { t } = useTranslation()
   const [loading, setLoading] = useState(false)
@@ -24,8 +35,9 @@ function LoginPage() {
           )
         }
         
-        // Use window.location to force a full page reload and re-check auth
-        window.location.href = '/'
+        // Use window.location to force a full page reload and re-check auth,
+        // or to resume a single sign-on request with the new session cookie
+        window.location.href = redirectTarget()
       } else {
         message.error('Login failed: No token received')
       }